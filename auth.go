@@ -0,0 +1,58 @@
+package sipnexus
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/emiago/sipgo/sip"
+	"github.com/itzmanish/sipnexus/pkg/auth"
+)
+
+// authenticate verifies the digest credentials of req against the realm
+// derived from uri. When they are missing or invalid it sends a 401 (or 407
+// when proxy is set) challenge and returns false. With authentication
+// disabled every request is accepted with an empty username.
+func (s *Server) authenticate(req *sip.Request, tx sip.ServerTransaction, uri sip.Uri, proxy bool) (string, bool) {
+	if s.authenticator == nil {
+		return "", true
+	}
+
+	authorization, authenticate := "Authorization", "WWW-Authenticate"
+	statusCode, reason := sip.StatusUnauthorized, "Unauthorized"
+	if proxy {
+		authorization, authenticate = "Proxy-Authorization", "Proxy-Authenticate"
+		statusCode, reason = sip.StatusProxyAuthRequired, "Proxy Authentication Required"
+	}
+
+	realm := s.authRealm(uri)
+	err := auth.ErrMissingCredentials
+	for _, h := range req.GetHeaders(authorization) {
+		var user string
+		user, err = s.authenticator.Verify(h.Value(), req.Method.String(), req.Recipient.String(), realm)
+		if err == nil {
+			return user, true
+		}
+		if errors.Is(err, auth.ErrStaleNonce) {
+			break
+		}
+	}
+	if !errors.Is(err, auth.ErrMissingCredentials) {
+		s.logger.Warnf("authentication of %s from %s failed: %v", req.Method, req.Source(), err)
+	}
+
+	resp := sip.NewResponseFromRequest(req, statusCode, reason, nil)
+	for _, chal := range s.authenticator.Challenges(realm, errors.Is(err, auth.ErrStaleNonce)) {
+		resp.AppendHeader(sip.NewHeader(authenticate, chal))
+	}
+	if err := tx.Respond(resp); err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to send %d response: %s", statusCode, err.Error()))
+	}
+	return "", false
+}
+
+func (s *Server) authRealm(uri sip.Uri) string {
+	if s.config.Auth.Realm != "" {
+		return s.config.Auth.Realm
+	}
+	return uri.Host
+}
@@ -17,8 +17,23 @@ func main() {
 	// Initialize logger
 	log := logger.NewLogger()
 
+	cfg := sipnexus.DefaultServerConfig()
+	// Behind a 1:1 NAT, such as on a cloud VM, advertise the public IP in
+	// SIP headers and SDP.
+	if publicIP := os.Getenv("SIPNEXUS_PUBLIC_IP"); publicIP != "" {
+		for i := range cfg.Listeners {
+			cfg.Listeners[i].AdvertisedAddress = publicIP
+		}
+		cfg.Media.AdvertisedAddress = publicIP
+	}
+	// Phones behind NAT put private addresses in their SDP; send media
+	// back to where theirs comes from.
+	if os.Getenv("SIPNEXUS_SYMMETRIC_RTP") == "true" {
+		cfg.Media.SymmetricRTP.Enabled = true
+	}
+
 	// Create a new SIP server
-	sipServer, err := sipnexus.NewServer(log)
+	sipServer, err := sipnexus.NewServer(log, cfg)
 	if err != nil {
 		log.Fatal("Failed to create SIP server: " + err.Error())
 	}
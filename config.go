@@ -1,8 +1,266 @@
 package sipnexus
 
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/itzmanish/sipnexus/pkg/auth"
+	"github.com/itzmanish/sipnexus/pkg/codec"
+	"github.com/itzmanish/sipnexus/pkg/media"
+)
+
 type Config struct {
 	server ServerConfig
 }
 
+// Transport names accepted in ListenerConfig.Transport.
+const (
+	TransportUDP = "udp"
+	TransportTCP = "tcp"
+	TransportTLS = "tls"
+	TransportWS  = "ws"
+	TransportWSS = "wss"
+)
+
 type ServerConfig struct {
+	// Listeners are brought up together by Server.Start and closed together
+	// by Server.Shutdown.
+	Listeners []ListenerConfig
+
+	Registrar RegistrarConfig
+	// Location stores registrar bindings. Defaults to an in-memory store.
+	Location LocationService
+
+	Auth AuthConfig
+
+	Sessions SessionConfig
+	Media    MediaConfig
+}
+
+// MediaConfig sets the UDP port range RTP and RTCP are bound in. Each call
+// takes an even RTP port and the odd port above it for RTCP.
+type MediaConfig struct {
+	RTPPortMin int
+	RTPPortMax int
+
+	// BindAddress is the local IP media sockets are bound on. Defaults to
+	// all interfaces.
+	BindAddress string
+	// AdvertisedAddress is the IP put in SDP c= and o= lines, such as the
+	// public IP of a host behind a 1:1 NAT. Defaults to BindAddress, or to
+	// the address of the local interface when that is unspecified, or to
+	// loopback when the host has none.
+	AdvertisedAddress string
+
+	// SymmetricRTP sends media to where the peer's RTP comes from rather
+	// than to the address in its SDP, for endpoints behind NAT.
+	SymmetricRTP media.SymmetricRTP
+
+	// Codecs names the codecs calls offer and accept, most preferred
+	// first, such as G722 for wideband audio. Defaults to
+	// media.DefaultCodecNames. "opus" is only known to builds with the
+	// opus tag, which need libopus.
+	//
+	// Media is plain RTP/AVP. There is no SRTP, so WebRTC offers of
+	// UDP/TLS/RTP/SAVPF are declined whatever their codecs.
+	Codecs []string
+}
+
+// SessionConfig controls the session reaper. A zero timeout disables that
+// check.
+type SessionConfig struct {
+	// MaxDuration ends calls that have been connected for this long.
+	MaxDuration time.Duration
+	// SetupTimeout ends answered calls whose ACK has not arrived.
+	SetupTimeout time.Duration
+	// RTPTimeout ends connected calls that received no RTP for this long.
+	RTPTimeout time.Duration
+	// ReapInterval is how often sessions are checked.
+	ReapInterval time.Duration
+}
+
+// AuthConfig enables digest authentication of REGISTER and INVITE requests.
+type AuthConfig struct {
+	// Credentials turns authentication on when set.
+	Credentials auth.CredentialStore
+	// Realm used in challenges. When empty the domain of the To URI for
+	// REGISTER and of the From URI for INVITE is used, so each served
+	// domain is authenticated against its own realm.
+	Realm  string
+	Digest auth.DigestOptions
+}
+
+// RegistrarConfig bounds the registration intervals accepted by the
+// registrar, in seconds.
+type RegistrarConfig struct {
+	MinExpires     uint32
+	MaxExpires     uint32
+	DefaultExpires uint32
+}
+
+// ListenerConfig describes a single SIP listening socket.
+type ListenerConfig struct {
+	Transport   string
+	BindAddress string
+	Port        int
+
+	// TLSCertFile and TLSKeyFile are required for tls and wss listeners.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// WSPath restricts ws and wss upgrades to a single request path.
+	// Empty accepts any path.
+	WSPath string
+
+	// AdvertisedAddress is the IP put in Contact and, for udp, in Via, such
+	// as the public IP of a host behind a 1:1 NAT. Defaults to BindAddress,
+	// or to the address of the local interface when that is unspecified,
+	// or to loopback when the host has none.
+	//
+	// Requests sent over tcp, tls, ws and wss keep the local address of
+	// their connection in Via, since sipgo binds outgoing connections to
+	// the Via address. Responses to them come back over the same
+	// connection (RFC 3261 18.2.2), so only Contact needs rewriting there.
+	AdvertisedAddress string
+}
+
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		Listeners: []ListenerConfig{
+			{Transport: TransportUDP, BindAddress: "0.0.0.0", Port: 5060},
+		},
+		Registrar: DefaultRegistrarConfig(),
+		Sessions:  DefaultSessionConfig(),
+		Media:     DefaultMediaConfig(),
+	}
+}
+
+func DefaultMediaConfig() MediaConfig {
+	return MediaConfig{
+		RTPPortMin: media.DefaultRTPPortMin,
+		RTPPortMax: media.DefaultRTPPortMax,
+	}
+}
+
+func DefaultSessionConfig() SessionConfig {
+	return SessionConfig{
+		MaxDuration: 4 * time.Hour,
+		// 64*T1, how long a UAS retransmits its 2xx waiting for the ACK.
+		SetupTimeout: 32 * time.Second,
+		RTPTimeout:   60 * time.Second,
+		ReapInterval: time.Second,
+	}
+}
+
+func DefaultRegistrarConfig() RegistrarConfig {
+	return RegistrarConfig{
+		MinExpires:     60,
+		MaxExpires:     7200,
+		DefaultExpires: 3600,
+	}
+}
+
+func (c ServerConfig) Validate() error {
+	if len(c.Listeners) == 0 {
+		return fmt.Errorf("no listeners configured")
+	}
+	for i, l := range c.Listeners {
+		if err := l.Validate(); err != nil {
+			return fmt.Errorf("listener %d: %w", i, err)
+		}
+	}
+	if err := c.Registrar.Validate(); err != nil {
+		return fmt.Errorf("registrar: %w", err)
+	}
+	if err := c.Sessions.Validate(); err != nil {
+		return fmt.Errorf("sessions: %w", err)
+	}
+	if err := c.Media.Validate(); err != nil {
+		return fmt.Errorf("media: %w", err)
+	}
+	return nil
+}
+
+func (c MediaConfig) Validate() error {
+	if err := validateIP("bind address", c.BindAddress); err != nil {
+		return err
+	}
+	if err := validateIP("advertised address", c.AdvertisedAddress); err != nil {
+		return err
+	}
+	if c.SymmetricRTP.RelatchPackets < 0 || c.SymmetricRTP.RelatchInterval < 0 {
+		return fmt.Errorf("negative symmetric RTP relatch setting")
+	}
+	if _, err := codec.Default.Select(c.Codecs...); err != nil {
+		return err
+	}
+	if c.RTPPortMin == 0 && c.RTPPortMax == 0 {
+		return nil
+	}
+	if c.RTPPortMin < 1024 || c.RTPPortMax > 65535 || c.RTPPortMax-c.RTPPortMin < 1 {
+		return fmt.Errorf("invalid RTP port range %d-%d", c.RTPPortMin, c.RTPPortMax)
+	}
+	return nil
+}
+
+func (c SessionConfig) Validate() error {
+	if c.MaxDuration < 0 || c.SetupTimeout < 0 || c.RTPTimeout < 0 || c.ReapInterval < 0 {
+		return fmt.Errorf("negative session timeout")
+	}
+	return nil
+}
+
+func (c RegistrarConfig) Validate() error {
+	if c == (RegistrarConfig{}) {
+		return nil
+	}
+	if c.MinExpires > c.MaxExpires {
+		return fmt.Errorf("min expires %d exceeds max expires %d", c.MinExpires, c.MaxExpires)
+	}
+	if c.DefaultExpires < c.MinExpires || c.DefaultExpires > c.MaxExpires {
+		return fmt.Errorf("default expires %d outside [%d, %d]", c.DefaultExpires, c.MinExpires, c.MaxExpires)
+	}
+	return nil
+}
+
+func (l ListenerConfig) Validate() error {
+	switch l.transport() {
+	case TransportUDP, TransportTCP, TransportWS:
+	case TransportTLS, TransportWSS:
+		if l.TLSCertFile == "" || l.TLSKeyFile == "" {
+			return fmt.Errorf("%s listener requires tls cert and key", l.transport())
+		}
+	default:
+		return fmt.Errorf("unsupported transport %q", l.Transport)
+	}
+	if l.Port < 0 || l.Port > 65535 {
+		return fmt.Errorf("invalid port %d", l.Port)
+	}
+	if l.WSPath != "" && !strings.HasPrefix(l.WSPath, "/") {
+		return fmt.Errorf("ws path must start with /")
+	}
+	return validateIP("advertised address", l.AdvertisedAddress)
+}
+
+// validateIP accepts an empty address or an IP literal.
+func validateIP(name, addr string) error {
+	if addr != "" && net.ParseIP(addr) == nil {
+		return fmt.Errorf("invalid %s %q", name, addr)
+	}
+	return nil
+}
+
+func (l ListenerConfig) transport() string {
+	return strings.ToLower(l.Transport)
+}
+
+func (l ListenerConfig) addr() string {
+	host := l.BindAddress
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(l.Port))
 }
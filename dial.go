@@ -0,0 +1,260 @@
+package sipnexus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+	"github.com/google/uuid"
+)
+
+// maxRedirects bounds how many 3xx responses Dial follows.
+const maxRedirects = 5
+
+// DialRequest describes an outbound call.
+type DialRequest struct {
+	// Recipient is the Request-URI of the INVITE. When it is the AOR of a
+	// locally registered user the call goes to its most preferred contact.
+	Recipient sip.Uri
+	// From identifies the caller. Defaults to sip:sipnexus@<advertised ip>.
+	From        sip.Uri
+	DisplayName string
+
+	// Username and Password answer digest challenges from the far end.
+	Username string
+	Password string
+
+	// Headers are appended to the INVITE.
+	Headers []sip.Header
+	// OnProvisional is called for every 1xx response.
+	OnProvisional func(res *sip.Response)
+}
+
+// DialError is returned when the far end rejects the call.
+type DialError struct {
+	StatusCode sip.StatusCode
+	Reason     string
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("call rejected: %d %s", e.StatusCode, e.Reason)
+}
+
+// Dial places an outbound call and returns the connected session once the
+// far end has answered and the 2xx has been acknowledged.
+func (s *Server) Dial(ctx context.Context, dr DialRequest) (*Session, error) {
+	target := dr.Recipient
+	if bindings, err := s.LookupContacts(target); err == nil && len(bindings) > 0 {
+		target = bindings[0].Contact.Address
+	}
+
+	session := s.sessionManager.CreateSession(uuid.NewString())
+	offer, err := session.rtc.CreateOffer()
+	if err != nil {
+		session.close(SessionStatus_Failed)
+		return nil, fmt.Errorf("failed to create offer: %w", err)
+	}
+
+	var credentials *sipgo.DigestAuth
+	if dr.Password != "" {
+		credentials = &sipgo.DigestAuth{Username: dr.Username, Password: dr.Password}
+	}
+
+	req := s.newInviteRequest(dr, target, session.CallID, []byte(offer))
+	var res *sip.Response
+	for redirects := 0; ; redirects++ {
+		res, err = s.sendInvite(ctx, req, credentials, session, dr.OnProvisional)
+		if err != nil {
+			session.close(SessionStatus_Failed)
+			return nil, err
+		}
+
+		if res.IsRedirection() && redirects < maxRedirects && res.Contact() != nil {
+			s.logger.Infof("call %s redirected to %s", session.CallID, res.Contact().Address.String())
+			req = redirectInvite(req, res.Contact().Address)
+			continue
+		}
+		break
+	}
+
+	if !res.IsSuccess() {
+		session.close(SessionStatus_Failed)
+		return nil, &DialError{StatusCode: res.StatusCode, Reason: res.Reason}
+	}
+
+	d, err := newUACDialog(s.clientFor(req.Transport()), req, res)
+	if err != nil {
+		session.close(SessionStatus_Failed)
+		return nil, err
+	}
+	d.credentials = credentials
+	session.setDialog(d)
+	session.answered()
+
+	// A 2xx must always be acknowledged, even when we are going to hang up.
+	if err := d.client.WriteRequest(d.newRequest(sip.ACK), sipgo.ClientRequestBuild); err != nil {
+		session.close(SessionStatus_Failed)
+		return nil, fmt.Errorf("failed to send ACK: %w", err)
+	}
+
+	if err := session.setRemoteAnswer(string(res.Body())); err != nil {
+		session.Hangup(ctx)
+		return nil, fmt.Errorf("failed to apply answer: %w", err)
+	}
+
+	session.setStatus(SessionStatus_Connected)
+	return session, nil
+}
+
+// sendInvite sends req and waits for its final response, answering one
+// digest challenge of each kind when credentials are set.
+func (s *Server) sendInvite(ctx context.Context, req *sip.Request, credentials *sipgo.DigestAuth, session *Session, onProvisional func(*sip.Response)) (*sip.Response, error) {
+	client := s.clientFor(req.Transport())
+	tx, err := client.TransactionRequest(ctx, req, sipgo.ClientRequestBuild)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send INVITE: %w", err)
+	}
+
+	provisional := func(res *sip.Response) {
+		if res.StatusCode == sip.StatusRinging || res.StatusCode == sip.StatusSessionInProgress {
+			session.setStatus(SessionStatus_Ringing)
+		}
+		if onProvisional != nil {
+			onProvisional(res)
+		}
+	}
+
+	challenged := map[sip.StatusCode]bool{}
+	for {
+		res, err := waitFinalResponse(ctx, tx, provisional)
+		if err != nil {
+			if errors.Is(err, ctx.Err()) {
+				// CANCEL only makes sense while the INVITE is pending.
+				tx.Cancel()
+				go s.abandonInvite(req, tx, credentials)
+				return nil, err
+			}
+			tx.Terminate()
+			return nil, err
+		}
+		tx.Terminate()
+
+		code := res.StatusCode
+		if (code != sip.StatusUnauthorized && code != sip.StatusProxyAuthRequired) || credentials == nil || challenged[code] {
+			return res, nil
+		}
+		challenged[code] = true
+
+		tx, err = client.DoDigestAuth(ctx, req, res, *credentials)
+		if err != nil {
+			return nil, fmt.Errorf("failed to answer challenge: %w", err)
+		}
+	}
+}
+
+// abandonInvite waits for the final response to req, whose transaction tx
+// was cancelled, until Timer B fires. A 2xx that crossed the CANCEL set up
+// a call the far end considers connected, so it is acknowledged and hung up.
+func (s *Server) abandonInvite(req *sip.Request, tx sip.ClientTransaction, credentials *sipgo.DigestAuth) {
+	res, err := waitFinalResponse(context.Background(), tx, nil)
+	tx.Terminate()
+	if err != nil || !res.IsSuccess() {
+		return
+	}
+
+	callID := req.CallID().Value()
+	s.logger.Infof("call %s was answered after it was cancelled, hanging up", callID)
+	d, err := newUACDialog(s.clientFor(req.Transport()), req, res)
+	if err != nil {
+		s.logger.Errorf("failed to hang up call %s: %v", callID, err)
+		return
+	}
+	d.credentials = credentials
+	if err := d.client.WriteRequest(d.newRequest(sip.ACK), sipgo.ClientRequestBuild); err != nil {
+		s.logger.Errorf("failed to send ACK for call %s: %v", callID, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sip.Timer_B)
+	defer cancel()
+	if res, err := d.do(ctx, d.newRequest(sip.BYE)); err != nil {
+		s.logger.Errorf("failed to send BYE for call %s: %v", callID, err)
+	} else if !res.IsSuccess() {
+		s.logger.Errorf("BYE for call %s rejected: %s", callID, res.StartLine())
+	}
+}
+
+func (s *Server) newInviteRequest(dr DialRequest, target sip.Uri, callID string, body []byte) *sip.Request {
+	req := sip.NewRequest(sip.INVITE, target)
+
+	fromURI := dr.From
+	if fromURI.Host == "" {
+		fromURI = sip.Uri{User: "sipnexus", Host: s.advertisedIP(req.Transport()).String()}
+	}
+	from := &sip.FromHeader{DisplayName: dr.DisplayName, Address: fromURI, Params: sip.NewParams()}
+	from.Params.Add("tag", sip.GenerateTagN(16))
+	req.AppendHeader(from)
+
+	to := &sip.ToHeader{Address: sip.Uri{Encrypted: dr.Recipient.Encrypted, User: dr.Recipient.User, Host: dr.Recipient.Host}, Params: sip.NewParams()}
+	req.AppendHeader(to)
+
+	callIDHdr := sip.CallIDHeader(callID)
+	req.AppendHeader(&callIDHdr)
+	req.AppendHeader(&sip.CSeqHeader{SeqNo: 1, MethodName: sip.INVITE})
+	maxForwards := sip.MaxForwardsHeader(70)
+	req.AppendHeader(&maxForwards)
+	req.AppendHeader(s.contactHeader(req.Transport()))
+
+	for _, h := range dr.Headers {
+		req.AppendHeader(h)
+	}
+	req.AppendHeader(sip.NewHeader("Content-Type", "application/sdp"))
+	req.SetBody(body)
+	return req
+}
+
+// redirectInvite retargets req to contact keeping the same call identity,
+// as a new transaction with the next CSeq.
+func redirectInvite(req *sip.Request, contact sip.Uri) *sip.Request {
+	next := req.Clone()
+	next.Recipient = *contact.Clone()
+	next.RemoveHeader("Via")
+	next.RemoveHeader("Authorization")
+	next.RemoveHeader("Proxy-Authorization")
+	next.CSeq().SeqNo++
+	next.SetDestination("")
+	return next
+}
+
+// contactHeader returns our Contact for requests sent over transport.
+func (s *Server) contactHeader(transport string) *sip.ContactHeader {
+	network := strings.ToLower(transport)
+	uri := sip.Uri{
+		User:      "sipnexus",
+		Host:      s.advertisedIP(network).String(),
+		Port:      s.listenPort(network),
+		UriParams: sip.NewParams(),
+	}
+	if network != TransportUDP {
+		uri.UriParams.Add("transport", network)
+	}
+	return &sip.ContactHeader{Address: uri, Params: sip.NewParams()}
+}
+
+// listenPort returns the port the first listener on transport is bound to,
+// or its configured port while it is not listening.
+func (s *Server) listenPort(transport string) int {
+	i := s.firstListener(transport)
+	if i < 0 {
+		return 0
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if i < len(s.listeners) {
+		_, port, _ := sip.ParseAddr(s.listeners[i].addr.String())
+		return port
+	}
+	return s.config.Listeners[i].Port
+}
@@ -0,0 +1,408 @@
+package sipnexus
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+	"github.com/itzmanish/sipnexus/pkg/auth"
+	"github.com/itzmanish/sipnexus/pkg/logger"
+	"github.com/itzmanish/sipnexus/pkg/media"
+)
+
+const testAnswerSDP = "v=0\r\n" +
+	"o=- 1 1 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 20000 RTP/AVP 0\r\n" +
+	"c=IN IP4 127.0.0.1\r\n" +
+	"a=rtpmap:0 PCMU/8000\r\n" +
+	"a=sendrecv\r\n"
+
+// testUAS is a minimal remote user agent answering calls from Server.Dial.
+type testUAS struct {
+	uri  sip.Uri
+	acks chan *sip.Request
+	byes chan *sip.Request
+}
+
+func startTestUAS(t *testing.T, onInvite func(req *sip.Request, tx sip.ServerTransaction)) *testUAS {
+	t.Helper()
+	ua, err := sipgo.NewUA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := sipgo.NewServer(ua)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, port, _ := sip.ParseAddr(conn.LocalAddr().String())
+	u := &testUAS{
+		uri:  sip.Uri{User: "bob", Host: host, Port: port},
+		acks: make(chan *sip.Request, 8),
+		byes: make(chan *sip.Request, 8),
+	}
+	srv.OnInvite(onInvite)
+	srv.OnAck(func(req *sip.Request, tx sip.ServerTransaction) {
+		u.acks <- req
+	})
+	srv.OnBye(func(req *sip.Request, tx sip.ServerTransaction) {
+		tx.Respond(sip.NewResponseFromRequest(req, sip.StatusOK, "OK", nil))
+		u.byes <- req
+	})
+	go srv.ServeUDP(conn)
+	t.Cleanup(func() {
+		conn.Close()
+		ua.Close()
+	})
+	return u
+}
+
+func answerInvite(uas func() *testUAS) func(req *sip.Request, tx sip.ServerTransaction) {
+	return func(req *sip.Request, tx sip.ServerTransaction) {
+		tx.Respond(sip.NewResponseFromRequest(req, sip.StatusRinging, "Ringing", nil))
+		time.Sleep(20 * time.Millisecond)
+		res := sip.NewSDPResponseFromRequest(req, []byte(testAnswerSDP))
+		res.AppendHeader(&sip.ContactHeader{Address: uas().uri})
+		tx.Respond(res)
+	}
+}
+
+func newTestDialer(t *testing.T) *Server {
+	t.Helper()
+	s, _ := startTestServer(t, ServerConfig{Listeners: []ListenerConfig{
+		{Transport: TransportUDP, BindAddress: "127.0.0.1"},
+	}})
+	return s
+}
+
+// waitRequest returns the next request on ch that belongs to callID,
+// skipping e.g. hop-by-hop ACKs of rejected attempts.
+func waitRequest(t *testing.T, ch chan *sip.Request, callID string) *sip.Request {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case req := <-ch:
+			if req.CallID().Value() == callID {
+				return req
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for request of call %s", callID)
+			return nil
+		}
+	}
+}
+
+func TestDialAndHangup(t *testing.T) {
+	var uas *testUAS
+	uas = startTestUAS(t, answerInvite(func() *testUAS { return uas }))
+	s := newTestDialer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ringing := false
+	session, err := s.Dial(ctx, DialRequest{
+		Recipient:     uas.uri,
+		OnProvisional: func(res *sip.Response) { ringing = ringing || res.StatusCode == sip.StatusRinging },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Hangup(ctx)
+	if session.Status != SessionStatus_Connected {
+		t.Fatalf("expected connected session, got %d", session.Status)
+	}
+	if !ringing {
+		t.Fatal("expected 180 Ringing to be reported")
+	}
+
+	ack := waitRequest(t, uas.acks, session.CallID)
+	if ack.CSeq().SeqNo != 1 {
+		t.Fatalf("expected ACK CSeq 1, got %d", ack.CSeq().SeqNo)
+	}
+
+	if err := session.Hangup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	bye := waitRequest(t, uas.byes, session.CallID)
+	if bye.CSeq().SeqNo != 2 {
+		t.Fatalf("unexpected BYE: %s", bye.StartLine())
+	}
+	if session.Status != SessionStatus_Disconnected {
+		t.Fatalf("expected disconnected session, got %d", session.Status)
+	}
+	if _, ok := s.sessionManager.GetSession(session.ID); ok {
+		t.Fatal("session not removed after hangup")
+	}
+}
+
+func TestDialDigestChallenge(t *testing.T) {
+	store := auth.NewMemoryCredentialStore()
+	store.Set("far.example", "trunk", "secret")
+	authenticator, err := auth.NewDigestAuthenticator(store, auth.DigestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var uas *testUAS
+	answer := answerInvite(func() *testUAS { return uas })
+	uas = startTestUAS(t, func(req *sip.Request, tx sip.ServerTransaction) {
+		h := req.GetHeader("Proxy-Authorization")
+		if h == nil {
+			res := sip.NewResponseFromRequest(req, sip.StatusProxyAuthRequired, "Proxy Authentication Required", nil)
+			res.AppendHeader(sip.NewHeader("Proxy-Authenticate", authenticator.Challenges("far.example", false)[0]))
+			tx.Respond(res)
+			return
+		}
+		if _, err := authenticator.Verify(h.Value(), "INVITE", req.Recipient.String(), "far.example"); err != nil {
+			tx.Respond(sip.NewResponseFromRequest(req, sip.StatusForbidden, "Forbidden", nil))
+			return
+		}
+		answer(req, tx)
+	})
+	s := newTestDialer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = s.Dial(ctx, DialRequest{Recipient: uas.uri, Username: "trunk", Password: "wrong"})
+	var dialErr *DialError
+	if !errors.As(err, &dialErr) || dialErr.StatusCode != sip.StatusForbidden {
+		t.Fatalf("expected 403 with wrong password, got %v", err)
+	}
+
+	session, err := s.Dial(ctx, DialRequest{Recipient: uas.uri, Username: "trunk", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Hangup(ctx)
+	ack := waitRequest(t, uas.acks, session.CallID)
+	if ack.CSeq().SeqNo == 1 {
+		// The transaction layer acknowledges the 407 as well.
+		ack = waitRequest(t, uas.acks, session.CallID)
+	}
+	if ack.CSeq().SeqNo != 2 {
+		t.Fatalf("expected ACK to match authenticated INVITE CSeq 2, got %d", ack.CSeq().SeqNo)
+	}
+}
+
+func TestHoldAndResume(t *testing.T) {
+	var uas *testUAS
+	answer := answerInvite(func() *testUAS { return uas })
+	invites := make(chan *sip.Request, 8)
+	rejectNext := make(chan bool, 1)
+	uas = startTestUAS(t, func(req *sip.Request, tx sip.ServerTransaction) {
+		invites <- req
+		select {
+		case <-rejectNext:
+			tx.Respond(sip.NewResponseFromRequest(req, statusRequestPending, "Request Pending", nil))
+		default:
+			answer(req, tx)
+		}
+	})
+	s := newTestDialer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	session, err := s.Dial(ctx, DialRequest{Recipient: uas.uri})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Hangup(ctx)
+	waitRequest(t, invites, session.CallID)
+	waitRequest(t, uas.acks, session.CallID)
+
+	steps := []struct {
+		name   string
+		do     func(context.Context) error
+		reject bool
+		dir    string
+		held   bool
+	}{
+		{"hold", session.Hold, false, "a=sendonly", true},
+		{"rejected resume", session.Resume, true, "a=sendrecv", true},
+		{"resume", session.Resume, false, "a=sendrecv", false},
+	}
+	for i, step := range steps {
+		if step.reject {
+			rejectNext <- true
+		}
+		err := step.do(ctx)
+		if step.reject != (err != nil) {
+			t.Fatalf("%s: unexpected result %v", step.name, err)
+		}
+		reinvite := waitRequest(t, invites, session.CallID)
+		if want := uint32(i + 2); reinvite.CSeq().SeqNo != want {
+			t.Fatalf("%s: expected re-INVITE CSeq %d, got %d", step.name, want, reinvite.CSeq().SeqNo)
+		}
+		if !strings.Contains(string(reinvite.Body()), step.dir) {
+			t.Fatalf("%s: expected %s in the offer:\n%s", step.name, step.dir, reinvite.Body())
+		}
+		if !step.reject {
+			ack := waitRequest(t, uas.acks, session.CallID)
+			if ack.CSeq().SeqNo < reinvite.CSeq().SeqNo {
+				// The transaction layer acknowledges the 491 as well.
+				ack = waitRequest(t, uas.acks, session.CallID)
+			}
+			if ack.CSeq().SeqNo != reinvite.CSeq().SeqNo {
+				t.Fatalf("%s: expected ACK for CSeq %d, got %d", step.name, reinvite.CSeq().SeqNo, ack.CSeq().SeqNo)
+			}
+		}
+		if session.Held() != step.held {
+			t.Fatalf("%s: expected held %v", step.name, step.held)
+		}
+		if session.State() != SessionStatus_Connected {
+			t.Fatalf("%s: expected the call to stay connected, got %s", step.name, session.State())
+		}
+	}
+}
+
+func TestDialRejectAndRedirect(t *testing.T) {
+	var target *testUAS
+	target = startTestUAS(t, answerInvite(func() *testUAS { return target }))
+	redirector := startTestUAS(t, func(req *sip.Request, tx sip.ServerTransaction) {
+		res := sip.NewResponseFromRequest(req, sip.StatusMovedTemporarily, "Moved Temporarily", nil)
+		res.AppendHeader(&sip.ContactHeader{Address: target.uri})
+		tx.Respond(res)
+	})
+	busy := startTestUAS(t, func(req *sip.Request, tx sip.ServerTransaction) {
+		tx.Respond(sip.NewResponseFromRequest(req, sip.StatusBusyHere, "Busy Here", nil))
+	})
+	s := newTestDialer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := s.Dial(ctx, DialRequest{Recipient: busy.uri})
+	var dialErr *DialError
+	if !errors.As(err, &dialErr) || dialErr.StatusCode != sip.StatusBusyHere {
+		t.Fatalf("expected 486, got %v", err)
+	}
+
+	session, err := s.Dial(ctx, DialRequest{Recipient: redirector.uri})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Hangup(ctx)
+	waitRequest(t, target.acks, session.CallID)
+	if err := session.Hangup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitRequest(t, target.byes, session.CallID)
+}
+
+func TestDialCancelCrossesAnswer(t *testing.T) {
+	var uas *testUAS
+	uas = startTestUAS(t, func(req *sip.Request, tx sip.ServerTransaction) {
+		cancels := tx.Cancels()
+		tx.Respond(sip.NewResponseFromRequest(req, sip.StatusRinging, "Ringing", nil))
+		select {
+		case <-cancels:
+		case <-time.After(5 * time.Second):
+			return
+		}
+		// The answer was already on its way when the CANCEL came in.
+		res := sip.NewSDPResponseFromRequest(req, []byte(testAnswerSDP))
+		res.AppendHeader(&sip.ContactHeader{Address: uas.uri})
+		tx.Respond(res)
+	})
+	s := newTestDialer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	callIDs := make(chan string, 1)
+	_, err := s.Dial(ctx, DialRequest{
+		Recipient: uas.uri,
+		OnProvisional: func(res *sip.Response) {
+			callIDs <- res.CallID().Value()
+			cancel()
+		},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the dial to be cancelled, got %v", err)
+	}
+
+	// The call the far end thinks is up is acknowledged and hung up.
+	callID := <-callIDs
+	waitRequest(t, uas.acks, callID)
+	waitRequest(t, uas.byes, callID)
+}
+
+func TestDialAdvertisedAddress(t *testing.T) {
+	invites := make(chan *sip.Request, 1)
+	var uas *testUAS
+	answer := answerInvite(func() *testUAS { return uas })
+	uas = startTestUAS(t, func(req *sip.Request, tx sip.ServerTransaction) {
+		invites <- req
+		answer(req, tx)
+	})
+	s, _ := startTestServer(t, ServerConfig{
+		Listeners: []ListenerConfig{
+			{Transport: TransportUDP, BindAddress: "127.0.0.1", AdvertisedAddress: "203.0.113.7"},
+		},
+		Media: MediaConfig{BindAddress: "127.0.0.1", AdvertisedAddress: "2001:db8::8"},
+	})
+	// The advertised Via is used once the listener is being served.
+	waitFor(t, func() bool { return s.clientFor(TransportUDP) != s.client })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	session, err := s.Dial(ctx, DialRequest{Recipient: uas.uri})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Hangup(ctx)
+
+	invite := <-invites
+	if host := invite.Via().Host; host != "203.0.113.7" {
+		t.Fatalf("expected advertised Via, got %s", host)
+	}
+	if host := invite.Contact().Address.Host; host != "203.0.113.7" {
+		t.Fatalf("expected advertised Contact, got %s", host)
+	}
+	if host := invite.From().Address.Host; host != "203.0.113.7" {
+		t.Fatalf("expected advertised From, got %s", host)
+	}
+	offer := string(invite.Body())
+	for _, line := range []string{" IN IP6 2001:db8::8\r\ns=", "c=IN IP6 2001:db8::8\r\n"} {
+		if !strings.Contains(offer, line) {
+			t.Fatalf("expected %q in offer:\n%s", line, offer)
+		}
+	}
+	if addr := session.rtc.(*media.UDPMediaEngine).LocalAddr(); !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("expected media bound on 127.0.0.1, got %s", addr)
+	}
+}
+
+func TestContactListenPort(t *testing.T) {
+	s, err := NewServer(logger.NewLogger(), ServerConfig{Listeners: []ListenerConfig{
+		{Transport: TransportUDP, BindAddress: "127.0.0.1"},
+		{Transport: TransportTCP, BindAddress: "127.0.0.1"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	// The Contact carries the bound port before the listeners are served.
+	for i, addr := range s.listenAddrs() {
+		transport := s.config.Listeners[i].Transport
+		_, port, _ := sip.ParseAddr(addr.String())
+		if got := s.contactHeader(transport).Address.Port; got != port || port == 0 {
+			t.Fatalf("%s Contact has port %d, listener is bound to %d", transport, got, port)
+		}
+	}
+}
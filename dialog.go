@@ -0,0 +1,279 @@
+package sipnexus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// errCSeqOutOfOrder is returned for in-dialog requests whose CSeq is not
+// higher than the last one received (RFC 3261 12.2.2).
+var errCSeqOutOfOrder = errors.New("CSeq out of order")
+
+type dialogState uint8
+
+const (
+	dialogEarly dialogState = iota
+	dialogConfirmed
+	dialogTerminated
+)
+
+// dialog holds what is needed to send and match requests within an INVITE
+// dialog (RFC 3261 section 12).
+type dialog struct {
+	client *sipgo.Client
+
+	mu           sync.Mutex
+	state        dialogState
+	callID       string
+	localURI     sip.Uri
+	localTag     string
+	remoteURI    sip.Uri
+	remoteTag    string
+	remoteTarget sip.Uri
+	routeSet     []sip.Uri
+	localCSeq    uint32
+	remoteCSeq   uint32
+	contact      *sip.ContactHeader
+
+	// credentials answer digest challenges on in-dialog requests.
+	credentials *sipgo.DigestAuth
+}
+
+// newUACDialog builds the dialog state from the INVITE we sent and the 2xx
+// that established it (RFC 3261 12.1.2).
+func newUACDialog(client *sipgo.Client, req *sip.Request, res *sip.Response) (*dialog, error) {
+	from, to, callID, cseq := req.From(), res.To(), req.CallID(), req.CSeq()
+	if from == nil || to == nil || callID == nil || cseq == nil {
+		return nil, errors.New("missing dialog headers")
+	}
+	localTag, _ := from.Params.Get("tag")
+	remoteTag, _ := to.Params.Get("tag")
+
+	d := &dialog{
+		client:       client,
+		state:        dialogConfirmed,
+		callID:       callID.Value(),
+		localURI:     from.Address,
+		localTag:     localTag,
+		remoteURI:    to.Address,
+		remoteTag:    remoteTag,
+		remoteTarget: req.Recipient,
+		localCSeq:    cseq.SeqNo,
+		contact:      req.Contact(),
+	}
+	if contact := res.Contact(); contact != nil {
+		d.remoteTarget = contact.Address
+	}
+
+	// The UAC route set is the Record-Route of the response in reverse.
+	rr := res.GetHeaders("Record-Route")
+	for i := len(rr) - 1; i >= 0; i-- {
+		if h, ok := rr[i].(*sip.RecordRouteHeader); ok {
+			d.routeSet = append(d.routeSet, h.Address)
+		}
+	}
+	return d, nil
+}
+
+// newUASDialog builds the dialog state from a received INVITE and the
+// response carrying our tag (RFC 3261 12.1.1). A provisional response
+// creates an early dialog that confirm moves on once the 2xx is sent.
+func newUASDialog(client *sipgo.Client, req *sip.Request, res *sip.Response) (*dialog, error) {
+	from, to, callID, cseq := req.From(), res.To(), req.CallID(), req.CSeq()
+	if from == nil || to == nil || callID == nil || cseq == nil {
+		return nil, errors.New("missing dialog headers")
+	}
+	localTag, _ := to.Params.Get("tag")
+	remoteTag, _ := from.Params.Get("tag")
+	if localTag == "" {
+		return nil, errors.New("response has no To tag")
+	}
+
+	d := &dialog{
+		client:     client,
+		state:      dialogEarly,
+		callID:     callID.Value(),
+		localURI:   to.Address,
+		localTag:   localTag,
+		remoteURI:  from.Address,
+		remoteTag:  remoteTag,
+		remoteCSeq: cseq.SeqNo,
+		contact:    res.Contact(),
+	}
+	if res.IsSuccess() {
+		d.state = dialogConfirmed
+	}
+	if contact := req.Contact(); contact != nil {
+		d.remoteTarget = contact.Address
+	} else {
+		d.remoteTarget = from.Address
+	}
+
+	// The UAS route set is the Record-Route of the request in order.
+	for _, h := range req.GetHeaders("Record-Route") {
+		if rr, ok := h.(*sip.RecordRouteHeader); ok {
+			d.routeSet = append(d.routeSet, rr.Address)
+		}
+	}
+	return d, nil
+}
+
+// dialogID joins the identifiers of a dialog as seen from our side.
+func dialogID(callID, localTag, remoteTag string) string {
+	return callID + ";" + localTag + ";" + remoteTag
+}
+
+func (d *dialog) id() string {
+	return dialogID(d.callID, d.localTag, d.remoteTag)
+}
+
+// matches reports whether the identifiers, seen from this side, belong to d.
+func (d *dialog) matches(callID, localTag, remoteTag string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.state != dialogTerminated && d.callID == callID && d.localTag == localTag && d.remoteTag == remoteTag
+}
+
+// receive validates the CSeq of an in-dialog request. ACK and CANCEL reuse
+// the CSeq of the INVITE and are not checked.
+func (d *dialog) receive(req *sip.Request) error {
+	if req.IsAck() || req.IsCancel() {
+		return nil
+	}
+	cseq := req.CSeq()
+	if cseq == nil {
+		return errors.New("missing CSeq")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.remoteCSeq != 0 && cseq.SeqNo <= d.remoteCSeq {
+		return errCSeqOutOfOrder
+	}
+	d.remoteCSeq = cseq.SeqNo
+	return nil
+}
+
+// refresh updates the remote target from the Contact of a target refresh
+// request or its response (RFC 3261 12.2).
+func (d *dialog) refresh(contact *sip.ContactHeader) {
+	if contact == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remoteTarget = *contact.Address.Clone()
+}
+
+func (d *dialog) confirm() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state == dialogEarly {
+		d.state = dialogConfirmed
+	}
+}
+
+func (d *dialog) terminate() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.state = dialogTerminated
+}
+
+// newRequest builds an in-dialog request. Every method except ACK and
+// CANCEL takes the next local CSeq.
+func (d *dialog) newRequest(method sip.RequestMethod) *sip.Request {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	req := sip.NewRequest(method, *d.remoteTarget.Clone())
+	for _, r := range d.routeSet {
+		req.AppendHeader(&sip.RouteHeader{Address: *r.Clone()})
+	}
+
+	from := &sip.FromHeader{Address: *d.localURI.Clone(), Params: sip.NewParams()}
+	from.Params.Add("tag", d.localTag)
+	req.AppendHeader(from)
+
+	to := &sip.ToHeader{Address: *d.remoteURI.Clone(), Params: sip.NewParams()}
+	if d.remoteTag != "" {
+		to.Params.Add("tag", d.remoteTag)
+	}
+	req.AppendHeader(to)
+
+	callID := sip.CallIDHeader(d.callID)
+	req.AppendHeader(&callID)
+
+	if method != sip.ACK && method != sip.CANCEL {
+		d.localCSeq++
+	}
+	req.AppendHeader(&sip.CSeqHeader{SeqNo: d.localCSeq, MethodName: method})
+
+	maxForwards := sip.MaxForwardsHeader(70)
+	req.AppendHeader(&maxForwards)
+	if d.contact != nil {
+		req.AppendHeader(d.contact.Clone())
+	}
+	return req
+}
+
+// do sends an in-dialog request and waits for its final response, answering
+// one digest challenge when credentials are available.
+func (d *dialog) do(ctx context.Context, req *sip.Request) (*sip.Response, error) {
+	tx, err := d.client.TransactionRequest(ctx, req, sipgo.ClientRequestBuild)
+	if err != nil {
+		return nil, err
+	}
+
+	authed := false
+	for {
+		res, err := waitFinalResponse(ctx, tx, nil)
+		tx.Terminate()
+		if err != nil {
+			return nil, err
+		}
+
+		challenged := res.StatusCode == sip.StatusUnauthorized || res.StatusCode == sip.StatusProxyAuthRequired
+		if !challenged || authed || d.credentials == nil {
+			return res, nil
+		}
+		authed = true
+
+		tx, err = d.client.DoDigestAuth(ctx, req, res, *d.credentials)
+		if err != nil {
+			return nil, err
+		}
+		// DoDigestAuth bumps the CSeq of the retried request.
+		d.mu.Lock()
+		d.localCSeq = req.CSeq().SeqNo
+		d.mu.Unlock()
+	}
+}
+
+// waitFinalResponse drains provisional responses into onProvisional until a
+// final response arrives.
+func waitFinalResponse(ctx context.Context, tx sip.ClientTransaction, onProvisional func(*sip.Response)) (*sip.Response, error) {
+	for {
+		select {
+		case res := <-tx.Responses():
+			if res.IsProvisional() {
+				if onProvisional != nil {
+					onProvisional(res)
+				}
+				continue
+			}
+			return res, nil
+		case <-tx.Done():
+			if err := tx.Err(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("transaction terminated")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
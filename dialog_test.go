@@ -0,0 +1,250 @@
+package sipnexus
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+	"github.com/emiago/sipgo/siptest"
+)
+
+const testOfferSDP = "v=0\r\n" +
+	"o=- 7 7 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 30000 RTP/AVP 0\r\n" +
+	"c=IN IP4 127.0.0.1\r\n" +
+	"a=rtpmap:0 PCMU/8000\r\n" +
+	"a=sendrecv\r\n"
+
+// newTestInDialog parses a request from the caller alice to the server.
+// toTag is left out when empty.
+func newTestInDialog(t *testing.T, method sip.RequestMethod, callID, toTag string, cseq uint32, body string) *sip.Request {
+	t.Helper()
+	to := "To: <sip:bob@127.0.0.1>"
+	if toTag != "" {
+		to += ";tag=" + toTag
+	}
+	cseqMethod := method
+	if method == sip.ACK {
+		cseqMethod = sip.INVITE
+	}
+	raw := fmt.Sprintf("%s sip:bob@127.0.0.1 SIP/2.0\r\n", method) +
+		"Via: SIP/2.0/UDP 127.0.0.1:5070;branch=z9hG4bK" + fmt.Sprint(time.Now().UnixNano()) + "\r\n" +
+		"From: <sip:alice@127.0.0.1>;tag=alice-tag\r\n" +
+		to + "\r\n" +
+		"Call-ID: " + callID + "\r\n" +
+		fmt.Sprintf("CSeq: %d %s\r\n", cseq, cseqMethod) +
+		"Contact: <sip:alice@127.0.0.1:5070>\r\n"
+	if body != "" {
+		raw += "Content-Type: application/sdp\r\n"
+	}
+	raw += fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body)
+
+	msg, err := sip.ParseMessage([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.(*sip.Request)
+}
+
+func handle(t *testing.T, h func(*sip.Request, sip.ServerTransaction), req *sip.Request) []*sip.Response {
+	t.Helper()
+	tx := siptest.NewServerTxRecorder(req)
+	h(req, tx)
+	return tx.Result()
+}
+
+func TestInboundDialogStates(t *testing.T) {
+	s := newTestRegistrar(t)
+	var mu sync.Mutex
+	var events []SessionStatus
+	unsubscribe := s.SubscribeSessions(func(ev SessionEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, ev.Status)
+	})
+	defer unsubscribe()
+
+	res := handle(t, s.handleInvite, newTestInDialog(t, sip.INVITE, "call-1", "", 1, testOfferSDP))
+	if len(res) != 2 || res[0].StatusCode != sip.StatusRinging || res[1].StatusCode != sip.StatusOK {
+		t.Fatalf("expected 180 and 200, got %v", res)
+	}
+	ringTag, _ := res[0].To().Params.Get("tag")
+	tag, _ := res[1].To().Params.Get("tag")
+	if tag == "" || tag != ringTag {
+		t.Fatalf("expected the same To tag on 180 and 200, got %q and %q", ringTag, tag)
+	}
+	if res[1].Contact() == nil {
+		t.Fatal("expected Contact on 200")
+	}
+
+	session, ok := s.sessionManager.FindDialog("call-1", tag, "alice-tag")
+	if !ok {
+		t.Fatal("dialog not found")
+	}
+	if session.State() != SessionStatus_Ringing {
+		t.Fatalf("expected ringing before ACK, got %s", session.State())
+	}
+
+	s.handleAck(newTestInDialog(t, sip.ACK, "call-1", tag, 1, ""), nil)
+	if session.State() != SessionStatus_Connected {
+		t.Fatalf("expected connected after ACK, got %s", session.State())
+	}
+
+	// In-dialog requests must carry increasing CSeqs.
+	res = handle(t, s.handleOptions, newTestInDialog(t, sip.OPTIONS, "call-1", tag, 1, ""))
+	if res[0].StatusCode != sip.StatusInternalServerError {
+		t.Fatalf("expected 500 for stale CSeq, got %d", res[0].StatusCode)
+	}
+
+	res = handle(t, s.handleBye, newTestInDialog(t, sip.BYE, "call-1", tag, 2, ""))
+	if res[0].StatusCode != sip.StatusOK {
+		t.Fatalf("expected 200 for BYE, got %d", res[0].StatusCode)
+	}
+	if session.State() != SessionStatus_Disconnected {
+		t.Fatalf("expected disconnected after BYE, got %s", session.State())
+	}
+
+	// The dialog is gone now.
+	res = handle(t, s.handleBye, newTestInDialog(t, sip.BYE, "call-1", tag, 3, ""))
+	if res[0].StatusCode != sip.StatusCallTransactionDoesNotExists {
+		t.Fatalf("expected 481 for BYE after hangup, got %d", res[0].StatusCode)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []SessionStatus{SessionStatus_Ringing, SessionStatus_Connected, SessionStatus_Disconnected}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Fatalf("expected events %v, got %v", want, events)
+	}
+}
+
+func TestUnknownDialogRejected(t *testing.T) {
+	s := newTestRegistrar(t)
+
+	tests := []struct {
+		name    string
+		handler func(*sip.Request, sip.ServerTransaction)
+		req     *sip.Request
+	}{
+		{"BYE", s.handleBye, newTestInDialog(t, sip.BYE, "nope", "x", 2, "")},
+		{"BYE without To tag", s.handleBye, newTestInDialog(t, sip.BYE, "nope", "", 2, "")},
+		{"re-INVITE", s.handleInvite, newTestInDialog(t, sip.INVITE, "nope", "x", 2, testOfferSDP)},
+		{"OPTIONS", s.handleOptions, newTestInDialog(t, sip.OPTIONS, "nope", "x", 2, "")},
+		{"CANCEL", s.handleCancel, newTestInDialog(t, sip.CANCEL, "nope", "", 1, "")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := handle(t, tt.handler, tt.req)
+			if len(res) != 1 || res[0].StatusCode != sip.StatusCallTransactionDoesNotExists {
+				t.Fatalf("expected 481, got %v", res)
+			}
+		})
+	}
+
+	// Out-of-dialog OPTIONS still works.
+	res := handle(t, s.handleOptions, newTestInDialog(t, sip.OPTIONS, "nope", "", 1, ""))
+	if res[0].StatusCode != sip.StatusOK {
+		t.Fatalf("expected 200, got %d", res[0].StatusCode)
+	}
+}
+
+func TestSessionStatusTransitions(t *testing.T) {
+	tests := []struct {
+		from, to SessionStatus
+		ok       bool
+	}{
+		{SessionStatus_New, SessionStatus_Ringing, true},
+		{SessionStatus_New, SessionStatus_Connected, true},
+		{SessionStatus_Ringing, SessionStatus_Failed, true},
+		{SessionStatus_Connected, SessionStatus_Disconnected, true},
+		{SessionStatus_Connected, SessionStatus_Failed, false},
+		{SessionStatus_Connected, SessionStatus_Ringing, false},
+		{SessionStatus_Disconnected, SessionStatus_Failed, false},
+		{SessionStatus_Failed, SessionStatus_Connected, false},
+	}
+	for _, tt := range tests {
+		if got := tt.from.canTransition(tt.to); got != tt.ok {
+			t.Errorf("%s -> %s: expected %v, got %v", tt.from, tt.to, tt.ok, got)
+		}
+	}
+}
+
+func TestReInviteAndUpdate(t *testing.T) {
+	s := newTestRegistrar(t)
+	res := handle(t, s.handleInvite, newTestInDialog(t, sip.INVITE, "call-re", "", 1, testOfferSDP))
+	tag, _ := res[1].To().Params.Get("tag")
+	s.handleAck(newTestInDialog(t, sip.ACK, "call-re", tag, 1, ""), nil)
+	session, _ := s.sessionManager.FindDialog("call-re", tag, "alice-tag")
+	// The port of our media, which re-negotiation must keep.
+	mline := strings.Fields(strings.SplitAfter(string(res[1].Body()), "m=audio ")[1])[0]
+
+	offer := func(lines ...string) string {
+		return strings.Replace(testOfferSDP, "a=sendrecv\r\n", strings.Join(lines, ""), 1)
+	}
+	tests := []struct {
+		name   string
+		method sip.RequestMethod
+		body   string
+		code   sip.StatusCode
+		answer string // direction in our answer
+		held   bool
+	}{
+		{"hold with sendonly", sip.INVITE, offer("a=sendonly\r\n"), sip.StatusOK, "a=recvonly", true},
+		{"resume", sip.INVITE, testOfferSDP, sip.StatusOK, "a=sendrecv", false},
+		{"hold with inactive", sip.UPDATE, offer("a=inactive\r\n"), sip.StatusOK, "a=inactive", true},
+		{"rejected offer keeps the session", sip.INVITE, strings.Replace(testOfferSDP, "RTP/AVP 0", "RTP/AVP 18", 1), sip.StatusNotAcceptableHere, "", true},
+		{"hold with 0.0.0.0", sip.UPDATE, strings.Replace(testOfferSDP, "IN IP4 127.0.0.1\r\na", "IN IP4 0.0.0.0\r\na", 1), sip.StatusOK, "a=sendrecv", true},
+		{"session refresh", sip.UPDATE, "", sip.StatusOK, "", true},
+		{"resume with UPDATE", sip.UPDATE, testOfferSDP, sip.StatusOK, "a=sendrecv", false},
+	}
+	for i, tt := range tests {
+		h := s.handleInvite
+		if tt.method == sip.UPDATE {
+			h = s.handleUpdate
+		}
+		res := handle(t, h, newTestInDialog(t, tt.method, "call-re", tag, uint32(i+2), tt.body))
+		if len(res) != 1 || res[0].StatusCode != tt.code {
+			t.Fatalf("%s: expected %d, got %v", tt.name, tt.code, res)
+		}
+		answer := string(res[0].Body())
+		if tt.answer != "" && !strings.Contains(answer, tt.answer) {
+			t.Fatalf("%s: expected %s in answer:\n%s", tt.name, tt.answer, answer)
+		}
+		if tt.answer != "" && !strings.Contains(answer, "m=audio "+mline+" ") {
+			t.Fatalf("%s: expected the media port %s to be kept:\n%s", tt.name, mline, answer)
+		}
+		if session.RemoteHeld() != tt.held {
+			t.Fatalf("%s: expected remote hold %v", tt.name, tt.held)
+		}
+		if session.State() != SessionStatus_Connected {
+			t.Fatalf("%s: expected the session to stay connected, got %s", tt.name, session.State())
+		}
+	}
+
+	// A re-INVITE without offer gets ours, answered in the ACK.
+	res = handle(t, s.handleInvite, newTestInDialog(t, sip.INVITE, "call-re", tag, 20, ""))
+	if len(res) != 1 || res[0].StatusCode != sip.StatusOK || !strings.Contains(string(res[0].Body()), "m=audio "+mline+" RTP/AVP 0") {
+		t.Fatalf("expected 200 with an offer, got %v", res)
+	}
+	// Until its ACK arrives, our offer crosses any other.
+	if res = handle(t, s.handleUpdate, newTestInDialog(t, sip.UPDATE, "call-re", tag, 21, testOfferSDP)); res[0].StatusCode != statusRequestPending {
+		t.Fatalf("expected 491 before the ACK, got %d", res[0].StatusCode)
+	}
+	s.handleAck(newTestInDialog(t, sip.ACK, "call-re", tag, 20, offer("a=sendonly\r\n")), nil)
+	if !session.RemoteHeld() {
+		t.Fatal("expected the answer in the ACK to be applied")
+	}
+
+	// Offers crossing one of ours are rejected.
+	session.beginOffer()
+	res = handle(t, s.handleInvite, newTestInDialog(t, sip.INVITE, "call-re", tag, 22, testOfferSDP))
+	session.endOffer()
+	if res[0].StatusCode != statusRequestPending {
+		t.Fatalf("expected 491 on glare, got %d", res[0].StatusCode)
+	}
+}
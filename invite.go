@@ -0,0 +1,89 @@
+package sipnexus
+
+import (
+	"sync"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// pendingInvite serializes the responses to an incoming INVITE with a CANCEL
+// for it, so exactly one of the 2xx and the 487 is sent (RFC 3261 9.2).
+type pendingInvite struct {
+	req *sip.Request
+	tx  sip.ServerTransaction
+
+	mu    sync.Mutex
+	final bool
+	// answered is closed with the final response. The transaction stops
+	// delivering CANCELs from then on (RFC 3261 9.2).
+	answered chan struct{}
+}
+
+func newPendingInvite(req *sip.Request, tx sip.ServerTransaction) *pendingInvite {
+	return &pendingInvite{req: req, tx: tx, answered: make(chan struct{})}
+}
+
+// respond sends res on the INVITE transaction. It reports false without
+// sending anything once a final response went out or the INVITE was
+// cancelled, including by a CANCEL that is waiting when res is final.
+func (p *pendingInvite) respond(res *sip.Response) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.final {
+		return false, nil
+	}
+	if !res.IsProvisional() {
+		select {
+		case req := <-p.tx.Cancels():
+			_, err := p.cancelLocked(req)
+			return false, err
+		default:
+		}
+		p.setFinal()
+	}
+	return true, p.tx.Respond(res)
+}
+
+// cancel answers a CANCEL with 200 and, when no final response has been sent
+// yet, terminates the INVITE with 487. It reports whether the INVITE was
+// terminated.
+func (p *pendingInvite) cancel(req *sip.Request) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cancelLocked(req)
+}
+
+func (p *pendingInvite) cancelLocked(req *sip.Request) (bool, error) {
+	if err := p.tx.Respond(sip.NewResponseFromRequest(req, sip.StatusOK, "OK", nil)); err != nil {
+		return false, err
+	}
+	if p.final {
+		return false, nil
+	}
+	p.setFinal()
+	return true, p.tx.Respond(sip.NewResponseFromRequest(p.req, sip.StatusRequestTerminated, "Request Terminated", nil))
+}
+
+func (p *pendingInvite) setFinal() {
+	p.final = true
+	close(p.answered)
+}
+
+// watchCancel waits for a CANCEL of the INVITE until it is answered or its
+// transaction ends, and tears the session down when the CANCEL won.
+func (s *Server) watchCancel(p *pendingInvite, session *Session) {
+	select {
+	case req := <-p.tx.Cancels():
+		s.logger.Infof("received CANCEL for call %s", session.CallID)
+		terminated, err := p.cancel(req)
+		if err != nil {
+			s.logger.Errorf("failed to respond to CANCEL: %v", err)
+		}
+		if terminated {
+			session.close(SessionStatus_Disconnected)
+		}
+	case <-p.answered:
+	case <-p.tx.Done():
+	}
+}
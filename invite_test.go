@@ -0,0 +1,370 @@
+package sipnexus
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+	"github.com/emiago/sipgo/siptest"
+	"github.com/itzmanish/sipnexus/pkg/logger"
+	"github.com/pion/sdp/v3"
+)
+
+// cancelTx is an INVITE server transaction whose CANCELs are injected by
+// the test and whose responses are recorded safely across goroutines.
+type cancelTx struct {
+	*siptest.ServerTxRecorder
+	cancels  chan *sip.Request
+	answered chan struct{}
+
+	mu        sync.Mutex
+	responses []*sip.Response
+}
+
+func newCancelTx(req *sip.Request) *cancelTx {
+	return &cancelTx{
+		ServerTxRecorder: siptest.NewServerTxRecorder(req),
+		cancels:          make(chan *sip.Request),
+		answered:         make(chan struct{}),
+	}
+}
+
+func (tx *cancelTx) Cancels() <-chan *sip.Request { return tx.cancels }
+
+func (tx *cancelTx) Respond(res *sip.Response) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.responses = append(tx.responses, res)
+	if !res.IsCancel() && !res.IsProvisional() && len(tx.finals()) == 1 {
+		close(tx.answered)
+	}
+	return nil
+}
+
+func (tx *cancelTx) finals() []*sip.Response {
+	var finals []*sip.Response
+	for _, res := range tx.responses {
+		if !res.IsCancel() && !res.IsProvisional() {
+			finals = append(finals, res)
+		}
+	}
+	return finals
+}
+
+// deliverCancel hands req to the INVITE the way the transaction layer does,
+// which drops CANCELs once a final response went out. It reports whether
+// the CANCEL was delivered.
+func (tx *cancelTx) deliverCancel(req *sip.Request) bool {
+	select {
+	case tx.cancels <- req:
+		return true
+	case <-tx.answered:
+		return false
+	}
+}
+
+func (tx *cancelTx) result() []*sip.Response {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return append([]*sip.Response(nil), tx.responses...)
+}
+
+func newTestCancel(t *testing.T, invite *sip.Request) *sip.Request {
+	t.Helper()
+	req := sip.NewRequest(sip.CANCEL, invite.Recipient)
+	req.AppendHeader(invite.Via().Clone())
+	req.AppendHeader(sip.HeaderClone(invite.From()))
+	req.AppendHeader(sip.HeaderClone(invite.To()))
+	req.AppendHeader(sip.HeaderClone(invite.CallID()))
+	req.AppendHeader(&sip.CSeqHeader{SeqNo: invite.CSeq().SeqNo, MethodName: sip.CANCEL})
+	return req
+}
+
+func TestPendingInviteCancel(t *testing.T) {
+	invite := newTestInDialog(t, sip.INVITE, "cancel-1", "", 1, testOfferSDP)
+	tx := newCancelTx(invite)
+	p := newPendingInvite(invite, tx)
+
+	if sent, _ := p.respond(sip.NewResponseFromRequest(invite, sip.StatusRinging, "Ringing", nil)); !sent {
+		t.Fatal("expected 180 to be sent")
+	}
+	if terminated, _ := p.cancel(newTestCancel(t, invite)); !terminated {
+		t.Fatal("expected CANCEL to terminate a ringing INVITE")
+	}
+	if sent, _ := p.respond(sip.NewResponseFromRequest(invite, sip.StatusOK, "OK", nil)); sent {
+		t.Fatal("expected 200 to be suppressed after CANCEL")
+	}
+
+	res := tx.result()
+	if len(res) != 3 || !res[1].IsCancel() || res[1].StatusCode != sip.StatusOK || res[2].StatusCode != sip.StatusRequestTerminated {
+		t.Fatalf("expected 180, 200 for CANCEL and 487, got %v", res)
+	}
+
+	// Once answered, CANCEL has no effect on the INVITE.
+	invite = newTestInDialog(t, sip.INVITE, "cancel-2", "", 1, testOfferSDP)
+	tx = newCancelTx(invite)
+	p = newPendingInvite(invite, tx)
+	p.respond(sip.NewResponseFromRequest(invite, sip.StatusOK, "OK", nil))
+	if terminated, _ := p.cancel(newTestCancel(t, invite)); terminated {
+		t.Fatal("expected CANCEL after 200 to be ignored")
+	}
+	if res := tx.result(); len(res) != 2 || !res[1].IsCancel() {
+		t.Fatalf("expected only the CANCEL to be answered, got %v", res)
+	}
+}
+
+func TestCancelRacesAnswer(t *testing.T) {
+	s := newTestRegistrar(t)
+
+	var mu sync.Mutex
+	disconnected := map[string]bool{}
+	defer s.SubscribeSessions(func(ev SessionEvent) {
+		if ev.Status == SessionStatus_Disconnected {
+			mu.Lock()
+			disconnected[ev.Session.CallID] = true
+			mu.Unlock()
+		}
+	})()
+	waitDisconnected := func(callID string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			mu.Lock()
+			done := disconnected[callID]
+			mu.Unlock()
+			if done {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("call %s was not disconnected", callID)
+	}
+
+	outcomes := map[sip.StatusCode]int{}
+	for i := 0; i < 100; i++ {
+		callID := fmt.Sprintf("race-%d", i)
+		invite := newTestInDialog(t, sip.INVITE, callID, "", 1, testOfferSDP)
+		tx := newCancelTx(invite)
+
+		// Even iterations deliver the CANCEL before the INVITE is answered,
+		// odd ones race it against the 200 OK.
+		early := i%2 == 0
+		var delivered bool
+		cancelled := make(chan struct{})
+		go func() {
+			defer close(cancelled)
+			if !early {
+				time.Sleep(time.Duration(i%10) * 50 * time.Microsecond)
+			}
+			delivered = tx.deliverCancel(newTestCancel(t, invite))
+		}()
+		if early {
+			time.Sleep(time.Millisecond)
+		}
+		s.handleInvite(invite, tx)
+		<-cancelled
+
+		if delivered {
+			waitFor(t, func() bool { return answeredCancel(tx.result()) })
+		}
+		tx.mu.Lock()
+		finals := tx.finals()
+		tx.mu.Unlock()
+		if len(finals) != 1 {
+			t.Fatalf("call %s: expected one final response, got %v", callID, tx.result())
+		}
+		final := finals[0]
+		outcomes[final.StatusCode]++
+		if early && final.StatusCode != sip.StatusRequestTerminated {
+			t.Fatalf("call %s: expected 487 for a CANCEL before the answer, got %d", callID, final.StatusCode)
+		}
+
+		switch final.StatusCode {
+		case sip.StatusRequestTerminated:
+			if !delivered {
+				t.Fatalf("call %s: 487 without CANCEL", callID)
+			}
+			waitDisconnected(callID)
+		case sip.StatusOK:
+			if delivered {
+				t.Fatalf("call %s: CANCEL delivered before the answer was lost", callID)
+			}
+			tag, _ := final.To().Params.Get("tag")
+			s.handleAck(newTestInDialog(t, sip.ACK, callID, tag, 1, ""), nil)
+			if res := handle(t, s.handleBye, newTestInDialog(t, sip.BYE, callID, tag, 2, "")); res[0].StatusCode != sip.StatusOK {
+				t.Fatalf("call %s: expected 200 for BYE, got %d", callID, res[0].StatusCode)
+			}
+			waitDisconnected(callID)
+		default:
+			t.Fatalf("call %s: unexpected final response %d", callID, final.StatusCode)
+		}
+		tx.Terminate()
+	}
+	t.Logf("outcomes: %v", outcomes)
+
+	if left := s.sessionManager.Len(); left != 0 {
+		t.Fatalf("expected no sessions left, got %d", left)
+	}
+	// Every call released its media ports.
+	if n := s.ports.InUse(); n != 0 {
+		t.Fatalf("%d media port pairs still in use", n)
+	}
+}
+
+func answeredCancel(res []*sip.Response) bool {
+	for _, r := range res {
+		if r.IsCancel() && r.StatusCode == sip.StatusOK {
+			return true
+		}
+	}
+	return false
+}
+
+func TestInviteMediaPortsExhausted(t *testing.T) {
+	port := freePortPair(t)
+	cfg := DefaultServerConfig()
+	cfg.Media = MediaConfig{RTPPortMin: port, RTPPortMax: port + 1}
+	s, err := NewServer(logger.NewLogger(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, session := range s.sessionManager.all() {
+			s.sessionManager.DeleteSession(session.ID)
+		}
+	})
+
+	res := handle(t, s.handleInvite, newTestInDialog(t, sip.INVITE, "ports-1", "", 1, testOfferSDP))
+	if res[len(res)-1].StatusCode != sip.StatusOK {
+		t.Fatalf("expected first call to be answered, got %d", res[len(res)-1].StatusCode)
+	}
+	res = handle(t, s.handleInvite, newTestInDialog(t, sip.INVITE, "ports-2", "", 1, testOfferSDP))
+	if len(res) != 1 || res[0].StatusCode != sip.StatusServiceUnavailable {
+		t.Fatalf("expected 503 with no media ports left, got %v", res)
+	}
+	if _, ok := s.sessionManager.GetSessionByCallID("ports-2"); ok {
+		t.Fatal("rejected call left a session behind")
+	}
+
+	// Hanging up the first call frees its ports for the next one.
+	session, _ := s.sessionManager.GetSessionByCallID("ports-1")
+	s.sessionManager.DeleteSession(session.ID)
+	res = handle(t, s.handleInvite, newTestInDialog(t, sip.INVITE, "ports-3", "", 1, testOfferSDP))
+	if res[len(res)-1].StatusCode != sip.StatusOK {
+		t.Fatalf("expected call after release to be answered, got %d", res[len(res)-1].StatusCode)
+	}
+}
+
+// freePortPair returns an even port that is free to bind together with the
+// one above it.
+func freePortPair(t *testing.T) int {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := conn.LocalAddr().(*net.UDPAddr).Port &^ 1
+		conn.Close()
+		rtp, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err != nil {
+			continue
+		}
+		rtcp, err := net.ListenUDP("udp", &net.UDPAddr{Port: port + 1})
+		rtp.Close()
+		if err != nil {
+			continue
+		}
+		rtcp.Close()
+		return port
+	}
+	t.Fatal("no free port pair")
+	return 0
+}
+
+func TestInviteAnswerAdvertisedAddress(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.Media.AdvertisedAddress = "198.51.100.4"
+	s, err := NewServer(logger.NewLogger(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := handle(t, s.handleInvite, newTestInDialog(t, sip.INVITE, "advertised-1", "", 1, testOfferSDP))
+	ok := res[len(res)-1]
+	if ok.StatusCode != sip.StatusOK {
+		t.Fatalf("expected 200, got %d", ok.StatusCode)
+	}
+	if !strings.Contains(string(ok.Body()), "c=IN IP4 198.51.100.4\r\n") {
+		t.Fatalf("expected advertised media address in answer:\n%s", ok.Body())
+	}
+	// The listener binds all interfaces, so its Contact uses the detected
+	// interface address.
+	if host := ok.Contact().Address.Host; host == "" || host == "0.0.0.0" {
+		t.Fatalf("expected a reachable Contact host, got %q", host)
+	}
+	session, _ := s.sessionManager.GetSessionByCallID("advertised-1")
+	s.sessionManager.DeleteSession(session.ID)
+}
+
+func TestInviteNoCommonCodec(t *testing.T) {
+	s := newTestRegistrar(t)
+	offer := strings.Replace(testOfferSDP, "m=audio 30000 RTP/AVP 0\r\n", "m=audio 30000 RTP/AVP 18\r\n", 1)
+	offer = strings.Replace(offer, "a=rtpmap:0 PCMU/8000", "a=rtpmap:18 G729/8000", 1)
+
+	res := handle(t, s.handleInvite, newTestInDialog(t, sip.INVITE, "g729-only", "", 1, offer))
+	if len(res) != 1 || res[0].StatusCode != sip.StatusNotAcceptableHere {
+		t.Fatalf("expected 488, got %v", res)
+	}
+	if s.sessionManager.Len() != 0 || s.ports.InUse() != 0 {
+		t.Fatal("rejected offer left a session or media ports behind")
+	}
+}
+
+func TestInviteUnusableConnection(t *testing.T) {
+	s := newTestRegistrar(t)
+
+	// Only a session-level c= line, which is valid.
+	sessionLevel := strings.Replace(testOfferSDP, "m=audio 30000 RTP/AVP 0\r\nc=IN IP4 127.0.0.1\r\n", "m=audio 30000 RTP/AVP 0\r\n", 1)
+	sessionLevel = strings.Replace(sessionLevel, "s=-\r\n", "s=-\r\nc=IN IP4 127.0.0.1\r\n", 1)
+	res := handle(t, s.handleInvite, newTestInDialog(t, sip.INVITE, "session-c", "", 1, sessionLevel))
+	if res[len(res)-1].StatusCode != sip.StatusOK {
+		t.Fatalf("expected 200 for a session-level connection, got %d", res[len(res)-1].StatusCode)
+	}
+	session, _ := s.sessionManager.GetSessionByCallID("session-c")
+	s.sessionManager.DeleteSession(session.ID)
+
+	// An unusable m-line is rejected with port 0 next to the accepted one.
+	extra := strings.Replace(testOfferSDP, "m=audio", "m=audio 30002 RTP/AVP 0\r\nc=IN IP4 media.invalid\r\nm=audio", 1)
+	res = handle(t, s.handleInvite, newTestInDialog(t, sip.INVITE, "extra-m", "", 1, extra))
+	if res[len(res)-1].StatusCode != sip.StatusOK {
+		t.Fatalf("expected 200 with one usable m-line, got %d", res[len(res)-1].StatusCode)
+	}
+	var answer sdp.SessionDescription
+	if err := answer.Unmarshal(res[len(res)-1].Body()); err != nil {
+		t.Fatal(err)
+	}
+	if len(answer.MediaDescriptions) != 2 || answer.MediaDescriptions[0].MediaName.Port.Value != 0 || answer.MediaDescriptions[1].MediaName.Port.Value == 0 {
+		t.Fatalf("expected the first m-line rejected, got %s", res[len(res)-1].Body())
+	}
+	session, _ = s.sessionManager.GetSessionByCallID("extra-m")
+	s.sessionManager.DeleteSession(session.ID)
+
+	for name, offer := range map[string]string{
+		"no connection": strings.Replace(testOfferSDP, "c=IN IP4 127.0.0.1\r\n", "", 1),
+		"hostname":      strings.Replace(testOfferSDP, "c=IN IP4 127.0.0.1", "c=IN IP4 media.invalid", 1),
+		"ipv6 as ipv4":  strings.Replace(testOfferSDP, "c=IN IP4 127.0.0.1", "c=IN IP4 ::1", 1),
+	} {
+		res := handle(t, s.handleInvite, newTestInDialog(t, sip.INVITE, "bad-c-"+name, "", 1, offer))
+		if len(res) != 1 || res[0].StatusCode != sip.StatusNotAcceptableHere {
+			t.Fatalf("%s: expected 488, got %v", name, res)
+		}
+	}
+	if s.sessionManager.Len() != 0 || s.ports.InUse() != 0 {
+		t.Fatal("rejected offers left sessions or media ports behind")
+	}
+}
@@ -0,0 +1,206 @@
+package sipnexus
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emiago/sipgo"
+)
+
+// wsHandshakeTimeout bounds how long a ws/wss client may take to send its
+// upgrade request before the connection is dropped, and wsMaxRequest how
+// long that request may be.
+const (
+	wsHandshakeTimeout = 5 * time.Second
+	wsMaxRequest       = 8 << 10
+)
+
+type listener struct {
+	cfg    ListenerConfig
+	addr   net.Addr
+	closer io.Closer
+	serve  func() error
+}
+
+// openListener binds cfg. For udp, onServe is called once the listener is
+// being served.
+func (s *Server) openListener(cfg ListenerConfig, advertised net.IP, onServe func()) (*listener, error) {
+	switch cfg.transport() {
+	case TransportUDP:
+		conn, err := net.ListenPacket("udp", cfg.addr())
+		if err != nil {
+			return nil, err
+		}
+		served := &advertisedPacketConn{
+			PacketConn: conn,
+			addr:       &net.UDPAddr{IP: advertised, Port: conn.LocalAddr().(*net.UDPAddr).Port},
+			onServe:    onServe,
+		}
+		return &listener{
+			cfg:    cfg,
+			addr:   conn.LocalAddr(),
+			closer: conn,
+			serve:  func() error { return s.srv.ServeUDP(served) },
+		}, nil
+
+	case TransportTCP, TransportWS:
+		l, err := net.Listen("tcp", cfg.addr())
+		if err != nil {
+			return nil, err
+		}
+		serve := func() error { return s.srv.ServeTCP(l) }
+		if cfg.transport() == TransportWS {
+			wl := newWSListener(l, cfg.WSPath)
+			serve = func() error { return s.srv.ServeWS(wl) }
+		}
+		return &listener{cfg: cfg, addr: l.Addr(), closer: l, serve: serve}, nil
+
+	case TransportTLS, TransportWSS:
+		conf, err := sipgo.GenerateTLSConfig(cfg.TLSCertFile, cfg.TLSKeyFile, nil)
+		if err != nil {
+			return nil, err
+		}
+		l, err := tls.Listen("tcp", cfg.addr(), conf)
+		if err != nil {
+			return nil, err
+		}
+		serve := func() error { return s.srv.ServeTLS(l) }
+		if cfg.transport() == TransportWSS {
+			wl := newWSListener(l, cfg.WSPath)
+			serve = func() error { return s.srv.ServeWSS(wl) }
+		}
+		return &listener{cfg: cfg, addr: l.Addr(), closer: l, serve: serve}, nil
+	}
+	return nil, fmt.Errorf("unsupported transport %q", cfg.Transport)
+}
+
+// advertisedPacketConn reports the advertised address as its local address.
+// sipgo indexes the listener by it and reuses the listener for requests
+// whose Via sent-by matches, so requests go out of the bound socket while
+// carrying the address peers behind NAT can reach.
+type advertisedPacketConn struct {
+	net.PacketConn
+	addr net.Addr
+
+	// onServe runs on the first read, by when sipgo has indexed the
+	// listener.
+	onServe func()
+	once    sync.Once
+}
+
+func (c *advertisedPacketConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *advertisedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.onServe != nil {
+		c.once.Do(c.onServe)
+	}
+	return c.PacketConn.ReadFrom(b)
+}
+
+// wsListener hands accepted connections to sipgo only once their upgrade
+// request has arrived. sipgo upgrades connections one at a time in its
+// accept loop, so a client that is slow to send its request would stall
+// every other one; here each connection is read in a goroutine of its own.
+// With a path set, upgrades for any other path are answered with 404.
+type wsListener struct {
+	net.Listener
+	path  string
+	conns chan net.Conn
+
+	// done is closed with err once the underlying listener fails.
+	done chan struct{}
+	err  error
+}
+
+func newWSListener(l net.Listener, path string) *wsListener {
+	wl := &wsListener{Listener: l, path: path, conns: make(chan net.Conn), done: make(chan struct{})}
+	go wl.run()
+	return wl
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *wsListener) run() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake reads the upgrade request of conn and queues conn for Accept
+// with the request replayed ahead of what follows it.
+func (l *wsListener) handshake(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(wsHandshakeTimeout))
+	r := bufio.NewReader(conn)
+	var req []byte
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil || len(req)+len(line) > wsMaxRequest {
+			conn.Close()
+			return
+		}
+		if req == nil && l.path != "" && requestPath(line) != l.path {
+			conn.Write([]byte("HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			conn.Close()
+			return
+		}
+		req = append(req, line...)
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	select {
+	case l.conns <- &bufferedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(req), r)}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// requestPath extracts the path from an HTTP request line without query.
+func requestPath(line []byte) string {
+	fields := bytes.Fields(line)
+	if len(fields) < 2 {
+		return ""
+	}
+	target := fields[1]
+	if i := bytes.IndexByte(target, '?'); i >= 0 {
+		target = target[:i]
+	}
+	return string(target)
+}
+
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func isClosedErr(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,166 @@
+package sipnexus
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// ErrStaleBinding is returned when a REGISTER refresh carries a CSeq that is
+// not newer than the one already stored for the same Call-ID.
+var ErrStaleBinding = errors.New("stale binding")
+
+// Binding is a single contact registered for an Address-of-Record.
+type Binding struct {
+	AOR     string
+	Contact sip.ContactHeader
+	CallID  string
+	CSeq    uint32
+	Expires time.Time
+
+	// Source is the transport address the REGISTER was received from.
+	Source    string
+	Transport string
+}
+
+// Key identifies the binding within its AOR.
+func (b *Binding) Key() string {
+	return contactKey(&b.Contact)
+}
+
+// Q returns the contact preference, defaulting to 1.0 when absent.
+func (b *Binding) Q() float64 {
+	if v, ok := b.Contact.Params.Get("q"); ok {
+		if q, err := strconv.ParseFloat(v, 64); err == nil {
+			return q
+		}
+	}
+	return 1.0
+}
+
+// LocationService stores registrar bindings. Implementations must be safe
+// for concurrent use.
+type LocationService interface {
+	// Lookup returns unexpired bindings for aor ordered by descending q.
+	Lookup(aor string) ([]Binding, error)
+	// Update adds or refreshes the bindings of one REGISTER, which share an
+	// AOR. A binding whose Expires is not in the future removes the
+	// matching contact instead. Either all bindings are applied or, on
+	// error, none of them.
+	Update(bindings ...Binding) error
+	// Remove deletes a single contact from aor.
+	Remove(aor string, contact string) error
+	// RemoveAll deletes every binding of aor.
+	RemoveAll(aor string) error
+}
+
+// MemoryLocationService is an in-process LocationService.
+type MemoryLocationService struct {
+	mu       sync.RWMutex
+	bindings map[string]map[string]Binding
+	now      func() time.Time
+}
+
+func NewMemoryLocationService() *MemoryLocationService {
+	return &MemoryLocationService{
+		bindings: make(map[string]map[string]Binding),
+		now:      time.Now,
+	}
+}
+
+func (m *MemoryLocationService) Lookup(aor string) ([]Binding, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := m.now()
+	result := make([]Binding, 0, len(m.bindings[aor]))
+	for _, b := range m.bindings[aor] {
+		if b.Expires.After(now) {
+			result = append(result, b)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Q() != result[j].Q() {
+			return result[i].Q() > result[j].Q()
+		}
+		return result[i].Key() < result[j].Key()
+	})
+	return result, nil
+}
+
+func (m *MemoryLocationService) Update(bindings ...Binding) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	for _, b := range bindings {
+		existing, ok := m.bindings[b.AOR][b.Key()]
+		if ok && existing.Expires.After(now) && existing.CallID == b.CallID && b.CSeq <= existing.CSeq {
+			return ErrStaleBinding
+		}
+	}
+
+	for _, b := range bindings {
+		if !b.Expires.After(now) {
+			m.remove(b.AOR, b.Key())
+			continue
+		}
+		contacts := m.bindings[b.AOR]
+		if contacts == nil {
+			contacts = make(map[string]Binding)
+			m.bindings[b.AOR] = contacts
+		}
+		contacts[b.Key()] = b
+	}
+	for _, b := range bindings {
+		m.purge(b.AOR, now)
+	}
+	return nil
+}
+
+func (m *MemoryLocationService) Remove(aor string, contact string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(aor, contact)
+	return nil
+}
+
+func (m *MemoryLocationService) RemoveAll(aor string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.bindings, aor)
+	return nil
+}
+
+func (m *MemoryLocationService) remove(aor string, key string) {
+	contacts := m.bindings[aor]
+	delete(contacts, key)
+	if len(contacts) == 0 {
+		delete(m.bindings, aor)
+	}
+}
+
+// purge drops expired bindings of aor. Callers must hold m.mu.
+func (m *MemoryLocationService) purge(aor string, now time.Time) {
+	for key, b := range m.bindings[aor] {
+		if !b.Expires.After(now) {
+			m.remove(aor, key)
+		}
+	}
+}
+
+// AddressOfRecord canonicalizes a To/Request-URI into the key used by the
+// location service: scheme, user and host only.
+func AddressOfRecord(uri sip.Uri) string {
+	aor := sip.Uri{Encrypted: uri.Encrypted, User: uri.User, Host: strings.ToLower(uri.Host)}
+	return aor.String()
+}
+
+func contactKey(c *sip.ContactHeader) string {
+	return c.Address.String()
+}
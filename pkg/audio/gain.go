@@ -0,0 +1,33 @@
+package audio
+
+import "math"
+
+// Gain is an amplitude factor in Q12 fixed point.
+type Gain int32
+
+// Unity leaves samples as they are.
+const Unity Gain = 1 << 12
+
+// GainDB returns the gain of db decibels.
+func GainDB(db float64) Gain {
+	return Gain(math.Round(math.Pow(10, db/20) * float64(Unity)))
+}
+
+// DB returns the gain in decibels.
+func (g Gain) DB() float64 {
+	return 20 * math.Log10(float64(g)/float64(Unity))
+}
+
+// Apply scales pcm in place, clipping what leaves the range of 16 bits.
+func (g Gain) Apply(pcm []int16) {
+	if g == Unity {
+		return
+	}
+	for i, s := range pcm {
+		pcm[i] = saturate((int64(s)*int64(g) + 1<<11) >> 12)
+	}
+}
+
+func saturate(v int64) int16 {
+	return int16(min(max(v, math.MinInt16), math.MaxInt16))
+}
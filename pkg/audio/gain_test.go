@@ -0,0 +1,36 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGain(t *testing.T) {
+	if g := GainDB(0); g != Unity {
+		t.Fatalf("0 dB is %d, want %d", g, Unity)
+	}
+	if db := GainDB(-6).DB(); math.Abs(db+6) > 0.01 {
+		t.Fatalf("-6 dB round trips to %.3f dB", db)
+	}
+
+	pcm := []int16{1000, -1000, 20000, -20000, 3}
+	GainDB(6).Apply(pcm)
+	for i, want := range []int16{1995, -1995, 32767, -32768, 6} {
+		if pcm[i] != want {
+			t.Fatalf("sample %d is %d, want %d", i, pcm[i], want)
+		}
+	}
+	Gain(Unity / 2).Apply(pcm)
+	if pcm[0] != 998 || pcm[1] != -997 {
+		t.Fatalf("halved to %d and %d", pcm[0], pcm[1])
+	}
+}
+
+func BenchmarkGain(b *testing.B) {
+	pcm := tones(960, 48000)
+	g := GainDB(-3)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		g.Apply(pcm)
+	}
+}
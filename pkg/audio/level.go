@@ -0,0 +1,65 @@
+package audio
+
+import "math"
+
+// MinLevel is the level of silence, in dBFS; quieter signals are reported
+// at it.
+const MinLevel = -127.0
+
+// Level returns the RMS level of pcm in dBFS, relative to a full-scale
+// square wave.
+func Level(pcm []int16) float64 {
+	var m Meter
+	m.Write(pcm)
+	return m.Level()
+}
+
+// Meter measures the level of audio written to it since it was reset. The
+// zero value is ready to use; a Meter is not safe for concurrent use.
+type Meter struct {
+	energy  float64
+	samples int
+	peak    int32
+}
+
+// Write adds pcm to the measurement.
+func (m *Meter) Write(pcm []int16) {
+	var energy int64
+	peak := m.peak
+	for _, s := range pcm {
+		v := int32(s)
+		energy += int64(v * v)
+		if v < 0 {
+			v = -v
+		}
+		peak = max(peak, v)
+	}
+	m.energy += float64(energy)
+	m.samples += len(pcm)
+	m.peak = peak
+}
+
+// Level returns the RMS level of what was written, in dBFS.
+func (m *Meter) Level() float64 {
+	if m.samples == 0 {
+		return MinLevel
+	}
+	return dBFS(math.Sqrt(m.energy / float64(m.samples)))
+}
+
+// Peak returns the level of the largest sample written, in dBFS.
+func (m *Meter) Peak() float64 {
+	return dBFS(float64(m.peak))
+}
+
+// Reset starts a new measurement.
+func (m *Meter) Reset() {
+	*m = Meter{}
+}
+
+func dBFS(amplitude float64) float64 {
+	if amplitude == 0 {
+		return MinLevel
+	}
+	return max(20*math.Log10(amplitude/math.MaxInt16), MinLevel)
+}
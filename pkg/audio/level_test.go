@@ -0,0 +1,49 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLevel(t *testing.T) {
+	sine := make([]int16, 8000)
+	for i := range sine {
+		sine[i] = int16(math.MaxInt16 * math.Sin(2*math.Pi*1000*float64(i)/8000))
+	}
+	// A full-scale sine is 3 dB below a full-scale square wave.
+	if got := Level(sine); math.Abs(got+3.01) > 0.05 {
+		t.Fatalf("full-scale sine at %.2f dBFS", got)
+	}
+	GainDB(-20).Apply(sine)
+	if got := Level(sine); math.Abs(got+23.01) > 0.05 {
+		t.Fatalf("sine at -20 dB measures %.2f dBFS", got)
+	}
+	if got := Level(make([]int16, 160)); got != MinLevel {
+		t.Fatalf("silence at %.2f dBFS", got)
+	}
+
+	var m Meter
+	m.Write(sine[:4000])
+	m.Write(make([]int16, 4000))
+	if got := m.Level(); math.Abs(got+26.02) > 0.05 {
+		t.Fatalf("sine then silence at %.2f dBFS", got)
+	}
+	if got := m.Peak(); math.Abs(got+20) > 0.05 {
+		t.Fatalf("peak at %.2f dBFS", got)
+	}
+	m.Reset()
+	if m.Level() != MinLevel || m.Peak() != MinLevel {
+		t.Fatal("levels left after Reset")
+	}
+}
+
+func BenchmarkLevel(b *testing.B) {
+	pcm := tones(160, 8000)
+	var m Meter
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m.Reset()
+		m.Write(pcm)
+		m.Level()
+	}
+}
@@ -0,0 +1,27 @@
+package audio
+
+// Downmix writes the mono mix of the interleaved stereo samples in src, the
+// mean of each left and right pair, to dst and returns how many samples were
+// written. A trailing unpaired sample is ignored.
+func Downmix(dst, src []int16) (int, error) {
+	n := len(src) / 2
+	if len(dst) < n {
+		return 0, ErrShortBuffer
+	}
+	for i := range dst[:n] {
+		dst[i] = int16((int32(src[2*i]) + int32(src[2*i+1])) >> 1)
+	}
+	return n, nil
+}
+
+// Upmix writes interleaved stereo carrying the mono samples of src on both
+// channels to dst and returns how many samples were written.
+func Upmix(dst, src []int16) (int, error) {
+	if len(dst) < 2*len(src) {
+		return 0, ErrShortBuffer
+	}
+	for i, s := range src {
+		dst[2*i], dst[2*i+1] = s, s
+	}
+	return 2 * len(src), nil
+}
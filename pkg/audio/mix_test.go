@@ -0,0 +1,43 @@
+package audio
+
+import "testing"
+
+func TestMix(t *testing.T) {
+	stereo := []int16{100, 300, -32768, -32768, 32767, 32767, 1, -2}
+	mono := make([]int16, 4)
+	n, err := Downmix(mono, stereo)
+	if err != nil || n != 4 {
+		t.Fatalf("Downmix = %d, %v", n, err)
+	}
+	for i, want := range []int16{200, -32768, 32767, -1} {
+		if mono[i] != want {
+			t.Fatalf("mono sample %d is %d, want %d", i, mono[i], want)
+		}
+	}
+
+	out := make([]int16, 8)
+	if n, err = Upmix(out, mono); err != nil || n != 8 {
+		t.Fatalf("Upmix = %d, %v", n, err)
+	}
+	for i := range out {
+		if out[i] != mono[i/2] {
+			t.Fatalf("stereo sample %d is %d, want %d", i, out[i], mono[i/2])
+		}
+	}
+
+	if _, err := Downmix(mono[:3], stereo); err != ErrShortBuffer {
+		t.Fatalf("Downmix = %v, want ErrShortBuffer", err)
+	}
+	if _, err := Upmix(out[:7], mono); err != ErrShortBuffer {
+		t.Fatalf("Upmix = %v, want ErrShortBuffer", err)
+	}
+}
+
+func BenchmarkDownmix(b *testing.B) {
+	stereo := tones(1920, 48000)
+	mono := make([]int16, len(stereo)/2)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Downmix(mono, stereo)
+	}
+}
@@ -0,0 +1,38 @@
+package audio
+
+import "math"
+
+// Noise generates white noise of a set level, such as comfort noise
+// standing in for the background during silence. The zero value generates
+// silence until SetLevel is called; a Noise is not safe for concurrent use.
+type Noise struct {
+	amplitude int32 // peak of the uniform distribution
+	state     uint32
+}
+
+// SetLevel sets the RMS level of the noise in dBFS. Levels at or below
+// MinLevel give silence.
+func (n *Noise) SetLevel(level float64) {
+	if level <= MinLevel {
+		n.amplitude = 0
+		return
+	}
+	// Uniform noise peaking at a has an RMS of a/√3.
+	rms := math.MaxInt16 * math.Pow(10, level/20)
+	n.amplitude = int32(min(rms*math.Sqrt(3), math.MaxInt16))
+}
+
+// Read fills pcm with noise.
+func (n *Noise) Read(pcm []int16) {
+	if n.state == 0 {
+		n.state = 0x9e3779b9
+	}
+	a := int64(n.amplitude)
+	for i := range pcm {
+		// xorshift32
+		n.state ^= n.state << 13
+		n.state ^= n.state >> 17
+		n.state ^= n.state << 5
+		pcm[i] = int16(int64(n.state)*(2*a+1)>>32 - a)
+	}
+}
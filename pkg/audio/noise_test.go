@@ -0,0 +1,32 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNoise(t *testing.T) {
+	var n Noise
+	pcm := make([]int16, 8000)
+	n.Read(pcm)
+	if got := Level(pcm); got != MinLevel {
+		t.Fatalf("unset noise at %.1f dBFS", got)
+	}
+	for _, level := range []float64{-60, -30, -10} {
+		n.SetLevel(level)
+		n.Read(pcm)
+		if got := Level(pcm); math.Abs(got-level) > 0.5 {
+			t.Fatalf("noise at %.0f dBFS measures %.1f dBFS", level, got)
+		}
+	}
+}
+
+func BenchmarkNoise(b *testing.B) {
+	var n Noise
+	n.SetLevel(-50)
+	pcm := make([]int16, 160)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		n.Read(pcm)
+	}
+}
@@ -0,0 +1,250 @@
+package audio
+
+import "math"
+
+// Settings of PLC at 8 kHz, after ITU-T G.711 Appendix I. They scale with
+// the sample rate.
+const (
+	plcHistory      = 390 // 48.75ms, enough for three of the longest periods and an overlap
+	plcPitchMin     = 40  // 200 Hz
+	plcPitchMax     = 120 // 66.7 Hz
+	plcCorrLen      = 160 // 20ms matched when searching the pitch
+	plcDecimation   = 2   // of the coarse pitch search
+	plcUnit         = 80  // 10ms, the step of attenuation and of using more periods
+	plcOverlapIncr  = 32  // 4ms more overlap on recovery per unit lost
+	plcCorrMinPower = 250.0
+	// plcAttenuation is how much quieter each unit of concealment after the
+	// first gets; audio is muted after 60ms.
+	plcAttenuation = 0.2
+)
+
+// PLC conceals lost frames of a stream by repeating its last pitch period,
+// as G.711 Appendix I describes. The first 10ms of a loss repeat one
+// period, the next two 10ms use two and then three periods so that the
+// repetition does not buzz, and from the second 10ms on the audio fades out
+// by 20% per 10ms. When audio resumes, the concealment is cross-faded into
+// it. Unlike Appendix I it adds no delay, so the start of a loss is not
+// smoothed.
+//
+// Feed every received frame to Good and call Conceal for every lost one. A
+// PLC does not allocate after it is made and is not safe for concurrent
+// use.
+type PLC struct {
+	scale   int     // sample rate / 8000
+	history []int16 // the audio that played last, newest at the end
+	erased  int     // samples concealed in the current loss
+
+	// The pitch buffer is a copy of history at the start of a loss, whose
+	// last blen samples are repeated starting at offset. Its last overlap
+	// samples are cross-faded with lastQ, the quarter period that played,
+	// so that the end joins the start.
+	buf     []float32
+	lastQ   []float32
+	pitch   int
+	overlap int
+	blen    int
+	offset  int
+
+	scratch []float32
+}
+
+// NewPLC returns a concealer for audio sampled at rate Hz, a multiple of
+// 8000.
+func NewPLC(rate int) *PLC {
+	scale := max(rate/8000, 1)
+	return &PLC{
+		scale:   scale,
+		history: make([]int16, plcHistory*scale),
+		buf:     make([]float32, plcHistory*scale),
+		lastQ:   make([]float32, plcPitchMax*scale/4),
+		scratch: make([]float32, plcUnit*scale),
+	}
+}
+
+// Good takes in a frame that was received. After a loss it cross-fades the
+// concealment into the start of pcm, which it changes in place.
+func (p *PLC) Good(pcm []int16) {
+	if p.erased > 0 {
+		unit := plcUnit * p.scale
+		units := (p.erased + unit - 1) / unit
+		// Longer losses take longer to blend.
+		n := min(p.overlap+(units-1)*plcOverlapIncr*p.scale, unit, len(pcm))
+		syn := p.scratch[:n]
+		p.synthesize(syn)
+		for i := range syn {
+			w := float32(i+1) / float32(n+1)
+			pcm[i] = saturate(int64((1-w)*syn[i]*p.gain(p.erased+i) + w*float32(pcm[i])))
+		}
+		p.erased = 0
+	}
+	p.save(pcm)
+}
+
+// Conceal writes audio for a lost frame of len(pcm) samples to pcm.
+func (p *PLC) Conceal(pcm []int16) {
+	unit := plcUnit * p.scale
+	for len(pcm) > 0 {
+		n := min(len(pcm), unit-p.erased%unit)
+		p.conceal(pcm[:n])
+		pcm = pcm[n:]
+	}
+}
+
+// conceal fills out, which does not cross a unit boundary.
+func (p *PLC) conceal(out []int16) {
+	unit := plcUnit * p.scale
+	switch {
+	case p.erased == 0:
+		p.start()
+	case p.erased >= 6*unit:
+		clear(out)
+		p.erased += len(out)
+		p.save(out)
+		return
+	case p.erased == unit || p.erased == 2*unit:
+		p.addPeriod(out)
+		p.erased += len(out)
+		p.save(out)
+		return
+	}
+	p.read(out, p.erased)
+	p.erased += len(out)
+	p.save(out)
+}
+
+// start prepares the pitch buffer at the start of a loss.
+func (p *PLC) start() {
+	for i, s := range p.history {
+		p.buf[i] = float32(s)
+	}
+	p.pitch = p.findPitch()
+	p.overlap = p.pitch / 4
+	end := len(p.buf)
+	copy(p.lastQ, p.buf[end-p.overlap:])
+	p.offset = 0
+	p.blen = p.pitch
+	p.join()
+}
+
+// addPeriod repeats one more period from the history, which makes the
+// concealment less periodic, and fills out cross-fading from the old
+// repetition into the new.
+func (p *PLC) addPeriod(out []int16) {
+	n := min(p.overlap, len(out))
+	tail := p.scratch[:n]
+	offset := p.offset
+	p.synthesize(tail)
+	p.offset = offset
+	for p.offset > p.pitch {
+		p.offset -= p.pitch
+	}
+	p.blen += p.pitch
+	p.join()
+
+	p.read(out, p.erased)
+	for i := range tail {
+		w := float32(i+1) / float32(n+1)
+		g := p.gain(p.erased + i)
+		out[i] = saturate(int64((1-w)*tail[i]*g + w*float32(out[i])))
+	}
+}
+
+// join cross-fades the quarter period before the repeated part of the pitch
+// buffer into its end, so that the repetition has no seam.
+func (p *PLC) join() {
+	end := len(p.buf)
+	l, r := p.lastQ[:p.overlap], p.buf[end-p.blen-p.overlap:]
+	o := p.buf[end-p.overlap:]
+	for i := range o {
+		w := float32(i+1) / float32(p.overlap+1)
+		o[i] = (1-w)*l[i] + w*r[i]
+	}
+}
+
+// read fills out with the repetition, attenuated for the samples from
+// erased on.
+func (p *PLC) read(out []int16, erased int) {
+	for i := range out {
+		out[i] = saturate(int64(p.next() * p.gain(erased+i)))
+	}
+}
+
+// synthesize fills out with the repetition, moving on.
+func (p *PLC) synthesize(out []float32) {
+	for i := range out {
+		out[i] = p.next()
+	}
+}
+
+func (p *PLC) next() float32 {
+	s := p.buf[len(p.buf)-p.blen+p.offset]
+	if p.offset++; p.offset == p.blen {
+		p.offset = 0
+	}
+	return s
+}
+
+// gain returns the attenuation of the sample concealed after erased others:
+// none for the first 10ms, then falling linearly by plcAttenuation per 10ms.
+func (p *PLC) gain(erased int) float32 {
+	unit := plcUnit * p.scale
+	if erased < unit {
+		return 1
+	}
+	return max(1-plcAttenuation*float32(erased-unit)/float32(unit), 0)
+}
+
+// save appends pcm to the history.
+func (p *PLC) save(pcm []int16) {
+	if len(pcm) >= len(p.history) {
+		copy(p.history, pcm[len(pcm)-len(p.history):])
+		return
+	}
+	copy(p.history, p.history[len(pcm):])
+	copy(p.history[len(p.history)-len(pcm):], pcm)
+}
+
+// findPitch returns the period of the end of the pitch buffer: the lag
+// whose segment correlates best with the last plcCorrLen samples, by a
+// coarse search on decimated samples refined around its best match.
+func (p *PLC) findPitch() int {
+	corrLen, diff := plcCorrLen*p.scale, (plcPitchMax-plcPitchMin)*p.scale
+	end := len(p.buf)
+	l := p.buf[end-corrLen:]
+	r := p.buf[end-corrLen-plcPitchMax*p.scale:]
+
+	best := p.search(l, r, 0, diff, plcDecimation*p.scale)
+	from := max(best-(plcDecimation*p.scale-1), 0)
+	to := min(best+(plcDecimation*p.scale-1), diff)
+	best = p.search(l, r, from, to, 1)
+	return plcPitchMax*p.scale - best
+}
+
+// search returns the lag j in [from, to], in steps of step, at which
+// r[j:] correlates best with l, normalized by the energy of r[j:]. Only
+// every step-th sample is compared.
+func (p *PLC) search(l, r []float32, from, to, step int) int {
+	n := len(l)
+	var energy float64
+	for i := 0; i < n; i += step {
+		energy += float64(r[from+i]) * float64(r[from+i])
+	}
+	best, bestCorr := from, math.Inf(-1)
+	for j := from; j <= to; j += step {
+		if j > from {
+			// Slide the window of compared samples by one.
+			energy -= float64(r[j-step]) * float64(r[j-step])
+			energy += float64(r[j-step+n]) * float64(r[j-step+n])
+		}
+		var corr float64
+		rj := r[j : j+n]
+		for i := 0; i < n; i += step {
+			corr += float64(rj[i]) * float64(l[i])
+		}
+		corr /= math.Sqrt(max(energy, plcCorrMinPower))
+		if corr > bestCorr {
+			best, bestCorr = j, corr
+		}
+	}
+	return best
+}
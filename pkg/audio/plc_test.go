@@ -0,0 +1,127 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+// voiced returns n samples at rate of a vowel-like sound: harmonics of
+// 125 Hz falling off with frequency.
+func voiced(n, rate int) []int16 {
+	pcm := make([]int16, n)
+	for i := range pcm {
+		var v float64
+		for h := 1; h <= 12; h++ {
+			v += math.Sin(2*math.Pi*125*float64(h*i)/float64(rate)+float64(h)) / float64(h)
+		}
+		pcm[i] = int16(5000 * v)
+	}
+	return pcm
+}
+
+// conceal runs pcm in frames of frame samples through a PLC, concealing
+// the frames for which lost is true.
+func conceal(pcm []int16, rate, frame int, lost func(int) bool) []int16 {
+	p := NewPLC(rate)
+	out := make([]int16, len(pcm))
+	copy(out, pcm)
+	for i := 0; i+frame <= len(out); i += frame {
+		if lost(i / frame) {
+			p.Conceal(out[i : i+frame])
+		} else {
+			p.Good(out[i : i+frame])
+		}
+	}
+	return out
+}
+
+// segmentSNR returns the SNR of got against want over [from, to).
+func segmentSNR(want, got []int16, from, to int) float64 {
+	return delayedSNR(want[from:to], got[from:to], 0, 0)
+}
+
+func TestPLC(t *testing.T) {
+	for _, rate := range []int{8000, 16000} {
+		pcm := voiced(rate, rate)
+		frame := rate / 50
+		step := maxStep(pcm)
+		for _, tc := range []struct {
+			name string
+			lost func(int) bool
+			// The SNR of the first 10ms of each loss must reach minSNR; a
+			// gap of silence would have 0 dB.
+			minSNR float64
+		}{
+			{"single", func(i int) bool { return i == 20 }, 20},
+			{"every fifth", func(i int) bool { return i%5 == 4 }, 20},
+			{"burst", func(i int) bool { return i >= 20 && i < 23 }, 20},
+		} {
+			out := conceal(pcm, rate, frame, tc.lost)
+			for i := 0; i < len(pcm)/frame; i++ {
+				if !tc.lost(i) || (i > 0 && tc.lost(i-1)) {
+					continue
+				}
+				start := i * frame
+				if got := segmentSNR(pcm, out, start, start+frame/2); got < tc.minSNR {
+					t.Fatalf("%d Hz, %s: loss at frame %d concealed with SNR %.1f dB", rate, tc.name, i, got)
+				}
+				// The concealment blends into the audio that resumes, with
+				// no click: no step is much larger than in the signal.
+				for j := start + 1; j < start+4*frame && j < len(out); j++ {
+					if d := math.Abs(float64(out[j]) - float64(out[j-1])); d > 2*step {
+						t.Fatalf("%d Hz, %s: step of %.0f at sample %d", rate, tc.name, d, j)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPLCFadesOut(t *testing.T) {
+	pcm := voiced(8000, 8000)
+	out := conceal(pcm, 8000, 160, func(i int) bool { return i >= 20 && i < 25 })
+	// Concealment fades out over 10 to 60ms and then is silent.
+	first := Level(out[3200:3280])
+	if got := Level(out[3200+240 : 3200+320]); got > first-4 {
+		t.Fatalf("concealment at 30-40ms is %.1f dBFS, %.1f dBFS at first", got, first)
+	}
+	for i := 3200 + 480; i < 4000; i++ {
+		if out[i] != 0 {
+			t.Fatalf("sample %d is %d after 60ms of loss", i, out[i])
+		}
+	}
+	// The audio after the loss fades in.
+	if math.Abs(float64(out[4000])) > math.Abs(float64(pcm[4000]))/8 || segmentSNR(pcm, out, 4000+80, 4160) < 40 {
+		t.Fatalf("audio after the loss does not fade in")
+	}
+}
+
+func TestPLCAllocs(t *testing.T) {
+	p := NewPLC(16000)
+	pcm := voiced(320, 16000)
+	allocs := testing.AllocsPerRun(100, func() {
+		p.Good(pcm)
+		p.Conceal(pcm)
+	})
+	if allocs != 0 {
+		t.Fatalf("%.1f allocations per frame", allocs)
+	}
+}
+
+func maxStep(pcm []int16) float64 {
+	var m float64
+	for i := 1; i < len(pcm); i++ {
+		m = max(m, math.Abs(float64(pcm[i])-float64(pcm[i-1])))
+	}
+	return m
+}
+
+func BenchmarkPLC(b *testing.B) {
+	p := NewPLC(8000)
+	pcm := voiced(160, 8000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.Good(pcm)
+		p.Conceal(pcm)
+	}
+}
@@ -0,0 +1,105 @@
+package audio
+
+import (
+	"errors"
+	"math"
+)
+
+// ErrShortBuffer is returned when the destination of an operation cannot
+// hold the result.
+var ErrShortBuffer = errors.New("audio: destination too short")
+
+// resamplerTaps is the filter length per input sample of the lower rate.
+const resamplerTaps = 24
+
+// Resampler converts a stream of samples between two rates in the ratio of
+// small integers with a polyphase windowed-sinc filter. It keeps the tail
+// of each block so that blocks join without clicks, and is not safe for
+// concurrent use.
+type Resampler struct {
+	up, down int
+	taps     int       // coefficients per phase
+	filter   []float64 // up phases of taps coefficients, each reversed
+	history  []float64 // the last taps-1 input samples
+	buf      []float64
+	pos      int // position of the next output, in upsampled input samples
+}
+
+// NewResampler returns a resampler from rate from to rate to, in Hz.
+func NewResampler(from, to int) *Resampler {
+	g := gcd(from, to)
+	up, down := to/g, from/g
+
+	// A low-pass at the lower of the two Nyquist rates, designed at the
+	// upsampled rate and scaled by up to make up for the inserted zeros.
+	// It is centred on a sample so that the delay, resamplerTaps/2
+	// samples of the lower rate, is a whole number of samples of either.
+	n := resamplerTaps * max(up, down)
+	cutoff := 0.45 / float64(max(up, down))
+	proto := make([]float64, n)
+	for i := range proto {
+		x := float64(i - n/2)
+		sinc := 2 * cutoff
+		if x != 0 {
+			sinc = math.Sin(2*math.Pi*cutoff*x) / (math.Pi * x)
+		}
+		// Blackman window
+		w := 0.42 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n)) + 0.08*math.Cos(4*math.Pi*float64(i)/float64(n))
+		proto[i] = sinc * w * float64(up)
+	}
+
+	taps := n / up
+	r := &Resampler{up: up, down: down, taps: taps, filter: make([]float64, n), history: make([]float64, taps-1)}
+	for phase := 0; phase < up; phase++ {
+		for t := 0; t < taps; t++ {
+			r.filter[phase*taps+taps-1-t] = proto[phase+t*up]
+		}
+	}
+	return r
+}
+
+// MaxOutput returns the most samples resampling in samples yields.
+func (r *Resampler) MaxOutput(in int) int {
+	return (in*r.up+r.down-1)/r.down + 1
+}
+
+// Resample writes the samples of src at the new rate to dst and returns how
+// many were written. The output is delayed by resamplerTaps/2 samples of
+// the lower rate.
+func (r *Resampler) Resample(dst, src []int16) (int, error) {
+	end := len(src) * r.up
+	if need := (end - r.pos + r.down - 1) / r.down; len(dst) < need {
+		return 0, ErrShortBuffer
+	}
+
+	if size := len(r.history) + len(src); cap(r.buf) < size {
+		r.buf = make([]float64, size)
+	}
+	r.buf = r.buf[:len(r.history)+len(src)]
+	in := r.buf[copy(r.buf, r.history):]
+	for i, s := range src {
+		in[i] = float64(s)
+	}
+	n := 0
+	for ; r.pos < end; r.pos += r.down {
+		phase, i := r.pos%r.up, r.pos/r.up
+		coeffs := r.filter[phase*r.taps : (phase+1)*r.taps]
+		window := r.buf[i : i+len(coeffs)]
+		var acc float64
+		for t := len(coeffs) - 1; t >= 0; t-- {
+			acc += coeffs[t] * window[t]
+		}
+		dst[n] = int16(math.Round(min(max(acc, math.MinInt16), math.MaxInt16)))
+		n++
+	}
+	r.pos -= end
+	copy(r.history, r.buf[len(r.buf)-len(r.history):])
+	return n, nil
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
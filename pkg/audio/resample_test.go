@@ -0,0 +1,112 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+// tones returns n samples at rate of a low and a high tone, both below
+// 4 kHz.
+func tones(n, rate int) []int16 {
+	pcm := make([]int16, n)
+	for i := range pcm {
+		x := 2 * math.Pi * float64(i) / float64(rate)
+		pcm[i] = int16(8000*math.Sin(440*x) + 4000*math.Sin(2500*x))
+	}
+	return pcm
+}
+
+// delayedSNR returns the SNR of got against want delayed by delay samples,
+// skipping the first skip samples while filters settle.
+func delayedSNR(want, got []int16, delay, skip int) float64 {
+	var signal, noise float64
+	for i := skip; i < len(want)-delay; i++ {
+		d := float64(got[i+delay]) - float64(want[i])
+		signal += float64(want[i]) * float64(want[i])
+		noise += d * d
+	}
+	return 10 * math.Log10(signal/noise)
+}
+
+func TestResampler(t *testing.T) {
+	for _, rate := range []int{16000, 48000} {
+		pcm := tones(8000, 8000)
+		up, down := NewResampler(8000, rate), NewResampler(rate, 8000)
+		wide := make([]int16, up.MaxOutput(160))
+		narrow := make([]int16, down.MaxOutput(len(wide)))
+		var out []int16
+		for i := 0; i < len(pcm); i += 160 {
+			n, err := up.Resample(wide, pcm[i:i+160])
+			if err != nil || n != rate/50 {
+				t.Fatalf("upsampled 160 samples to %d, %v", n, err)
+			}
+			if n, err = down.Resample(narrow, wide[:n]); err != nil || n != 160 {
+				t.Fatalf("downsampled %d samples to %d, %v", len(wide), n, err)
+			}
+			out = append(out, narrow[:n]...)
+		}
+		// Each resampler delays by resamplerTaps/2 samples at 8 kHz.
+		if got := delayedSNR(pcm, out, resamplerTaps, 400); got < 30 {
+			t.Fatalf("round trip through %d Hz has SNR %.1f dB", rate, got)
+		}
+	}
+}
+
+func TestResamplerBlocks(t *testing.T) {
+	// Blocks of any length join into the same stream.
+	pcm := tones(4000, 8000)
+	whole := make([]int16, 3*len(pcm))
+	n, err := NewResampler(8000, 24000).Resample(whole, pcm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewResampler(8000, 24000)
+	var pieces []int16
+	buf := make([]int16, r.MaxOutput(97))
+	for i := 0; i < len(pcm); i += 97 {
+		m, err := r.Resample(buf, pcm[i:min(i+97, len(pcm))])
+		if err != nil {
+			t.Fatal(err)
+		}
+		pieces = append(pieces, buf[:m]...)
+	}
+	if len(pieces) != n {
+		t.Fatalf("resampled %d samples in blocks, %d at once", len(pieces), n)
+	}
+	for i := range pieces {
+		if pieces[i] != whole[i] {
+			t.Fatalf("sample %d is %d in blocks, %d at once", i, pieces[i], whole[i])
+		}
+	}
+}
+
+func TestResamplerShortBuffer(t *testing.T) {
+	r := NewResampler(8000, 16000)
+	if _, err := r.Resample(make([]int16, 319), make([]int16, 160)); err != ErrShortBuffer {
+		t.Fatalf("Resample = %v, want ErrShortBuffer", err)
+	}
+}
+
+func BenchmarkResample(b *testing.B) {
+	for _, bc := range []struct {
+		name     string
+		from, to int
+	}{
+		{"8k-16k", 8000, 16000},
+		{"16k-8k", 16000, 8000},
+		{"8k-48k", 8000, 48000},
+		{"48k-8k", 48000, 8000},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			r := NewResampler(bc.from, bc.to)
+			pcm := tones(bc.from/50, bc.from)
+			dst := make([]int16, r.MaxOutput(len(pcm)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.Resample(dst, pcm)
+			}
+		})
+	}
+}
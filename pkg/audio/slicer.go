@@ -0,0 +1,52 @@
+package audio
+
+// Slicer cuts audio arriving in blocks of any length into frames of a fixed
+// length, as when the peers on two legs of a call use different ptimes. Its
+// buffer grows to what the blocks need and is reused from then on. A Slicer
+// is not safe for concurrent use.
+type Slicer struct {
+	frame int
+	buf   []int16
+	start int // of the samples not yet sliced
+}
+
+// NewSlicer returns a slicer into frames of frame samples.
+func NewSlicer(frame int) *Slicer {
+	return &Slicer{frame: frame, buf: make([]int16, 0, 2*frame)}
+}
+
+// Frame returns the samples per frame.
+func (s *Slicer) Frame() int {
+	return s.frame
+}
+
+// Write appends pcm to the audio waiting to be sliced. Frames returned by
+// Next before are overwritten.
+func (s *Slicer) Write(pcm []int16) {
+	if s.start > 0 {
+		s.buf = s.buf[:copy(s.buf, s.buf[s.start:])]
+		s.start = 0
+	}
+	s.buf = append(s.buf, pcm...)
+}
+
+// Next returns the next whole frame, or false while less than a frame is
+// buffered. The frame is valid until the next Write.
+func (s *Slicer) Next() ([]int16, bool) {
+	if len(s.buf)-s.start < s.frame {
+		return nil, false
+	}
+	f := s.buf[s.start : s.start+s.frame]
+	s.start += s.frame
+	return f, true
+}
+
+// Buffered returns the samples waiting for a frame to fill.
+func (s *Slicer) Buffered() int {
+	return len(s.buf) - s.start
+}
+
+// Reset drops the buffered samples.
+func (s *Slicer) Reset() {
+	s.buf, s.start = s.buf[:0], 0
+}
@@ -0,0 +1,69 @@
+package audio
+
+import "testing"
+
+func TestSlicer(t *testing.T) {
+	// 20 ms blocks into 30 ms frames at 8 kHz.
+	s := NewSlicer(240)
+	var next int16
+	for block := 0; block < 6; block++ {
+		pcm := make([]int16, 160)
+		for i := range pcm {
+			pcm[i] = int16(block*160 + i)
+		}
+		s.Write(pcm)
+		frames := 0
+		for f, ok := s.Next(); ok; f, ok = s.Next() {
+			if len(f) != 240 {
+				t.Fatalf("frame of %d samples", len(f))
+			}
+			for _, v := range f {
+				if v != next {
+					t.Fatalf("sample %d after %d", v, next-1)
+				}
+				next++
+			}
+			frames++
+		}
+		want := 1
+		if block%3 == 0 {
+			want = 0
+		}
+		if frames != want {
+			t.Fatalf("block %d gave %d frames, want %d", block, frames, want)
+		}
+	}
+	if s.Buffered() != 0 || next != 960 {
+		t.Fatalf("%d samples left after %d sliced", s.Buffered(), next)
+	}
+
+	s.Write(make([]int16, 100))
+	s.Reset()
+	if _, ok := s.Next(); ok || s.Buffered() != 0 {
+		t.Fatal("samples left after Reset")
+	}
+}
+
+func TestSlicerAllocs(t *testing.T) {
+	s := NewSlicer(240)
+	pcm := make([]int16, 160)
+	allocs := testing.AllocsPerRun(100, func() {
+		s.Write(pcm)
+		for _, ok := s.Next(); ok; _, ok = s.Next() {
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("%.1f allocations per block", allocs)
+	}
+}
+
+func BenchmarkSlicer(b *testing.B) {
+	s := NewSlicer(240)
+	pcm := make([]int16, 160)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.Write(pcm)
+		for _, ok := s.Next(); ok; _, ok = s.Next() {
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package audio
+
+// Settings of VAD.
+const (
+	// vadMargin is how far above the noise floor a frame must be to count
+	// as speech, in dB.
+	vadMargin = 9.0
+	// vadFloor is the noise floor assumed before any was measured, in
+	// dBFS, and the level below which nothing counts as speech.
+	vadFloor = -60.0
+	// vadRise bounds how fast the noise floor follows louder frames, in dB
+	// per second, so that speech does not pass for noise.
+	vadRise = 2.0
+	// vadHangover is how long speech is assumed to go on after the last
+	// loud frame, in milliseconds, keeping the ends of words and short
+	// pauses.
+	vadHangover = 300
+)
+
+// VAD detects voice activity from the level of frames against an estimate of
+// the background noise. The noise floor follows quieter frames at once and
+// louder ones slowly. A VAD is not safe for concurrent use.
+type VAD struct {
+	rate  int
+	floor float64 // dBFS
+	noise float64 // mean level of the frames without speech, in dBFS
+	quiet int     // samples since the last loud frame
+}
+
+// NewVAD returns a detector for audio sampled at rate Hz.
+func NewVAD(rate int) *VAD {
+	return &VAD{rate: rate, floor: vadFloor, noise: vadFloor, quiet: rate * vadHangover / 1000}
+}
+
+// Active reports whether pcm, the next frame of the stream, carries speech.
+func (v *VAD) Active(pcm []int16) bool {
+	level := Level(pcm)
+	if level < v.floor {
+		v.floor = level
+	} else {
+		v.floor = min(level, v.floor+vadRise*float64(len(pcm))/float64(v.rate))
+	}
+
+	if level > max(v.floor, vadFloor)+vadMargin {
+		v.quiet = 0
+		return true
+	}
+	// The floor follows the quietest frames; the mean is a better estimate
+	// of what the background sounds like.
+	v.noise += (level - v.noise) / 8
+	v.quiet += len(pcm)
+	return v.quiet <= v.rate*vadHangover/1000
+}
+
+// NoiseLevel returns the estimated level of the background noise in dBFS.
+func (v *VAD) NoiseLevel() float64 {
+	return v.noise
+}
+
+// Reset forgets the stream measured so far.
+func (v *VAD) Reset() {
+	*v = *NewVAD(v.rate)
+}
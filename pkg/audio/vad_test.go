@@ -0,0 +1,53 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+func TestVAD(t *testing.T) {
+	var noise Noise
+	noise.SetLevel(-50)
+	v := NewVAD(8000)
+	frame := make([]int16, 160)
+	speech := tones(8000, 8000)
+	GainDB(-10).Apply(speech)
+
+	// 2 s of background noise, then 1 s of speech and 1 s of noise again.
+	var active []bool
+	for i := 0; i < 200; i++ {
+		if i >= 100 && i < 150 {
+			copy(frame, speech[(i-100)*160:])
+			active = append(active, v.Active(frame))
+			continue
+		}
+		noise.Read(frame)
+		active = append(active, v.Active(frame))
+	}
+	// The noise floor starts at -60 dBFS, so noise 10 dB above it takes a
+	// while to be learned.
+	for i, want := range active {
+		switch {
+		case i >= 50 && i < 100 && want:
+			t.Fatalf("noise frame %d is active", i)
+		case i >= 100 && i < 150 && !want:
+			t.Fatalf("speech frame %d is inactive", i)
+		case i >= 150 && i < 165 && !want:
+			t.Fatalf("frame %d in the hangover is inactive", i)
+		case i >= 170 && want:
+			t.Fatalf("noise frame %d after speech is active", i)
+		}
+	}
+	if got := v.NoiseLevel(); math.Abs(got+50) > 2 {
+		t.Fatalf("noise level %.1f dBFS", got)
+	}
+}
+
+func BenchmarkVAD(b *testing.B) {
+	pcm := tones(160, 8000)
+	v := NewVAD(8000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		v.Active(pcm)
+	}
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownUser is returned by a CredentialStore that has no password for
+// the requested user.
+var ErrUnknownUser = errors.New("unknown user")
+
+// CredentialStore resolves the password of a user within a realm.
+// Implementations must be safe for concurrent use.
+type CredentialStore interface {
+	Password(realm, username string) (string, error)
+}
+
+// CredentialFunc adapts a callback into a CredentialStore, e.g. to query an
+// external user database.
+type CredentialFunc func(realm, username string) (string, error)
+
+func (f CredentialFunc) Password(realm, username string) (string, error) {
+	return f(realm, username)
+}
+
+// MemoryCredentialStore keeps credentials in process memory.
+type MemoryCredentialStore struct {
+	mu    sync.RWMutex
+	users map[string]string
+}
+
+func NewMemoryCredentialStore() *MemoryCredentialStore {
+	return &MemoryCredentialStore{
+		users: make(map[string]string),
+	}
+}
+
+func (m *MemoryCredentialStore) Set(realm, username, password string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[credentialKey(realm, username)] = password
+}
+
+func (m *MemoryCredentialStore) Delete(realm, username string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.users, credentialKey(realm, username))
+}
+
+func (m *MemoryCredentialStore) Password(realm, username string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	password, ok := m.users[credentialKey(realm, username)]
+	if !ok {
+		return "", ErrUnknownUser
+	}
+	return password, nil
+}
+
+// NewFileCredentialStore loads a static credential file. Each non-empty line
+// that does not start with '#' has the form:
+//
+//	username:realm:password
+//
+// The password is everything after the second colon.
+func NewFileCredentialStore(path string) (*MemoryCredentialStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open credential file: %w", err)
+	}
+	defer f.Close()
+
+	store := NewMemoryCredentialStore()
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:realm:password", path, lineNo)
+		}
+		store.Set(parts[1], parts[0], parts[2])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read credential file: %w", err)
+	}
+	return store, nil
+}
+
+func credentialKey(realm, username string) string {
+	return realm + "\x00" + username
+}
@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/icholy/digest"
+)
+
+var (
+	ErrMissingCredentials = errors.New("missing credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrStaleNonce means the credentials were correct but the nonce has
+	// expired; the client should be challenged again with stale=true.
+	ErrStaleNonce = errors.New("stale nonce")
+	// ErrNonceReplay means the nonce count was not greater than one
+	// already accepted for the same nonce.
+	ErrNonceReplay = errors.New("nonce count replayed")
+)
+
+const (
+	AlgorithmMD5    = "MD5"
+	AlgorithmSHA256 = "SHA-256"
+)
+
+const (
+	nonceRandLen = 8
+	nonceMACLen  = 16
+)
+
+type DigestOptions struct {
+	// NonceTTL is how long a nonce is accepted after it was issued.
+	NonceTTL time.Duration
+	// Algorithms offered in challenges, most preferred first. RFC 8760
+	// recommends offering SHA-256 ahead of MD5.
+	Algorithms []string
+	// Secret signs nonces so they can be validated without storing them.
+	// A random secret is generated when empty.
+	Secret []byte
+}
+
+func DefaultDigestOptions() DigestOptions {
+	return DigestOptions{
+		NonceTTL:   5 * time.Minute,
+		Algorithms: []string{AlgorithmSHA256, AlgorithmMD5},
+	}
+}
+
+// DigestAuthenticator implements the server side of RFC 3261 / RFC 8760
+// digest authentication with qop=auth.
+type DigestAuthenticator struct {
+	store CredentialStore
+	opts  DigestOptions
+
+	mu        sync.Mutex
+	counts    map[string]nonceCount
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+type nonceCount struct {
+	nc      int
+	expires time.Time
+}
+
+func NewDigestAuthenticator(store CredentialStore, opts DigestOptions) (*DigestAuthenticator, error) {
+	defaults := DefaultDigestOptions()
+	if opts.NonceTTL <= 0 {
+		opts.NonceTTL = defaults.NonceTTL
+	}
+	if len(opts.Algorithms) == 0 {
+		opts.Algorithms = defaults.Algorithms
+	}
+	for _, alg := range opts.Algorithms {
+		if alg != AlgorithmMD5 && alg != AlgorithmSHA256 {
+			return nil, fmt.Errorf("unsupported digest algorithm %q", alg)
+		}
+	}
+	if len(opts.Secret) == 0 {
+		opts.Secret = make([]byte, 32)
+		if _, err := rand.Read(opts.Secret); err != nil {
+			return nil, fmt.Errorf("failed to generate nonce secret: %w", err)
+		}
+	}
+
+	return &DigestAuthenticator{
+		store:  store,
+		opts:   opts,
+		counts: make(map[string]nonceCount),
+		now:    time.Now,
+	}, nil
+}
+
+// Challenges returns one WWW-Authenticate/Proxy-Authenticate value per
+// configured algorithm, all sharing a fresh nonce.
+func (a *DigestAuthenticator) Challenges(realm string, stale bool) []string {
+	nonce := a.newNonce()
+	challenges := make([]string, 0, len(a.opts.Algorithms))
+	for _, alg := range a.opts.Algorithms {
+		chal := digest.Challenge{
+			Realm:     realm,
+			Nonce:     nonce,
+			Stale:     stale,
+			Algorithm: alg,
+			QOP:       []string{"auth"},
+		}
+		challenges = append(challenges, chal.String())
+	}
+	return challenges
+}
+
+// Verify checks an Authorization or Proxy-Authorization header value against
+// the method, Request-URI and realm of the request carrying it and returns
+// the authenticated username. Credentials for another URI are rejected, so
+// that they cannot be replayed against other requests (RFC 3261 22.4).
+func (a *DigestAuthenticator) Verify(header, method, uri, realm string) (string, error) {
+	if header == "" {
+		return "", ErrMissingCredentials
+	}
+	cred, err := digest.ParseCredentials(header)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	algorithm := cred.Algorithm
+	if algorithm == "" {
+		algorithm = AlgorithmMD5
+	}
+	switch {
+	case cred.Realm != realm:
+		return "", fmt.Errorf("%w: realm mismatch", ErrInvalidCredentials)
+	case !sameURI(cred.URI, uri):
+		return "", fmt.Errorf("%w: uri %q does not match %q", ErrInvalidCredentials, cred.URI, uri)
+	case !slices.Contains(a.opts.Algorithms, algorithm):
+		return "", fmt.Errorf("%w: algorithm %q not offered", ErrInvalidCredentials, cred.Algorithm)
+	case cred.QOP != "auth" || cred.Nc <= 0 || cred.Cnonce == "":
+		return "", fmt.Errorf("%w: qop=auth required", ErrInvalidCredentials)
+	case cred.Userhash:
+		return "", fmt.Errorf("%w: userhash not supported", ErrInvalidCredentials)
+	}
+
+	issued, ok := a.parseNonce(cred.Nonce)
+	if !ok {
+		return "", fmt.Errorf("%w: invalid nonce", ErrInvalidCredentials)
+	}
+
+	password, err := a.store.Password(realm, cred.Username)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	expected, err := digest.Digest(&digest.Challenge{
+		Realm:     realm,
+		Nonce:     cred.Nonce,
+		Algorithm: cred.Algorithm,
+		QOP:       []string{"auth"},
+	}, digest.Options{
+		Method:   method,
+		URI:      cred.URI,
+		Username: cred.Username,
+		Password: password,
+		Cnonce:   cred.Cnonce,
+		Count:    cred.Nc,
+	})
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	if subtle.ConstantTimeCompare([]byte(expected.Response), []byte(cred.Response)) != 1 {
+		return "", fmt.Errorf("%w: response mismatch", ErrInvalidCredentials)
+	}
+
+	now := a.now()
+	expires := issued.Add(a.opts.NonceTTL)
+	if !now.Before(expires) {
+		return "", ErrStaleNonce
+	}
+	if err := a.checkNonceCount(cred.Nonce, cred.Nc, expires, now); err != nil {
+		return "", err
+	}
+	return cred.Username, nil
+}
+
+func (a *DigestAuthenticator) checkNonceCount(nonce string, nc int, expires, now time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if now.Sub(a.lastPrune) > a.opts.NonceTTL {
+		for n, c := range a.counts {
+			if !now.Before(c.expires) {
+				delete(a.counts, n)
+			}
+		}
+		a.lastPrune = now
+	}
+
+	if c, ok := a.counts[nonce]; ok && nc <= c.nc {
+		return ErrNonceReplay
+	}
+	a.counts[nonce] = nonceCount{nc: nc, expires: expires}
+	return nil
+}
+
+// sameURI compares two SIP URIs as RFC 3261 19.1.4 does, short of escaping:
+// scheme, host and parameter names are case-insensitive, parameters and
+// headers may come in any order.
+func sameURI(a, b string) bool {
+	return slices.Equal(uriParts(a), uriParts(b))
+}
+
+// uriParts splits uri into its scheme and user@host part, followed by its
+// sorted parameters and headers.
+func uriParts(uri string) []string {
+	uri, headers, _ := strings.Cut(uri, "?")
+	parts := strings.Split(uri, ";")
+	if scheme, rest, ok := strings.Cut(parts[0], ":"); ok {
+		user, host, ok := strings.Cut(rest, "@")
+		if !ok {
+			user, host = "", user
+		}
+		parts[0] = strings.ToLower(scheme) + ":" + user + "@" + strings.ToLower(host)
+	}
+	for i, p := range parts[1:] {
+		name, value, _ := strings.Cut(p, "=")
+		parts[i+1] = strings.ToLower(name) + "=" + value
+	}
+	slices.Sort(parts[1:])
+	if headers != "" {
+		h := strings.Split(headers, "&")
+		slices.Sort(h)
+		parts = append(parts, "?")
+		parts = append(parts, h...)
+	}
+	return parts
+}
+
+// newNonce returns hex(timestamp | random | hmac(timestamp | random)).
+func (a *DigestAuthenticator) newNonce() string {
+	buf := make([]byte, 8+nonceRandLen, 8+nonceRandLen+nonceMACLen)
+	binary.BigEndian.PutUint64(buf, uint64(a.now().UnixNano()))
+	rand.Read(buf[8:])
+	buf = append(buf, a.nonceMAC(buf)...)
+	return hex.EncodeToString(buf)
+}
+
+func (a *DigestAuthenticator) parseNonce(nonce string) (time.Time, bool) {
+	buf, err := hex.DecodeString(nonce)
+	if err != nil || len(buf) != 8+nonceRandLen+nonceMACLen {
+		return time.Time{}, false
+	}
+	data, mac := buf[:8+nonceRandLen], buf[8+nonceRandLen:]
+	if !hmac.Equal(mac, a.nonceMAC(data)) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(data))), true
+}
+
+func (a *DigestAuthenticator) nonceMAC(data []byte) []byte {
+	h := hmac.New(sha256.New, a.opts.Secret)
+	h.Write(data)
+	return h.Sum(nil)[:nonceMACLen]
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/icholy/digest"
+)
+
+func newTestAuthenticator(t *testing.T) *DigestAuthenticator {
+	t.Helper()
+	store := NewMemoryCredentialStore()
+	store.Set("example.com", "alice", "secret")
+	a, err := NewDigestAuthenticator(store, DigestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func answer(t *testing.T, chalHeader, password string, nc int) string {
+	t.Helper()
+	chal, err := digest.ParseChallenge(chalHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred, err := digest.Digest(chal, digest.Options{
+		Method:   "REGISTER",
+		URI:      "sip:example.com",
+		Username: "alice",
+		Password: password,
+		Count:    nc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cred.String()
+}
+
+func TestDigestVerify(t *testing.T) {
+	a := newTestAuthenticator(t)
+	challenges := a.Challenges("example.com", false)
+	if len(challenges) != 2 {
+		t.Fatalf("expected SHA-256 and MD5 challenges, got %v", challenges)
+	}
+
+	// Both challenges share a nonce, so the nonce count has to advance.
+	for i, chal := range challenges {
+		user, err := a.Verify(answer(t, chal, "secret", i+1), "REGISTER", "sip:example.com", "example.com")
+		if err != nil {
+			t.Fatalf("verify %s: %v", chal, err)
+		}
+		if user != "alice" {
+			t.Fatalf("expected alice, got %s", user)
+		}
+	}
+}
+
+func TestDigestVerifyFailures(t *testing.T) {
+	a := newTestAuthenticator(t)
+	chal := a.Challenges("example.com", false)[0]
+
+	if _, err := a.Verify(answer(t, chal, "wrong", 1), "REGISTER", "sip:example.com", "example.com"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected invalid credentials, got %v", err)
+	}
+	if _, err := a.Verify(answer(t, chal, "secret", 1), "INVITE", "sip:example.com", "example.com"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected method mismatch to fail, got %v", err)
+	}
+	if _, err := a.Verify(answer(t, chal, "secret", 1), "REGISTER", "sip:example.com", "other.com"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected realm mismatch to fail, got %v", err)
+	}
+	if _, err := a.Verify(answer(t, chal, "secret", 1), "REGISTER", "sip:other.com", "example.com"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected uri mismatch to fail, got %v", err)
+	}
+	if _, err := a.Verify("", "REGISTER", "sip:example.com", "example.com"); !errors.Is(err, ErrMissingCredentials) {
+		t.Fatalf("expected missing credentials, got %v", err)
+	}
+
+	// A nonce signed by another server is rejected.
+	other := newTestAuthenticator(t)
+	if _, err := a.Verify(answer(t, other.Challenges("example.com", false)[0], "secret", 1), "REGISTER", "sip:example.com", "example.com"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected foreign nonce to fail, got %v", err)
+	}
+}
+
+func TestDigestNonceReplayAndExpiry(t *testing.T) {
+	a := newTestAuthenticator(t)
+	now := time.Now()
+	a.now = func() time.Time { return now }
+	chal := a.Challenges("example.com", false)[0]
+
+	if _, err := a.Verify(answer(t, chal, "secret", 1), "REGISTER", "sip:example.com", "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Verify(answer(t, chal, "secret", 1), "REGISTER", "sip:example.com", "example.com"); !errors.Is(err, ErrNonceReplay) {
+		t.Fatalf("expected replay, got %v", err)
+	}
+	if _, err := a.Verify(answer(t, chal, "secret", 2), "REGISTER", "sip:example.com", "example.com"); err != nil {
+		t.Fatalf("expected increasing nc to be accepted, got %v", err)
+	}
+
+	now = now.Add(DefaultDigestOptions().NonceTTL)
+	if _, err := a.Verify(answer(t, chal, "secret", 3), "REGISTER", "sip:example.com", "example.com"); !errors.Is(err, ErrStaleNonce) {
+		t.Fatalf("expected stale nonce, got %v", err)
+	}
+}
+
+func TestSameURI(t *testing.T) {
+	same := [][2]string{
+		{"sip:bob@example.com", "sip:bob@Example.COM"},
+		{"SIP:bob@example.com;transport=tcp;lr", "sip:bob@example.com;lr;Transport=tcp"},
+		{"sip:example.com?a=1&b=2", "sip:example.com?b=2&a=1"},
+	}
+	for _, uris := range same {
+		if !sameURI(uris[0], uris[1]) {
+			t.Errorf("expected %s and %s to match", uris[0], uris[1])
+		}
+	}
+	different := [][2]string{
+		{"sip:bob@example.com", "sip:Bob@example.com"},
+		{"sip:bob@example.com", "sips:bob@example.com"},
+		{"sip:bob@example.com", "sip:bob@example.com:5060"},
+		{"sip:bob@example.com", "sip:bob@example.com;transport=tcp"},
+		{"sip:example.com", "sip:other.com"},
+	}
+	for _, uris := range different {
+		if sameURI(uris[0], uris[1]) {
+			t.Errorf("expected %s and %s to differ", uris[0], uris[1])
+		}
+	}
+}
+
+func TestCredentialStores(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	content := "# comment\nalice:example.com:se:cret\n\nbob:other.com:pw\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileCredentialStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pw, err := store.Password("example.com", "alice"); err != nil || pw != "se:cret" {
+		t.Fatalf("unexpected password %q, %v", pw, err)
+	}
+	if _, err := store.Password("example.com", "bob"); !errors.Is(err, ErrUnknownUser) {
+		t.Fatalf("expected unknown user, got %v", err)
+	}
+
+	fn := CredentialFunc(func(realm, username string) (string, error) {
+		if username == "carol" {
+			return "pw", nil
+		}
+		return "", ErrUnknownUser
+	})
+	if pw, err := fn.Password("any", "carol"); err != nil || pw != "pw" {
+		t.Fatalf("unexpected password %q, %v", pw, err)
+	}
+}
@@ -0,0 +1,42 @@
+package codec
+
+import "errors"
+
+// CNPayloadType is the static payload type of comfort noise (RFC 3389) at
+// 8000 Hz.
+const CNPayloadType = 13
+
+// ErrInvalidComfortNoise is returned for a CN payload without a valid noise
+// level.
+var ErrInvalidComfortNoise = errors.New("codec: invalid comfort noise payload")
+
+// ComfortNoise is the content of a CN payload (RFC 3389 section 3), which a
+// sender puts in place of audio during silence so that the receiver can
+// play noise resembling the background instead of dead air.
+type ComfortNoise struct {
+	// Level is the noise level in -dBov, from 0 to 127.
+	Level uint8
+	// Reflection holds the quantized reflection coefficients describing the
+	// spectrum of the noise, if the sender included any. We send none and
+	// play white noise, as RFC 3389 allows.
+	Reflection []byte
+}
+
+// ParseComfortNoise parses a CN payload. Reflection aliases payload.
+func ParseComfortNoise(payload []byte) (ComfortNoise, error) {
+	if len(payload) == 0 || payload[0] > 127 {
+		return ComfortNoise{}, ErrInvalidComfortNoise
+	}
+	return ComfortNoise{Level: payload[0], Reflection: payload[1:]}, nil
+}
+
+// ComfortNoiseLevel returns the CN level of noise at level dBFS, clamped to
+// what a payload can carry.
+func ComfortNoiseLevel(level float64) uint8 {
+	return uint8(min(max(-level+0.5, 0), 127))
+}
+
+// Append appends the payload of cn to dst.
+func (cn ComfortNoise) Append(dst []byte) []byte {
+	return append(append(dst, cn.Level&0x7f), cn.Reflection...)
+}
@@ -0,0 +1,35 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestComfortNoise(t *testing.T) {
+	cn, err := ParseComfortNoise([]byte{42, 0x80, 0x7f})
+	if err != nil || cn.Level != 42 || !bytes.Equal(cn.Reflection, []byte{0x80, 0x7f}) {
+		t.Fatalf("ParseComfortNoise = %+v, %v", cn, err)
+	}
+	if got := cn.Append([]byte{1}); !bytes.Equal(got, []byte{1, 42, 0x80, 0x7f}) {
+		t.Fatalf("Append = %x", got)
+	}
+	for _, payload := range [][]byte{nil, {128}} {
+		if _, err := ParseComfortNoise(payload); err != ErrInvalidComfortNoise {
+			t.Fatalf("ParseComfortNoise(%x) = %v, want ErrInvalidComfortNoise", payload, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		level float64
+		want  uint8
+	}{
+		{-40.4, 40},
+		{-40.6, 41},
+		{3, 0},
+		{-200, 127},
+	} {
+		if got := ComfortNoiseLevel(tc.level); got != tc.want {
+			t.Fatalf("ComfortNoiseLevel(%v) = %d, want %d", tc.level, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrShortBuffer is returned when the destination of Encode or Decode cannot
+// hold the result.
+var ErrShortBuffer = errors.New("codec: destination too short")
+
+// MaxFrameDuration is the longest audio a single payload may carry.
+const MaxFrameDuration = 200 * time.Millisecond
+
+// Encoder compresses 16-bit linear PCM into the payload of an RTP packet.
+// An Encoder keeps the state of one stream and is not safe for concurrent
+// use.
+type Encoder interface {
+	// Encode writes the encoding of pcm to dst and returns the bytes
+	// written.
+	Encode(dst []byte, pcm []int16) (int, error)
+}
+
+// Decoder expands the payload of an RTP packet into 16-bit linear PCM. A
+// Decoder keeps the state of one stream and is not safe for concurrent use.
+type Decoder interface {
+	// Decode writes the samples of data to dst and returns how many were
+	// written.
+	Decode(dst []int16, data []byte) (int, error)
+}
+
+// Concealer is implemented by decoders that make up audio for lost
+// packets, so that a loss is heard neither as a gap nor as a click.
+type Concealer interface {
+	// Conceal writes n samples standing in for a lost packet to dst and
+	// returns how many were written. next is the payload of the packet
+	// after the lost one, or nil if it has not arrived; decoders with
+	// in-band FEC recover the lost audio from it.
+	Conceal(dst []int16, n int, next []byte) (int, error)
+}
+
+// Configurable is implemented by codecs whose encoders follow the format
+// parameters the receiving peer states in its fmtp, such as the bitrate
+// Opus may use.
+type Configurable interface {
+	// NewEncoderFor returns an encoder for a peer that asked for fmtp.
+	NewEncoderFor(fmtp string) Encoder
+}
+
+// NewEncoderFor returns an encoder of c for a peer that asked for fmtp.
+// Codecs that are not Configurable ignore fmtp.
+func NewEncoderFor(c Codec, fmtp string) Encoder {
+	if cc, ok := c.(Configurable); ok {
+		return cc.NewEncoderFor(fmtp)
+	}
+	return c.NewEncoder()
+}
+
+// Info describes a payload format as SDP names it.
+type Info struct {
+	// Name is the encoding name of the rtpmap, such as "PCMU".
+	Name string
+	// PayloadType is the static payload type of RFC 3551, or the dynamic
+	// one we offer the codec with.
+	PayloadType uint8
+	// ClockRate is the RTP clock rate and SampleRate the rate of the PCM
+	// the codec takes and returns. They differ for G.722.
+	ClockRate  uint32
+	SampleRate int
+	Channels   int
+	// Fmtp holds the format parameters we offer, if any.
+	Fmtp string
+}
+
+// Timestamp returns how far samples of PCM per channel advance the RTP
+// timestamp.
+func (i Info) Timestamp(samples int) uint32 {
+	return uint32(int64(samples) * int64(i.ClockRate) / int64(i.SampleRate))
+}
+
+// Samples returns the samples of PCM per channel an RTP timestamp
+// increment of ts spans.
+func (i Info) Samples(ts uint32) int {
+	return int(int64(ts) * int64(i.SampleRate) / int64(i.ClockRate))
+}
+
+func (i Info) frameSamples(d time.Duration) int {
+	return int(int64(i.SampleRate)*int64(d)/int64(time.Second)) * max(i.Channels, 1)
+}
+
+// Codec creates encoders and decoders of one payload format.
+type Codec interface {
+	Info() Info
+	NewEncoder() Encoder
+	NewDecoder() Decoder
+}
+
+// Registry is a set of codecs in order of preference. It is safe for
+// concurrent use.
+type Registry struct {
+	mu     sync.RWMutex
+	codecs []Codec
+}
+
+// Default holds the codecs sipnexus can code, and so transcode between.
+// Which of them calls offer is configured separately, see Select.
+var Default = NewRegistry(PCMU, PCMA, G722)
+
+// NewRegistry returns a registry of codecs, most preferred first.
+func NewRegistry(codecs ...Codec) *Registry {
+	r := &Registry{}
+	for _, c := range codecs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+// Register adds c with the least preference. A codec of the same format
+// must not be registered already.
+func (r *Registry) Register(c Codec) error {
+	info := c.Info()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, other := range r.codecs {
+		if matches(other.Info(), info.Name, info.ClockRate, info.Channels) {
+			return fmt.Errorf("codec: %s/%d already registered", info.Name, info.ClockRate)
+		}
+	}
+	r.codecs = append(r.codecs, c)
+	return nil
+}
+
+// Lookup returns the codec of the format named as in an rtpmap. Names are
+// case-insensitive and channels of 0 mean 1.
+func (r *Registry) Lookup(name string, clockRate uint32, channels int) (Codec, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, c := range r.codecs {
+		if matches(c.Info(), name, clockRate, channels) {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// Select returns a registry of the codecs of r with the given names, in
+// the order given. Names are case-insensitive.
+func (r *Registry) Select(names ...string) (*Registry, error) {
+	selected := &Registry{}
+	for _, name := range names {
+		c, ok := r.lookupName(name)
+		if !ok {
+			return nil, fmt.Errorf("codec: %s not registered", name)
+		}
+		if err := selected.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return selected, nil
+}
+
+func (r *Registry) lookupName(name string) (Codec, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, c := range r.codecs {
+		if strings.EqualFold(c.Info().Name, name) {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// Codecs returns the registered codecs, most preferred first.
+func (r *Registry) Codecs() []Codec {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Codec(nil), r.codecs...)
+}
+
+func matches(info Info, name string, clockRate uint32, channels int) bool {
+	return strings.EqualFold(info.Name, name) && info.ClockRate == clockRate && max(info.Channels, 1) == max(channels, 1)
+}
@@ -0,0 +1,53 @@
+package codec
+
+import "testing"
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry(PCMU)
+	if err := r.Register(PCMA); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(PCMU); err == nil {
+		t.Fatal("registered PCMU twice")
+	}
+
+	for _, tc := range []struct {
+		name     string
+		rate     uint32
+		channels int
+		want     Codec
+	}{
+		{"PCMU", 8000, 0, PCMU},
+		{"pcmu", 8000, 1, PCMU},
+		{"PCMA", 8000, 1, PCMA},
+		{"PCMU", 16000, 1, nil},
+		{"PCMU", 8000, 2, nil},
+		{"G729", 8000, 1, nil},
+	} {
+		c, ok := r.Lookup(tc.name, tc.rate, tc.channels)
+		if ok != (tc.want != nil) || c != tc.want {
+			t.Fatalf("Lookup(%s/%d/%d) = %v, %v", tc.name, tc.rate, tc.channels, c, ok)
+		}
+	}
+
+	codecs := r.Codecs()
+	if len(codecs) != 2 || codecs[0] != PCMU || codecs[1] != PCMA {
+		t.Fatalf("Codecs = %v", codecs)
+	}
+}
+
+func TestRegistrySelect(t *testing.T) {
+	if codecs := Default.Codecs(); codecs[0] != PCMU {
+		t.Fatalf("expected PCMU to stay the most preferred codec, got %v", codecs)
+	}
+	r, err := Default.Select("g722", "PCMU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codecs := r.Codecs(); len(codecs) != 2 || codecs[0] != G722 || codecs[1] != PCMU {
+		t.Fatalf("Codecs = %v", codecs)
+	}
+	if _, err := Default.Select("PCMU", "G729"); err == nil {
+		t.Fatal("selected a codec that is not registered")
+	}
+}
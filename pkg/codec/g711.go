@@ -0,0 +1,156 @@
+package codec
+
+import "github.com/itzmanish/sipnexus/pkg/audio"
+
+// G.711 companding as in the reference implementation by Sun Microsystems:
+// µ-law (PCMU) and A-law (PCMA) code each 16-bit sample in 8 bits, on eight
+// segments whose step size doubles from one to the next.
+
+// PCMU and PCMA are the G.711 payload formats of RFC 3551.
+var (
+	PCMU Codec = &g711{info: Info{Name: "PCMU", PayloadType: 0, ClockRate: 8000, SampleRate: 8000, Channels: 1}, encode: LinearToUlaw, decode: UlawToLinear}
+	PCMA Codec = &g711{info: Info{Name: "PCMA", PayloadType: 8, ClockRate: 8000, SampleRate: 8000, Channels: 1}, encode: LinearToAlaw, decode: AlawToLinear}
+)
+
+const (
+	ulawBias = 0x84
+	ulawClip = 32635
+)
+
+var (
+	ulawTable [256]int16
+	alawTable [256]int16
+)
+
+func init() {
+	for i := range 256 {
+		ulawTable[i] = decodeUlaw(byte(i))
+		alawTable[i] = decodeAlaw(byte(i))
+	}
+}
+
+// g711 is stateless, so its encoders are the codec itself. Decoders keep
+// the audio they decoded last to conceal losses as G.711 Appendix I does.
+type g711 struct {
+	info   Info
+	encode func(int16) byte
+	decode func(byte) int16
+}
+
+func (c *g711) Info() Info          { return c.info }
+func (c *g711) NewEncoder() Encoder { return c }
+
+func (c *g711) NewDecoder() Decoder {
+	return &g711Decoder{decode: c.decode, plc: audio.NewPLC(c.info.SampleRate)}
+}
+
+func (c *g711) Encode(dst []byte, pcm []int16) (int, error) {
+	if len(dst) < len(pcm) {
+		return 0, ErrShortBuffer
+	}
+	for i, s := range pcm {
+		dst[i] = c.encode(s)
+	}
+	return len(pcm), nil
+}
+
+type g711Decoder struct {
+	decode func(byte) int16
+	plc    *audio.PLC
+}
+
+func (d *g711Decoder) Decode(dst []int16, data []byte) (int, error) {
+	if len(dst) < len(data) {
+		return 0, ErrShortBuffer
+	}
+	for i, b := range data {
+		dst[i] = d.decode(b)
+	}
+	d.plc.Good(dst[:len(data)])
+	return len(data), nil
+}
+
+func (d *g711Decoder) Conceal(dst []int16, n int, _ []byte) (int, error) {
+	if len(dst) < n {
+		return 0, ErrShortBuffer
+	}
+	d.plc.Conceal(dst[:n])
+	return n, nil
+}
+
+// LinearToUlaw encodes a sample in µ-law.
+func LinearToUlaw(sample int16) byte {
+	v := int(sample)
+	mask := byte(0xff)
+	if v < 0 {
+		v = -v
+		mask = 0x7f
+	}
+	v = min(v, ulawClip) + ulawBias
+	// The segment is the position of the top bit above bit 7.
+	seg := 0
+	for t := v >> 8; t > 0; t >>= 1 {
+		seg++
+	}
+	return (byte(seg<<4) | byte(v>>(seg+3))&0x0f) ^ mask
+}
+
+// UlawToLinear decodes a µ-law sample.
+func UlawToLinear(u byte) int16 {
+	return ulawTable[u]
+}
+
+// LinearToAlaw encodes a sample in A-law.
+func LinearToAlaw(sample int16) byte {
+	v := int(sample) >> 3
+	mask := byte(0xd5)
+	if v < 0 {
+		v = -v - 1
+		mask = 0x55
+	}
+	seg := 0
+	for t := v >> 5; t > 0; t >>= 1 {
+		seg++
+	}
+	if seg > 7 {
+		return 0x7f ^ mask
+	}
+	a := byte(seg << 4)
+	if seg < 2 {
+		a |= byte(v>>1) & 0x0f
+	} else {
+		a |= byte(v>>seg) & 0x0f
+	}
+	return a ^ mask
+}
+
+// AlawToLinear decodes an A-law sample.
+func AlawToLinear(a byte) int16 {
+	return alawTable[a]
+}
+
+func decodeUlaw(u byte) int16 {
+	u = ^u
+	t := (int(u&0x0f)<<3 + ulawBias) << ((u & 0x70) >> 4)
+	if u&0x80 != 0 {
+		return int16(ulawBias - t)
+	}
+	return int16(t - ulawBias)
+}
+
+func decodeAlaw(a byte) int16 {
+	a ^= 0x55
+	t := int(a&0x0f) << 4
+	switch seg := int(a&0x70) >> 4; seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t = (t + 0x108) << (seg - 1)
+	}
+	if a&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
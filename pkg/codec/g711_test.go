@@ -0,0 +1,243 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/itzmanish/sipnexus/pkg/audio"
+)
+
+const soundsDir = "../../testdata/sounds/"
+
+// readWAV returns the samples of a 16-bit mono WAV file.
+func readWAV(t testing.TB, name string) []int16 {
+	t.Helper()
+	b, err := os.ReadFile(soundsDir + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < 12 || string(b[:4]) != "RIFF" || string(b[8:12]) != "WAVE" {
+		t.Fatalf("%s is not a WAV file", name)
+	}
+	for b = b[12:]; len(b) >= 8; {
+		id, size := string(b[:4]), int(binary.LittleEndian.Uint32(b[4:8]))
+		b = b[8:]
+		if size > len(b) {
+			t.Fatalf("%s: truncated %q chunk", name, id)
+		}
+		if id == "fmt " && (binary.LittleEndian.Uint16(b[0:]) != 1 || binary.LittleEndian.Uint16(b[2:]) != 1 || binary.LittleEndian.Uint16(b[14:]) != 16) {
+			t.Fatalf("%s is not 16-bit mono PCM", name)
+		}
+		if id == "data" {
+			pcm := make([]int16, size/2)
+			for i := range pcm {
+				pcm[i] = int16(binary.LittleEndian.Uint16(b[2*i:]))
+			}
+			return pcm
+		}
+		b = b[size+size%2:]
+	}
+	t.Fatalf("%s has no data chunk", name)
+	return nil
+}
+
+func readSound(t testing.TB, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(soundsDir + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// snr returns the signal to noise ratio of got against want, in dB.
+func snr(want, got []int16) float64 {
+	var signal, noise float64
+	for i := range want {
+		d := float64(got[i]) - float64(want[i])
+		signal += float64(want[i]) * float64(want[i])
+		noise += d * d
+	}
+	return 10 * math.Log10(signal/noise)
+}
+
+func TestG711Tables(t *testing.T) {
+	for _, tc := range []struct {
+		decode func(byte) int16
+		code   byte
+		want   int16
+	}{
+		{UlawToLinear, 0x00, -32124},
+		{UlawToLinear, 0x80, 32124},
+		{UlawToLinear, 0xff, 0},
+		{UlawToLinear, 0xfe, 8},
+		{AlawToLinear, 0xd5, 8},
+		{AlawToLinear, 0x55, -8},
+		{AlawToLinear, 0xaa, 32256},
+		{AlawToLinear, 0x2a, -32256},
+	} {
+		if got := tc.decode(tc.code); got != tc.want {
+			t.Fatalf("decode(%#x) = %d, want %d", tc.code, got, tc.want)
+		}
+	}
+
+	// Every code but µ-law's negative zero decodes to a value that encodes
+	// back to it.
+	for i := range 256 {
+		c := byte(i)
+		if got := LinearToUlaw(UlawToLinear(c)); got != c && c != 0x7f {
+			t.Fatalf("µ-law %#x round trips to %#x", c, got)
+		}
+		if got := LinearToAlaw(AlawToLinear(c)); got != c {
+			t.Fatalf("A-law %#x round trips to %#x", c, got)
+		}
+	}
+	if LinearToUlaw(math.MaxInt16) != 0x80 || LinearToUlaw(math.MinInt16) != 0x00 {
+		t.Fatal("µ-law does not clip")
+	}
+	if LinearToAlaw(math.MaxInt16) != 0xaa || LinearToAlaw(math.MinInt16) != 0x2a {
+		t.Fatal("A-law does not clip")
+	}
+}
+
+func TestG711Sounds(t *testing.T) {
+	pcm := readWAV(t, "demo-thanks.wav")
+	for _, tc := range []struct {
+		codec Codec
+		file  string
+	}{
+		{PCMU, "demo-thanks.ulaw"},
+		{PCMA, "demo-thanks.alaw"},
+	} {
+		t.Run(tc.codec.Info().Name, func(t *testing.T) {
+			ref := readSound(t, tc.file)
+			if len(ref) != len(pcm) {
+				t.Fatalf("%s has %d samples, the WAV %d", tc.file, len(ref), len(pcm))
+			}
+
+			decoded := make([]int16, len(ref))
+			if n, err := tc.codec.NewDecoder().Decode(decoded, ref); err != nil || n != len(ref) {
+				t.Fatalf("Decode = %d, %v", n, err)
+			}
+			// The file was encoded by another encoder, so it is compared
+			// by what it sounds like: as close to the WAV as companding
+			// allows, and stable when encoded again.
+			refSNR := snr(pcm, decoded)
+			if refSNR < 30 {
+				t.Fatalf("%s decodes with SNR %.1f dB", tc.file, refSNR)
+			}
+			encoded := make([]byte, len(decoded))
+			if n, err := tc.codec.NewEncoder().Encode(encoded, decoded); err != nil || n != len(decoded) {
+				t.Fatalf("Encode = %d, %v", n, err)
+			}
+			if tc.codec == PCMU {
+				// µ-law has two zeros; encoders differ in which one they
+				// pick.
+				for i := range encoded {
+					if ref[i] == 0x7f && encoded[i] == 0xff {
+						encoded[i] = 0x7f
+					}
+				}
+			}
+			if !bytes.Equal(encoded, ref) {
+				t.Fatalf("re-encoding %s changes it", tc.file)
+			}
+
+			// Our encoding of the WAV is at least as faithful.
+			if _, err := tc.codec.NewEncoder().Encode(encoded, pcm); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tc.codec.NewDecoder().Decode(decoded, encoded); err != nil {
+				t.Fatal(err)
+			}
+			if got := snr(pcm, decoded); got < refSNR {
+				t.Fatalf("round trip SNR %.1f dB, %s has %.1f dB", got, tc.file, refSNR)
+			}
+		})
+	}
+}
+
+func TestG711ShortBuffer(t *testing.T) {
+	if _, err := PCMU.NewEncoder().Encode(make([]byte, 159), make([]int16, 160)); err != ErrShortBuffer {
+		t.Fatalf("Encode err = %v, want ErrShortBuffer", err)
+	}
+	if _, err := PCMA.NewDecoder().Decode(make([]int16, 159), make([]byte, 160)); err != ErrShortBuffer {
+		t.Fatalf("Decode err = %v, want ErrShortBuffer", err)
+	}
+}
+
+func BenchmarkG711(b *testing.B) {
+	pcm := make([]int16, 160)
+	for i := range pcm {
+		pcm[i] = int16(8000 * math.Sin(float64(i)/10))
+	}
+	payload := make([]byte, 160)
+	enc, dec := PCMU.NewEncoder(), PCMU.NewDecoder()
+	for i := 0; i < b.N; i++ {
+		enc.Encode(payload, pcm)
+		dec.Decode(pcm, payload)
+	}
+}
+
+func TestG711Conceal(t *testing.T) {
+	ulaw := readSound(t, "demo-thanks.ulaw")
+	ulaw = ulaw[:len(ulaw)/160*160]
+	want := make([]int16, len(ulaw))
+	PCMU.NewDecoder().Decode(want, ulaw)
+	var maxStep float64
+	for i := 1; i < len(want); i++ {
+		maxStep = max(maxStep, math.Abs(float64(want[i])-float64(want[i-1])))
+	}
+
+	for _, tc := range []struct {
+		name string
+		lost func(frame int) bool
+	}{
+		{"one in ten", func(i int) bool { return i%10 == 5 }},
+		{"one in five", func(i int) bool { return i%5 == 2 }},
+		{"bursts of two", func(i int) bool { return i%17 == 8 || i%17 == 9 }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dec := PCMU.NewDecoder()
+			got := make([]int16, len(ulaw))
+			for i := range len(ulaw) / 160 {
+				frame := got[i*160 : (i+1)*160]
+				if !tc.lost(i) {
+					dec.Decode(frame, ulaw[i*160:(i+1)*160])
+					continue
+				}
+				if n, err := dec.(Concealer).Conceal(frame, 160, nil); err != nil || n != 160 {
+					t.Fatalf("concealed %d samples, %v", n, err)
+				}
+			}
+
+			// Speech drifts in pitch, so the concealed waveform is not
+			// the lost one; it should sound as loud, where silence would
+			// leave a hole, and join the received audio without clicks.
+			var diff float64
+			var voiced int
+			for i := range len(ulaw) / 160 {
+				if !tc.lost(i) {
+					continue
+				}
+				lost := audio.Level(want[i*160 : (i+1)*160])
+				if lost < -50 {
+					continue
+				}
+				diff += math.Abs(audio.Level(got[i*160:(i+1)*160]) - lost)
+				voiced++
+				for _, j := range []int{i * 160, min((i+1)*160, len(got)-1)} {
+					if step := math.Abs(float64(got[j]) - float64(got[j-1])); step > maxStep {
+						t.Fatalf("step of %.0f into or out of lost frame %d, the audio has at most %.0f", step, i, maxStep)
+					}
+				}
+			}
+			if diff /= float64(voiced); diff > 8 {
+				t.Fatalf("concealed frames are %.1f dB off the level of the lost ones", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package codec
+
+// G.722 (ITU-T G.722) at 64 kbit/s: a QMF splits 16 kHz audio into two
+// bands of 8 kHz, coded with ADPCM in 6 and 2 bits and packed into one byte
+// per pair of input samples. The fixed-point arithmetic follows the ITU
+// reference as adapted by the spandsp library.
+//
+// RFC 3551 registers G.722 with an RTP clock rate of 8000 although it samples
+// at 16000, an error kept for compatibility: RTP timestamps advance by one
+// per byte of payload, half the number of samples. See Info.Timestamp.
+
+// G722 is the G.722 payload format of RFC 3551.
+var G722 Codec = g722{}
+
+var (
+	g722QMF = [12]int{3, -11, 12, 32, -210, 951, 3876, -805, 362, -156, 53, -11}
+
+	g722Q6   = [32]int{0, 35, 72, 110, 150, 190, 233, 276, 323, 370, 422, 473, 530, 587, 650, 714, 786, 858, 940, 1023, 1121, 1219, 1339, 1458, 1612, 1765, 1980, 2195, 2557, 2919, 0, 0}
+	g722ILN  = [32]int{0, 63, 62, 31, 30, 29, 28, 27, 26, 25, 24, 23, 22, 21, 20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 0}
+	g722ILP  = [32]int{0, 61, 60, 59, 58, 57, 56, 55, 54, 53, 52, 51, 50, 49, 48, 47, 46, 45, 44, 43, 42, 41, 40, 39, 38, 37, 36, 35, 34, 33, 32, 0}
+	g722WL   = [8]int{-60, -30, 58, 172, 334, 538, 1198, 3042}
+	g722RL42 = [16]int{0, 7, 6, 5, 4, 3, 2, 1, 7, 6, 5, 4, 3, 2, 1, 0}
+	g722ILB  = [32]int{2048, 2093, 2139, 2186, 2233, 2282, 2332, 2383, 2435, 2489, 2543, 2599, 2656, 2714, 2774, 2834, 2896, 2960, 3025, 3091, 3158, 3228, 3298, 3371, 3444, 3520, 3597, 3676, 3756, 3838, 3922, 4008}
+	g722QM4  = [16]int{0, -20456, -12896, -8968, -6288, -4240, -2584, -1200, 20456, 12896, 8968, 6288, 4240, 2584, 1200, 0}
+	g722QM6  = [64]int{
+		-136, -136, -136, -136, -24808, -21904, -19008, -16704,
+		-14984, -13512, -12280, -11192, -10232, -9360, -8576, -7856,
+		-7192, -6576, -6000, -5456, -4944, -4464, -4008, -3576,
+		-3168, -2776, -2400, -2032, -1688, -1360, -1040, -728,
+		24808, 21904, 19008, 16704, 14984, 13512, 12280, 11192,
+		10232, 9360, 8576, 7856, 7192, 6576, 6000, 5456,
+		4944, 4464, 4008, 3576, 3168, 2776, 2400, 2032,
+		1688, 1360, 1040, 728, 432, 136, -432, -136,
+	}
+	g722IHN = [3]int{0, 1, 0}
+	g722IHP = [3]int{0, 3, 2}
+	g722WH  = [3]int{0, -214, 798}
+	g722RH2 = [4]int{2, 1, 2, 1}
+	g722QM2 = [4]int{-7408, -1616, 7408, 1616}
+)
+
+type g722 struct{}
+
+func (g722) Info() Info {
+	return Info{Name: "G722", PayloadType: 9, ClockRate: 8000, SampleRate: 16000, Channels: 1}
+}
+
+func (g722) NewEncoder() Encoder { return newG722Encoder() }
+func (g722) NewDecoder() Decoder { return newG722Decoder() }
+
+// g722Band is the ADPCM state of one sub-band. The delay lines are indexed
+// from 1 as in the reference, with r1 and p1 the newest.
+type g722Band struct {
+	s, sp, sz int
+	r1, r2    int
+	p1, p2    int
+	a1, a2    int
+	b, d      [7]int
+	nb, det   int
+}
+
+type g722State struct {
+	band [2]g722Band
+	x    [24]int // QMF delay line
+}
+
+func (st *g722State) reset() {
+	*st = g722State{}
+	st.band[0].det = 32
+	st.band[1].det = 8
+}
+
+type g722Encoder struct{ g722State }
+
+func newG722Encoder() *g722Encoder {
+	e := &g722Encoder{}
+	e.reset()
+	return e
+}
+
+// Encode codes pairs of samples; a trailing odd sample is dropped.
+func (e *g722Encoder) Encode(dst []byte, pcm []int16) (int, error) {
+	n := len(pcm) / 2
+	if len(dst) < n {
+		return 0, ErrShortBuffer
+	}
+	for j := 0; j < n; j++ {
+		// Transmit QMF, keeping every other output.
+		copy(e.x[:22], e.x[2:])
+		e.x[22], e.x[23] = int(pcm[2*j]), int(pcm[2*j+1])
+		sumEven, sumOdd := 0, 0
+		for i := 0; i < 12; i++ {
+			sumOdd += e.x[2*i] * g722QMF[i]
+			sumEven += e.x[2*i+1] * g722QMF[11-i]
+		}
+		xlow := (sumEven + sumOdd) >> 14
+		xhigh := (sumEven - sumOdd) >> 14
+
+		low := &e.band[0]
+		el := saturate(xlow - low.s)
+		wd := el
+		if el < 0 {
+			wd = -(el + 1)
+		}
+		i := 1
+		for ; i < 30; i++ {
+			if wd < (g722Q6[i]*low.det)>>12 {
+				break
+			}
+		}
+		ilow := g722ILP[i]
+		if el < 0 {
+			ilow = g722ILN[i]
+		}
+		ril := ilow >> 2
+		dlow := (low.det * g722QM4[ril]) >> 15
+		low.scaleLow(ril)
+		low.update(dlow)
+
+		high := &e.band[1]
+		eh := saturate(xhigh - high.s)
+		wd = eh
+		if eh < 0 {
+			wd = -(eh + 1)
+		}
+		mih := 1
+		if wd >= (564*high.det)>>12 {
+			mih = 2
+		}
+		ihigh := g722IHP[mih]
+		if eh < 0 {
+			ihigh = g722IHN[mih]
+		}
+		dhigh := (high.det * g722QM2[ihigh]) >> 15
+		high.scaleHigh(ihigh)
+		high.update(dhigh)
+
+		dst[j] = byte(ihigh<<6 | ilow)
+	}
+	return n, nil
+}
+
+type g722Decoder struct{ g722State }
+
+func newG722Decoder() *g722Decoder {
+	d := &g722Decoder{}
+	d.reset()
+	return d
+}
+
+// Decode expands each byte into two samples.
+func (d *g722Decoder) Decode(dst []int16, data []byte) (int, error) {
+	if len(dst) < 2*len(data) {
+		return 0, ErrShortBuffer
+	}
+	for j, code := range data {
+		ilow, ihigh := int(code&0x3f), int(code>>6)
+
+		low := &d.band[0]
+		rlow := min(max(low.s+(low.det*g722QM6[ilow])>>15, -16384), 16383)
+		ril := ilow >> 2
+		dlow := (low.det * g722QM4[ril]) >> 15
+		low.scaleLow(ril)
+		low.update(dlow)
+
+		high := &d.band[1]
+		dhigh := (high.det * g722QM2[ihigh]) >> 15
+		rhigh := min(max(high.s+dhigh, -16384), 16383)
+		high.scaleHigh(ihigh)
+		high.update(dhigh)
+
+		// Receive QMF.
+		copy(d.x[:22], d.x[2:])
+		d.x[22], d.x[23] = rlow+rhigh, rlow-rhigh
+		out1, out2 := 0, 0
+		for i := 0; i < 12; i++ {
+			out2 += d.x[2*i] * g722QMF[i]
+			out1 += d.x[2*i+1] * g722QMF[11-i]
+		}
+		dst[2*j] = int16(saturate(out1 >> 11))
+		dst[2*j+1] = int16(saturate(out2 >> 11))
+	}
+	return 2 * len(data), nil
+}
+
+// scaleLow adapts the step size of the low band to the quantized
+// difference ril (blocks 3L, LOGSCL and SCALEL).
+func (b *g722Band) scaleLow(ril int) {
+	b.nb = min(max((b.nb*127)>>7+g722WL[g722RL42[ril]], 0), 18432)
+	b.det = scale(b.nb, 8)
+}
+
+// scaleHigh does as scaleLow for the high band (blocks 3H).
+func (b *g722Band) scaleHigh(ihigh int) {
+	b.nb = min(max((b.nb*127)>>7+g722WH[g722RH2[ihigh]], 0), 22528)
+	b.det = scale(b.nb, 10)
+}
+
+func scale(nb, shift int) int {
+	wd1 := (nb >> 6) & 31
+	wd2 := shift - nb>>11
+	if wd2 < 0 {
+		return (g722ILB[wd1] << -wd2) << 2
+	}
+	return (g722ILB[wd1] >> wd2) << 2
+}
+
+// update runs the adaptive predictor of a band on the quantized difference
+// d (block 4), leaving the next estimate in b.s.
+func (b *g722Band) update(d int) {
+	// RECONS and PARREC
+	r0 := saturate(b.s + d)
+	p0 := saturate(b.sz + d)
+
+	// UPPOL2
+	sg0, sg1, sg2 := p0>>15, b.p1>>15, b.p2>>15
+	wd1 := saturate(b.a1 << 2)
+	wd2 := wd1
+	if sg0 == sg1 {
+		wd2 = -wd1
+	}
+	wd2 = min(wd2, 32767)
+	wd3 := -128
+	if sg0 == sg2 {
+		wd3 = 128
+	}
+	wd3 += wd2>>7 + (b.a2*32512)>>15
+	a2 := min(max(wd3, -12288), 12288)
+
+	// UPPOL1
+	wd1 = -192
+	if sg0 == sg1 {
+		wd1 = 192
+	}
+	a1 := saturate(wd1 + (b.a1*32640)>>15)
+	wd3 = saturate(15360 - a2)
+	a1 = min(max(a1, -wd3), wd3)
+
+	// UPZERO, with DELAYA of the coefficients
+	wd1 = 0
+	if d != 0 {
+		wd1 = 128
+	}
+	sgd := d >> 15
+	for i := 1; i < 7; i++ {
+		wd2 = -wd1
+		if b.d[i]>>15 == sgd {
+			wd2 = wd1
+		}
+		b.b[i] = saturate(wd2 + (b.b[i]*32640)>>15)
+	}
+
+	// DELAYA
+	copy(b.d[2:], b.d[1:6])
+	b.d[1] = d
+	b.r2, b.r1 = b.r1, r0
+	b.p2, b.p1 = b.p1, p0
+	b.a1, b.a2 = a1, a2
+
+	// FILTEP
+	b.sp = saturate((b.a1*saturate(b.r1+b.r1))>>15 + (b.a2*saturate(b.r2+b.r2))>>15)
+
+	// FILTEZ
+	sz := 0
+	for i := 1; i < 7; i++ {
+		sz += (b.b[i] * saturate(b.d[i]+b.d[i])) >> 15
+	}
+	b.sz = saturate(sz)
+
+	// PREDIC
+	b.s = saturate(b.sp + b.sz)
+}
+
+func saturate(v int) int {
+	return min(max(v, -32768), 32767)
+}
@@ -0,0 +1,117 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// tones returns n samples at rate of a tone in each G.722 band.
+func tones(n, rate int) []int16 {
+	pcm := make([]int16, n)
+	for i := range pcm {
+		t := float64(i) / float64(rate)
+		pcm[i] = int16(6000*math.Sin(2*math.Pi*440*t) + 3000*math.Sin(2*math.Pi*5500*t))
+	}
+	return pcm
+}
+
+// delayedSNR returns the SNR of got against want delayed by the codec,
+// skipping the first skip samples while filters settle.
+func delayedSNR(want, got []int16, delay, skip int) float64 {
+	return snr(want[skip:len(want)-delay], got[skip+delay:])
+}
+
+func TestG722RoundTrip(t *testing.T) {
+	pcm := tones(16000, 16000)
+	enc, dec := G722.NewEncoder(), G722.NewDecoder()
+	payload := make([]byte, 160)
+	out := make([]int16, 0, len(pcm))
+	frame := make([]int16, 320)
+	for i := 0; i < len(pcm); i += 320 {
+		n, err := enc.Encode(payload, pcm[i:i+320])
+		if err != nil || n != 160 {
+			t.Fatalf("Encode = %d, %v", n, err)
+		}
+		if n, err = dec.Decode(frame, payload); err != nil || n != 320 {
+			t.Fatalf("Decode = %d, %v", n, err)
+		}
+		out = append(out, frame...)
+	}
+	// The two QMFs delay the signal by 22 samples.
+	if got := delayedSNR(pcm, out, 22, 320); got < 25 {
+		t.Fatalf("round trip SNR %.1f dB", got)
+	}
+}
+
+// TestG722Interop checks that we code bit for bit like the spandsp G.722
+// codec (via github.com/gotranspile/g722), which passes the ITU-T test
+// vectors. demo-thanks.g722 is its encoding of the samples of
+// demo-thanks.wav taken as 16 kHz audio, and demo-thanks-g722.sln16 its
+// decoding of that.
+func TestG722Interop(t *testing.T) {
+	payload := readSound(t, "demo-thanks.g722")
+	pcm := readWAV(t, "demo-thanks.wav")[:2*len(payload)]
+	raw := readSound(t, "demo-thanks-g722.sln16")
+	decoded := make([]int16, len(raw)/2)
+	for i := range decoded {
+		decoded[i] = int16(binary.LittleEndian.Uint16(raw[2*i:]))
+	}
+
+	enc, dec := G722.NewEncoder(), G722.NewDecoder()
+	frame := make([]int16, 320)
+	for i := 0; i < len(payload); i += 160 {
+		got := make([]byte, 160)
+		if _, err := enc.Encode(got, pcm[2*i:2*i+320]); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, payload[i:i+160]) {
+			t.Fatalf("frame %d: encoding differs from the reference", i/160)
+		}
+		if _, err := dec.Decode(frame, payload[i:i+160]); err != nil {
+			t.Fatal(err)
+		}
+		for j, s := range frame {
+			if want := decoded[2*i+j]; s != want {
+				t.Fatalf("frame %d: sample %d decoded as %d, want %d", i/160, j, s, want)
+			}
+		}
+	}
+}
+
+func TestG722Timestamp(t *testing.T) {
+	info := G722.Info()
+	if info.ClockRate != 8000 || info.SampleRate != 16000 {
+		t.Fatalf("G.722 clock rate %d, sample rate %d", info.ClockRate, info.SampleRate)
+	}
+	// 20ms are 320 samples but advance the timestamp by 160.
+	if got := info.Timestamp(320); got != 160 {
+		t.Fatalf("Timestamp(320) = %d, want 160", got)
+	}
+	if got := info.Samples(160); got != 320 {
+		t.Fatalf("Samples(160) = %d, want 320", got)
+	}
+	if got := PCMU.Info().Timestamp(160); got != 160 {
+		t.Fatalf("PCMU Timestamp(160) = %d, want 160", got)
+	}
+}
+
+func TestG722ShortBuffer(t *testing.T) {
+	if _, err := G722.NewEncoder().Encode(make([]byte, 159), make([]int16, 320)); err != ErrShortBuffer {
+		t.Fatalf("Encode err = %v, want ErrShortBuffer", err)
+	}
+	if _, err := G722.NewDecoder().Decode(make([]int16, 319), make([]byte, 160)); err != ErrShortBuffer {
+		t.Fatalf("Decode err = %v, want ErrShortBuffer", err)
+	}
+}
+
+func BenchmarkG722(b *testing.B) {
+	pcm := tones(320, 16000)
+	payload := make([]byte, 160)
+	enc, dec := G722.NewEncoder(), G722.NewDecoder()
+	for i := 0; i < b.N; i++ {
+		enc.Encode(payload, pcm)
+		dec.Decode(pcm, payload)
+	}
+}
@@ -0,0 +1,102 @@
+package codec
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Opus (RFC 6716) needs libopus, so it is only built into sipnexus with the
+// "opus" build tag, which registers it in Default. See opus_cgo.go. CI runs
+// the tests with the tag as well, against libopus-dev.
+
+// OpusPayloadType is the dynamic payload type we offer Opus with.
+const OpusPayloadType = 111
+
+// OpusParams are the format parameters of Opus (RFC 7587 section 6.1). Each
+// side states in its fmtp what it prefers to receive.
+type OpusParams struct {
+	// MinPtime is the shortest packetization it accepts, in milliseconds.
+	MinPtime int
+	// MaxAverageBitrate caps the bitrate, in bits per second. Zero leaves
+	// it to the encoder.
+	MaxAverageBitrate int
+	// Stereo is set when it prefers to receive stereo.
+	Stereo bool
+	// UseInbandFEC is set when it can use forward error correction carried
+	// in the packets.
+	UseInbandFEC bool
+}
+
+// DefaultOpusParams are the ones we offer.
+var DefaultOpusParams = OpusParams{MinPtime: 10, UseInbandFEC: true}
+
+// ParseOpusParams parses an Opus fmtp, ignoring parameters it does not
+// know. Missing parameters take the defaults of RFC 7587, which are all
+// off.
+func ParseOpusParams(fmtp string) OpusParams {
+	var p OpusParams
+	for _, kv := range strings.Split(fmtp, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(k)) {
+		case "minptime":
+			p.MinPtime = n
+		case "maxaveragebitrate":
+			p.MaxAverageBitrate = n
+		case "stereo":
+			p.Stereo = n == 1
+		case "useinbandfec":
+			p.UseInbandFEC = n == 1
+		}
+	}
+	return p
+}
+
+// String returns p as an fmtp, leaving out parameters at their default.
+func (p OpusParams) String() string {
+	var params []string
+	if p.MinPtime > 0 {
+		params = append(params, "minptime="+strconv.Itoa(p.MinPtime))
+	}
+	if p.MaxAverageBitrate > 0 {
+		params = append(params, "maxaveragebitrate="+strconv.Itoa(p.MaxAverageBitrate))
+	}
+	if p.Stereo {
+		params = append(params, "stereo=1")
+	}
+	if p.UseInbandFEC {
+		params = append(params, "useinbandfec=1")
+	}
+	return strings.Join(params, ";")
+}
+
+// opusFrameDurations are the frame durations of whole milliseconds the
+// Opus encoder codes.
+var opusFrameDurations = []int{10, 20, 40, 60}
+
+// OpusPtime rounds ptime, in milliseconds, up to a frame duration the Opus
+// encoder codes, at most 60ms.
+func OpusPtime(ptime int) int {
+	for _, d := range opusFrameDurations {
+		if ptime <= d {
+			return d
+		}
+	}
+	return opusFrameDurations[len(opusFrameDurations)-1]
+}
+
+// opusInfo describes Opus in SDP. The rtpmap always has 48000 and 2
+// channels whatever is sent (RFC 7587 section 7); we code mono at 48 kHz.
+func opusInfo() Info {
+	return Info{
+		Name:        "opus",
+		PayloadType: OpusPayloadType,
+		ClockRate:   48000,
+		SampleRate:  48000,
+		Channels:    2,
+		Fmtp:        DefaultOpusParams.String(),
+	}
+}
@@ -0,0 +1,131 @@
+//go:build opus
+
+package codec
+
+/*
+#cgo pkg-config: opus
+#include <opus.h>
+
+// The ctl functions are variadic, which cgo cannot call.
+static int opus_set_inband_fec(OpusEncoder *e, opus_int32 v) { return opus_encoder_ctl(e, OPUS_SET_INBAND_FEC(v)); }
+static int opus_set_bitrate(OpusEncoder *e, opus_int32 v) { return opus_encoder_ctl(e, OPUS_SET_BITRATE(v)); }
+static int opus_set_packet_loss(OpusEncoder *e, opus_int32 v) { return opus_encoder_ctl(e, OPUS_SET_PACKET_LOSS_PERC(v)); }
+*/
+import "C"
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+// opusExpectedLoss is the packet loss the encoder protects against with
+// in-band FEC, in percent.
+const opusExpectedLoss = 10
+
+// Opus is the Opus payload format of RFC 7587, coding mono at 48 kHz.
+var Opus Codec = opusCodec{}
+
+func init() {
+	if err := Default.Register(Opus); err != nil {
+		panic(err)
+	}
+}
+
+type opusCodec struct{}
+
+func (opusCodec) Info() Info { return opusInfo() }
+
+// NewEncoder returns an encoder for a peer that takes DefaultOpusParams.
+func (opusCodec) NewEncoder() Encoder { return newOpusEncoder(DefaultOpusParams) }
+
+// NewEncoderFor returns an encoder that keeps to the maxaveragebitrate of
+// fmtp, and adds in-band FEC only if it asks for useinbandfec.
+func (opusCodec) NewEncoderFor(fmtp string) Encoder { return newOpusEncoder(ParseOpusParams(fmtp)) }
+
+func newOpusEncoder(p OpusParams) *opusEncoder {
+	var cerr C.int
+	e := &opusEncoder{enc: C.opus_encoder_create(48000, 1, C.OPUS_APPLICATION_VOIP, &cerr)}
+	if cerr != C.OPUS_OK {
+		panic(opusError(int(cerr)))
+	}
+	if p.MaxAverageBitrate > 0 {
+		C.opus_set_bitrate(e.enc, C.opus_int32(p.MaxAverageBitrate))
+	}
+	if p.UseInbandFEC {
+		C.opus_set_inband_fec(e.enc, 1)
+		C.opus_set_packet_loss(e.enc, opusExpectedLoss)
+	}
+	runtime.SetFinalizer(e, func(e *opusEncoder) { C.opus_encoder_destroy(e.enc) })
+	return e
+}
+
+func (opusCodec) NewDecoder() Decoder {
+	var cerr C.int
+	d := &opusDecoder{dec: C.opus_decoder_create(48000, 1, &cerr)}
+	if cerr != C.OPUS_OK {
+		panic(opusError(int(cerr)))
+	}
+	runtime.SetFinalizer(d, func(d *opusDecoder) { C.opus_decoder_destroy(d.dec) })
+	return d
+}
+
+type opusEncoder struct {
+	enc *C.OpusEncoder
+}
+
+// Encode codes one frame, which must be 2.5, 5, 10, 20, 40 or 60ms long.
+func (e *opusEncoder) Encode(dst []byte, pcm []int16) (int, error) {
+	if len(pcm) == 0 || len(dst) == 0 {
+		return 0, ErrShortBuffer
+	}
+	n := C.opus_encode(e.enc, (*C.opus_int16)(unsafe.Pointer(&pcm[0])), C.int(len(pcm)),
+		(*C.uchar)(unsafe.Pointer(&dst[0])), C.opus_int32(len(dst)))
+	runtime.KeepAlive(e)
+	if n < 0 {
+		return 0, opusError(int(n))
+	}
+	return int(n), nil
+}
+
+type opusDecoder struct {
+	dec *C.OpusDecoder
+}
+
+func (d *opusDecoder) Decode(dst []int16, data []byte) (int, error) {
+	if len(dst) == 0 || len(data) == 0 {
+		return 0, ErrShortBuffer
+	}
+	n := C.opus_decode(d.dec, (*C.uchar)(unsafe.Pointer(&data[0])), C.opus_int32(len(data)),
+		(*C.opus_int16)(unsafe.Pointer(&dst[0])), C.int(len(dst)), 0)
+	runtime.KeepAlive(d)
+	if n < 0 {
+		return 0, opusError(int(n))
+	}
+	return int(n), nil
+}
+
+// Conceal recovers the lost frame from the in-band FEC of next, or lets
+// libopus conceal it when next is nil or carries no FEC. n must be a
+// multiple of 2.5ms.
+func (d *opusDecoder) Conceal(dst []int16, n int, next []byte) (int, error) {
+	if n == 0 || len(dst) < n {
+		return 0, ErrShortBuffer
+	}
+	var data *C.uchar
+	fec := 0
+	if len(next) > 0 {
+		data, fec = (*C.uchar)(unsafe.Pointer(&next[0])), 1
+	}
+	r := C.opus_decode(d.dec, data, C.opus_int32(len(next)),
+		(*C.opus_int16)(unsafe.Pointer(&dst[0])), C.int(n), C.int(fec))
+	runtime.KeepAlive(d)
+	if r < 0 {
+		return 0, opusError(int(r))
+	}
+	return int(r), nil
+}
+
+func opusError(code int) error {
+	return fmt.Errorf("codec: opus: %s", C.GoString(C.opus_strerror(C.int(code))))
+}
@@ -0,0 +1,150 @@
+//go:build opus
+
+package codec
+
+import (
+	"math"
+	"testing"
+
+	"github.com/itzmanish/sipnexus/pkg/audio"
+)
+
+func TestOpusRegistered(t *testing.T) {
+	if c, ok := Default.Lookup("opus", 48000, 2); !ok || c != Opus {
+		t.Fatal("Opus is not in the default registry")
+	}
+}
+
+func TestOpusTranscode(t *testing.T) {
+	ulaw := readSound(t, "demo-thanks.ulaw")
+	ulaw = ulaw[:len(ulaw)/160*160]
+	pcm := readWAV(t, "demo-thanks.wav")[:len(ulaw)]
+
+	toOpus, fromOpus := NewTranscoder(PCMU, Opus), NewTranscoder(Opus, PCMU)
+	packet := make([]byte, 1500)
+	frame := make([]byte, 160)
+	var out []byte
+	for off := 0; off < len(ulaw); off += 160 {
+		n, err := toOpus.Transcode(packet, ulaw[off:off+160])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 160 {
+			t.Fatalf("20ms of Opus took %d bytes", n)
+		}
+		if n, err = fromOpus.Transcode(frame, packet[:n]); err != nil || n != 160 {
+			t.Fatalf("decoded 20ms of Opus to %d bytes of PCMU, %v", n, err)
+		}
+		out = append(out, frame...)
+	}
+	decoded := make([]int16, len(out))
+	PCMU.NewDecoder().Decode(decoded, out)
+
+	// Opus codes what is heard rather than the waveform, so the bar is
+	// lower than for G.711. The encoder and the resamplers delay the audio.
+	best := math.Inf(-1)
+	for d := 0; d < 200; d++ {
+		best = max(best, delayedSNR(pcm, decoded, d, 800))
+	}
+	if best < 8 {
+		t.Fatalf("round trip through Opus has SNR %.1f dB", best)
+	}
+}
+
+func TestOpusConceal(t *testing.T) {
+	pcm := readWAV(t, "demo-thanks.wav")
+	wide := make([]int16, 6*len(pcm)+1)
+	n, _ := audio.NewResampler(8000, 48000).Resample(wide, pcm)
+	wide = wide[:n/960*960]
+
+	enc := Opus.NewEncoder()
+	var packets [][]byte
+	for off := 0; off < len(wide); off += 960 {
+		packet := make([]byte, 1500)
+		n, err := enc.Encode(packet, wide[off:off+960])
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet[:n])
+	}
+
+	// Every tenth packet is lost. Decoding them all is what concealment
+	// aims for.
+	lost := func(i int) bool { return i%10 == 5 }
+	decode := func(fec bool) []int16 {
+		dec := Opus.NewDecoder().(Concealer)
+		out := make([]int16, len(wide))
+		for i, packet := range packets {
+			frame := out[i*960 : (i+1)*960]
+			var err error
+			switch {
+			case !lost(i):
+				_, err = dec.(Decoder).Decode(frame, packet)
+			case fec && i+1 < len(packets):
+				_, err = dec.Conceal(frame, 960, packets[i+1])
+			default:
+				_, err = dec.Conceal(frame, 960, nil)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return out
+	}
+	withFEC, withoutFEC := decode(true), decode(false)
+	want := make([]int16, len(wide))
+	dec := Opus.NewDecoder()
+	for i, packet := range packets {
+		if _, err := dec.Decode(want[i*960:(i+1)*960], packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lostSNR := func(got []int16) float64 {
+		var signal, noise float64
+		for i := range packets {
+			if !lost(i) {
+				continue
+			}
+			for j := i * 960; j < (i+1)*960; j++ {
+				d := float64(got[j]) - float64(want[j])
+				signal += float64(want[j]) * float64(want[j])
+				noise += d * d
+			}
+		}
+		return 10 * math.Log10(signal/noise)
+	}
+	// A gap of silence would have 0 dB.
+	fec, plc := lostSNR(withFEC), lostSNR(withoutFEC)
+	if fec <= plc || fec < 1 {
+		t.Fatalf("lost packets recovered by FEC with SNR %.1f dB, concealed with %.1f dB", fec, plc)
+	}
+}
+
+func TestOpusEncoderFor(t *testing.T) {
+	pcm := readWAV(t, "demo-thanks.wav")
+	wide := make([]int16, 6*len(pcm)+1)
+	n, _ := audio.NewResampler(8000, 48000).Resample(wide, pcm)
+	wide = wide[:n/960*960]
+
+	// bitrate returns the bits per second enc codes wide at.
+	bitrate := func(enc Encoder) int {
+		packet := make([]byte, 1500)
+		var total int
+		for off := 0; off < len(wide); off += 960 {
+			n, err := enc.Encode(packet, wide[off:off+960])
+			if err != nil {
+				t.Fatal(err)
+			}
+			total += n
+		}
+		return total * 8 * 50 / (len(wide) / 960)
+	}
+	capped := bitrate(NewEncoderFor(Opus, "maxaveragebitrate=12000"))
+	if capped > 12000*6/5 {
+		t.Fatalf("capped at 12000 b/s, coded at %d", capped)
+	}
+	if def := bitrate(Opus.NewEncoder()); def <= capped {
+		t.Fatalf("coded at %d b/s uncapped, %d capped", def, capped)
+	}
+}
@@ -0,0 +1,35 @@
+package codec
+
+import "testing"
+
+func TestOpusParams(t *testing.T) {
+	for _, tc := range []struct {
+		fmtp string
+		want OpusParams
+		str  string
+	}{
+		{"", OpusParams{}, ""},
+		{"minptime=10;useinbandfec=1", OpusParams{MinPtime: 10, UseInbandFEC: true}, "minptime=10;useinbandfec=1"},
+		{"minptime=10; useinbandfec=1; stereo=1; maxaveragebitrate=24000", OpusParams{MinPtime: 10, MaxAverageBitrate: 24000, Stereo: true, UseInbandFEC: true}, "minptime=10;maxaveragebitrate=24000;stereo=1;useinbandfec=1"},
+		{"stereo=0;sprop-stereo=1;usedtx=1;bogus", OpusParams{}, ""},
+	} {
+		got := ParseOpusParams(tc.fmtp)
+		if got != tc.want {
+			t.Fatalf("ParseOpusParams(%q) = %+v, want %+v", tc.fmtp, got, tc.want)
+		}
+		if got.String() != tc.str {
+			t.Fatalf("String() = %q, want %q", got.String(), tc.str)
+		}
+	}
+	if info := opusInfo(); info.Fmtp != "minptime=10;useinbandfec=1" || info.ClockRate != 48000 || info.Channels != 2 {
+		t.Fatalf("opus is offered as %+v", info)
+	}
+}
+
+func TestOpusPtime(t *testing.T) {
+	for ptime, want := range map[int]int{0: 10, 10: 10, 15: 20, 20: 20, 30: 40, 50: 60, 60: 60, 120: 60} {
+		if got := OpusPtime(ptime); got != want {
+			t.Fatalf("OpusPtime(%d) = %d, want %d", ptime, got, want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package codec
+
+import "github.com/itzmanish/sipnexus/pkg/audio"
+
+// Transcoder converts payloads of one codec into another, resampling when
+// their sample rates differ. It keeps the state of one stream and is not
+// safe for concurrent use.
+type Transcoder struct {
+	from, to  Info
+	dec       Decoder
+	enc       Encoder
+	resampler *audio.Resampler
+	pcm, out  []int16
+}
+
+// NewTranscoder returns a transcoder from payloads of from to payloads of
+// to.
+func NewTranscoder(from, to Codec) *Transcoder {
+	t := &Transcoder{from: from.Info(), to: to.Info(), dec: from.NewDecoder(), enc: to.NewEncoder()}
+	t.pcm = make([]int16, t.from.frameSamples(MaxFrameDuration))
+	if t.from.SampleRate != t.to.SampleRate {
+		t.resampler = audio.NewResampler(t.from.SampleRate, t.to.SampleRate)
+		t.out = make([]int16, t.resampler.MaxOutput(len(t.pcm)))
+	}
+	return t
+}
+
+// Transcode writes the payload carrying the audio of src to dst and returns
+// its length. src may carry up to MaxFrameDuration of audio.
+func (t *Transcoder) Transcode(dst, src []byte) (int, error) {
+	n, err := t.dec.Decode(t.pcm, src)
+	if err != nil {
+		return 0, err
+	}
+	pcm := t.pcm[:n]
+	if t.resampler != nil {
+		if n, err = t.resampler.Resample(t.out, pcm); err != nil {
+			return 0, err
+		}
+		pcm = t.out[:n]
+	}
+	return t.enc.Encode(dst, pcm)
+}
@@ -0,0 +1,127 @@
+package codec
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// l16 is linear PCM in network order (RFC 3551 section 4.5.11) at 48 kHz,
+// standing in for Opus to test transcoding between 8 and 48 kHz.
+type l16 struct{}
+
+func (l16) Info() Info {
+	return Info{Name: "L16", PayloadType: 96, ClockRate: 48000, SampleRate: 48000, Channels: 1}
+}
+func (l16) NewEncoder() Encoder { return l16{} }
+func (l16) NewDecoder() Decoder { return l16{} }
+
+func (l16) Encode(dst []byte, pcm []int16) (int, error) {
+	if len(dst) < 2*len(pcm) {
+		return 0, ErrShortBuffer
+	}
+	for i, s := range pcm {
+		binary.BigEndian.PutUint16(dst[2*i:], uint16(s))
+	}
+	return 2 * len(pcm), nil
+}
+
+func (l16) Decode(dst []int16, data []byte) (int, error) {
+	if len(dst) < len(data)/2 {
+		return 0, ErrShortBuffer
+	}
+	for i := range data[:len(data)/2*2] {
+		if i%2 == 0 {
+			dst[i/2] = int16(binary.BigEndian.Uint16(data[i:]))
+		}
+	}
+	return len(data) / 2, nil
+}
+
+// transcodeChain passes payload through transcoders along chain 20ms at a
+// time and returns it decoded. The codecs of chain must code 20ms in 160
+// bytes, as G.711 and G.722 do.
+func transcodeChain(t *testing.T, payload []byte, chain ...Codec) []int16 {
+	t.Helper()
+	dst := make([]byte, 160)
+	for i := 0; i+1 < len(chain); i++ {
+		tc := NewTranscoder(chain[i], chain[i+1])
+		var out []byte
+		for off := 0; off+160 <= len(payload); off += 160 {
+			n, err := tc.Transcode(dst, payload[off:off+160])
+			if err != nil || n != 160 {
+				t.Fatalf("%s to %s = %d, %v", chain[i].Info().Name, chain[i+1].Info().Name, n, err)
+			}
+			out = append(out, dst[:n]...)
+		}
+		payload = out
+	}
+	pcm := make([]int16, 2*len(payload))
+	n, err := chain[len(chain)-1].NewDecoder().Decode(pcm, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pcm[:n]
+}
+
+func TestTranscode(t *testing.T) {
+	ulaw := readSound(t, "demo-thanks.ulaw")
+	ulaw = ulaw[:len(ulaw)/160*160]
+	pcm := readWAV(t, "demo-thanks.wav")[:len(ulaw)]
+	direct := snr(pcm, transcodeChain(t, ulaw, PCMU))
+
+	for _, tc := range []struct {
+		name  string
+		chain []Codec
+		// delay is how many samples the chain delays the audio, and loss
+		// how much SNR it may cost over decoding ulaw directly.
+		delay int
+		loss  float64
+	}{
+		{"PCMU-PCMA-PCMU", []Codec{PCMU, PCMA, PCMU}, 0, 3},
+		// Resampling up and down delays by 12 samples each, the G.722
+		// QMFs by 11.
+		{"PCMU-G722-PCMU", []Codec{PCMU, G722, PCMU}, 35, 12},
+		{"PCMU-G722-PCMA", []Codec{PCMU, G722, PCMA}, 35, 12},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out := transcodeChain(t, ulaw, tc.chain...)
+			if len(out) != len(pcm) {
+				t.Fatalf("transcoded %d samples to %d", len(pcm), len(out))
+			}
+			if got := delayedSNR(pcm, out, tc.delay, 160); got < direct-tc.loss {
+				t.Fatalf("SNR %.1f dB, %.1f dB without transcoding", got, direct)
+			}
+		})
+	}
+}
+
+func TestTranscode48k(t *testing.T) {
+	ulaw := readSound(t, "demo-thanks.ulaw")
+	ulaw = ulaw[:len(ulaw)/160*160]
+	pcm := readWAV(t, "demo-thanks.wav")[:len(ulaw)]
+
+	up, down := NewTranscoder(PCMU, l16{}), NewTranscoder(l16{}, PCMU)
+	wide := make([]byte, 2*960)
+	frame := make([]byte, 160)
+	var out []byte
+	for off := 0; off < len(ulaw); off += 160 {
+		// Each 20ms frame is 960 samples at 48 kHz, a size Opus can code.
+		n, err := up.Transcode(wide, ulaw[off:off+160])
+		if err != nil || n != 2*960 {
+			t.Fatalf("transcoded 20ms to %d bytes of L16, %v", n, err)
+		}
+		if n, err = down.Transcode(frame, wide); err != nil || n != 160 {
+			t.Fatalf("transcoded 20ms to %d bytes of PCMU, %v", n, err)
+		}
+		out = append(out, frame...)
+	}
+	decoded := make([]int16, len(out))
+	PCMU.NewDecoder().Decode(decoded, out)
+
+	// The resamplers delay by 12 samples each and cut what is close to
+	// 4 kHz; encoding µ-law again adds its noise.
+	direct := snr(pcm, transcodeChain(t, ulaw, PCMU))
+	if got := delayedSNR(pcm, decoded, 24, 160); got < direct-12 {
+		t.Fatalf("SNR %.1f dB, %.1f dB without transcoding", got, direct)
+	}
+}
@@ -28,11 +28,11 @@ func init() {
 	zerolog.CallerMarshalFunc = func(pc uintptr, file string, line int) string {
 		return filepath.Base(file) + ":" + strconv.Itoa(line)
 	}
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	log.Logger = log.Logger.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Timestamp().Caller().Logger()
 }
 
 func NewLogger() Logger {
-	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	return &ZeroLogger{
 		log: log.Logger,
 	}
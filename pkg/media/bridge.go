@@ -0,0 +1,635 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/itzmanish/sipnexus/pkg/audio"
+	"github.com/itzmanish/sipnexus/pkg/codec"
+	"github.com/itzmanish/sipnexus/pkg/logger"
+	"github.com/pion/rtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrNoTranscoder is returned when the audio of one leg cannot be converted
+// to the codec of the other.
+var ErrNoTranscoder = errors.New("no transcoder between the codecs of the legs")
+
+// maxPayloadSize bounds the payload of an encoded frame.
+const maxPayloadSize = 1500
+
+// cnInterval is how often CN is repeated while audio is suppressed, to
+// update the noise level.
+const cnInterval = time.Second
+
+var (
+	mediaBridges = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sipnexus_media_bridges",
+		Help: "Bridges currently joining two media legs.",
+	})
+	bridgeTranscodedFrames = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sipnexus_bridge_transcoded_frames_total",
+		Help: "Frames a bridge encoded because the codecs or ptimes of its legs differ.",
+	})
+	bridgeConcealedFrames = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sipnexus_bridge_concealed_frames_total",
+		Help: "Lost frames a bridge concealed or recovered from FEC while transcoding.",
+	})
+)
+
+// Bridge joins two legs of a call, sending the audio received on each to
+// the other. Each direction relays packets when both legs use the same codec
+// and ptime, and otherwise decodes, resamples and encodes them, cutting the
+// audio into frames of the ptime the receiving peer asked for, and encoding
+// them as its fmtp asks. Opus frames are no shorter than the peer's minptime
+// and of a duration Opus codes. The choice is made again whenever either leg
+// renegotiates.
+//
+// Both paths read the jitter buffer of the sending leg, so switching between
+// them loses nothing and the receiving peer gets packets in order. What
+// the bridge sends is one continuous stream of the receiving leg's SSRC:
+// sequence numbers and timestamps carry on across changes of the source and
+// of the path. DTMF (RFC 4733) is relayed as is alongside relayed audio, and
+// otherwise re-stamped onto the stream the bridge encodes.
+//
+// Comfort noise (RFC 3389) is passed on to legs that negotiated CN. For
+// other legs the bridge encodes noise of the level the CN describes until
+// audio resumes. Audio sent to a leg that takes CN goes through a VAD, and
+// silence is sent as CN instead. Relayed audio is decoded for the VAD only.
+type Bridge struct {
+	links     [2]*bridgeLink
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewBridge starts forwarding media between a and b, which must both have
+// negotiated media. Codecs are converted with codec.Default.
+func NewBridge(log logger.Logger, a, b MediaEngine) (*Bridge, error) {
+	return newBridge(log, a, b, codec.Default)
+}
+
+func newBridge(log logger.Logger, a, b MediaEngine, registry *codec.Registry) (*Bridge, error) {
+	br := &Bridge{done: make(chan struct{})}
+	br.links[0] = newBridgeLink(log, a, b, registry, br.done)
+	br.links[1] = newBridgeLink(log, b, a, registry, br.done)
+	for _, l := range br.links {
+		if err := l.start(); err != nil {
+			return nil, err
+		}
+	}
+	mediaBridges.Inc()
+	for _, l := range br.links {
+		go l.run()
+	}
+	return br, nil
+}
+
+// Close stops forwarding. The legs stay open; each direction ends when its
+// leg receives the next frame or is closed.
+func (br *Bridge) Close() error {
+	br.closeOnce.Do(func() {
+		close(br.done)
+		mediaBridges.Dec()
+	})
+	return nil
+}
+
+// bridgeLink forwards the media of one direction of a bridge.
+type bridgeLink struct {
+	logger   logger.Logger
+	src, dst MediaEngine
+	registry *codec.Registry
+	done     <-chan struct{}
+
+	// mu serializes forwarding with the comfort noise timer.
+	mu  sync.Mutex
+	out outStream
+
+	// The plan for the format of the last frame, remade when it changes.
+	from, to    Codec
+	fromPtime   int
+	toPtime     int
+	relay       bool
+	dec         codec.Decoder
+	enc         codec.Encoder
+	resampler   *audio.Resampler
+	rate        int           // sample rate of the audio sent
+	slicer      *audio.Slicer // into frames of the ptime sent
+	duration    uint32        // timestamp units per frame sent
+	pcm, wide   []int16       // decoded, and resampled
+	payload     []byte
+	lastSamples int // samples of the last frame received, at from's rate
+
+	// Comfort noise played while the source is silent, for a receiving leg
+	// without CN. Each run of the timer is one generation.
+	noise      audio.Noise
+	noiseFrame []int16
+	silent     bool
+	generation int
+
+	// Silence suppression of what is sent, for a receiving leg with CN.
+	// Relayed audio is decoded by dec for it.
+	vad        *audio.VAD
+	suppressed bool
+	cnAt       time.Time // when CN was last sent
+	cn         []byte
+
+	// The DTMF event last re-stamped, by its SSRC and timestamp at the
+	// source.
+	inEvent   bool
+	eventSSRC uint32
+	eventTS   uint32
+}
+
+func newBridgeLink(log logger.Logger, src, dst MediaEngine, registry *codec.Registry, done <-chan struct{}) *bridgeLink {
+	return &bridgeLink{logger: log, src: src, dst: dst, registry: registry, done: done, out: outStream{ssrc: dst.SSRC()}}
+}
+
+// start plans for the codec the source negotiated.
+func (l *bridgeLink) start() error {
+	from, ok := l.src.Stream()
+	if !ok {
+		return ErrNotNegotiated
+	}
+	c, ok := from.Codec()
+	if !ok {
+		return ErrNotNegotiated
+	}
+	return l.plan(c.PayloadType)
+}
+
+func (l *bridgeLink) run() {
+	for {
+		f, err := l.src.ReadFrame()
+		if err != nil {
+			return
+		}
+		select {
+		case <-l.done:
+			return
+		default:
+		}
+		if err := l.forward(f, time.Now()); err != nil {
+			if errors.Is(err, ErrEngineClosed) {
+				return
+			}
+			l.logger.Warnf("bridge dropped a frame: %v", err)
+		}
+	}
+}
+
+// forward sends frame f on to the other leg.
+func (l *bridgeLink) forward(f Frame, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f.Lost && l.silent {
+		// The noise plays on; what was lost may have been a CN update.
+		return nil
+	}
+	if !f.Lost {
+		from, _ := l.src.Stream()
+		pt := f.Packet.PayloadType
+		if ev, ok := from.TelephoneEvent(); ok && ev.PayloadType == pt {
+			return l.relayEvent(f.Packet, ev, now)
+		}
+		if c, ok := from.payloadCodec(pt); ok && c.IsComfortNoise() {
+			return l.comfortNoise(f.Packet, now)
+		}
+		l.stopNoise()
+		if err := l.plan(pt); err != nil {
+			return err
+		}
+	}
+	if l.relay {
+		// A lost packet leaves a gap in the sequence numbers, which the
+		// receiving peer conceals.
+		if f.Lost {
+			return nil
+		}
+		if suppressed, err := l.suppressRelayed(f.Packet, now); suppressed || err != nil {
+			return err
+		}
+		return l.write(l.out.relay(f.Packet, l.to.PayloadType, samples(time.Duration(l.fromPtime)*time.Millisecond, l.to.ClockRate), now))
+	}
+	return l.transcode(f, now)
+}
+
+// relayEvent passes a DTMF packet of format ev on to a receiving leg that
+// takes DTMF. While audio is relayed the packet is too, so that the
+// timestamps of both agree. Otherwise it is re-stamped onto the stream the
+// bridge encodes, the packets of one event sharing the timestamp of its
+// start.
+func (l *bridgeLink) relayEvent(pkt *rtp.Packet, ev Codec, now time.Time) error {
+	to, _ := l.dst.Stream()
+	out, ok := to.TelephoneEvent()
+	if !ok {
+		return nil
+	}
+	if l.relay && out.ClockRate == ev.ClockRate {
+		return l.write(l.out.relay(pkt, out.PayloadType, 0, now))
+	}
+	if len(pkt.Payload) < 4 {
+		return fmt.Errorf("telephone-event payload of %d bytes", len(pkt.Payload))
+	}
+	payload := append([]byte(nil), pkt.Payload[:4]...)
+	duration := min(uint32(binary.BigEndian.Uint16(payload[2:]))*out.ClockRate/ev.ClockRate, math.MaxUint16)
+	binary.BigEndian.PutUint16(payload[2:], uint16(duration))
+	start := !l.inEvent || pkt.SSRC != l.eventSSRC || pkt.Timestamp != l.eventTS
+	l.inEvent, l.eventSSRC, l.eventTS = true, pkt.SSRC, pkt.Timestamp
+	return l.write(l.out.event(out.PayloadType, payload, start, duration, now))
+}
+
+// plan prepares to forward frames of payload type pt, unless the current
+// plan already does.
+func (l *bridgeLink) plan(pt uint8) error {
+	fromStream, _ := l.src.Stream()
+	toStream, ok := l.dst.Stream()
+	if !ok {
+		return ErrNotNegotiated
+	}
+	from, ok := fromStream.payloadCodec(pt)
+	if !ok {
+		return fmt.Errorf("unexpected payload type %d", pt)
+	}
+	to, _ := toStream.Codec()
+	toPtime := to.sendPtime(toStream.Ptime)
+	if l.dec != nil || l.relay {
+		if from == l.from && to == l.to && fromStream.Ptime == l.fromPtime && toPtime == l.toPtime {
+			return nil
+		}
+	}
+
+	l.from, l.to = from, to
+	l.fromPtime, l.toPtime = fromStream.Ptime, toPtime
+	l.out.setClockRate(to.ClockRate)
+	l.relay = from.Matches(to) && fromStream.Ptime == toPtime
+	l.dec, l.enc, l.resampler, l.slicer = nil, nil, nil, nil
+	dec, ok := l.registry.Lookup(from.Name, from.ClockRate, int(from.Channels))
+	if l.relay {
+		if _, cn := toStream.ComfortNoise(); ok && cn {
+			l.decoder(dec)
+			l.vad = audio.NewVAD(dec.Info().SampleRate)
+		}
+		return nil
+	}
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoTranscoder, from.Name)
+	}
+	if err := l.encoder(); err != nil {
+		return err
+	}
+	in := l.decoder(dec)
+	l.wide = l.pcm
+	if in != l.rate {
+		l.resampler = audio.NewResampler(in, l.rate)
+		l.wide = make([]int16, l.resampler.MaxOutput(len(l.pcm)))
+	}
+	l.lastSamples = in * fromStream.Ptime / 1000
+	return nil
+}
+
+// decoder prepares to decode audio of dec and returns its sample rate.
+func (l *bridgeLink) decoder(dec codec.Codec) int {
+	in := dec.Info().SampleRate
+	l.dec = dec.NewDecoder()
+	l.pcm = make([]int16, in*int(codec.MaxFrameDuration/time.Millisecond)/1000)
+	return in
+}
+
+// encoder prepares to encode audio for the receiving leg as its fmtp asks,
+// unless it already can. Relayed legs only need to for comfort noise.
+func (l *bridgeLink) encoder() error {
+	if l.enc != nil {
+		return nil
+	}
+	enc, ok := l.registry.Lookup(l.to.Name, l.to.ClockRate, int(l.to.Channels))
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoTranscoder, l.to.Name)
+	}
+	out := enc.Info()
+	l.enc, l.rate = codec.NewEncoderFor(enc, l.to.RemoteFmtp), out.SampleRate
+	l.slicer = audio.NewSlicer(out.SampleRate * l.toPtime / 1000)
+	l.duration = out.Timestamp(l.slicer.Frame())
+	l.payload = make([]byte, maxPayloadSize)
+	l.noiseFrame = make([]int16, l.slicer.Frame())
+	l.vad = audio.NewVAD(out.SampleRate)
+	return nil
+}
+
+// transcode decodes f, or conceals it when it was lost, and sends every
+// frame of audio that is complete.
+func (l *bridgeLink) transcode(f Frame, now time.Time) error {
+	n := l.lastSamples
+	var err error
+	if f.Lost {
+		// Silence stands in when concealing fails; the error is returned
+		// after it was sent.
+		err = l.conceal(f)
+	} else {
+		if n, err = l.dec.Decode(l.pcm, f.Packet.Payload); err != nil {
+			return err
+		}
+		l.lastSamples = n
+	}
+	pcm := l.pcm[:n]
+	if l.resampler != nil {
+		n, err := l.resampler.Resample(l.wide, pcm)
+		if err != nil {
+			return err
+		}
+		pcm = l.wide[:n]
+	}
+	l.slicer.Write(pcm)
+
+	for frame, ok := l.slicer.Next(); ok; frame, ok = l.slicer.Next() {
+		suppressed, cnErr := l.suppress(frame, now)
+		if cnErr != nil {
+			err = cnErr
+		}
+		if suppressed {
+			continue
+		}
+		if sendErr := l.send(frame, now); sendErr != nil {
+			err = sendErr
+		}
+	}
+	return err
+}
+
+// conceal stands in for the lost frame f with what the decoder makes up,
+// recovered from the FEC of the next packet if that already arrived, or
+// with silence when the decoder cannot conceal.
+func (l *bridgeLink) conceal(f Frame) error {
+	pcm := l.pcm[:l.lastSamples]
+	c, ok := l.dec.(codec.Concealer)
+	if !ok {
+		clear(pcm)
+		return nil
+	}
+	var next []byte
+	if f.Next != nil && f.Next.PayloadType == l.from.PayloadType {
+		next = f.Next.Payload
+	}
+	if _, err := c.Conceal(pcm, len(pcm), next); err != nil {
+		clear(pcm)
+		return err
+	}
+	bridgeConcealedFrames.Inc()
+	return nil
+}
+
+// send encodes frame and sends it.
+func (l *bridgeLink) send(frame []int16, now time.Time) error {
+	n, err := l.enc.Encode(l.payload, frame)
+	if err != nil {
+		return err
+	}
+	bridgeTranscodedFrames.Inc()
+	return l.write(l.out.generate(l.to.PayloadType, l.payload[:n], l.duration, now))
+}
+
+// suppress reports whether frame is silence to leave out because the
+// receiving leg takes CN, which is sent in its place when the silence starts
+// and every cnInterval after.
+func (l *bridgeLink) suppress(frame []int16, now time.Time) (bool, error) {
+	active := l.vad.Active(frame)
+	to, _ := l.dst.Stream()
+	cn, ok := to.ComfortNoise()
+	if active || !ok {
+		l.suppressed = false
+		return false, nil
+	}
+	if l.suppressed && now.Sub(l.cnAt) < cnInterval {
+		return true, nil
+	}
+	l.suppressed, l.cnAt = true, now
+	level := codec.ComfortNoiseLevel(l.vad.NoiseLevel())
+	return true, l.sendComfortNoise(cn.PayloadType, codec.ComfortNoise{Level: level}, now)
+}
+
+// suppressRelayed reports whether the relayed pkt is silence to leave out,
+// decoding it for the VAD when the receiving leg takes CN.
+func (l *bridgeLink) suppressRelayed(pkt *rtp.Packet, now time.Time) (bool, error) {
+	if l.dec == nil {
+		return false, nil
+	}
+	n, err := l.dec.Decode(l.pcm, pkt.Payload)
+	if err != nil {
+		return false, err
+	}
+	return l.suppress(l.pcm[:n], now)
+}
+
+// comfortNoise handles a CN packet from the source, which fell silent. A
+// receiving leg that takes CN gets it too; for others noise of the level it
+// describes is encoded until audio resumes.
+func (l *bridgeLink) comfortNoise(pkt *rtp.Packet, now time.Time) error {
+	cn, err := codec.ParseComfortNoise(pkt.Payload)
+	if err != nil {
+		return err
+	}
+	to, _ := l.dst.Stream()
+	if out, ok := to.ComfortNoise(); ok {
+		if l.relay {
+			return l.write(l.out.relay(pkt, out.PayloadType, 0, now))
+		}
+		l.slicer.Reset()
+		return l.sendComfortNoise(out.PayloadType, cn, now)
+	}
+
+	if err := l.encoder(); err != nil {
+		return err
+	}
+	l.noise.SetLevel(-float64(cn.Level))
+	if !l.silent {
+		l.silent = true
+		l.slicer.Reset()
+		l.playNoise(l.generation)
+	}
+	return nil
+}
+
+// sendComfortNoise sends cn with payload type pt.
+func (l *bridgeLink) sendComfortNoise(pt uint8, cn codec.ComfortNoise, now time.Time) error {
+	l.cn = cn.Append(l.cn[:0])
+	return l.write(l.out.silence(pt, l.cn, now))
+}
+
+// playNoise sends a frame of comfort noise and schedules the next while
+// generation is the current one.
+func (l *bridgeLink) playNoise(generation int) {
+	l.noise.Read(l.noiseFrame)
+	if err := l.send(l.noiseFrame, time.Now()); err != nil {
+		if errors.Is(err, ErrEngineClosed) {
+			return
+		}
+		l.logger.Warnf("bridge dropped comfort noise: %v", err)
+	}
+	time.AfterFunc(time.Duration(l.toPtime)*time.Millisecond, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		select {
+		case <-l.done:
+			return
+		default:
+		}
+		if l.silent && l.generation == generation {
+			l.playNoise(generation)
+		}
+	})
+}
+
+// stopNoise stops comfort noise, as audio resumed.
+func (l *bridgeLink) stopNoise() {
+	if l.silent {
+		l.silent = false
+		l.generation++
+	}
+}
+
+// write sends pkt unless the receiving peer does not want media.
+func (l *bridgeLink) write(pkt *rtp.Packet) error {
+	if s, ok := l.dst.Stream(); ok && !s.Direction.Sends() {
+		return nil
+	}
+	return l.dst.WriteRTP(pkt)
+}
+
+// outStream numbers the packets a bridge sends on a leg as one stream of
+// the leg's SSRC, whichever source and path they come from.
+type outStream struct {
+	ssrc    uint32
+	started bool
+	seq     uint16 // of the last packet sent
+	ts      uint32
+	at      time.Time
+
+	// nextTS is where the last packet sent ends. The next generated packet
+	// starts there while contiguous.
+	nextTS     uint32
+	contiguous bool
+
+	// Relayed packets keep their spacing: their numbers are moved by the
+	// offsets set when their source started.
+	mapped    bool
+	srcSSRC   uint32
+	seqOffset uint16
+	tsOffset  uint32
+	clockRate uint32
+
+	eventTS uint32 // where the DTMF event being generated starts
+}
+
+// setClockRate sets the clock of the timestamps, which breaks the stream
+// when it changes.
+func (o *outStream) setClockRate(clockRate uint32) {
+	if clockRate != o.clockRate {
+		o.clockRate, o.contiguous = clockRate, false
+		o.nextTS = o.ts
+	}
+}
+
+// resume returns the numbers of the packet following the last one sent. Its
+// timestamp continues the last generated packet, or after a break in the
+// stream, such as a change of source, counts the time since the last packet
+// and at least the length of that packet.
+func (o *outStream) resume(now time.Time) (uint16, uint32) {
+	if !o.started {
+		o.started = true
+		return uint16(rand.Uint32()), rand.Uint32()
+	}
+	if o.contiguous {
+		return o.seq + 1, o.nextTS
+	}
+	return o.seq + 1, o.ts + max(samples(now.Sub(o.at), o.clockRate), o.nextTS-o.ts, 1)
+}
+
+// relay returns a copy of src, a packet of the source, rewritten to be sent
+// with payload type pt. It spans duration timestamp units. src itself is
+// left alone, since ReadRTP hands the same packet out.
+func (o *outStream) relay(src *rtp.Packet, pt uint8, duration uint32, now time.Time) *rtp.Packet {
+	pkt := &rtp.Packet{Header: src.Header.Clone(), Payload: src.Payload, PaddingSize: src.PaddingSize}
+	remapped := !o.mapped || pkt.SSRC != o.srcSSRC
+	if remapped {
+		seq, ts := o.resume(now)
+		o.seqOffset = seq - pkt.SequenceNumber
+		o.tsOffset = ts - pkt.Timestamp
+		o.srcSSRC, o.mapped = pkt.SSRC, true
+		o.contiguous = false
+		pkt.Marker = true
+	}
+	pkt.SSRC = o.ssrc
+	pkt.PayloadType = pt
+	pkt.SequenceNumber += o.seqOffset
+	pkt.Timestamp += o.tsOffset
+	if remapped || int16(pkt.SequenceNumber-o.seq) > 0 {
+		o.seq, o.ts, o.at = pkt.SequenceNumber, pkt.Timestamp, now
+		o.nextTS = pkt.Timestamp + duration
+	}
+	return pkt
+}
+
+// silence returns the next packet, carrying payload of pt such as CN, which
+// starts a silence: the packet after it counts the time that passed.
+func (o *outStream) silence(pt uint8, payload []byte, now time.Time) *rtp.Packet {
+	pkt := o.generate(pt, payload, 0, now)
+	pkt.Marker = false
+	o.contiguous = false
+	return pkt
+}
+
+// generate returns the next packet carrying payload of pt, which spans
+// duration timestamp units.
+func (o *outStream) generate(pt uint8, payload []byte, duration uint32, now time.Time) *rtp.Packet {
+	seq, ts := o.resume(now)
+	pkt := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         !o.contiguous,
+			PayloadType:    pt,
+			SequenceNumber: seq,
+			Timestamp:      ts,
+			SSRC:           o.ssrc,
+		},
+		Payload: payload,
+	}
+	o.seq, o.ts, o.at = seq, ts, now
+	o.nextTS, o.contiguous = ts+duration, true
+	o.mapped = false
+	return pkt
+}
+
+// event returns the next packet carrying the RFC 4733 payload of pt, whose
+// event has lasted duration timestamp units. start begins a new event; the
+// packets after it until the next start keep its timestamp, and audio
+// generated after them follows the event.
+func (o *outStream) event(pt uint8, payload []byte, start bool, duration uint32, now time.Time) *rtp.Packet {
+	if start {
+		pkt := o.generate(pt, payload, duration, now)
+		pkt.Marker = true
+		o.eventTS = pkt.Timestamp
+		return pkt
+	}
+	o.seq++
+	o.at = now
+	if end := o.eventTS + duration; int32(end-o.nextTS) > 0 {
+		o.nextTS = end
+	}
+	return &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    pt,
+			SequenceNumber: o.seq,
+			Timestamp:      o.eventTS,
+			SSRC:           o.ssrc,
+		},
+		Payload: payload,
+	}
+}
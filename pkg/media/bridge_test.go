@@ -0,0 +1,604 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/itzmanish/sipnexus/pkg/audio"
+	"github.com/itzmanish/sipnexus/pkg/codec"
+	"github.com/itzmanish/sipnexus/pkg/logger"
+	"github.com/pion/rtp"
+)
+
+var (
+	pcmu      = Codec{PayloadType: 0, Name: "PCMU", ClockRate: 8000}
+	pcma      = Codec{PayloadType: 8, Name: "PCMA", ClockRate: 8000}
+	g722      = Codec{PayloadType: 9, Name: "G722", ClockRate: 8000}
+	g729      = Codec{PayloadType: 18, Name: "G729", ClockRate: 8000}
+	dtmf      = Codec{PayloadType: 101, Name: telephoneEvent, ClockRate: 8000}
+	dtmfOther = Codec{PayloadType: 96, Name: telephoneEvent, ClockRate: 8000}
+	cn        = Codec{PayloadType: 13, Name: comfortNoise, ClockRate: 8000}
+)
+
+// testLeg is a MediaEngine that negotiated stream, receiving the frames
+// pushed to frames, or generated by source, and handing what is written to
+// it to written.
+type testLeg struct {
+	stream  Stream
+	ssrc    uint32
+	frames  chan Frame
+	written chan *rtp.Packet
+
+	// source, when set, generates the frames to receive until it returns
+	// false, when drained is called.
+	source  func() (Frame, bool)
+	drained func()
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newTestLeg(ptime int, codecs ...Codec) *testLeg {
+	return &testLeg{
+		stream:  Stream{Accepted: true, Codecs: codecs, Direction: SendRecv, RemoteDirection: SendRecv, Ptime: ptime},
+		ssrc:    uint32(len(codecs))<<16 | uint32(ptime),
+		frames:  make(chan Frame, 1024),
+		written: make(chan *rtp.Packet, 1024),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (l *testLeg) SetOffer(string) (string, error) { return "", errors.New("not supported") }
+func (l *testLeg) CreateOffer() (string, error)    { return "", errors.New("not supported") }
+func (l *testLeg) SetAnswer(string) error          { return errors.New("not supported") }
+func (l *testLeg) Hold(bool)                       {}
+func (l *testLeg) Stream() (Stream, bool)          { return l.stream, true }
+func (l *testLeg) Stats() Stats                    { return Stats{} }
+func (l *testLeg) SSRC() uint32                    { return l.ssrc }
+func (l *testLeg) LastRTP() time.Time              { return time.Time{} }
+func (l *testLeg) ReadRTP() (*rtp.Packet, error)   { return nil, ErrEngineClosed }
+func (l *testLeg) WriteSample(Sample) error        { return nil }
+
+func (l *testLeg) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *testLeg) ReadFrame() (Frame, error) {
+	if l.source != nil {
+		if f, ok := l.source(); ok {
+			return f, nil
+		}
+		l.drained()
+		l.source = nil
+	}
+	select {
+	case f := <-l.frames:
+		return f, nil
+	case <-l.closed:
+		return Frame{}, ErrEngineClosed
+	}
+}
+
+func (l *testLeg) WriteRTP(pkt *rtp.Packet) error {
+	if l.written == nil {
+		return nil
+	}
+	l.written <- pkt.Clone()
+	return nil
+}
+
+func (l *testLeg) push(pt uint8, ssrc uint32, seq uint16, ts uint32, payload []byte) {
+	l.frames <- Frame{
+		Packet:         &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: pt, SequenceNumber: seq, Timestamp: ts, SSRC: ssrc}, Payload: payload},
+		SequenceNumber: seq,
+		Timestamp:      ts,
+	}
+}
+
+func (l *testLeg) read(t *testing.T, n int) []*rtp.Packet {
+	t.Helper()
+	pkts := make([]*rtp.Packet, n)
+	for i := range pkts {
+		select {
+		case pkts[i] = <-l.written:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %d of %d packets", i, n)
+		}
+	}
+	return pkts
+}
+
+func newTestBridge(t testing.TB, a, b *testLeg) {
+	t.Helper()
+	br, err := NewBridge(logger.NewLogger(), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		br.Close()
+		a.Close()
+		b.Close()
+	})
+}
+
+func TestBridgeRelay(t *testing.T) {
+	a, b := newTestLeg(20, pcmu, dtmf), newTestLeg(20, pcmu, dtmfOther)
+	newTestBridge(t, a, b)
+
+	payload := bytes.Repeat([]byte{0x55}, 160)
+	for i := 0; i < 3; i++ {
+		a.push(0, 1, 100+uint16(i), 1000+160*uint32(i), payload)
+	}
+	a.push(101, 1, 103, 1480, []byte{5, 0x0a, 0, 160})
+	// The peer restarts its stream.
+	a.push(0, 2, 5000, 90000, payload)
+	a.push(0, 2, 5001, 90160, payload)
+
+	pkts := b.read(t, 6)
+	for i, pkt := range pkts {
+		if pkt.SSRC != b.ssrc {
+			t.Fatalf("packet %d has SSRC %d, want the leg's %d", i, pkt.SSRC, b.ssrc)
+		}
+		if i > 0 && pkt.SequenceNumber != pkts[i-1].SequenceNumber+1 {
+			t.Fatalf("packet %d has sequence %d after %d", i, pkt.SequenceNumber, pkts[i-1].SequenceNumber)
+		}
+	}
+	for i := 1; i < 3; i++ {
+		if pkts[i].Timestamp != pkts[0].Timestamp+160*uint32(i) || pkts[i].Marker {
+			t.Fatalf("relayed packet %d has timestamp %d, want %d", i, pkts[i].Timestamp, pkts[0].Timestamp+160*uint32(i))
+		}
+	}
+	if pkts[3].PayloadType != 96 || pkts[3].Timestamp != pkts[0].Timestamp+480 {
+		t.Fatalf("DTMF relayed with payload type %d at %d", pkts[3].PayloadType, pkts[3].Timestamp-pkts[0].Timestamp)
+	}
+	if !pkts[4].Marker || int32(pkts[4].Timestamp-pkts[3].Timestamp) <= 0 || pkts[5].Timestamp != pkts[4].Timestamp+160 {
+		t.Fatalf("new source continues at %d, %d after %d", pkts[4].Timestamp, pkts[5].Timestamp, pkts[3].Timestamp)
+	}
+	if !bytes.Equal(pkts[5].Payload, payload) {
+		t.Fatal("relay changed the payload")
+	}
+}
+
+func readSound(t testing.TB, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile("../../testdata/sounds/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBridgeRelayKeepsSource(t *testing.T) {
+	// Other readers of the leg, such as ReadRTP, share the packets the
+	// bridge relays.
+	a, b := newTestLeg(20, pcmu), newTestLeg(20, pcmu)
+	newTestBridge(t, a, b)
+
+	pkt := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 0, SequenceNumber: 7, Timestamp: 1120, SSRC: 1}, Payload: make([]byte, 160)}
+	a.frames <- Frame{Packet: pkt, SequenceNumber: 7, Timestamp: 1120}
+	if sent := b.read(t, 1)[0]; sent.SSRC != b.ssrc {
+		t.Fatalf("relayed with SSRC %d, want %d", sent.SSRC, b.ssrc)
+	}
+	if pkt.SSRC != 1 || pkt.SequenceNumber != 7 || pkt.Timestamp != 1120 || pkt.Marker {
+		t.Fatalf("relaying rewrote the source packet to %+v", pkt.Header)
+	}
+}
+
+func TestBridgeTranscodeDTMF(t *testing.T) {
+	a, b := newTestLeg(20, pcmu, dtmf), newTestLeg(20, pcma, dtmfOther)
+	newTestBridge(t, a, b)
+
+	payload := bytes.Repeat([]byte{0x55}, 160)
+	for i := range 3 {
+		a.push(0, 1, uint16(i), 160*uint32(i), payload)
+	}
+	// Digit 5 lasts 60ms; its end is sent three times.
+	a.push(101, 1, 3, 480, []byte{5, 0x0a, 0, 160})
+	a.push(101, 1, 4, 480, []byte{5, 0x0a, 1, 64})
+	for i := range 3 {
+		a.push(101, 1, 5+uint16(i), 480, []byte{5, 0x8a, 1, 224})
+	}
+	a.push(0, 1, 8, 960, payload)
+
+	pkts := b.read(t, 9)
+	for i, pkt := range pkts[1:] {
+		if pkt.SequenceNumber != pkts[i].SequenceNumber+1 {
+			t.Fatalf("packet %d has sequence %d after %d", i+1, pkt.SequenceNumber, pkts[i].SequenceNumber)
+		}
+	}
+	start := pkts[0].Timestamp + 480
+	for i, pkt := range pkts[3:8] {
+		if pkt.PayloadType != 96 || pkt.Timestamp != start || pkt.Marker != (i == 0) {
+			t.Fatalf("DTMF packet %d of payload type %d at %d with marker %v, want 96 at %d", i, pkt.PayloadType, pkt.Timestamp, pkt.Marker, start)
+		}
+	}
+	if !bytes.Equal(pkts[7].Payload, []byte{5, 0x8a, 1, 224}) {
+		t.Fatalf("DTMF end sent as %x", pkts[7].Payload)
+	}
+	if pkts[8].PayloadType != 8 || pkts[8].Timestamp != start+480 {
+		t.Fatalf("audio resumes at %d, want %d after the event", pkts[8].Timestamp, start+480)
+	}
+}
+
+func TestBridgeTranscode(t *testing.T) {
+	// 20ms of PCMU become 30ms of G.722.
+	a, b := newTestLeg(20, pcmu), newTestLeg(30, g722)
+	newTestBridge(t, a, b)
+
+	ulaw := readSound(t, "demo-thanks.ulaw")
+	frames := len(ulaw) / 480 * 3
+	for i := 0; i < frames; i++ {
+		a.push(0, 1, uint16(i), 160*uint32(i), ulaw[160*i:160*(i+1)])
+	}
+	pkts := b.read(t, frames*2/3)
+
+	var wide []int16
+	dec := codec.G722.NewDecoder()
+	buf := make([]int16, 480)
+	for i, pkt := range pkts {
+		if pkt.PayloadType != 9 || len(pkt.Payload) != 240 {
+			t.Fatalf("packet %d has %d bytes of payload type %d, want 240 of G.722", i, len(pkt.Payload), pkt.PayloadType)
+		}
+		if i > 0 && (pkt.SequenceNumber != pkts[i-1].SequenceNumber+1 || pkt.Timestamp != pkts[i-1].Timestamp+240 || pkt.Marker) {
+			t.Fatalf("packet %d at %d/%d after %d/%d", i, pkt.SequenceNumber, pkt.Timestamp, pkts[i-1].SequenceNumber, pkts[i-1].Timestamp)
+		}
+		n, err := dec.Decode(buf, pkt.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wide = append(wide, buf[:n]...)
+	}
+	if !pkts[0].Marker {
+		t.Fatal("expected a marker on the first packet")
+	}
+
+	// Back at 8 kHz the audio is close to what was sent, delayed by both
+	// resamplers and G.722.
+	narrow := make([]int16, len(wide)/2+1)
+	n, _ := audio.NewResampler(16000, 8000).Resample(narrow, wide)
+	sent := make([]int16, n)
+	codec.PCMU.NewDecoder().Decode(sent, ulaw[:n])
+	if got := delayedSNR(sent, narrow[:n], 35, 160); got < 20 {
+		t.Fatalf("transcoded audio has SNR %.1f dB", got)
+	}
+}
+
+func TestBridgeLostFrame(t *testing.T) {
+	a, b := newTestLeg(20, pcmu), newTestLeg(20, pcma)
+	newTestBridge(t, a, b)
+
+	// A 400 Hz tone loses its fourth packet, which is concealed from the
+	// three before it.
+	tone := make([]int16, 5*160)
+	ulaw := make([]byte, len(tone))
+	for i := range tone {
+		tone[i] = int16(8000 * math.Sin(math.Pi*float64(i)/10))
+		ulaw[i] = codec.LinearToUlaw(tone[i])
+	}
+	for i := range 5 {
+		seq, ts := uint16(10+i), uint32(1600+160*i)
+		if i == 3 {
+			a.frames <- Frame{Lost: true, SequenceNumber: seq, Timestamp: ts}
+			continue
+		}
+		a.push(0, 1, seq, ts, ulaw[160*i:160*(i+1)])
+	}
+
+	pkts := b.read(t, 5)
+	for i := 1; i < 5; i++ {
+		if pkts[i].Timestamp != pkts[0].Timestamp+160*uint32(i) || pkts[i].Marker {
+			t.Fatalf("packet %d has timestamp %d, want %d", i, pkts[i].Timestamp, pkts[0].Timestamp+160*uint32(i))
+		}
+	}
+	got := make([]int16, 160)
+	codec.PCMA.NewDecoder().Decode(got, pkts[3].Payload)
+	if snr := delayedSNR(tone[3*160:4*160], got, 0, 0); snr < 20 {
+		t.Fatalf("lost frame concealed with SNR %.1f dB", snr)
+	}
+}
+
+func TestBridgeComfortNoise(t *testing.T) {
+	// The source goes silent with CN, which the other leg did not
+	// negotiate.
+	a, b := newTestLeg(20, pcmu, cn), newTestLeg(20, pcmu)
+	newTestBridge(t, a, b)
+
+	voice := bytes.Repeat([]byte{0x55}, 160)
+	a.push(0, 1, 1, 160, voice)
+	a.push(13, 1, 2, 320, []byte{40})
+	pkts := b.read(t, 5)
+	pcm := make([]int16, 160)
+	for i, pkt := range pkts[1:] {
+		if pkt.PayloadType != 0 || pkt.Timestamp != pkts[0].Timestamp+160*uint32(i+1) {
+			t.Fatalf("noise packet %d of payload type %d at %d after %d", i, pkt.PayloadType, pkt.Timestamp, pkts[0].Timestamp)
+		}
+		codec.PCMU.NewDecoder().Decode(pcm, pkt.Payload)
+		if level := audio.Level(pcm); math.Abs(level+40) > 2 {
+			t.Fatalf("noise at %.1f dBFS, want -40", level)
+		}
+	}
+
+	// Audio stops the noise.
+	a.push(0, 1, 3, 16000, voice)
+	for i := 0; ; i++ {
+		pkt := b.read(t, 1)[0]
+		if bytes.Equal(pkt.Payload, voice) {
+			if !pkt.Marker {
+				t.Fatal("expected a marker where audio resumes")
+			}
+			break
+		}
+		if i == 2 {
+			t.Fatal("noise goes on after audio resumed")
+		}
+	}
+	select {
+	case pkt := <-b.written:
+		t.Fatalf("unexpected packet of payload type %d after audio resumed", pkt.PayloadType)
+	case <-time.After(60 * time.Millisecond):
+	}
+}
+
+func TestBridgeComfortNoiseRelay(t *testing.T) {
+	a, b := newTestLeg(20, pcmu, cn), newTestLeg(20, pcmu, Codec{PayloadType: 98, Name: "CN", ClockRate: 8000})
+	newTestBridge(t, a, b)
+
+	a.push(0, 1, 1, 160, bytes.Repeat([]byte{0x55}, 160))
+	a.push(13, 1, 2, 320, []byte{40, 0x80})
+	pkts := b.read(t, 2)
+	if pkts[1].PayloadType != 98 || !bytes.Equal(pkts[1].Payload, []byte{40, 0x80}) || pkts[1].Timestamp != pkts[0].Timestamp+160 {
+		t.Fatalf("CN relayed as %+v", pkts[1])
+	}
+}
+
+func TestBridgeSilenceSuppression(t *testing.T) {
+	// What is transcoded for a leg that takes CN goes through the VAD.
+	a, b := newTestLeg(20, pcmu), newTestLeg(20, pcma, cn)
+	newTestBridge(t, a, b)
+
+	speech := make([]byte, 160)
+	for i := range speech {
+		speech[i] = codec.LinearToUlaw(int16(8000 * math.Sin(float64(i)/4)))
+	}
+	silence := bytes.Repeat([]byte{codec.LinearToUlaw(0)}, 160)
+	seq := uint16(0)
+	push := func(payload []byte, n int) {
+		for i := 0; i < n; i++ {
+			a.push(0, 1, seq, 160*uint32(seq), payload)
+			seq++
+		}
+	}
+	push(speech, 10)
+	push(silence, 50)
+	push(speech, 1)
+
+	var voice int
+	var cnPkt *rtp.Packet
+	for cnPkt == nil {
+		pkt := b.read(t, 1)[0]
+		switch pkt.PayloadType {
+		case 8:
+			voice++
+		case 13:
+			cnPkt = pkt
+		}
+		if voice > 30 {
+			t.Fatal("silence was not suppressed")
+		}
+	}
+	// The hangover keeps 300ms after the speech.
+	if voice != 25 {
+		t.Fatalf("%d frames before CN, want 25", voice)
+	}
+	if len(cnPkt.Payload) != 1 || cnPkt.Payload[0] < 60 || cnPkt.Marker {
+		t.Fatalf("CN %x with marker %v, want a low level", cnPkt.Payload, cnPkt.Marker)
+	}
+	pkt := b.read(t, 1)[0]
+	if pkt.PayloadType != 8 || !pkt.Marker || pkt.SequenceNumber != cnPkt.SequenceNumber+1 || int32(pkt.Timestamp-cnPkt.Timestamp) <= 0 {
+		t.Fatalf("speech resumes with %+v after CN %+v", pkt.Header, cnPkt.Header)
+	}
+}
+
+func TestBridgeRelaySilenceSuppression(t *testing.T) {
+	// Relayed audio is decoded for the VAD of a leg that takes CN.
+	a, b := newTestLeg(20, pcmu), newTestLeg(20, pcmu, cn)
+	newTestBridge(t, a, b)
+
+	speech := make([]byte, 160)
+	for i := range speech {
+		speech[i] = codec.LinearToUlaw(int16(8000 * math.Sin(float64(i)/4)))
+	}
+	silence := bytes.Repeat([]byte{codec.LinearToUlaw(0)}, 160)
+	for i := range 61 {
+		payload := silence
+		if i < 10 || i == 60 {
+			payload = speech
+		}
+		a.push(0, 1, uint16(i), 160*uint32(i), payload)
+	}
+
+	var voice int
+	var cnPkt *rtp.Packet
+	for cnPkt == nil {
+		pkt := b.read(t, 1)[0]
+		switch pkt.PayloadType {
+		case 0:
+			voice++
+		case 13:
+			cnPkt = pkt
+		}
+		if voice > 30 {
+			t.Fatal("relayed silence was not suppressed")
+		}
+	}
+	if voice != 25 {
+		t.Fatalf("%d frames before CN, want 25", voice)
+	}
+	pkt := b.read(t, 1)[0]
+	if pkt.PayloadType != 0 || !bytes.Equal(pkt.Payload, speech) || !pkt.Marker || pkt.SequenceNumber != cnPkt.SequenceNumber+1 {
+		t.Fatalf("speech resumes with %+v after CN %+v", pkt.Header, cnPkt.Header)
+	}
+}
+
+func TestBridgeNoTranscoder(t *testing.T) {
+	a, b := newTestLeg(20, g729), newTestLeg(20, pcmu)
+	if _, err := NewBridge(logger.NewLogger(), a, b); !errors.Is(err, ErrNoTranscoder) {
+		t.Fatalf("expected ErrNoTranscoder, got %v", err)
+	}
+}
+
+func TestBridgeOpusParams(t *testing.T) {
+	// The Opus leg asked for 40ms at least, and a bitrate cap.
+	fmtp := "minptime=40;maxaveragebitrate=16000"
+	opus := paramCodec{fmtp: make(chan string, 2)}
+	a := newTestLeg(20, pcmu)
+	b := newTestLeg(20, Codec{PayloadType: 96, Name: "opus", ClockRate: 48000, Channels: 2, RemoteFmtp: fmtp})
+	br, err := newBridge(logger.NewLogger(), a, b, codec.NewRegistry(codec.PCMU, opus))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		br.Close()
+		a.Close()
+		b.Close()
+	})
+	if got := <-opus.fmtp; got != fmtp {
+		t.Fatalf("encoder made for fmtp %q, want %q", got, fmtp)
+	}
+
+	silence := bytes.Repeat([]byte{codec.LinearToUlaw(0)}, 160)
+	for i := range 6 {
+		a.push(0, 1, uint16(i), 160*uint32(i), silence)
+	}
+	pkts := b.read(t, 2)
+	if pkts[0].PayloadType != 96 || len(pkts[0].Payload) != 40 || pkts[1].Timestamp-pkts[0].Timestamp != 1920 {
+		t.Fatalf("sent %d bytes of payload type %d, %d apart; want 40ms frames of 96", len(pkts[0].Payload), pkts[0].PayloadType, pkts[1].Timestamp-pkts[0].Timestamp)
+	}
+}
+
+func TestBridgeOpusPtime(t *testing.T) {
+	// Opus has no 30ms frames, so 40ms ones are sent.
+	opus := paramCodec{fmtp: make(chan string, 2)}
+	a := newTestLeg(20, pcmu)
+	b := newTestLeg(30, Codec{PayloadType: 111, Name: "opus", ClockRate: 48000, Channels: 2})
+	br, err := newBridge(logger.NewLogger(), a, b, codec.NewRegistry(codec.PCMU, opus))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		br.Close()
+		a.Close()
+		b.Close()
+	})
+
+	silence := bytes.Repeat([]byte{codec.LinearToUlaw(0)}, 160)
+	for i := range 6 {
+		a.push(0, 1, uint16(i), 160*uint32(i), silence)
+	}
+	pkts := b.read(t, 2)
+	if len(pkts[0].Payload) != 40 || pkts[1].Timestamp-pkts[0].Timestamp != 1920 {
+		t.Fatalf("sent %d bytes, %d apart; want 40ms frames", len(pkts[0].Payload), pkts[1].Timestamp-pkts[0].Timestamp)
+	}
+}
+
+// paramCodec stands in for Opus, telling what fmtp its encoders are made
+// for. They encode a byte per millisecond.
+type paramCodec struct{ fmtp chan string }
+
+func (c paramCodec) Info() codec.Info {
+	return codec.Info{Name: "opus", PayloadType: 111, ClockRate: 48000, SampleRate: 48000, Channels: 2}
+}
+func (c paramCodec) NewEncoder() codec.Encoder { return c.NewEncoderFor("") }
+func (c paramCodec) NewDecoder() codec.Decoder { return nil }
+
+func (c paramCodec) NewEncoderFor(fmtp string) codec.Encoder {
+	c.fmtp <- fmtp
+	return msEncoder{}
+}
+
+type msEncoder struct{}
+
+func (msEncoder) Encode(dst []byte, pcm []int16) (int, error) { return len(pcm) / 48, nil }
+
+// delayedSNR returns the SNR of got against want delayed by delay samples,
+// in dB, skipping the first skip samples.
+func delayedSNR(want, got []int16, delay, skip int) float64 {
+	var signal, noise float64
+	for i := skip; i+delay < len(got) && i < len(want); i++ {
+		d := float64(got[i+delay]) - float64(want[i])
+		signal += float64(want[i]) * float64(want[i])
+		noise += d * d
+	}
+	return 10 * math.Log10(signal/noise)
+}
+
+// BenchmarkBridge runs 500 bridged calls, each leg receiving b.N frames of
+// 20ms as fast as they are forwarded. x-realtime is how many times faster
+// than real time the audio of all calls was forwarded. The legs are stubs,
+// so this is the cost of the bridge alone; BenchmarkBridgeUDP measures calls
+// over sockets.
+func BenchmarkBridge(b *testing.B) {
+	const calls = 500
+	ulaw := make([]byte, 160)
+	for i := range ulaw {
+		ulaw[i] = codec.LinearToUlaw(int16(8000 * math.Sin(float64(i)/4)))
+	}
+	g722Payload := make([]byte, 160)
+	codec.G722.NewEncoder().Encode(g722Payload, make([]int16, 320))
+
+	for _, bc := range []struct {
+		name           string
+		a, b           Codec
+		aPtime, bPtime int
+		bPayload       []byte
+	}{
+		{"relay", pcmu, pcmu, 20, 20, ulaw},
+		{"ptime", pcmu, pcmu, 20, 30, ulaw},
+		{"PCMA", pcmu, pcma, 20, 20, ulaw},
+		{"G722", pcmu, g722, 20, 20, g722Payload},
+	} {
+		b.Run(fmt.Sprintf("%s/%d", bc.name, calls), func(b *testing.B) {
+			var wg sync.WaitGroup
+			legs := make([]*testLeg, 0, 2*calls)
+			for i := 0; i < calls; i++ {
+				a, c := newTestLeg(bc.aPtime, bc.a), newTestLeg(bc.bPtime, bc.b)
+				a.written, c.written = nil, nil
+				a.source = frameSource(b.N, bc.a.PayloadType, ulaw)
+				c.source = frameSource(b.N, bc.b.PayloadType, bc.bPayload)
+				legs = append(legs, a, c)
+			}
+			wg.Add(len(legs))
+			for _, l := range legs {
+				l.drained = wg.Done
+			}
+
+			b.ResetTimer()
+			for i := 0; i < len(legs); i += 2 {
+				newTestBridge(b, legs[i], legs[i+1])
+			}
+			wg.Wait()
+			b.StopTimer()
+			b.ReportMetric(float64(b.N)*0.02/b.Elapsed().Seconds(), "x-realtime")
+		})
+	}
+}
+
+// frameSource returns a source of n frames of payload.
+func frameSource(n int, pt uint8, payload []byte) func() (Frame, bool) {
+	i := 0
+	return func() (Frame, bool) {
+		if i == n {
+			return Frame{}, false
+		}
+		pkt := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: pt, SequenceNumber: uint16(i), Timestamp: 160 * uint32(i), SSRC: 1}, Payload: payload}
+		i++
+		return Frame{Packet: pkt, SequenceNumber: pkt.SequenceNumber, Timestamp: pkt.Timestamp}, true
+	}
+}
@@ -0,0 +1,283 @@
+//go:build unix
+
+package media
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/itzmanish/sipnexus/pkg/codec"
+	"github.com/itzmanish/sipnexus/pkg/logger"
+	"github.com/pion/rtp"
+)
+
+// BenchmarkBridgeUDP bridges 100 and 500 calls between UDPMediaEngines,
+// each leg talking over loopback to a socket standing in for a phone that
+// sends 20ms of audio every 20ms. An op is 20ms of every call. Unlike
+// BenchmarkBridge it runs in real time and counts what the sockets and the
+// jitter buffers cost as well. The phones run in a child process, so the
+// CPU time of this one is what the bridges took.
+//
+// x-realtime is how many times the CPUs available could carry the calls:
+// the audio forwarded over the CPU time it took, times GOMAXPROCS. Frames
+// not forwarded in time do not count; forwarded-% is the share that was.
+// cpu-%/call is the share of one CPU a call takes. They are reported rather
+// than checked, as they depend on the machine.
+func BenchmarkBridgeUDP(b *testing.B) {
+	ulaw := make([]byte, 160)
+	for i := range ulaw {
+		ulaw[i] = codec.LinearToUlaw(int16(8000 * math.Sin(float64(i)/4)))
+	}
+	g722Payload := make([]byte, 160)
+	codec.G722.NewEncoder().Encode(g722Payload, make([]int16, 320))
+
+	for _, bc := range []struct {
+		name     string
+		a, b     Codec
+		bPayload []byte
+	}{
+		{"relay", pcmu, pcmu, ulaw},
+		{"PCMA", pcmu, pcma, ulaw},
+		{"G722", pcmu, g722, g722Payload},
+	} {
+		for _, calls := range []int{100, 500} {
+			b.Run(fmt.Sprintf("%s/%d", bc.name, calls), func(b *testing.B) {
+				ports, err := NewPortAllocator(40000, 40000+8*calls)
+				if err != nil {
+					b.Fatal(err)
+				}
+				phones := startPhones(b, 2*calls)
+				var engines []*UDPMediaEngine
+				for i := 0; i < calls; i++ {
+					a := newPhoneEngine(b, ports, phones.ports[2*i], bc.a)
+					c := newPhoneEngine(b, ports, phones.ports[2*i+1], bc.b)
+					newBridgeOf(b, a, c)
+					phones.call(b, a, bc.a, ulaw)
+					phones.call(b, c, bc.b, bc.bPayload)
+					engines = append(engines, a, c)
+				}
+				phones.start(b)
+
+				// The jitter buffers fill before the clock starts.
+				time.Sleep(200 * time.Millisecond)
+				b.ResetTimer()
+				start, forwarded := cpuTime(b), sentFrames(engines)
+				audio := time.Duration(b.N) * 20 * time.Millisecond
+				time.Sleep(audio)
+				cpu := cpuTime(b) - start
+				forwarded = sentFrames(engines) - forwarded
+				b.StopTimer()
+				// Overloaded engines would take long to close under traffic.
+				phones.stop()
+
+				kept := min(float64(forwarded)/float64(b.N*len(engines)), 1)
+				b.ReportMetric(kept*float64(runtime.GOMAXPROCS(0))*audio.Seconds()/cpu.Seconds(), "x-realtime")
+				b.ReportMetric(100*kept, "forwarded-%")
+				b.ReportMetric(100*cpu.Seconds()/audio.Seconds()/float64(calls), "cpu-%/call")
+			})
+		}
+	}
+}
+
+// phoneProcess runs the phones of BenchmarkBridgeUDP in a child process,
+// TestHelperUDPPhones. Each phone is a socket, at ports, that is told the
+// engine to send to and then sends a frame every 20ms until stdin closes.
+// What the engines send back is read and dropped.
+type phoneProcess struct {
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	ports    []int
+	stopOnce sync.Once
+}
+
+func startPhones(b *testing.B, n int) *phoneProcess {
+	b.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperUDPPhones$")
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", phonesEnv, n))
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		b.Fatal(err)
+	}
+	p := &phoneProcess{cmd: cmd, stdin: stdin}
+	b.Cleanup(p.stop)
+	lines := bufio.NewScanner(stdout)
+	for len(p.ports) < n && lines.Scan() {
+		port, err := strconv.Atoi(lines.Text())
+		if err != nil {
+			b.Fatalf("phones: %s", lines.Text())
+		}
+		p.ports = append(p.ports, port)
+	}
+	if len(p.ports) < n {
+		b.Fatalf("phones opened %d of %d sockets", len(p.ports), n)
+	}
+	go io.Copy(io.Discard, stdout)
+	return p
+}
+
+// call tells the next phone to send payload of c to engine.
+func (p *phoneProcess) call(b *testing.B, engine *UDPMediaEngine, c Codec, payload []byte) {
+	b.Helper()
+	if _, err := fmt.Fprintf(p.stdin, "%d %d %x\n", engine.LocalAddr().Port, c.PayloadType, payload); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// start tells the phones to send.
+func (p *phoneProcess) start(b *testing.B) {
+	b.Helper()
+	if _, err := fmt.Fprintln(p.stdin, "start"); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// stop ends the phones.
+func (p *phoneProcess) stop() {
+	p.stopOnce.Do(func() {
+		p.stdin.Close()
+		p.cmd.Wait()
+	})
+}
+
+// phonesEnv holds the number of phones TestHelperUDPPhones runs.
+const phonesEnv = "SIPNEXUS_UDP_PHONES"
+
+// TestHelperUDPPhones is the child process of phoneProcess.
+func TestHelperUDPPhones(t *testing.T) {
+	n, err := strconv.Atoi(os.Getenv(phonesEnv))
+	if err != nil {
+		t.Skip("runs the phones of BenchmarkBridgeUDP")
+	}
+	conns := make([]*net.UDPConn, n)
+	for i := range conns {
+		if conns[i], err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+			t.Fatal(err)
+		}
+		defer conns[i].Close()
+		fmt.Println(conns[i].LocalAddr().(*net.UDPAddr).Port)
+		go func(conn *net.UDPConn) {
+			buf := make([]byte, 1500)
+			for {
+				if _, err := conn.Read(buf); err != nil {
+					return
+				}
+			}
+		}(conns[i])
+	}
+
+	lines := bufio.NewScanner(os.Stdin)
+	var phones []*udpPhone
+	for lines.Scan() && lines.Text() != "start" {
+		var port int
+		var pt uint8
+		var payload []byte
+		if _, err := fmt.Sscanf(lines.Text(), "%d %d %x", &port, &pt, &payload); err != nil {
+			t.Fatal(err)
+		}
+		phones = append(phones, newUDPPhone(t, conns[len(phones)], &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, pt, payload))
+	}
+	stop := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, os.Stdin)
+		close(stop)
+	}()
+	tick := time.NewTicker(20 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-stop:
+			return
+		}
+		for _, p := range phones {
+			if err := p.send(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// udpPhone sends a frame of payload at a time from conn to an engine.
+type udpPhone struct {
+	conn   *net.UDPConn
+	to     *net.UDPAddr
+	packet []byte
+}
+
+func newUDPPhone(t *testing.T, conn *net.UDPConn, to *net.UDPAddr, pt uint8, payload []byte) *udpPhone {
+	t.Helper()
+	pkt := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: pt, SSRC: rand.Uint32()}, Payload: payload}
+	packet, err := pkt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &udpPhone{conn: conn, to: to, packet: packet}
+}
+
+// send sends the next frame of 20ms, numbering it in place.
+func (p *udpPhone) send() error {
+	binary.BigEndian.PutUint16(p.packet[2:], binary.BigEndian.Uint16(p.packet[2:])+1)
+	binary.BigEndian.PutUint32(p.packet[4:], binary.BigEndian.Uint32(p.packet[4:])+160)
+	_, err := p.conn.WriteToUDP(p.packet, p.to)
+	return err
+}
+
+// newPhoneEngine returns an engine that negotiated c with the phone at port.
+func newPhoneEngine(b *testing.B, ports *PortAllocator, port int, c Codec) *UDPMediaEngine {
+	b.Helper()
+	engine := NewUDPMediaEngine(logger.NewLogger(), ports, Interface{BindIP: net.IPv4(127, 0, 0, 1), Codecs: RegistryCodecs(codec.Default)}).(*UDPMediaEngine)
+	b.Cleanup(func() { engine.Close() })
+	offer := sdpOf("c=IN IP4 127.0.0.1", fmt.Sprintf("m=audio %d RTP/AVP %d", port, c.PayloadType), "a=rtpmap:"+c.rtpmap())
+	if _, err := engine.SetOffer(offer); err != nil {
+		b.Fatal(err)
+	}
+	return engine
+}
+
+// sentFrames returns how many frames engines sent their phones.
+func sentFrames(engines []*UDPMediaEngine) int {
+	var n int
+	for _, e := range engines {
+		n += int(e.Stats().PacketsSent)
+	}
+	return n
+}
+
+func newBridgeOf(b *testing.B, x, y MediaEngine) {
+	b.Helper()
+	br, err := NewBridge(logger.NewLogger(), x, y)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { br.Close() })
+}
+
+// cpuTime returns the CPU time the process used so far.
+func cpuTime(b *testing.B) time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
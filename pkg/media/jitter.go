@@ -0,0 +1,291 @@
+package media
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Defaults for JitterBufferConfig.
+const (
+	DefaultJitterMinDelay = 20 * time.Millisecond
+	DefaultJitterMaxDelay = 200 * time.Millisecond
+)
+
+// JitterBufferConfig bounds the playout delay of a JitterBuffer.
+type JitterBufferConfig struct {
+	// ClockRate is the RTP clock rate of the stream. Defaults to 8000.
+	ClockRate uint32
+	// MinDelay and MaxDelay bound how long packets are held. The delay
+	// adapts between them to the measured jitter.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// Capacity bounds the packets held; the oldest is dropped beyond it and
+	// played as lost. Defaults to rtpBufferSize.
+	Capacity int
+}
+
+// Frame is the next packet in playout order, or the gap a lost packet left.
+type Frame struct {
+	// Packet is nil when Lost is set.
+	Packet *rtp.Packet
+	// Lost is set for a packet that did not arrive in time, so that the
+	// consumer can conceal it.
+	Lost           bool
+	SequenceNumber uint16
+	// Timestamp is the one of Packet, or an estimate for lost packets.
+	Timestamp uint32
+	// Next is the packet after a lost one when it already arrived, so that
+	// the consumer can recover the loss from in-band FEC. It stays
+	// buffered and is returned again on its turn.
+	Next *rtp.Packet
+}
+
+// JitterBufferStats count what a JitterBuffer did so far.
+type JitterBufferStats struct {
+	// Delay is the current playout delay and Jitter the interarrival jitter
+	// it adapts to.
+	Delay  time.Duration
+	Jitter time.Duration
+	// Lost counts gaps signalled, Late packets that arrived after their
+	// slot was played and Dropped packets discarded for lack of room, whose
+	// slots are signalled as gaps too.
+	Lost, Late, Dropped uint64
+	Buffered            int
+}
+
+type bufferedPacket struct {
+	seq int64 // extended sequence number
+	ts  int64 // extended timestamp
+	pkt *rtp.Packet
+}
+
+// JitterBuffer reorders received RTP packets by sequence number and releases
+// them at their playout time, a delay after their arrival that adapts to the
+// measured jitter. Packets arriving after their turn are dropped; turns of
+// packets that never arrived are signalled as lost frames. A packet from
+// another SSRC starts the buffer over, as the sender changed.
+//
+// Sequence numbers and timestamps are extended to 64 bits so that both wrap
+// transparently. The delay grows at once when packets come late and shrinks
+// only at the start of a talkspurt, where a change is not heard.
+//
+// All methods take the current time so the buffer can be driven by a
+// simulated clock.
+type JitterBuffer struct {
+	cfg JitterBufferConfig
+
+	mu      sync.Mutex
+	packets []bufferedPacket // sorted by seq
+	started bool
+	ssrc    uint32
+	next    int64 // seq of the next frame to play
+	highSeq int64 // highest seq received
+	highTS  int64 // timestamp of highSeq
+	lastTS  int64 // timestamp of the last frame played
+	tsStep  int64 // timestamp increment per packet, for lost ones
+
+	// Playout of timestamp ts is at base + (ts-baseTS)/clock.
+	base   time.Time
+	baseTS int64
+	delay  time.Duration
+
+	jitter      float64 // seconds
+	transit     time.Duration
+	haveTransit bool
+
+	lost, late, dropped uint64
+}
+
+// NewJitterBuffer returns an empty buffer.
+func NewJitterBuffer(cfg JitterBufferConfig) *JitterBuffer {
+	if cfg.ClockRate == 0 {
+		cfg.ClockRate = 8000
+	}
+	if cfg.MinDelay <= 0 {
+		cfg.MinDelay = DefaultJitterMinDelay
+	}
+	if cfg.MaxDelay < cfg.MinDelay {
+		cfg.MaxDelay = max(DefaultJitterMaxDelay, cfg.MinDelay)
+	}
+	if cfg.Capacity <= 0 {
+		cfg.Capacity = rtpBufferSize
+	}
+	return &JitterBuffer{cfg: cfg, delay: cfg.MinDelay}
+}
+
+// Push adds a packet that arrived at now.
+func (jb *JitterBuffer) Push(pkt *rtp.Packet, now time.Time) {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+
+	if !jb.started || pkt.SSRC != jb.ssrc {
+		jb.restart(pkt, now)
+		return
+	}
+	seq := jb.highSeq + int64(int16(pkt.SequenceNumber-uint16(jb.highSeq)))
+	ts := jb.highTS + int64(int32(pkt.Timestamp-uint32(jb.highTS)))
+	if d := seq - jb.highSeq; d > maxDropout || d < -maxDropout {
+		// The sender restarted its sequence.
+		jb.restart(pkt, now)
+		return
+	}
+	jb.measure(ts, now)
+
+	if seq < jb.next {
+		jb.late++
+		// Make room for packets this late from now on.
+		if late := now.Sub(jb.playout(ts)); late > 0 {
+			jb.setDelay(jb.delay + late)
+		}
+		return
+	}
+	i := sort.Search(len(jb.packets), func(i int) bool { return jb.packets[i].seq >= seq })
+	if i < len(jb.packets) && jb.packets[i].seq == seq {
+		return // duplicate
+	}
+	if seq > jb.highSeq {
+		if seq == jb.highSeq+1 {
+			jb.tsStep = ts - jb.highTS
+		}
+		jb.highSeq, jb.highTS = seq, ts
+	}
+
+	// A talkspurt starting on an empty buffer is where the delay may
+	// shrink to the target.
+	if pkt.Marker && len(jb.packets) == 0 && seq == jb.next {
+		jb.sync(ts, now, jb.target())
+	}
+
+	jb.packets = append(jb.packets, bufferedPacket{})
+	copy(jb.packets[i+1:], jb.packets[i:])
+	jb.packets[i] = bufferedPacket{seq: seq, ts: ts, pkt: pkt}
+
+	// The turns up to the dropped packet are still played, as gaps.
+	if len(jb.packets) > jb.cfg.Capacity {
+		jb.packets = jb.packets[1:]
+		jb.dropped++
+	}
+}
+
+// Pop returns the next frame if it is due at now: the next packet in
+// sequence once its playout time came, or a lost frame when that packet is
+// missing and its playout time passed.
+func (jb *JitterBuffer) Pop(now time.Time) (Frame, bool) {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+
+	due, ok := jb.due()
+	if !ok || now.Before(due) {
+		return Frame{}, false
+	}
+	head := jb.packets[0]
+	if head.seq == jb.next {
+		jb.packets = jb.packets[1:]
+		jb.next++
+		jb.lastTS = head.ts
+		return Frame{Packet: head.pkt, SequenceNumber: head.pkt.SequenceNumber, Timestamp: head.pkt.Timestamp}, true
+	}
+
+	ts := jb.missingTS(head)
+	f := Frame{Lost: true, SequenceNumber: uint16(jb.next), Timestamp: uint32(ts)}
+	jb.next++
+	jb.lastTS = ts
+	jb.lost++
+	if head.seq == jb.next {
+		f.Next = head.pkt
+	}
+	return f, true
+}
+
+// Next returns when the next frame is due, or false while nothing is
+// buffered.
+func (jb *JitterBuffer) Next() (time.Time, bool) {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+	return jb.due()
+}
+
+// Stats returns the counters of the buffer.
+func (jb *JitterBuffer) Stats() JitterBufferStats {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+	return JitterBufferStats{
+		Delay:    jb.delay,
+		Jitter:   time.Duration(jb.jitter * float64(time.Second)),
+		Lost:     jb.lost,
+		Late:     jb.late,
+		Dropped:  jb.dropped,
+		Buffered: len(jb.packets),
+	}
+}
+
+func (jb *JitterBuffer) due() (time.Time, bool) {
+	if len(jb.packets) == 0 {
+		return time.Time{}, false
+	}
+	head := jb.packets[0]
+	if head.seq == jb.next {
+		return jb.playout(head.ts), true
+	}
+	return jb.playout(jb.missingTS(head)), true
+}
+
+// missingTS estimates the timestamp of the next packet, which is missing, by
+// spreading the timestamps between the last played packet and head evenly.
+func (jb *JitterBuffer) missingTS(head bufferedPacket) int64 {
+	return jb.lastTS + (head.ts-jb.lastTS)/(head.seq-jb.next+1)
+}
+
+func (jb *JitterBuffer) restart(pkt *rtp.Packet, now time.Time) {
+	seq := int64(pkt.SequenceNumber)
+	ts := int64(pkt.Timestamp)
+	jb.started = true
+	jb.ssrc = pkt.SSRC
+	jb.packets = append(jb.packets[:0], bufferedPacket{seq: seq, ts: ts, pkt: pkt})
+	jb.next, jb.highSeq, jb.highTS = seq, seq, ts
+	jb.lastTS = ts - jb.tsStep
+	jb.sync(ts, now, jb.delay)
+}
+
+// sync maps timestamp ts to play delay after now.
+func (jb *JitterBuffer) sync(ts int64, now time.Time, delay time.Duration) {
+	jb.base, jb.baseTS, jb.delay = now.Add(delay), ts, delay
+	// Transit is measured against the mapping, so it starts over.
+	jb.haveTransit = false
+}
+
+// setDelay changes the delay, moving playout of everything not yet played.
+func (jb *JitterBuffer) setDelay(delay time.Duration) {
+	delay = min(max(delay, jb.cfg.MinDelay), jb.cfg.MaxDelay)
+	jb.base = jb.base.Add(delay - jb.delay)
+	jb.delay = delay
+	jb.haveTransit = false
+}
+
+func (jb *JitterBuffer) playout(ts int64) time.Time {
+	return jb.base.Add(time.Duration((ts - jb.baseTS) * int64(time.Second) / int64(jb.cfg.ClockRate)))
+}
+
+// measure updates the interarrival jitter (RFC 3550 section 6.4.1) with a
+// packet of timestamp ts arriving at now.
+func (jb *JitterBuffer) measure(ts int64, now time.Time) {
+	transit := now.Sub(jb.base) - time.Duration((ts-jb.baseTS)*int64(time.Second)/int64(jb.cfg.ClockRate))
+	if jb.haveTransit {
+		d := (transit - jb.transit).Seconds()
+		if d < 0 {
+			d = -d
+		}
+		jb.jitter += (d - jb.jitter) / 16
+	}
+	jb.transit, jb.haveTransit = transit, true
+}
+
+// target is the delay the buffer aims for: four times the mean jitter
+// covers nearly all of the arrival spread.
+func (jb *JitterBuffer) target() time.Duration {
+	d := time.Duration(4 * jb.jitter * float64(time.Second))
+	return min(max(d, jb.cfg.MinDelay), jb.cfg.MaxDelay)
+}
@@ -0,0 +1,270 @@
+package media
+
+import (
+	"math/rand/v2"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// arrival is a packet as delivered by the simulated network.
+type arrival struct {
+	at  time.Time
+	pkt *rtp.Packet
+}
+
+// simNetwork sends count 20ms PCMU packets starting at seq and ts and
+// returns them in arrival order. Each packet is delayed by a base of 40ms
+// plus a random jitter of up to jitter, and lost with probability loss.
+// The random source is seeded so that runs are repeatable.
+func simNetwork(start time.Time, seq uint16, ts uint32, count int, jitter time.Duration, loss float64, seed uint64) (arrivals []arrival, sent []bool) {
+	rng := rand.New(rand.NewPCG(seed, seed))
+	sent = make([]bool, count)
+	for i := 0; i < count; i++ {
+		if rng.Float64() < loss {
+			continue
+		}
+		sent[i] = true
+		delay := 40 * time.Millisecond
+		if jitter > 0 {
+			delay += time.Duration(rng.Int64N(int64(jitter)))
+		}
+		arrivals = append(arrivals, arrival{
+			at: start.Add(time.Duration(i)*20*time.Millisecond + delay),
+			pkt: &rtp.Packet{Header: rtp.Header{
+				Marker:         i == 0,
+				SequenceNumber: seq + uint16(i),
+				Timestamp:      ts + uint32(160*i),
+			}},
+		})
+	}
+	sort.SliceStable(arrivals, func(i, j int) bool { return arrivals[i].at.Before(arrivals[j].at) })
+	return arrivals, sent
+}
+
+// playOut drives jb with the arrivals on a 1ms clock and returns the frames
+// it released with the time each was released at.
+func playOut(jb *JitterBuffer, arrivals []arrival) (frames []Frame, at []time.Time) {
+	now := arrivals[0].at
+	end := arrivals[len(arrivals)-1].at.Add(time.Second)
+	for ; now.Before(end); now = now.Add(time.Millisecond) {
+		for len(arrivals) > 0 && !arrivals[0].at.After(now) {
+			jb.Push(arrivals[0].pkt, arrivals[0].at)
+			arrivals = arrivals[1:]
+		}
+		for {
+			f, ok := jb.Pop(now)
+			if !ok {
+				break
+			}
+			frames = append(frames, f)
+			at = append(at, now)
+		}
+	}
+	return frames, at
+}
+
+func TestJitterBufferReorders(t *testing.T) {
+	tests := []struct {
+		name   string
+		seq    uint16
+		ts     uint32
+		jitter time.Duration
+		loss   float64
+	}{
+		{"steady", 1000, 5000, 0, 0},
+		{"reordering", 1000, 5000, 50 * time.Millisecond, 0},
+		{"lossy", 1000, 5000, 30 * time.Millisecond, 0.05},
+		{"wrapping", 65500, 0xffffff00, 30 * time.Millisecond, 0.02},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Unix(1700000000, 0)
+			arrivals, sent := simNetwork(start, tt.seq, tt.ts, 500, tt.jitter, tt.loss, 1)
+			jb := NewJitterBuffer(JitterBufferConfig{ClockRate: 8000, MaxDelay: 200 * time.Millisecond})
+			frames, at := playOut(jb, arrivals)
+
+			// The first packet to arrive starts playout; anything sent
+			// before it is late by definition.
+			first := int(arrivals[0].pkt.SequenceNumber - tt.seq)
+			if len(frames) != len(sent)-first {
+				t.Fatalf("expected %d frames, got %d", len(sent)-first, len(frames))
+			}
+			lost := 0
+			for i, f := range frames {
+				n := first + i
+				if f.SequenceNumber != tt.seq+uint16(n) {
+					t.Fatalf("frame %d: expected seq %d, got %d", i, tt.seq+uint16(n), f.SequenceNumber)
+				}
+				if f.Timestamp != tt.ts+uint32(160*n) {
+					t.Fatalf("frame %d: expected timestamp %d, got %d", i, tt.ts+uint32(160*n), f.Timestamp)
+				}
+				if f.Lost {
+					lost++
+					if sent[n] && jb.Stats().Late == 0 {
+						t.Fatalf("frame %d: packet was sent but reported lost without being late", i)
+					}
+					continue
+				}
+				if !sent[n] || f.Packet.SequenceNumber != f.SequenceNumber {
+					t.Fatalf("frame %d: unexpected packet %v", i, f.Packet)
+				}
+				// Playout is paced by timestamp once started.
+				if i > 0 {
+					if gap := at[i].Sub(at[i-1]); gap > 25*time.Millisecond && !frames[i-1].Lost {
+						if jb.Stats().Late == 0 {
+							t.Fatalf("frame %d: %s after the previous one", i, gap)
+						}
+					}
+				}
+			}
+			st := jb.Stats()
+			if uint64(lost) != st.Lost {
+				t.Fatalf("expected %d lost frames counted, got %+v", lost, st)
+			}
+			missing := 0
+			for _, ok := range sent[first:] {
+				if !ok {
+					missing++
+				}
+			}
+			if uint64(lost) != uint64(missing)+st.Late {
+				t.Fatalf("expected %d lost and %d late to make %d gaps, got %d", missing, st.Late, missing+int(st.Late), lost)
+			}
+			if tt.jitter == 0 && (lost != 0 || st.Jitter != 0 || st.Delay != DefaultJitterMinDelay) {
+				t.Fatalf("expected no loss, jitter or extra delay on a steady network, got %+v", st)
+			}
+		})
+	}
+}
+
+func TestJitterBufferAdapts(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	delayFor := func(jitter time.Duration) JitterBufferStats {
+		arrivals, _ := simNetwork(start, 0, 0, 500, jitter, 0, 2)
+		// Talkspurts of one second give the delay room to adapt.
+		for _, a := range arrivals {
+			a.pkt.Marker = a.pkt.SequenceNumber%50 == 0
+		}
+		jb := NewJitterBuffer(JitterBufferConfig{})
+		playOut(jb, arrivals)
+		return jb.Stats()
+	}
+	low, high := delayFor(5*time.Millisecond), delayFor(80*time.Millisecond)
+	if high.Jitter <= low.Jitter {
+		t.Fatalf("expected more jitter measured, got %s and %s", low.Jitter, high.Jitter)
+	}
+	if high.Delay <= low.Delay {
+		t.Fatalf("expected the delay to grow with jitter, got %s and %s", low.Delay, high.Delay)
+	}
+	if high.Delay > DefaultJitterMaxDelay {
+		t.Fatalf("delay %s exceeds the maximum", high.Delay)
+	}
+	// A buffer deep enough for the jitter rarely plays a gap for a late
+	// packet after the first talkspurts.
+	if high.Late > 25 {
+		t.Fatalf("expected the buffer to absorb the jitter, %d packets were late", high.Late)
+	}
+}
+
+func TestJitterBufferLatePacket(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	jb := NewJitterBuffer(JitterBufferConfig{MinDelay: 20 * time.Millisecond, MaxDelay: 100 * time.Millisecond})
+	pkt := func(seq uint16) *rtp.Packet {
+		return &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: uint32(seq) * 160}}
+	}
+	jb.Push(pkt(0), now)
+	jb.Push(pkt(2), now.Add(40*time.Millisecond))
+	if _, ok := jb.Pop(now.Add(19 * time.Millisecond)); ok {
+		t.Fatal("released before the playout delay")
+	}
+	if f, ok := jb.Pop(now.Add(20 * time.Millisecond)); !ok || f.Lost || f.SequenceNumber != 0 {
+		t.Fatalf("expected packet 0, got %+v", f)
+	}
+	if f, ok := jb.Pop(now.Add(40 * time.Millisecond)); !ok || !f.Lost || f.SequenceNumber != 1 || f.Timestamp != 160 {
+		t.Fatalf("expected a gap for packet 1, got %+v", f)
+	} else if f.Next == nil || f.Next.SequenceNumber != 2 {
+		t.Fatalf("expected the gap to carry packet 2 for FEC, got %+v", f.Next)
+	}
+	// Packet 1 shows up 50ms after it was due.
+	jb.Push(pkt(1), now.Add(90*time.Millisecond))
+	st := jb.Stats()
+	if st.Late != 1 || st.Delay != 70*time.Millisecond {
+		t.Fatalf("expected a late packet to grow the delay to 70ms, got %+v", st)
+	}
+	// The grown delay moves packet 2 from 60ms to 110ms.
+	if _, ok := jb.Pop(now.Add(100 * time.Millisecond)); ok {
+		t.Fatal("expected packet 2 to be held longer")
+	}
+	if f, ok := jb.Pop(now.Add(110 * time.Millisecond)); !ok || f.SequenceNumber != 2 {
+		t.Fatalf("expected packet 2, got %+v", f)
+	}
+
+	// Duplicates are dropped.
+	jb.Push(pkt(3), now.Add(120*time.Millisecond))
+	jb.Push(pkt(3), now.Add(121*time.Millisecond))
+	if st := jb.Stats(); st.Buffered != 1 {
+		t.Fatalf("expected the duplicate dropped, got %+v", st)
+	}
+}
+
+func TestJitterBufferOverflow(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	jb := NewJitterBuffer(JitterBufferConfig{Capacity: 3})
+	pkt := func(ssrc uint32, seq uint16) *rtp.Packet {
+		return &rtp.Packet{Header: rtp.Header{SSRC: ssrc, SequenceNumber: seq, Timestamp: uint32(seq) * 160}}
+	}
+	for _, seq := range []uint16{0, 2, 3, 4} {
+		jb.Push(pkt(1, seq), now)
+	}
+	if st := jb.Stats(); st.Dropped != 1 || st.Buffered != 3 {
+		t.Fatalf("expected packet 0 dropped, got %+v", st)
+	}
+	// Every turn is played, the dropped packet's and the missing one's as
+	// gaps.
+	for seq := uint16(0); seq <= 4; seq++ {
+		f, ok := jb.Pop(now.Add(time.Second))
+		if !ok || f.SequenceNumber != seq || f.Lost != (seq < 2) {
+			t.Fatalf("expected frame %d, got %+v", seq, f)
+		}
+	}
+
+	// Another source starts over at its own sequence.
+	jb.Push(pkt(1, 5), now.Add(time.Second))
+	jb.Push(pkt(2, 100), now.Add(time.Second))
+	if f, ok := jb.Pop(now.Add(2 * time.Second)); !ok || f.Lost || f.SequenceNumber != 100 {
+		t.Fatalf("expected packet 100 of the new source, got %+v", f)
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	peer, ume := newTestPeer(t, SendRecv)
+	for _, seq := range []uint16{10, 12, 11, 14} {
+		b, _ := (&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 160}}).Marshal()
+		peer.WriteToUDP(b, ume.LocalAddr())
+	}
+	for _, want := range []struct {
+		seq  uint16
+		lost bool
+	}{{10, false}, {11, false}, {12, false}, {13, true}, {14, false}} {
+		f, err := ume.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.SequenceNumber != want.seq || f.Lost != want.lost {
+			t.Fatalf("expected seq %d lost %v, got %+v", want.seq, want.lost, f)
+		}
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := ume.ReadFrame()
+		done <- err
+	}()
+	ume.Close()
+	if err := <-done; err != ErrEngineClosed {
+		t.Fatalf("expected ErrEngineClosed, got %v", err)
+	}
+}
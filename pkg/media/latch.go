@@ -0,0 +1,123 @@
+package media
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Defaults for SymmetricRTP.
+const (
+	DefaultRelatchPackets  = 5
+	DefaultRelatchInterval = 5 * time.Second
+)
+
+var (
+	rtpRelatches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sipnexus_rtp_relatches_total",
+		Help: "Times symmetric RTP moved a stream to a new remote address.",
+	})
+	rtpForeignPackets = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sipnexus_rtp_foreign_packets_total",
+		Help: "RTP packets dropped because they did not come from the latched address.",
+	})
+)
+
+// SymmetricRTP configures symmetric RTP (comedia): media is sent to the
+// address RTP is received from instead of the one in the SDP, which for
+// endpoints behind NAT is usually a private address.
+type SymmetricRTP struct {
+	Enabled bool
+	// RelatchPackets is how many consecutive packets of the latched source
+	// must arrive from a new address before media moves there.
+	RelatchPackets int
+	// RelatchInterval is the least time between two address changes, which
+	// keeps a third party from hijacking the stream by spraying packets.
+	RelatchInterval time.Duration
+}
+
+// latch learns the remote RTP address from received packets. The first
+// valid packet latches its source address and SSRC. Packets from other
+// addresses are dropped; one carrying the latched SSRC only takes over once
+// it has sent RelatchPackets in a row and RelatchInterval has passed since
+// the last change, as when a NAT binding of the peer changes.
+type latch struct {
+	cfg SymmetricRTP
+
+	mu   sync.Mutex
+	addr *net.UDPAddr // nil until the first packet
+	ssrc uint32
+	at   time.Time
+
+	candidate *net.UDPAddr
+	seen      int
+}
+
+func newLatch(cfg SymmetricRTP) *latch {
+	if cfg.RelatchPackets <= 0 {
+		cfg.RelatchPackets = DefaultRelatchPackets
+	}
+	if cfg.RelatchInterval <= 0 {
+		cfg.RelatchInterval = DefaultRelatchInterval
+	}
+	return &latch{cfg: cfg}
+}
+
+// reset forgets the latched address, as after a re-negotiation.
+func (l *latch) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.addr, l.candidate, l.seen = nil, nil, 0
+}
+
+// observe checks a valid packet with ssrc received from src at now. It
+// reports whether the packet is to be accepted and returns the address to
+// send to when it changed.
+func (l *latch) observe(src *net.UDPAddr, ssrc uint32, now time.Time) (accept bool, moved *net.UDPAddr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.addr == nil {
+		l.move(src, ssrc, now)
+		return true, l.addr
+	}
+	if sameAddr(l.addr, src) {
+		l.candidate, l.seen = nil, 0
+		return true, nil
+	}
+
+	if ssrc != l.ssrc {
+		return false, nil
+	}
+	if l.candidate == nil || !sameAddr(l.candidate, src) {
+		l.candidate, l.seen = src, 0
+	}
+	l.seen++
+	if l.seen < l.cfg.RelatchPackets || now.Sub(l.at) < l.cfg.RelatchInterval {
+		return false, nil
+	}
+	l.move(src, ssrc, now)
+	rtpRelatches.Inc()
+	return true, l.addr
+}
+
+// source returns the latched SSRC, or false before the first packet.
+func (l *latch) source() (uint32, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ssrc, l.addr != nil
+}
+
+func (l *latch) move(src *net.UDPAddr, ssrc uint32, now time.Time) {
+	l.addr = &net.UDPAddr{IP: append(net.IP(nil), src.IP...), Port: src.Port, Zone: src.Zone}
+	l.ssrc = ssrc
+	l.at = now
+	l.candidate, l.seen = nil, 0
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
@@ -0,0 +1,142 @@
+package media
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/itzmanish/sipnexus/pkg/logger"
+	"github.com/pion/rtp"
+)
+
+func TestLatch(t *testing.T) {
+	l := newLatch(SymmetricRTP{Enabled: true, RelatchPackets: 3, RelatchInterval: time.Second})
+	phone := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 4000}
+	rebound := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 4100}
+	attacker := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 66), Port: 4000}
+	start := time.Now()
+
+	steps := []struct {
+		name   string
+		src    *net.UDPAddr
+		ssrc   uint32
+		at     time.Duration
+		accept bool
+		moved  *net.UDPAddr
+	}{
+		{"first packet latches", phone, 1, 0, true, phone},
+		{"latched source", phone, 1, 10 * time.Millisecond, true, nil},
+		{"other SSRC elsewhere", attacker, 2, 20 * time.Millisecond, false, nil},
+		{"other SSRC elsewhere again", attacker, 2, 30 * time.Millisecond, false, nil},
+		{"other SSRC elsewhere thrice", attacker, 2, 40 * time.Millisecond, false, nil},
+		{"rebinding, 1st", rebound, 1, 50 * time.Millisecond, false, nil},
+		{"rebinding, 2nd", rebound, 1, 60 * time.Millisecond, false, nil},
+		{"rebinding too soon", rebound, 1, 70 * time.Millisecond, false, nil},
+		{"rebinding after the interval", rebound, 1, 2 * time.Second, true, rebound},
+		{"old address is foreign now", phone, 1, 2*time.Second + 10*time.Millisecond, false, nil},
+		{"new address", rebound, 1, 2*time.Second + 20*time.Millisecond, true, nil},
+		{"interrupted run, 1st", phone, 1, 4 * time.Second, false, nil},
+		{"interrupted run, 2nd", phone, 1, 4*time.Second + 10*time.Millisecond, false, nil},
+		{"latched source interrupts", rebound, 1, 4*time.Second + 20*time.Millisecond, true, nil},
+		{"run restarts", phone, 1, 4*time.Second + 30*time.Millisecond, false, nil},
+	}
+	for _, s := range steps {
+		accept, moved := l.observe(s.src, s.ssrc, start.Add(s.at))
+		if accept != s.accept {
+			t.Fatalf("%s: expected accept %v", s.name, s.accept)
+		}
+		if fmt.Sprint(moved) != fmt.Sprint(s.moved) {
+			t.Fatalf("%s: expected move to %v, got %v", s.name, s.moved, moved)
+		}
+	}
+
+	l.reset()
+	if accept, moved := l.observe(attacker, 2, start.Add(5*time.Second)); !accept || !sameAddr(moved, attacker) {
+		t.Fatal("expected to latch anew after reset")
+	}
+}
+
+func TestSymmetricRTP(t *testing.T) {
+	loopback := net.IPv4(127, 0, 0, 1)
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: loopback})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	// The SDP names an address the phone does not receive on, like a
+	// private address behind NAT.
+	advertised, phone, other := listen(), listen(), listen()
+
+	ports, _ := NewPortAllocator(34400, 34401)
+	ume := NewUDPMediaEngine(logger.NewLogger(), ports, Interface{
+		BindIP:       loopback,
+		SymmetricRTP: SymmetricRTP{Enabled: true, RelatchPackets: 2, RelatchInterval: time.Hour},
+	}).(*UDPMediaEngine)
+	defer ume.Close()
+	offer := sdpOf("c=IN IP4 127.0.0.1",
+		fmt.Sprintf("m=audio %d RTP/AVP 0", advertised.LocalAddr().(*net.UDPAddr).Port),
+		"a=rtpmap:0 PCMU/8000")
+	if _, err := ume.SetOffer(offer); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(from *net.UDPConn, pt uint8, ssrc uint32) {
+		b, _ := (&rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: pt, SSRC: ssrc}}).Marshal()
+		if _, err := from.WriteToUDP(b, ume.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectMedia := func(conn *net.UDPConn, want bool) {
+		t.Helper()
+		if err := ume.WriteSample(Sample{Data: make([]byte, 160)}); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err := conn.Read(make([]byte, 1500))
+		if want && err != nil {
+			t.Fatalf("expected media at %s: %v", conn.LocalAddr(), err)
+		}
+		if !want && err == nil {
+			t.Fatalf("unexpected media at %s", conn.LocalAddr())
+		}
+	}
+
+	// Before any RTP arrives media goes where the SDP says.
+	expectMedia(advertised, true)
+
+	// A payload type that was not negotiated does not latch.
+	send(phone, 96, 7)
+	send(phone, 0, 7)
+	if pkt, err := ume.ReadRTP(); err != nil || pkt.PayloadType != 0 {
+		t.Fatalf("expected the PCMU packet, got %v, %v", pkt, err)
+	}
+	expectMedia(phone, true)
+
+	// Another source cannot take over within the relatch interval.
+	send(other, 0, 7)
+	send(other, 0, 7)
+	send(phone, 0, 7)
+	if pkt, err := ume.ReadRTP(); err != nil || pkt.SSRC != 7 {
+		t.Fatalf("expected the phone's packet, got %v, %v", pkt, err)
+	}
+	select {
+	case pkt := <-ume.packets:
+		t.Fatalf("unexpected packet %v", pkt)
+	default:
+	}
+	expectMedia(phone, true)
+	expectMedia(other, false)
+
+	// Dropped packets do not count as media received.
+	last := ume.LastRTP()
+	send(other, 0, 8)
+	send(phone, 96, 7)
+	time.Sleep(50 * time.Millisecond)
+	if !ume.LastRTP().Equal(last) {
+		t.Fatal("dropped packets updated the last RTP time")
+	}
+}
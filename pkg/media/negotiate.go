@@ -0,0 +1,560 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/itzmanish/sipnexus/pkg/codec"
+	"github.com/itzmanish/sipnexus/pkg/utils"
+	"github.com/pion/sdp/v3"
+)
+
+// ErrNoCommonMedia is returned when no offered stream can be accepted, which
+// rejects the whole offer (RFC 3264 section 6).
+var ErrNoCommonMedia = errors.New("no acceptable media in offer")
+
+// DefaultPtime is the packetization time we send at, in milliseconds.
+const DefaultPtime = 20
+
+// Codec is an RTP payload format as described by rtpmap and fmtp.
+type Codec struct {
+	PayloadType uint8
+	Name        string
+	ClockRate   uint32
+	// Channels is 0 when the rtpmap leaves it out, which means 1.
+	Channels uint16
+	// Fmtp holds the format parameters we put in SDP and RemoteFmtp those
+	// of the peer. They differ for formats such as Opus whose parameters
+	// state what each side prefers to receive.
+	Fmtp       string
+	RemoteFmtp string
+}
+
+// telephoneEvent is the RFC 4733 payload format carrying DTMF.
+const telephoneEvent = "telephone-event"
+
+// comfortNoise is the RFC 3389 payload format carrying background noise
+// levels during silence.
+const comfortNoise = "CN"
+
+// telephoneEventCodec is the DTMF format we offer next to the audio codecs.
+var telephoneEventCodec = Codec{PayloadType: 101, Name: telephoneEvent, ClockRate: 8000, Fmtp: "0-16"}
+
+// comfortNoiseCodec is the comfort noise format we offer and accept.
+var comfortNoiseCodec = Codec{PayloadType: codec.CNPayloadType, Name: comfortNoise, ClockRate: 8000}
+
+// DefaultCodecNames are the codecs of codec.Default we offer and accept
+// unless configured otherwise, most preferred first. Every endpoint takes
+// G.711; wideband codecs are opted into.
+var DefaultCodecNames = []string{"PCMU", "PCMA"}
+
+// DefaultCodecs returns the formats of DefaultCodecNames.
+func DefaultCodecs() []Codec {
+	r, err := codec.Default.Select(DefaultCodecNames...)
+	if err != nil {
+		panic(err)
+	}
+	return RegistryCodecs(r)
+}
+
+// RegistryCodecs returns the formats of the codecs in r in order of
+// preference, followed by CN and telephone-event.
+func RegistryCodecs(r *codec.Registry) []Codec {
+	var codecs []Codec
+	for _, c := range r.Codecs() {
+		info := c.Info()
+		codecs = append(codecs, Codec{
+			PayloadType: info.PayloadType,
+			Name:        info.Name,
+			ClockRate:   info.ClockRate,
+			Channels:    uint16(info.Channels),
+			Fmtp:        info.Fmtp,
+		})
+	}
+	return append(codecs, comfortNoiseCodec, telephoneEventCodec)
+}
+
+// staticCodecs are the audio payload types of RFC 3551 offers may use
+// without an rtpmap.
+var staticCodecs = map[uint8]Codec{
+	0:  {PayloadType: 0, Name: "PCMU", ClockRate: 8000},
+	3:  {PayloadType: 3, Name: "GSM", ClockRate: 8000},
+	4:  {PayloadType: 4, Name: "G723", ClockRate: 8000},
+	8:  {PayloadType: 8, Name: "PCMA", ClockRate: 8000},
+	9:  {PayloadType: 9, Name: "G722", ClockRate: 8000},
+	13: {PayloadType: 13, Name: "CN", ClockRate: 8000},
+	18: {PayloadType: 18, Name: "G729", ClockRate: 8000},
+}
+
+func (c Codec) rtpmap() string {
+	v := fmt.Sprintf("%d %s/%d", c.PayloadType, c.Name, c.ClockRate)
+	if c.Channels > 1 {
+		v += "/" + strconv.Itoa(int(c.Channels))
+	}
+	return v
+}
+
+// Matches reports whether c and other are the same format, ignoring the
+// payload type.
+func (c Codec) Matches(other Codec) bool {
+	return strings.EqualFold(c.Name, other.Name) && c.ClockRate == other.ClockRate && max(c.Channels, 1) == max(other.Channels, 1)
+}
+
+// OpusParams returns the Opus parameters the peer asked for.
+func (c Codec) OpusParams() codec.OpusParams {
+	return codec.ParseOpusParams(c.RemoteFmtp)
+}
+
+// sendPtime returns the ptime in milliseconds to send c with when ptime was
+// negotiated. Opus is sent no shorter than the peer's minptime, in frames
+// the encoder codes.
+func (c Codec) sendPtime(ptime int) int {
+	if !strings.EqualFold(c.Name, "opus") {
+		return ptime
+	}
+	return codec.OpusPtime(max(ptime, c.OpusParams().MinPtime))
+}
+
+// declarative reports whether the fmtp of c states what each side prefers
+// to receive rather than describing the stream, so that an answer carries
+// its own instead of echoing the offer (RFC 7587 section 7).
+func (c Codec) declarative() bool {
+	return strings.EqualFold(c.Name, "opus")
+}
+
+// IsTelephoneEvent reports whether c carries DTMF rather than audio.
+func (c Codec) IsTelephoneEvent() bool {
+	return strings.EqualFold(c.Name, telephoneEvent)
+}
+
+// IsComfortNoise reports whether c carries comfort noise rather than audio.
+func (c Codec) IsComfortNoise() bool {
+	return strings.EqualFold(c.Name, comfortNoise)
+}
+
+// isAudio reports whether c is an audio codec.
+func (c Codec) isAudio() bool {
+	return !c.IsTelephoneEvent() && !c.IsComfortNoise()
+}
+
+// Direction is the SDP direction attribute of a stream.
+type Direction string
+
+const (
+	SendRecv Direction = "sendrecv"
+	SendOnly Direction = "sendonly"
+	RecvOnly Direction = "recvonly"
+	Inactive Direction = "inactive"
+)
+
+// answer returns the direction answering an offer of d by a side that would
+// use local on its own (RFC 3264 6.1).
+func (d Direction) answer(local Direction) Direction {
+	return newDirection(d.Receives() && local.Sends(), d.Sends() && local.Receives())
+}
+
+func newDirection(sends, receives bool) Direction {
+	switch {
+	case sends && receives:
+		return SendRecv
+	case sends:
+		return SendOnly
+	case receives:
+		return RecvOnly
+	}
+	return Inactive
+}
+
+// Sends reports whether media flows from the side using direction d.
+func (d Direction) Sends() bool {
+	return d == SendRecv || d == SendOnly
+}
+
+// Receives reports whether the side using direction d accepts media.
+func (d Direction) Receives() bool {
+	return d == SendRecv || d == RecvOnly
+}
+
+// Stream is the outcome of negotiating one m-line.
+type Stream struct {
+	// Media, Protos and Formats are copied from the offer.
+	Media   string
+	Protos  []string
+	Formats []string
+
+	// Accepted is false for streams answered with port 0.
+	Accepted bool
+	// Codecs are the formats both sides support, in the order of the offer
+	// and with its payload types.
+	Codecs []Codec
+	// Direction is ours, as put in the answer.
+	Direction Direction
+	// RemoteDirection is the one the peer put in its offer or answer.
+	RemoteDirection Direction
+	// Remote and RemoteRTCP are where the peer receives RTP and RTCP. The
+	// IP is unspecified when the peer put the stream on hold with
+	// c=0.0.0.0.
+	Remote     *net.UDPAddr
+	RemoteRTCP *net.UDPAddr
+	// RTCPMux is set when RTCP shares the RTP port (RFC 5761).
+	RTCPMux bool
+	// Ptime is the packetization time the peer asked for, in milliseconds.
+	Ptime int
+}
+
+// RemoteHold reports whether the peer put the stream on hold, either with
+// sendonly or inactive (RFC 3264 section 8.4) or with c=0.0.0.0 (RFC 2543).
+func (s Stream) RemoteHold() bool {
+	return !s.RemoteDirection.Receives() || (s.Remote != nil && s.Remote.IP.IsUnspecified())
+}
+
+// hasPayloadType reports whether pt is one of the negotiated formats.
+func (s Stream) hasPayloadType(pt uint8) bool {
+	_, ok := s.payloadCodec(pt)
+	return ok
+}
+
+// payloadCodec returns the negotiated format of payload type pt.
+func (s Stream) payloadCodec(pt uint8) (Codec, bool) {
+	for _, c := range s.Codecs {
+		if c.PayloadType == pt {
+			return c, true
+		}
+	}
+	return Codec{}, false
+}
+
+// Codec returns the audio codec media is sent with.
+func (s Stream) Codec() (Codec, bool) {
+	for _, c := range s.Codecs {
+		if c.isAudio() {
+			return c, true
+		}
+	}
+	return Codec{}, false
+}
+
+// ComfortNoise returns the negotiated CN format of the clock rate of the
+// audio codec, if any. Only then may silence be sent as comfort noise.
+func (s Stream) ComfortNoise() (Codec, bool) {
+	audio, ok := s.Codec()
+	if !ok {
+		return Codec{}, false
+	}
+	for _, c := range s.Codecs {
+		if c.IsComfortNoise() && c.ClockRate == audio.ClockRate {
+			return c, true
+		}
+	}
+	return Codec{}, false
+}
+
+// TelephoneEvent returns the negotiated DTMF format, if any.
+func (s Stream) TelephoneEvent() (Codec, bool) {
+	for _, c := range s.Codecs {
+		if c.IsTelephoneEvent() {
+			return c, true
+		}
+	}
+	return Codec{}, false
+}
+
+// Negotiator implements RFC 3264 offer/answer for a single RTP audio stream.
+type Negotiator struct {
+	// Codecs are the formats we support, most preferred first. Our offers
+	// use their payload types.
+	Codecs []Codec
+	// Ptime is the packetization time we send at, in milliseconds.
+	Ptime int
+	// Direction is the one we want, such as sendonly while we hold the
+	// call. Offers use it and answers never exceed it. Empty means
+	// sendrecv.
+	Direction Direction
+}
+
+// NewNegotiator returns a negotiator for DefaultCodecs.
+func NewNegotiator() *Negotiator {
+	return &Negotiator{Codecs: DefaultCodecs(), Ptime: DefaultPtime}
+}
+
+// Negotiate answers each m-line of offer. At most one audio stream is
+// accepted since a session has a single RTP socket; the others are
+// rejected. It returns ErrNoCommonMedia when no stream is accepted.
+func (n *Negotiator) Negotiate(offer *utils.SessionDescription) ([]Stream, error) {
+	sessionDir := direction(offer.Attributes, SendRecv)
+	streams := make([]Stream, len(offer.Media))
+	accepted := false
+	for i, md := range offer.Media {
+		streams[i] = Stream{
+			Media:   md.MediaName.Media,
+			Protos:  md.MediaName.Protos,
+			Formats: md.MediaName.Formats,
+		}
+		if accepted || md.MediaName.Media != "audio" || md.Disabled() || !isRTPAVP(md.MediaName.Protos) {
+			continue
+		}
+		codecs := n.intersect(md.MediaDescription)
+		if !hasAudio(codecs) {
+			continue
+		}
+		streams[i].Accepted = true
+		streams[i].Codecs = codecs
+		streams[i].RemoteDirection = direction(md.Attributes, sessionDir)
+		streams[i].Direction = streams[i].RemoteDirection.answer(n.direction())
+		streams[i].Remote = md.RTP
+		streams[i].RemoteRTCP = md.RTCP
+		streams[i].RTCPMux = md.RTCPMux
+		streams[i].Ptime = ptime(md.MediaDescription)
+		accepted = true
+	}
+	if !accepted {
+		return nil, ErrNoCommonMedia
+	}
+	return streams, nil
+}
+
+// Answer returns the answer m-lines for streams, with accepted streams
+// received on port.
+func (n *Negotiator) Answer(streams []Stream, port int) []*sdp.MediaDescription {
+	mds := make([]*sdp.MediaDescription, 0, len(streams))
+	for _, s := range streams {
+		if !s.Accepted {
+			mds = append(mds, rejectedMedia(s))
+			continue
+		}
+		md := n.media(port, s.Codecs, s.Direction)
+		if s.RTCPMux {
+			md.WithPropertyAttribute("rtcp-mux")
+		}
+		mds = append(mds, md)
+	}
+	return mds
+}
+
+// Offer returns the m-line of an offer of codecs received on port. A
+// re-offer passes the codecs negotiated before, since payload type mappings
+// must not change within a session (RFC 3264 section 8.3.2).
+func (n *Negotiator) Offer(port int, codecs []Codec) *sdp.MediaDescription {
+	return n.media(port, codecs, n.direction())
+}
+
+// NegotiateAnswer applies the answer to an offer of the offered codecs. The
+// answer may only use formats we offered (RFC 3264 section 6.1).
+func (n *Negotiator) NegotiateAnswer(answer *utils.SessionDescription, offered []Codec) (Stream, error) {
+	if len(answer.Media) != 1 {
+		return Stream{}, fmt.Errorf("answer has %d m-lines for 1 offered", len(answer.Media))
+	}
+	md := answer.Media[0]
+	s := Stream{
+		Media:   md.MediaName.Media,
+		Protos:  md.MediaName.Protos,
+		Formats: md.MediaName.Formats,
+	}
+	if md.Disabled() {
+		return s, ErrNoCommonMedia
+	}
+	var codecs []Codec
+	for _, c := range offeredCodecs(md.MediaDescription) {
+		for _, local := range offered {
+			if local.PayloadType == c.PayloadType && local.Matches(c) {
+				c.Fmtp, c.RemoteFmtp = local.Fmtp, c.Fmtp
+				codecs = append(codecs, c)
+				break
+			}
+		}
+	}
+	if !hasAudio(codecs) {
+		return s, ErrNoCommonMedia
+	}
+	s.Accepted = true
+	s.Codecs = codecs
+	s.RemoteDirection = direction(md.Attributes, direction(answer.Attributes, SendRecv))
+	s.Direction = s.RemoteDirection.answer(n.direction())
+	s.Remote = md.RTP
+	s.RemoteRTCP = md.RTCP
+	s.Ptime = ptime(md.MediaDescription)
+	return s, nil
+}
+
+func (n *Negotiator) direction() Direction {
+	if n.Direction == "" {
+		return SendRecv
+	}
+	return n.Direction
+}
+
+func (n *Negotiator) ptime() int {
+	if n.Ptime == 0 {
+		return DefaultPtime
+	}
+	return n.Ptime
+}
+
+// intersect returns the offered formats of md we support, in offer order.
+func (n *Negotiator) intersect(md *sdp.MediaDescription) []Codec {
+	var codecs []Codec
+	for _, c := range offeredCodecs(md) {
+		for _, local := range n.Codecs {
+			if !local.Matches(c) {
+				continue
+			}
+			c.RemoteFmtp = c.Fmtp
+			if c.Fmtp == "" || c.declarative() {
+				c.Fmtp = local.Fmtp
+			}
+			codecs = append(codecs, c)
+			break
+		}
+	}
+	return codecs
+}
+
+func (n *Negotiator) media(port int, codecs []Codec, dir Direction) *sdp.MediaDescription {
+	md := &sdp.MediaDescription{
+		MediaName: sdp.MediaName{
+			Media:  "audio",
+			Port:   sdp.RangedPort{Value: port},
+			Protos: []string{"RTP", "AVP"},
+		},
+	}
+	for _, c := range codecs {
+		md.MediaName.Formats = append(md.MediaName.Formats, strconv.Itoa(int(c.PayloadType)))
+	}
+	for _, c := range codecs {
+		md.WithValueAttribute("rtpmap", c.rtpmap())
+		if c.Fmtp != "" {
+			md.WithValueAttribute("fmtp", fmt.Sprintf("%d %s", c.PayloadType, c.Fmtp))
+		}
+	}
+	md.WithValueAttribute("ptime", strconv.Itoa(n.ptime()))
+	md.WithPropertyAttribute(string(dir))
+	return md
+}
+
+// rejectedMedia answers s with port 0, keeping the offered formats since an
+// m-line needs at least one.
+func rejectedMedia(s Stream) *sdp.MediaDescription {
+	return &sdp.MediaDescription{
+		MediaName: sdp.MediaName{
+			Media:   s.Media,
+			Port:    sdp.RangedPort{Value: 0},
+			Protos:  s.Protos,
+			Formats: s.Formats,
+		},
+	}
+}
+
+// offeredCodecs returns the formats of md in order, resolving static payload
+// types that have no rtpmap.
+func offeredCodecs(md *sdp.MediaDescription) []Codec {
+	rtpmaps := map[uint8]Codec{}
+	fmtps := map[uint8]string{}
+	for _, a := range md.Attributes {
+		pt, value, ok := formatAttribute(a.Value)
+		if !ok {
+			continue
+		}
+		switch a.Key {
+		case "rtpmap":
+			if c, ok := parseRtpmap(pt, value); ok {
+				rtpmaps[pt] = c
+			}
+		case "fmtp":
+			fmtps[pt] = value
+		}
+	}
+
+	var codecs []Codec
+	for _, f := range md.MediaName.Formats {
+		n, err := strconv.ParseUint(f, 10, 7)
+		if err != nil {
+			continue
+		}
+		pt := uint8(n)
+		c, ok := rtpmaps[pt]
+		if !ok {
+			if c, ok = staticCodecs[pt]; !ok {
+				continue
+			}
+		}
+		c.Fmtp = fmtps[pt]
+		codecs = append(codecs, c)
+	}
+	return codecs
+}
+
+// formatAttribute splits the value of an rtpmap or fmtp attribute into its
+// payload type and the rest.
+func formatAttribute(v string) (uint8, string, bool) {
+	pt, rest, ok := strings.Cut(v, " ")
+	if !ok {
+		return 0, "", false
+	}
+	n, err := strconv.ParseUint(pt, 10, 7)
+	if err != nil {
+		return 0, "", false
+	}
+	return uint8(n), strings.TrimSpace(rest), true
+}
+
+// parseRtpmap parses "<name>/<clock rate>[/<channels>]".
+func parseRtpmap(pt uint8, v string) (Codec, bool) {
+	parts := strings.Split(v, "/")
+	if len(parts) < 2 {
+		return Codec{}, false
+	}
+	rate, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return Codec{}, false
+	}
+	c := Codec{PayloadType: pt, Name: parts[0], ClockRate: uint32(rate)}
+	if len(parts) > 2 {
+		ch, err := strconv.ParseUint(parts[2], 10, 16)
+		if err != nil {
+			return Codec{}, false
+		}
+		c.Channels = uint16(ch)
+	}
+	return c, true
+}
+
+func hasAudio(codecs []Codec) bool {
+	for _, c := range codecs {
+		if c.isAudio() {
+			return true
+		}
+	}
+	return false
+}
+
+// isRTPAVP reports whether protos is plain RTP. Secure profiles need SRTP,
+// which we do not support, so WebRTC offers of UDP/TLS/RTP/SAVPF are
+// declined even when they carry Opus.
+func isRTPAVP(protos []string) bool {
+	return strings.EqualFold(strings.Join(protos, "/"), "RTP/AVP")
+}
+
+// direction returns the direction attribute in attrs, or def if there is
+// none.
+func direction(attrs []sdp.Attribute, def Direction) Direction {
+	for _, a := range attrs {
+		switch d := Direction(a.Key); d {
+		case SendRecv, SendOnly, RecvOnly, Inactive:
+			return d
+		}
+	}
+	return def
+}
+
+// ptime returns the a=ptime of md, or DefaultPtime.
+func ptime(md *sdp.MediaDescription) int {
+	if v, ok := md.Attribute("ptime"); ok {
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && n > 0 {
+			return n
+		}
+	}
+	return DefaultPtime
+}
@@ -0,0 +1,35 @@
+//go:build opus
+
+package media
+
+import (
+	"testing"
+
+	"github.com/itzmanish/sipnexus/pkg/codec"
+	"github.com/pion/sdp/v3"
+)
+
+func TestNegotiateOpusBuiltIn(t *testing.T) {
+	// The audio of a browser's offer, over plain RTP as a SIP endpoint
+	// sends it.
+	r, err := codec.Default.Select("opus", "PCMU")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &Negotiator{Codecs: RegistryCodecs(r), Ptime: DefaultPtime}
+	offer := sdpOf("c=IN IP4 192.0.2.30", "m=audio 4000 RTP/AVP 111 9 0 8 13 126",
+		"a=rtpmap:111 opus/48000/2", "a=fmtp:111 minptime=10;useinbandfec=1",
+		"a=rtpmap:126 telephone-event/8000")
+	streams, err := n.Negotiate(parseSDP(t, offer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := streams[0].Codec()
+	if c.Name != "opus" || c.PayloadType != 111 || !c.OpusParams().UseInbandFEC {
+		t.Fatalf("negotiated %+v, want opus with FEC", c)
+	}
+	sd := &sdp.SessionDescription{MediaDescriptions: n.Answer(streams, 4000)}
+	if rtpmap, _ := sd.MediaDescriptions[0].Attribute("rtpmap"); rtpmap != "111 opus/48000/2" {
+		t.Fatalf("answered with rtpmap %q, want opus", rtpmap)
+	}
+}
@@ -0,0 +1,498 @@
+package media
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/itzmanish/sipnexus/pkg/codec"
+	"github.com/itzmanish/sipnexus/pkg/utils"
+	"github.com/pion/sdp/v3"
+)
+
+// sdpOf joins lines into a session description with a common header. The
+// c= and a= lines before the first m= line are session level.
+func sdpOf(lines ...string) string {
+	sd := []string{"v=0", "o=- 1 1 IN IP4 192.0.2.10", "s=-"}
+	var attrs []string
+	i := 0
+	for ; i < len(lines) && !strings.HasPrefix(lines[i], "m="); i++ {
+		if strings.HasPrefix(lines[i], "c=") {
+			sd = append(sd, lines[i])
+		} else {
+			attrs = append(attrs, lines[i])
+		}
+	}
+	sd = append(append(append(sd, "t=0 0"), attrs...), lines[i:]...)
+	return strings.Join(sd, "\r\n") + "\r\n"
+}
+
+func parseSDP(t *testing.T, s string) *utils.SessionDescription {
+	t.Helper()
+	sd, err := utils.ParseSDP([]byte(s))
+	if err != nil {
+		t.Fatalf("bad test SDP: %v", err)
+	}
+	return sd
+}
+
+func TestNegotiate(t *testing.T) {
+	testCases := []struct {
+		name     string
+		offer    string
+		err      error
+		accepted []bool
+		// The rest describes the accepted stream.
+		codecs []uint8
+		dir    Direction
+		remote string
+		ptime  int
+	}{
+		{
+			name: "polycom prefers G722",
+			offer: sdpOf("c=IN IP4 192.0.2.10",
+				"m=audio 2222 RTP/AVP 9 102 0 8 18 127",
+				"a=rtpmap:9 G722/8000", "a=rtpmap:102 G7221/16000", "a=fmtp:102 bitrate=32000",
+				"a=rtpmap:0 PCMU/8000", "a=rtpmap:8 PCMA/8000", "a=rtpmap:18 G729/8000",
+				"a=fmtp:18 annexb=no", "a=rtpmap:127 telephone-event/8000", "a=sendrecv"),
+			accepted: []bool{true},
+			codecs:   []uint8{0, 8, 127},
+			dir:      SendRecv,
+			remote:   "192.0.2.10:2222",
+			ptime:    20,
+		},
+		{
+			name: "yealink prefers PCMA",
+			offer: sdpOf("c=IN IP4 192.0.2.11",
+				"m=audio 11780 RTP/AVP 8 0 18 101",
+				"a=rtpmap:8 PCMA/8000", "a=rtpmap:0 PCMU/8000", "a=rtpmap:18 G729/8000",
+				"a=rtpmap:101 telephone-event/8000", "a=fmtp:101 0-15", "a=ptime:30", "a=sendrecv"),
+			accepted: []bool{true},
+			codecs:   []uint8{8, 0, 101},
+			dir:      SendRecv,
+			remote:   "192.0.2.11:11780",
+			ptime:    30,
+		},
+		{
+			name:     "cisco static payload types without rtpmap",
+			offer:    sdpOf("c=IN IP4 192.0.2.12", "m=audio 16434 RTP/AVP 18 0 8"),
+			accepted: []bool{true},
+			codecs:   []uint8{0, 8},
+			dir:      SendRecv,
+			remote:   "192.0.2.12:16434",
+			ptime:    20,
+		},
+		{
+			name: "trunk with session level connection",
+			offer: sdpOf("c=IN IP4 198.51.100.20",
+				"m=audio 10000 RTP/AVP 0 101",
+				"a=rtpmap:0 PCMU/8000", "a=rtpmap:101 telephone-event/8000", "a=fmtp:101 0-16", "a=ptime:20"),
+			accepted: []bool{true},
+			codecs:   []uint8{0, 101},
+			dir:      SendRecv,
+			remote:   "198.51.100.20:10000",
+			ptime:    20,
+		},
+		{
+			name: "media level connection overrides session level",
+			offer: sdpOf("c=IN IP4 198.51.100.20",
+				"m=audio 10000 RTP/AVP 0", "c=IN IP4 198.51.100.21"),
+			accepted: []bool{true},
+			codecs:   []uint8{0},
+			dir:      SendRecv,
+			remote:   "198.51.100.21:10000",
+			ptime:    20,
+		},
+		{
+			name:     "ipv6 connection",
+			offer:    sdpOf("m=audio 5004 RTP/AVP 0", "c=IN IP6 2001:db8::1"),
+			accepted: []bool{true},
+			codecs:   []uint8{0},
+			dir:      SendRecv,
+			remote:   "[2001:db8::1]:5004",
+			ptime:    20,
+		},
+		{
+			name:     "lower case encoding name",
+			offer:    sdpOf("c=IN IP4 192.0.2.13", "m=audio 4000 RTP/AVP 0", "a=rtpmap:0 pcmu/8000"),
+			accepted: []bool{true},
+			codecs:   []uint8{0},
+			dir:      SendRecv,
+			remote:   "192.0.2.13:4000",
+			ptime:    20,
+		},
+		{
+			name:     "hold with sendonly",
+			offer:    sdpOf("c=IN IP4 192.0.2.14", "m=audio 4000 RTP/AVP 0", "a=sendonly"),
+			accepted: []bool{true},
+			codecs:   []uint8{0},
+			dir:      RecvOnly,
+			remote:   "192.0.2.14:4000",
+			ptime:    20,
+		},
+		{
+			name:     "hold with RFC 2543 connection",
+			offer:    sdpOf("c=IN IP4 0.0.0.0", "m=audio 4000 RTP/AVP 0", "a=inactive"),
+			accepted: []bool{true},
+			codecs:   []uint8{0},
+			dir:      Inactive,
+			remote:   "0.0.0.0:4000",
+			ptime:    20,
+		},
+		{
+			name:     "recvonly",
+			offer:    sdpOf("c=IN IP4 192.0.2.15", "m=audio 4000 RTP/AVP 8", "a=recvonly"),
+			accepted: []bool{true},
+			codecs:   []uint8{8},
+			dir:      SendOnly,
+			remote:   "192.0.2.15:4000",
+			ptime:    20,
+		},
+		{
+			name:     "session level direction",
+			offer:    sdpOf("c=IN IP4 192.0.2.16", "a=sendonly", "m=audio 4000 RTP/AVP 0"),
+			accepted: []bool{true},
+			codecs:   []uint8{0},
+			dir:      RecvOnly,
+			remote:   "192.0.2.16:4000",
+			ptime:    20,
+		},
+		{
+			name: "linphone audio and video",
+			offer: sdpOf("c=IN IP4 192.0.2.17",
+				"m=audio 7078 RTP/AVP 96 0 8 101", "a=rtpmap:96 opus/48000/2", "a=fmtp:96 useinbandfec=1",
+				"a=rtpmap:101 telephone-event/8000",
+				"m=video 9078 RTP/AVP 97", "a=rtpmap:97 VP8/90000"),
+			accepted: []bool{true, false},
+			codecs:   []uint8{0, 8, 101},
+			dir:      SendRecv,
+			remote:   "192.0.2.17:7078",
+			ptime:    20,
+		},
+		{
+			name: "disabled stream before an audio stream",
+			offer: sdpOf("c=IN IP4 192.0.2.18",
+				"m=audio 0 RTP/AVP 0", "m=audio 4002 RTP/AVP 8"),
+			accepted: []bool{false, true},
+			codecs:   []uint8{8},
+			dir:      SendRecv,
+			remote:   "192.0.2.18:4002",
+			ptime:    20,
+		},
+		{
+			name: "second audio stream",
+			offer: sdpOf("c=IN IP4 192.0.2.19",
+				"m=audio 4000 RTP/AVP 0", "m=audio 4002 RTP/AVP 0"),
+			accepted: []bool{true, false},
+			codecs:   []uint8{0},
+			dir:      SendRecv,
+			remote:   "192.0.2.19:4000",
+			ptime:    20,
+		},
+		{
+			name: "webrtc secure profile",
+			offer: sdpOf("c=IN IP4 0.0.0.0",
+				"m=audio 9 UDP/TLS/RTP/SAVPF 111 0 8", "a=rtpmap:111 opus/48000/2"),
+			err: ErrNoCommonMedia,
+		},
+		{
+			name:  "no common codec",
+			offer: sdpOf("c=IN IP4 192.0.2.20", "m=audio 4000 RTP/AVP 18", "a=rtpmap:18 G729/8000"),
+			err:   ErrNoCommonMedia,
+		},
+		{
+			name: "only telephone-event in common",
+			offer: sdpOf("c=IN IP4 192.0.2.21", "m=audio 4000 RTP/AVP 18 101",
+				"a=rtpmap:101 telephone-event/8000"),
+			err: ErrNoCommonMedia,
+		},
+		{
+			name:  "video only",
+			offer: sdpOf("c=IN IP4 192.0.2.22", "m=video 4000 RTP/AVP 97", "a=rtpmap:97 H264/90000"),
+			err:   ErrNoCommonMedia,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			streams, err := NewNegotiator().Negotiate(parseSDP(t, tc.offer))
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if tc.err != nil {
+				return
+			}
+			if len(streams) != len(tc.accepted) {
+				t.Fatalf("expected %d streams, got %d", len(tc.accepted), len(streams))
+			}
+			var active Stream
+			for i, s := range streams {
+				if s.Accepted != tc.accepted[i] {
+					t.Fatalf("stream %d: expected accepted=%v", i, tc.accepted[i])
+				}
+				if s.Accepted {
+					active = s
+				}
+			}
+
+			var pts []uint8
+			for _, c := range active.Codecs {
+				pts = append(pts, c.PayloadType)
+			}
+			if len(pts) != len(tc.codecs) {
+				t.Fatalf("expected payload types %v, got %v", tc.codecs, pts)
+			}
+			for i := range pts {
+				if pts[i] != tc.codecs[i] {
+					t.Fatalf("expected payload types %v, got %v", tc.codecs, pts)
+				}
+			}
+			if active.Direction != tc.dir {
+				t.Fatalf("expected direction %s, got %s", tc.dir, active.Direction)
+			}
+			if got := active.Remote.String(); got != tc.remote {
+				t.Fatalf("expected remote %s, got %s", tc.remote, got)
+			}
+			if active.Ptime != tc.ptime {
+				t.Fatalf("expected ptime %d, got %d", tc.ptime, active.Ptime)
+			}
+		})
+	}
+}
+
+func TestNegotiatorAnswer(t *testing.T) {
+	offer := sdpOf("c=IN IP4 192.0.2.17",
+		"m=audio 7078 RTP/AVP 96 8 0 97", "a=rtpmap:96 opus/48000/2",
+		"a=rtpmap:97 telephone-event/8000", "a=fmtp:97 0-15", "a=sendonly",
+		"m=video 9078 RTP/AVP 98", "a=rtpmap:98 VP8/90000")
+	n := NewNegotiator()
+	streams, err := n.Negotiate(parseSDP(t, offer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd := &sdp.SessionDescription{
+		Origin:            sdp.Origin{Username: "-", NetworkType: "IN", AddressType: "IP4", UnicastAddress: "192.0.2.1"},
+		SessionName:       "-",
+		TimeDescriptions:  []sdp.TimeDescription{{}},
+		MediaDescriptions: n.Answer(streams, 4000),
+	}
+	b, err := sd.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer := string(b)
+
+	for _, line := range []string{
+		"m=audio 4000 RTP/AVP 8 0 97\r\n",
+		"a=rtpmap:8 PCMA/8000\r\n",
+		"a=rtpmap:0 PCMU/8000\r\n",
+		// The offer's payload type and events are kept.
+		"a=rtpmap:97 telephone-event/8000\r\n",
+		"a=fmtp:97 0-15\r\n",
+		"a=ptime:20\r\n",
+		"a=recvonly\r\n",
+		"m=video 0 RTP/AVP 98\r\n",
+	} {
+		if !strings.Contains(answer, line) {
+			t.Fatalf("expected %q in answer:\n%s", line, answer)
+		}
+	}
+	if strings.Contains(answer, "opus") || strings.Contains(answer, "VP8") {
+		t.Fatalf("answer contains unsupported formats:\n%s", answer)
+	}
+	if strings.Index(answer, "m=audio") > strings.Index(answer, "m=video") {
+		t.Fatalf("answer reordered the m-lines:\n%s", answer)
+	}
+}
+
+func TestRegistryCodecs(t *testing.T) {
+	n := &Negotiator{Codecs: RegistryCodecs(codec.NewRegistry(codec.PCMA))}
+	offer := sdpOf("c=IN IP4 192.0.2.17", "m=audio 7078 RTP/AVP 0 8 101",
+		"a=rtpmap:101 telephone-event/8000")
+	streams, err := n.Negotiate(parseSDP(t, offer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := streams[0].Codec(); c.Name != "PCMA" || len(streams[0].Codecs) != 2 {
+		t.Fatalf("negotiated %v, want PCMA and telephone-event", streams[0].Codecs)
+	}
+
+	offer = sdpOf("c=IN IP4 192.0.2.17", "m=audio 7078 RTP/AVP 0 101",
+		"a=rtpmap:101 telephone-event/8000")
+	if _, err := n.Negotiate(parseSDP(t, offer)); !errors.Is(err, ErrNoCommonMedia) {
+		t.Fatalf("expected ErrNoCommonMedia for a codec not registered, got %v", err)
+	}
+}
+
+func TestNegotiateComfortNoise(t *testing.T) {
+	n := NewNegotiator()
+	offer := sdpOf("c=IN IP4 192.0.2.18", "m=audio 4000 RTP/AVP 13 0 8 126",
+		"a=rtpmap:13 CN/8000", "a=rtpmap:126 telephone-event/8000")
+	streams, err := n.Negotiate(parseSDP(t, offer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := streams[0]
+	if len(s.Codecs) != 4 {
+		t.Fatalf("negotiated %v, want CN, PCMU, PCMA and telephone-event", s.Codecs)
+	}
+	if c, _ := s.Codec(); c.Name != "PCMU" {
+		t.Fatalf("sending %s, want PCMU", c.Name)
+	}
+	if cn, ok := s.ComfortNoise(); !ok || cn.PayloadType != 13 {
+		t.Fatalf("ComfortNoise = %v, %v", cn, ok)
+	}
+	answer := n.Answer(streams, 5000)[0].Attributes[0].String()
+	if answer != "rtpmap:13 CN/8000" {
+		t.Fatalf("answer starts with %q", answer)
+	}
+
+	// CN alone is no audio.
+	offer = sdpOf("c=IN IP4 192.0.2.18", "m=audio 4000 RTP/AVP 13 126",
+		"a=rtpmap:126 telephone-event/8000")
+	if _, err := n.Negotiate(parseSDP(t, offer)); !errors.Is(err, ErrNoCommonMedia) {
+		t.Fatalf("expected ErrNoCommonMedia for CN alone, got %v", err)
+	}
+
+	// CN at 8000 Hz does not go with a codec of another clock rate.
+	opus := stubCodec{Name: "opus", PayloadType: 111, ClockRate: 48000, SampleRate: 48000, Channels: 2}
+	n = &Negotiator{Codecs: RegistryCodecs(codec.NewRegistry(opus))}
+	offer = sdpOf("c=IN IP4 192.0.2.18", "m=audio 4000 RTP/AVP 111 13",
+		"a=rtpmap:111 opus/48000/2")
+	if streams, err = n.Negotiate(parseSDP(t, offer)); err != nil {
+		t.Fatal(err)
+	}
+	if cn, ok := streams[0].ComfortNoise(); ok {
+		t.Fatalf("ComfortNoise = %v with Opus", cn)
+	}
+}
+
+// stubCodec registers a format without implementing it.
+type stubCodec codec.Info
+
+func (c stubCodec) Info() codec.Info          { return codec.Info(c) }
+func (c stubCodec) NewEncoder() codec.Encoder { return nil }
+func (c stubCodec) NewDecoder() codec.Decoder { return nil }
+
+func TestNegotiateOpus(t *testing.T) {
+	opus := stubCodec{Name: "opus", PayloadType: 111, ClockRate: 48000, SampleRate: 48000, Channels: 2, Fmtp: codec.DefaultOpusParams.String()}
+	n := &Negotiator{Codecs: RegistryCodecs(codec.NewRegistry(codec.PCMU, opus))}
+	offer := sdpOf("c=IN IP4 192.0.2.17", "m=audio 7078 RTP/AVP 96 0",
+		"a=rtpmap:96 opus/48000/2", "a=fmtp:96 minptime=20;useinbandfec=1;stereo=1")
+	streams, err := n.Negotiate(parseSDP(t, offer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := streams[0].Codec()
+	if c.Name != "opus" || c.PayloadType != 96 {
+		t.Fatalf("negotiated %+v, want opus", c)
+	}
+	if p := c.OpusParams(); p != (codec.OpusParams{MinPtime: 20, UseInbandFEC: true, Stereo: true}) {
+		t.Fatalf("peer asked for %+v", p)
+	}
+
+	// The answer states our own preferences rather than the offer's.
+	sd := &sdp.SessionDescription{MediaDescriptions: n.Answer(streams, 4000)}
+	fmtp, _ := sd.MediaDescriptions[0].Attribute("fmtp")
+	if fmtp != "96 minptime=10;useinbandfec=1" {
+		t.Fatalf("answered with fmtp %q", fmtp)
+	}
+
+	// Ours are kept when the peer answers with its own.
+	answer := sdpOf("c=IN IP4 192.0.2.17", "m=audio 7078 RTP/AVP 111",
+		"a=rtpmap:111 opus/48000/2", "a=fmtp:111 stereo=1")
+	s, err := n.NegotiateAnswer(parseSDP(t, answer), n.Codecs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Codecs[0].Fmtp != "minptime=10;useinbandfec=1" || !s.Codecs[0].OpusParams().Stereo {
+		t.Fatalf("negotiated %+v", s.Codecs[0])
+	}
+}
+
+func TestNegotiateAnswer(t *testing.T) {
+	testCases := []struct {
+		name   string
+		answer string
+		err    bool
+		codecs []uint8
+		dir    Direction
+	}{
+		{
+			name:   "PCMA chosen",
+			answer: sdpOf("c=IN IP4 192.0.2.30", "m=audio 5000 RTP/AVP 8 101", "a=rtpmap:101 telephone-event/8000", "a=sendrecv"),
+			codecs: []uint8{8, 101},
+			dir:    SendRecv,
+		},
+		{
+			name:   "peer only receives",
+			answer: sdpOf("c=IN IP4 192.0.2.30", "m=audio 5000 RTP/AVP 0", "a=recvonly"),
+			codecs: []uint8{0},
+			dir:    SendOnly,
+		},
+		{
+			name:   "stream rejected",
+			answer: sdpOf("c=IN IP4 192.0.2.30", "m=audio 0 RTP/AVP 0"),
+			err:    true,
+		},
+		{
+			name:   "format not offered",
+			answer: sdpOf("c=IN IP4 192.0.2.30", "m=audio 5000 RTP/AVP 18"),
+			err:    true,
+		},
+		{
+			name:   "payload type remapped",
+			answer: sdpOf("c=IN IP4 192.0.2.30", "m=audio 5000 RTP/AVP 96", "a=rtpmap:96 PCMU/8000"),
+			err:    true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := NewNegotiator().NegotiateAnswer(parseSDP(t, tc.answer), DefaultCodecs())
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(s.Codecs) != len(tc.codecs) {
+				t.Fatalf("expected %v, got %+v", tc.codecs, s.Codecs)
+			}
+			for i, c := range s.Codecs {
+				if c.PayloadType != tc.codecs[i] {
+					t.Fatalf("expected %v, got %+v", tc.codecs, s.Codecs)
+				}
+			}
+			if s.Direction != tc.dir {
+				t.Fatalf("expected direction %s, got %s", tc.dir, s.Direction)
+			}
+			if c, _ := s.Codec(); c.PayloadType != tc.codecs[0] {
+				t.Fatalf("expected to send with %d, got %d", tc.codecs[0], c.PayloadType)
+			}
+		})
+	}
+}
+
+func TestStreamRemoteHold(t *testing.T) {
+	tests := []struct {
+		dir  Direction
+		ip   net.IP
+		hold bool
+	}{
+		{SendRecv, net.IPv4(192, 0, 2, 1), false},
+		{RecvOnly, net.IPv4(192, 0, 2, 1), false},
+		{SendOnly, net.IPv4(192, 0, 2, 1), true},
+		{Inactive, net.IPv4(192, 0, 2, 1), true},
+		{SendRecv, net.IPv4zero, true},
+	}
+	for _, tt := range tests {
+		s := Stream{RemoteDirection: tt.dir, Remote: &net.UDPAddr{IP: tt.ip, Port: 4000}}
+		if s.RemoteHold() != tt.hold {
+			t.Errorf("%s to %s: expected hold %v", tt.dir, tt.ip, tt.hold)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrPortsExhausted is returned when every RTP port of the range is in use.
+var ErrPortsExhausted = errors.New("no free RTP ports")
+
+const (
+	DefaultRTPPortMin = 10000
+	DefaultRTPPortMax = 20000
+)
+
+var (
+	rtpPortsInUse = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sipnexus_rtp_ports_in_use",
+		Help: "RTP/RTCP port pairs currently allocated.",
+	})
+	rtpPortsExhausted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sipnexus_rtp_ports_exhausted_total",
+		Help: "Port allocations that failed because the range was exhausted.",
+	})
+)
+
+// PortPair is an allocated RTP socket on an even port and its RTCP socket
+// on the next odd port (RFC 3550 section 11).
+type PortPair struct {
+	RTP  *net.UDPConn
+	RTCP *net.UDPConn
+
+	alloc *PortAllocator
+	port  int
+	once  sync.Once
+}
+
+// Port returns the RTP port; RTCP uses Port()+1.
+func (p *PortPair) Port() int {
+	return p.port
+}
+
+// Close closes both sockets and returns the pair to its allocator.
+func (p *PortPair) Close() error {
+	var err error
+	p.once.Do(func() {
+		err = errors.Join(p.RTP.Close(), p.RTCP.Close())
+		p.alloc.release(p.port)
+	})
+	return err
+}
+
+// PortAllocator hands out RTP/RTCP port pairs from a fixed range. Ports are
+// handed out round robin so a just released pair is not reused at once,
+// which keeps late packets of an old call out of a new one.
+type PortAllocator struct {
+	min, max int
+
+	mu    sync.Mutex
+	next  int
+	inUse map[int]struct{}
+}
+
+// NewPortAllocator returns an allocator for the pairs within [min, max].
+// min is rounded up to an even port.
+func NewPortAllocator(min, max int) (*PortAllocator, error) {
+	if min%2 != 0 {
+		min++
+	}
+	if min <= 0 || max > 65535 || max < min+1 {
+		return nil, fmt.Errorf("invalid RTP port range %d-%d", min, max)
+	}
+	return &PortAllocator{
+		min:   min,
+		max:   max,
+		next:  min,
+		inUse: make(map[int]struct{}),
+	}, nil
+}
+
+// Size returns how many pairs the range holds.
+func (a *PortAllocator) Size() int {
+	return (a.max - a.min + 1) / 2
+}
+
+// InUse returns how many pairs are allocated.
+func (a *PortAllocator) InUse() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.inUse)
+}
+
+// Allocate binds the next free pair on ip. Ports that turn out to be taken
+// by another process are skipped.
+func (a *PortAllocator) Allocate(ip net.IP) (*PortPair, error) {
+	for tries := 0; tries < a.Size(); tries++ {
+		port, ok := a.reserve()
+		if !ok {
+			break
+		}
+		rtp, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+		if err != nil {
+			a.release(port)
+			continue
+		}
+		rtcp, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port + 1})
+		if err != nil {
+			rtp.Close()
+			a.release(port)
+			continue
+		}
+		return &PortPair{RTP: rtp, RTCP: rtcp, alloc: a, port: port}, nil
+	}
+	rtpPortsExhausted.Inc()
+	return nil, ErrPortsExhausted
+}
+
+// reserve marks the next unused pair as allocated.
+func (a *PortAllocator) reserve() (int, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i := 0; i < a.Size(); i++ {
+		port := a.next
+		a.next += 2
+		if a.next+1 > a.max {
+			a.next = a.min
+		}
+		if _, ok := a.inUse[port]; !ok {
+			a.inUse[port] = struct{}{}
+			rtpPortsInUse.Inc()
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+func (a *PortAllocator) release(port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.inUse[port]; ok {
+		delete(a.inUse, port)
+		rtpPortsInUse.Dec()
+	}
+}
@@ -0,0 +1,138 @@
+package media
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestPortAllocatorPairs(t *testing.T) {
+	a, err := NewPortAllocator(31001, 31009)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Size() != 4 {
+		t.Fatalf("expected 4 pairs in 31002-31009, got %d", a.Size())
+	}
+
+	var pairs []*PortPair
+	for i := 0; i < a.Size(); i++ {
+		p, err := a.Allocate(net.IPv4(127, 0, 0, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Port()%2 != 0 {
+			t.Fatalf("RTP port %d is odd", p.Port())
+		}
+		if got := p.RTCP.LocalAddr().(*net.UDPAddr).Port; got != p.Port()+1 {
+			t.Fatalf("expected RTCP on %d, got %d", p.Port()+1, got)
+		}
+		pairs = append(pairs, p)
+	}
+	if _, err := a.Allocate(net.IPv4(127, 0, 0, 1)); !errors.Is(err, ErrPortsExhausted) {
+		t.Fatalf("expected exhaustion, got %v", err)
+	}
+
+	// A released pair can be allocated again, and releasing twice is safe.
+	released := pairs[1].Port()
+	pairs[1].Close()
+	pairs[1].Close()
+	if a.InUse() != 3 {
+		t.Fatalf("expected 3 pairs in use, got %d", a.InUse())
+	}
+	p, err := a.Allocate(net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Port() != released {
+		t.Fatalf("expected the released port %d, got %d", released, p.Port())
+	}
+	pairs[1] = p
+
+	for _, p := range pairs {
+		p.Close()
+	}
+	if a.InUse() != 0 {
+		t.Fatalf("expected no pairs in use, got %d", a.InUse())
+	}
+}
+
+func TestPortAllocatorSkipsBusyPorts(t *testing.T) {
+	a, err := NewPortAllocator(31100, 31103)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another process holds the RTCP port of the first pair.
+	busy, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 31101})
+	if err != nil {
+		t.Skipf("port 31101 not available: %v", err)
+	}
+	defer busy.Close()
+
+	p, err := a.Allocate(net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if p.Port() != 31102 {
+		t.Fatalf("expected busy pair to be skipped, got %d", p.Port())
+	}
+	if _, err := a.Allocate(net.IPv4(127, 0, 0, 1)); !errors.Is(err, ErrPortsExhausted) {
+		t.Fatalf("expected exhaustion, got %v", err)
+	}
+	if a.InUse() != 1 {
+		t.Fatalf("expected the busy pair not to stay reserved, got %d in use", a.InUse())
+	}
+}
+
+func TestPortAllocatorConcurrent(t *testing.T) {
+	const calls = 500
+	a, err := NewPortAllocator(32000, 32000+2*calls-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seen := map[int]bool{}
+	pairs := make(chan *PortPair, calls)
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, err := a.Allocate(net.IPv4(127, 0, 0, 1))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			if seen[p.Port()] {
+				t.Errorf("port %d allocated twice", p.Port())
+			}
+			seen[p.Port()] = true
+			mu.Unlock()
+			pairs <- p
+		}()
+	}
+	wg.Wait()
+	close(pairs)
+
+	if a.InUse() != calls {
+		t.Fatalf("expected %d pairs in use, got %d", calls, a.InUse())
+	}
+	for p := range pairs {
+		p.Close()
+	}
+	if a.InUse() != 0 {
+		t.Fatalf("expected no pairs in use, got %d", a.InUse())
+	}
+}
+
+func TestNewPortAllocatorRange(t *testing.T) {
+	for _, r := range [][2]int{{0, 100}, {20000, 20000}, {20001, 20001}, {65000, 70000}} {
+		if _, err := NewPortAllocator(r[0], r[1]); err == nil {
+			t.Errorf("expected error for range %v", r)
+		}
+	}
+}
@@ -3,80 +3,482 @@ package media
 import (
 	"errors"
 	"fmt"
+	"math/rand/v2"
 	"net"
-	"net/netip"
-	"slices"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/itzmanish/sipnexus/pkg/logger"
+	"github.com/itzmanish/sipnexus/pkg/utils"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/pion/sdp/v3"
 )
 
-var SupportedCodecs = []string{"pcmu", "PCMU"}
+var ErrEngineClosed = errors.New("media engine closed")
 
 type MediaEngine interface {
+	// SetOffer applies a remote offer and returns the local answer. On an
+	// engine that negotiated before it handles a re-offer, keeping the
+	// local port.
 	SetOffer(offer string) (string, error)
+	// CreateOffer binds the local media socket and returns an offer for
+	// outbound calls, or a re-offer once media was negotiated.
+	CreateOffer() (string, error)
+	// SetAnswer applies the remote answer to the last offer from
+	// CreateOffer.
+	SetAnswer(answer string) error
+	// Hold makes the following offers and answers sendonly, or inactive
+	// when the peer does not send either, until it is called with false.
+	Hold(hold bool)
+	// Stream returns the negotiated stream, or false before negotiation
+	// ended.
+	Stream() (Stream, bool)
+	// Stats returns the quality statistics of the stream so far.
+	Stats() Stats
+	// SSRC returns the synchronization source of the RTP the engine sends.
+	SSRC() uint32
+	// Close stops the read loop and releases the media socket.
+	Close() error
+	// LastRTP returns when the last RTP packet was received, or the zero
+	// time if none has arrived yet.
+	LastRTP() time.Time
+
+	// ReadRTP returns the next received RTP packet. It fails with
+	// ErrEngineClosed once the engine is closed.
+	ReadRTP() (*rtp.Packet, error)
+	// ReadFrame returns the next received packet in playout order from a
+	// jitter buffer, blocking until it is due, or a lost frame for one
+	// that did not arrive in time. Use either ReadRTP or ReadFrame.
+	ReadFrame() (Frame, error)
+	// WriteRTP sends pkt to the peer as is.
+	WriteRTP(pkt *rtp.Packet) error
+	// WriteSample packetizes s with the negotiated codec and sends it once
+	// it is due, pacing writes at the rate the media plays out.
+	WriteSample(s Sample) error
+}
+
+// Interface is the local IP media is bound on and the IP advertised for it
+// in SDP. They differ when the host is behind a 1:1 NAT. SymmetricRTP deals
+// with the peer being behind NAT.
+type Interface struct {
+	BindIP       net.IP
+	AdvertisedIP net.IP
+	SymmetricRTP SymmetricRTP
+	// Codecs are the formats offered and accepted, most preferred first.
+	// Defaults to DefaultCodecs.
+	Codecs []Codec
 }
 
+// sdpAddress returns the SDP address type and address of the advertised IP.
+func (i Interface) sdpAddress() (string, string) {
+	ip := i.AdvertisedIP
+	if ip == nil {
+		ip = i.BindIP
+	}
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+	if ip.To4() == nil {
+		return "IP6", ip.String()
+	}
+	return "IP4", ip.String()
+}
+
+// UDPMediaEngine negotiates a single RTP audio stream and carries it over a
+// UDP port pair. Negotiation methods are serialized by negMu; mu guards the
+// state shared with the read loop and writers.
 type UDPMediaEngine struct {
-	logger        logger.Logger
-	rtpConn       *UDPConn
-	selectedCodec []string // [format,codecName, clockRate], [8,pcma, 8000]
-	selectedCI    string   // selected connection information
+	logger logger.Logger
+	ports  *PortAllocator
+	iface  Interface
+
+	negMu      sync.Mutex
+	negotiator *Negotiator
+	offered    []Codec // codecs of an offer awaiting its answer
+
+	mu       sync.Mutex
+	closed   bool
+	pair     *PortPair
+	rtpConn  *UDPConn
+	rtcpConn *UDPConn
+	stream   *Stream // the negotiated stream, nil until negotiated
+	started  bool    // whether the loops were started
+	loops    sync.WaitGroup
+	latch    *latch       // nil unless symmetric RTP is enabled
+	lastRTP  atomic.Int64 // unix nanoseconds
+
+	jitter   atomic.Pointer[JitterBuffer] // replaced when the clock rate changes
+	buffered chan struct{}                // signalled when a packet is buffered
+
+	stats          *rtpStats
+	cname          string
+	reportInterval time.Duration
+
+	packets chan *rtp.Packet
+	done    chan struct{} // closed by Close
+
+	writeMu    sync.Mutex // serializes WriteSample
+	packetizer *packetizer
+	pacer      pacer
+
+	sessionID      uint64
+	sessionVersion uint64
 }
 
-func NewUDPMediaEngine(log logger.Logger) MediaEngine {
+// NewUDPMediaEngine returns an engine taking its RTP/RTCP ports from ports
+// and binding them on iface.
+func NewUDPMediaEngine(log logger.Logger, ports *PortAllocator, iface Interface) MediaEngine {
+	now := uint64(time.Now().Unix())
+	p := newPacketizer()
 	me := &UDPMediaEngine{
-		logger: log,
+		logger:         log,
+		ports:          ports,
+		iface:          iface,
+		negotiator:     NewNegotiator(),
+		packets:        make(chan *rtp.Packet, rtpBufferSize),
+		buffered:       make(chan struct{}, 1),
+		done:           make(chan struct{}),
+		packetizer:     p,
+		stats:          newRTPStats(p.ssrc),
+		cname:          fmt.Sprintf("%016x@sipnexus", rand.Uint64()),
+		reportInterval: rtcpInterval,
+		sessionID:      now,
+		sessionVersion: now,
+	}
+	if iface.SymmetricRTP.Enabled {
+		me.latch = newLatch(iface.SymmetricRTP)
+	}
+	if iface.Codecs != nil {
+		me.negotiator.Codecs = iface.Codecs
 	}
 
 	return me
 }
 
 func (ume *UDPMediaEngine) SetOffer(offer string) (string, error) {
-	var sd sdp.SessionDescription
-	err := sd.Unmarshal([]byte(offer))
+	sd, err := utils.ParseSDP([]byte(offer))
 	if err != nil {
-		return "", fmt.Errorf("failed to parse SDP: %w", err)
+		return "", err
 	}
 
-	err = ume.validateFormats(sd.MediaDescriptions)
+	ume.negMu.Lock()
+	defer ume.negMu.Unlock()
+	streams, err := ume.negotiator.Negotiate(sd)
+	if err != nil {
+		return "", err
+	}
+	port, err := ume.bind()
 	if err != nil {
 		return "", err
 	}
-	conn, err := NewUDPConn(net.UDPAddr{
-		IP:   net.ParseIP("0.0.0.0"),
-		Port: getFreePort(),
-	})
+	for _, stream := range streams {
+		if stream.Accepted {
+			if err := ume.startRemote(stream); err != nil {
+				return "", err
+			}
+		}
+	}
+	// A new offer from the peer supersedes ours (RFC 3264 section 8).
+	ume.offered = nil
+	answer, err := ume.localDescription(ume.negotiator.Answer(streams, port)).Marshal()
+	return string(answer), err
+}
+
+func (ume *UDPMediaEngine) CreateOffer() (string, error) {
+	ume.negMu.Lock()
+	defer ume.negMu.Unlock()
+	port, err := ume.bind()
 	if err != nil {
 		return "", err
 	}
-	ume.rtpConn = conn
-	ume.logger.Infof("ci: %v", ume.selectedCI)
-	err = ume.rtpConn.SetRemoteAddr(net.UDPAddrFromAddrPort(netip.MustParseAddrPort(ume.selectedCI)))
+	codecs := ume.negotiator.Codecs
+	if stream, ok := ume.Stream(); ok {
+		codecs = stream.Codecs
+	}
+	offer, err := ume.localDescription([]*sdp.MediaDescription{ume.negotiator.Offer(port, codecs)}).Marshal()
 	if err != nil {
 		return "", err
 	}
-	go ume.readLoop()
-	return ume.generateAnswer(sd)
+	ume.offered = codecs
+	return string(offer), nil
+}
+
+func (ume *UDPMediaEngine) SetAnswer(answer string) error {
+	sd, err := utils.ParseSDP([]byte(answer))
+	if err != nil {
+		return err
+	}
+
+	ume.negMu.Lock()
+	defer ume.negMu.Unlock()
+	if ume.offered == nil {
+		return errors.New("no local offer")
+	}
+	stream, err := ume.negotiator.NegotiateAnswer(sd, ume.offered)
+	if err != nil {
+		return err
+	}
+	ume.offered = nil
+	return ume.startRemote(stream)
+}
+
+func (ume *UDPMediaEngine) Hold(hold bool) {
+	ume.negMu.Lock()
+	defer ume.negMu.Unlock()
+	if hold {
+		ume.negotiator.Direction = SendOnly
+	} else {
+		ume.negotiator.Direction = SendRecv
+	}
+}
+
+// Close sends an RTCP BYE, releases the media sockets and their ports and
+// waits for the loops to end. The engine cannot be used afterwards.
+func (ume *UDPMediaEngine) Close() error {
+	ume.mu.Lock()
+	if ume.closed {
+		ume.mu.Unlock()
+		return nil
+	}
+	ume.closed = true
+	close(ume.done)
+	if ume.started {
+		bye := append(ume.stats.report(time.Now(), ume.cname), &rtcp.Goodbye{Sources: []uint32{ume.packetizer.ssrc}})
+		if err := ume.writeRTCPLocked(bye); err != nil {
+			ume.logger.Warnf("failed to send RTCP BYE: %v", err)
+		}
+	}
+	var err error
+	if ume.pair != nil {
+		err = ume.pair.Close()
+	}
+	ume.mu.Unlock()
+
+	ume.loops.Wait()
+	return err
+}
+
+// LocalAddr returns the bound RTP address, or nil before the engine bound.
+func (ume *UDPMediaEngine) LocalAddr() *net.UDPAddr {
+	ume.mu.Lock()
+	defer ume.mu.Unlock()
+	if ume.rtpConn == nil {
+		return nil
+	}
+	addr := ume.rtpConn.localAddr
+	return &addr
+}
+
+func (ume *UDPMediaEngine) ReadRTP() (*rtp.Packet, error) {
+	select {
+	case pkt := <-ume.packets:
+		return pkt, nil
+	case <-ume.done:
+		return nil, ErrEngineClosed
+	}
+}
+
+func (ume *UDPMediaEngine) ReadFrame() (Frame, error) {
+	t := time.NewTimer(time.Hour)
+	defer t.Stop()
+	for {
+		// Wait for the next frame to be due, or for a packet that may come
+		// before it, when nothing is buffered.
+		var due <-chan time.Time
+		if jb := ume.jitter.Load(); jb != nil {
+			if f, ok := jb.Pop(time.Now()); ok {
+				return f, nil
+			}
+			if next, ok := jb.Next(); ok {
+				t.Reset(time.Until(next))
+				due = t.C
+			}
+		}
+		select {
+		case <-due:
+		case <-ume.buffered:
+		case <-ume.done:
+			return Frame{}, ErrEngineClosed
+		}
+	}
+}
+
+func (ume *UDPMediaEngine) WriteRTP(pkt *rtp.Packet) error {
+	b, err := pkt.Marshal()
+	if err != nil {
+		return err
+	}
+	ume.mu.Lock()
+	if ume.closed {
+		ume.mu.Unlock()
+		return ErrEngineClosed
+	}
+	if ume.stream == nil {
+		ume.mu.Unlock()
+		return ErrNotNegotiated
+	}
+	conn := ume.rtpConn
+	ume.mu.Unlock()
+	if err := conn.write(b); err != nil {
+		return err
+	}
+	ume.stats.sent(pkt, time.Now())
+	return nil
+}
+
+func (ume *UDPMediaEngine) WriteSample(s Sample) error {
+	stream, ok := ume.Stream()
+	if !ok {
+		return ErrNotNegotiated
+	}
+	codec, _ := stream.Codec()
+	d := s.Duration
+	if d == 0 {
+		d = time.Duration(ume.negotiator.ptime()) * time.Millisecond
+	}
+
+	ume.writeMu.Lock()
+	defer ume.writeMu.Unlock()
+	gap, err := ume.pacer.wait(d, ume.done)
+	if err != nil {
+		return err
+	}
+	if gap > 0 {
+		ume.packetizer.skip(samples(gap, codec.ClockRate))
+	}
+	pkt := ume.packetizer.packetize(codec.PayloadType, s.Data, samples(d, codec.ClockRate))
+	// Media is still paced and counted while the peer does not want it, so
+	// the stream stays continuous when it resumes.
+	if !stream.Direction.Sends() {
+		return nil
+	}
+	return ume.WriteRTP(pkt)
+}
+
+// samples converts d to RTP timestamp units at clockRate.
+func samples(d time.Duration, clockRate uint32) uint32 {
+	return uint32(d * time.Duration(clockRate) / time.Second)
+}
+
+// Stream returns the negotiated stream, or false before negotiation ended.
+func (ume *UDPMediaEngine) Stream() (Stream, bool) {
+	ume.mu.Lock()
+	defer ume.mu.Unlock()
+	if ume.stream == nil {
+		return Stream{}, false
+	}
+	return *ume.stream, true
+}
+
+func (ume *UDPMediaEngine) Stats() Stats {
+	return ume.stats.stats()
+}
+
+func (ume *UDPMediaEngine) SSRC() uint32 {
+	return ume.packetizer.ssrc
+}
+
+func (ume *UDPMediaEngine) LastRTP() time.Time {
+	ns := ume.lastRTP.Load()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// bind allocates the port pair on first use and returns the RTP port.
+func (ume *UDPMediaEngine) bind() (int, error) {
+	ume.mu.Lock()
+	defer ume.mu.Unlock()
+	if ume.closed {
+		return 0, ErrEngineClosed
+	}
+	if ume.rtpConn != nil {
+		return ume.rtpConn.localAddr.Port, nil
+	}
+	ip := ume.iface.BindIP
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+	pair, err := ume.ports.Allocate(ip)
+	if err != nil {
+		return 0, err
+	}
+	ume.pair = pair
+	ume.rtpConn = &UDPConn{
+		conn:      pair.RTP,
+		localAddr: net.UDPAddr{IP: ip, Port: pair.Port()},
+	}
+	ume.rtcpConn = &UDPConn{
+		conn:      pair.RTCP,
+		localAddr: net.UDPAddr{IP: ip, Port: pair.Port() + 1},
+	}
+	return pair.Port(), nil
+}
+
+// startRemote makes stream the negotiated one, pointing the media sockets
+// at its remote addresses, and starts the loops on first use.
+func (ume *UDPMediaEngine) startRemote(stream Stream) error {
+	ume.mu.Lock()
+	defer ume.mu.Unlock()
+	if ume.closed {
+		return ErrEngineClosed
+	}
+	codec, _ := stream.Codec()
+	ume.logger.Infof("negotiated %s/%d with %s, %s", codec.Name, codec.ClockRate, stream.Remote, stream.Direction)
+	remote, remoteRTCP := stream.Remote, stream.RemoteRTCP
+	if ume.latch != nil {
+		// A re-negotiation keeping the address keeps what was latched; a
+		// new address has to be learned again.
+		if ume.stream == nil || !sameAddr(ume.stream.Remote, remote) {
+			ume.latch.reset()
+		} else {
+			remote, remoteRTCP = ume.rtpConn.RemoteAddr(), ume.rtcpConn.RemoteAddr()
+		}
+	}
+	ume.rtpConn.SetRemoteAddr(remote)
+	ume.rtcpConn.SetRemoteAddr(remoteRTCP)
+	ume.stream = &stream
+	ume.stats.setClockRate(codec.ClockRate)
+	if jb := ume.jitter.Load(); jb == nil || jb.cfg.ClockRate != codec.ClockRate {
+		ume.jitter.Store(NewJitterBuffer(JitterBufferConfig{ClockRate: codec.ClockRate}))
+	}
+	if !ume.started {
+		ume.started = true
+		ume.loops.Add(3)
+		go ume.readLoop(ume.rtpConn.conn)
+		go ume.readRTCPLoop(ume.rtcpConn.conn)
+		go ume.reportLoop()
+	}
+	return nil
 }
 
-func (ume *UDPMediaEngine) generateAnswer(offer sdp.SessionDescription) (string, error) {
-	answer := sdp.SessionDescription{
+// localDescription wraps our m-lines in a session description, bumping the
+// origin version as every description we send differs from the last.
+func (ume *UDPMediaEngine) localDescription(media []*sdp.MediaDescription) *sdp.SessionDescription {
+	ume.mu.Lock()
+	version := ume.sessionVersion
+	ume.sessionVersion++
+	ume.mu.Unlock()
+
+	addrType, addr := ume.iface.sdpAddress()
+	return &sdp.SessionDescription{
 		Version: 0,
 		Origin: sdp.Origin{
 			Username:       "-",
-			SessionID:      offer.Origin.SessionID,
-			SessionVersion: offer.Origin.SessionID + 2,
+			SessionID:      ume.sessionID,
+			SessionVersion: version,
 			NetworkType:    "IN",
-			AddressType:    "IP4",
-			UnicastAddress: "0.0.0.0",
+			AddressType:    addrType,
+			UnicastAddress: addr,
 		},
 		SessionName: "SIP Nexus",
 		ConnectionInformation: &sdp.ConnectionInformation{
 			NetworkType: "IN",
-			AddressType: "IP4",
-			Address:     &sdp.Address{Address: "0.0.0.0"},
+			AddressType: addrType,
+			Address:     &sdp.Address{Address: addr},
 		},
 		TimeDescriptions: []sdp.TimeDescription{
 			{
@@ -86,90 +488,187 @@ func (ume *UDPMediaEngine) generateAnswer(offer sdp.SessionDescription) (string,
 				},
 			},
 		},
-		MediaDescriptions: []*sdp.MediaDescription{
-			{
-				MediaName: sdp.MediaName{
-					Media:   "audio",
-					Port:    sdp.RangedPort{Value: ume.rtpConn.localAddr.Port},
-					Protos:  []string{"RTP", "AVP"},
-					Formats: []string{"0"},
-				},
-				Attributes: []sdp.Attribute{
-					{Key: "rtpmap", Value: "0 PCMU/8000"},
-					{Key: "ptime", Value: "20"},
-					{Key: "maxptime", Value: "150"},
-					{Key: "sendrecv"},
-				},
-			},
-		}}
-	ans, err := answer.Marshal()
-	return string(ans), err
+		MediaDescriptions: media,
+	}
 }
 
-func (ume *UDPMediaEngine) validateFormats(mediaDesc []*sdp.MediaDescription) error {
-	// 111 - opus, 0 - pcmu, 8 - pcma
-	filterSupportedCodec := func(codec string) (string, string, bool) {
-		values := strings.Split(codec, "/")
-		if len(values) < 2 {
-			return "", "", false
+// readLoop hands received packets to ReadRTP until conn is closed by Close.
+// RTCP multiplexed on the port is passed on to the statistics.
+func (ume *UDPMediaEngine) readLoop(conn *net.UDPConn) {
+	defer ume.loops.Done()
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
 		}
-		codecName := values[0]
-		clockRate := values[1]
-		return codecName, clockRate, slices.Contains(SupportedCodecs, codecName)
-	}
-	validCodecs := [][]string{}
-	for _, md := range mediaDesc {
-		if md.MediaName.Media != "audio" {
+		now := time.Now()
+		if isRTCP(buf[:n]) {
+			ume.receiveRTCP(buf[:n], src, now)
 			continue
 		}
-		for _, a := range md.Attributes {
-			if a.Key != "rtpmap" {
-				continue
-			}
-			values := strings.Split(a.Value, " ")
-			if len(values) != 2 {
-				continue
-			}
-			format := values[0]
-			codec := values[1]
-			ume.logger.Infof("got codec info %#v", values)
-			if codecName, rate, ok := filterSupportedCodec(codec); ok {
-				validCodecs = append(validCodecs, []string{format, codecName, rate})
-				if ume.selectedCI == "" {
-					ume.selectedCI = fmt.Sprintf("%v:%v", md.ConnectionInformation.Address.String(), md.MediaName.Port.Value)
-				}
-			}
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(append([]byte(nil), buf[:n]...)); err != nil {
+			continue
+		}
+		if ume.latch != nil && !ume.latchPacket(src, pkt, now) {
+			rtpForeignPackets.Inc()
+			continue
+		}
+		// Only media of the peer keeps the call from timing out.
+		ume.lastRTP.Store(now.UnixNano())
+		ume.stats.receive(pkt, now)
+		ume.jitter.Load().Push(pkt, now)
+		select {
+		case ume.buffered <- struct{}{}:
+		default:
+		}
+		select {
+		case ume.packets <- pkt:
+		default:
+			// Nobody is reading fast enough; drop rather than stall.
+		}
+	}
+}
+
+// readRTCPLoop takes in RTCP from the peer until conn is closed by Close.
+func (ume *UDPMediaEngine) readRTCPLoop(conn *net.UDPConn) {
+	defer ume.loops.Done()
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
 		}
+		ume.receiveRTCP(buf[:n], src, time.Now())
 	}
-	if len(validCodecs) == 0 {
-		return errors.New("invalid codecs")
+}
+
+// receiveRTCP processes a compound RTCP packet from src. Only reports from
+// the peer's RTCP address or about the source we receive are taken in, so
+// that a third party cannot skew the statistics. With symmetric RTP reports
+// go back to where the peer's reports come from, once they are known to be
+// about the source we latched.
+func (ume *UDPMediaEngine) receiveRTCP(b []byte, src *net.UDPAddr, now time.Time) {
+	pkts, err := rtcp.Unmarshal(b)
+	if err != nil {
+		return
+	}
+	sender, ok := rtcpSender(pkts)
+	remote, receiving := ume.stats.source()
+	fromSource := ok && receiving && sender == remote
+	if !fromSource && !ume.fromRTCPPeer(src) {
+		rtcpForeignPackets.Inc()
+		return
+	}
+	ume.stats.process(pkts, now)
+	if ume.latch == nil || !ok {
+		return
 	}
 
-	ume.selectedCodec = validCodecs[0]
+	ume.mu.Lock()
+	defer ume.mu.Unlock()
+	if ume.stream == nil || ume.stream.RTCPMux || ume.stream.Remote.IP.IsUnspecified() {
+		return
+	}
+	if ssrc, ok := ume.latch.source(); ok && sender == ssrc {
+		ume.rtcpConn.SetRemoteAddr(src)
+	}
+}
 
-	return nil
+// fromRTCPPeer reports whether src is where we send RTCP to, as negotiated
+// or latched.
+func (ume *UDPMediaEngine) fromRTCPPeer(src *net.UDPAddr) bool {
+	ume.mu.Lock()
+	defer ume.mu.Unlock()
+	if ume.stream == nil {
+		return false
+	}
+	conn := ume.rtcpConn
+	if ume.stream.RTCPMux {
+		conn = ume.rtpConn
+	}
+	remote := conn.RemoteAddr()
+	return remote != nil && sameAddr(remote, src)
 }
 
-// TODO: implement close as well
-func (ume *UDPMediaEngine) readLoop() {
+// rtcpSender returns the SSRC of the sender of a compound packet, which
+// starts with a sender or receiver report (RFC 3550 section 6.1).
+func rtcpSender(pkts []rtcp.Packet) (uint32, bool) {
+	for _, p := range pkts {
+		switch p := p.(type) {
+		case *rtcp.SenderReport:
+			return p.SSRC, true
+		case *rtcp.ReceiverReport:
+			return p.SSRC, true
+		}
+	}
+	return 0, false
+}
+
+// reportLoop sends RTCP reports every interval until Close.
+func (ume *UDPMediaEngine) reportLoop() {
+	defer ume.loops.Done()
+	t := time.NewTicker(ume.reportInterval)
+	defer t.Stop()
 	for {
-		buf := make([]byte, 1024)
-		n, _, err := ume.rtpConn.conn.ReadFrom(buf)
-		if err != nil {
+		select {
+		case <-ume.done:
 			return
+		case now := <-t.C:
+			ume.mu.Lock()
+			if !ume.closed {
+				if err := ume.writeRTCPLocked(ume.stats.report(now, ume.cname)); err != nil {
+					ume.logger.Warnf("failed to send RTCP report: %v", err)
+				}
+			}
+			ume.mu.Unlock()
 		}
-		ume.logger.Infof("read packets: %v", n)
 	}
 }
 
-type UDPConn struct {
-	conn       *net.UDPConn
-	localAddr  net.UDPAddr
-	remoteAddr *net.UDPAddr
+// writeRTCPLocked sends a compound RTCP packet to the peer, on the RTP port
+// when RTCP is multiplexed. ume.mu must be held.
+func (ume *UDPMediaEngine) writeRTCPLocked(pkts []rtcp.Packet) error {
+	b, err := rtcp.Marshal(pkts)
+	if err != nil {
+		return err
+	}
+	conn := ume.rtcpConn
+	if ume.stream != nil && ume.stream.RTCPMux {
+		conn = ume.rtpConn
+	}
+	return conn.write(b)
 }
 
-func getFreePort() int {
-	return 10001
+// latchPacket runs a received packet through symmetric RTP, moving the
+// remote address when it latches. It reports false for packets to drop:
+// those of payload types that were not negotiated and those from addresses
+// other than the latched one.
+func (ume *UDPMediaEngine) latchPacket(src *net.UDPAddr, pkt *rtp.Packet, now time.Time) bool {
+	// Holding mu keeps a re-negotiation from interleaving with a move.
+	ume.mu.Lock()
+	defer ume.mu.Unlock()
+	stream := ume.stream
+	if stream == nil || !stream.hasPayloadType(pkt.PayloadType) {
+		return false
+	}
+	accept, moved := ume.latch.observe(src, pkt.SSRC, now)
+	// A peer holding with c=0.0.0.0 gets nothing, wherever it sends from.
+	if moved != nil && !stream.Remote.IP.IsUnspecified() {
+		ume.logger.Infof("latched RTP to %s, SDP has %s", moved, stream.Remote)
+		ume.rtpConn.SetRemoteAddr(moved)
+	}
+	return accept
+}
+
+// UDPConn is a media socket and the peer address it sends to.
+type UDPConn struct {
+	conn      *net.UDPConn
+	localAddr net.UDPAddr
+
+	mu         sync.Mutex
+	remoteAddr *net.UDPAddr
 }
 
 func NewUDPConn(laddr net.UDPAddr) (*UDPConn, error) {
@@ -184,10 +683,28 @@ func NewUDPConn(laddr net.UDPAddr) (*UDPConn, error) {
 	return c, err
 }
 
-func (uc *UDPConn) SetRemoteAddr(addr *net.UDPAddr) error {
-	if uc.remoteAddr != nil {
-		return errors.New("remote addr is already set")
-	}
+// SetRemoteAddr points the connection at addr, replacing the previous
+// address after a re-negotiation.
+func (uc *UDPConn) SetRemoteAddr(addr *net.UDPAddr) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
 	uc.remoteAddr = addr
-	return nil
+}
+
+// RemoteAddr returns the address media is sent to.
+func (uc *UDPConn) RemoteAddr() *net.UDPAddr {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	return uc.remoteAddr
+}
+
+// write sends b to the remote address. Nothing is sent before the address
+// is known or to a peer on hold with an unspecified address.
+func (uc *UDPConn) write(b []byte) error {
+	remote := uc.RemoteAddr()
+	if remote == nil || remote.IP.IsUnspecified() {
+		return nil
+	}
+	_, err := uc.conn.WriteToUDP(b, remote)
+	return err
 }
@@ -0,0 +1,181 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/itzmanish/sipnexus/pkg/logger"
+)
+
+func TestReOffer(t *testing.T) {
+	peer, ume := newTestPeer(t, SendRecv)
+	port := ume.LocalAddr().Port
+
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	answer, err := ume.SetOffer(sdpOf("c=IN IP4 127.0.0.1",
+		fmt.Sprintf("m=audio %d RTP/AVP 0", other.LocalAddr().(*net.UDPAddr).Port),
+		"a=rtpmap:0 PCMU/8000", "a=sendonly"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(answer, fmt.Sprintf("m=audio %d ", port)) {
+		t.Fatalf("expected the re-answer to keep port %d:\n%s", port, answer)
+	}
+	if !strings.Contains(answer, "a=recvonly") {
+		t.Fatalf("expected recvonly answer to a sendonly re-offer:\n%s", answer)
+	}
+	stream, _ := ume.Stream()
+	if stream.Remote.Port != other.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("remote not updated, got %s", stream.Remote)
+	}
+
+	// Media to the new address flows through the same read loop.
+	b, _ := ume.packetizer.packetize(0, []byte{1}, 160).Marshal()
+	other.WriteToUDP(b, ume.LocalAddr())
+	if _, err := ume.ReadRTP(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Resuming sends to the new address and no longer to the old one.
+	if _, err := ume.SetOffer(sdpOf("c=IN IP4 127.0.0.1",
+		fmt.Sprintf("m=audio %d RTP/AVP 0", other.LocalAddr().(*net.UDPAddr).Port),
+		"a=rtpmap:0 PCMU/8000")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ume.WriteSample(Sample{Data: make([]byte, 160)}); err != nil {
+		t.Fatal(err)
+	}
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := other.Read(make([]byte, 1500)); err != nil {
+		t.Fatalf("expected media at the new address: %v", err)
+	}
+	peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := peer.Read(make([]byte, 1500)); err == nil {
+		t.Fatal("received media at the old address")
+	}
+}
+
+func TestCreateOfferSetAnswer(t *testing.T) {
+	ports, _ := NewPortAllocator(34200, 34201)
+	ume := NewUDPMediaEngine(logger.NewLogger(), ports, Interface{BindIP: net.IPv4(127, 0, 0, 1)}).(*UDPMediaEngine)
+	defer ume.Close()
+
+	answer := sdpOf("c=IN IP4 127.0.0.1", "m=audio 4000 RTP/AVP 8", "a=rtpmap:8 PCMA/8000")
+	if err := ume.SetAnswer(answer); err == nil {
+		t.Fatal("expected an error for an answer without offer")
+	}
+
+	offer, err := ume.CreateOffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(offer, "m=audio 34200 RTP/AVP 0 8 13 101") {
+		t.Fatalf("unexpected offer:\n%s", offer)
+	}
+	if err := ume.SetAnswer(answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := ume.SetAnswer(answer); err == nil {
+		t.Fatal("expected an error for a second answer to the same offer")
+	}
+	stream, ok := ume.Stream()
+	if codec, _ := stream.Codec(); !ok || codec.Name != "PCMA" {
+		t.Fatalf("expected PCMA, got %v", stream)
+	}
+
+	// A re-offer on hold keeps the port and only offers the negotiated codec.
+	ume.Hold(true)
+	first := offer
+	offer, err = ume.CreateOffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(offer, "m=audio 34200 RTP/AVP 8\r\n") || !strings.Contains(offer, "a=sendonly") {
+		t.Fatalf("unexpected re-offer:\n%s", offer)
+	}
+	if originOf(offer) == originOf(first) {
+		t.Fatalf("expected the session version to grow:\n%s", offer)
+	}
+	if err := ume.SetAnswer(sdpOf("c=IN IP4 127.0.0.1", "m=audio 4000 RTP/AVP 8", "a=rtpmap:8 PCMA/8000", "a=recvonly")); err != nil {
+		t.Fatal(err)
+	}
+	if stream, _ := ume.Stream(); stream.Direction != SendOnly {
+		t.Fatalf("expected sendonly on hold, got %s", stream.Direction)
+	}
+}
+
+func TestCloseReleasesPorts(t *testing.T) {
+	ports, _ := NewPortAllocator(34300, 34301)
+	for i := 0; i < 3; i++ {
+		ume := NewUDPMediaEngine(logger.NewLogger(), ports, Interface{BindIP: net.IPv4(127, 0, 0, 1)})
+		if _, err := ume.CreateOffer(); err != nil {
+			t.Fatalf("round %d: %v", i, err)
+		}
+		if err := ume.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ume.Close(); err != nil {
+			t.Fatal("second Close should be a no-op")
+		}
+		if _, err := ume.CreateOffer(); !errors.Is(err, ErrEngineClosed) {
+			t.Fatalf("expected ErrEngineClosed, got %v", err)
+		}
+	}
+	if ports.InUse() != 0 {
+		t.Fatalf("expected all ports released, %d in use", ports.InUse())
+	}
+}
+
+func TestEngineConcurrentUse(t *testing.T) {
+	peer, ume := newTestPeer(t, SendRecv)
+	offer := sdpOf("c=IN IP4 127.0.0.1",
+		fmt.Sprintf("m=audio %d RTP/AVP 0", peer.LocalAddr().(*net.UDPAddr).Port),
+		"a=rtpmap:0 PCMU/8000")
+
+	var wg sync.WaitGroup
+	run := func(f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := f(); errors.Is(err, ErrEngineClosed) {
+					return
+				}
+			}
+		}()
+	}
+	run(func() error { _, err := ume.SetOffer(offer); return err })
+	run(func() error { ume.Hold(true); _, err := ume.CreateOffer(); return err })
+	run(func() error { return ume.WriteSample(Sample{Data: make([]byte, 160), Duration: time.Millisecond}) })
+	run(func() error { _, err := ume.ReadRTP(); return err })
+	go func() {
+		b, _ := newPacketizer().packetize(0, nil, 160).Marshal()
+		for i := 0; i < 20; i++ {
+			peer.WriteToUDP(b, ume.LocalAddr())
+		}
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if err := ume.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
+
+func originOf(sdp string) string {
+	for _, line := range strings.Split(sdp, "\r\n") {
+		if strings.HasPrefix(line, "o=") {
+			return line
+		}
+	}
+	return ""
+}
@@ -0,0 +1,366 @@
+package media
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// rtcpInterval is how often reports are sent. RFC 3550 section 6.2 sets
+// 5 seconds as the minimum; with two participants it is also the typical
+// interval.
+const rtcpInterval = 5 * time.Second
+
+// Sequence number distances from RFC 3550 appendix A.1.
+const (
+	maxDropout  = 3000
+	maxMisorder = 100
+)
+
+var (
+	rtpPacketsLost = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sipnexus_rtp_packets_lost_total",
+		Help: "RTP packets lost on the way to us, as counted for receiver reports.",
+	})
+	rtpJitter = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "sipnexus_rtp_jitter_seconds",
+		Help:    "Interarrival jitter of received RTP at each report.",
+		Buckets: []float64{.001, .005, .01, .02, .03, .05, .1, .2},
+	})
+	rtcpForeignPackets = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sipnexus_rtcp_foreign_packets_total",
+		Help: "RTCP packets dropped because they came neither from the peer nor about its source.",
+	})
+	rtcpRTT = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "sipnexus_rtcp_rtt_seconds",
+		Help:    "Round trip time measured from RTCP reports of the peer.",
+		Buckets: []float64{.01, .025, .05, .1, .15, .2, .3, .5, 1},
+	})
+	callMOS = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "sipnexus_call_mos",
+		Help:    "Estimated mean opinion score of calls at each report.",
+		Buckets: []float64{1, 2, 2.5, 3, 3.5, 3.8, 4, 4.2, 4.4},
+	})
+)
+
+// Stats describe the quality of a call's media as seen by us and as
+// reported by the peer.
+type Stats struct {
+	PacketsSent     uint32
+	OctetsSent      uint32
+	PacketsReceived uint32
+	// PacketsLost is the number of packets that did not arrive, negative
+	// when duplicates arrived (RFC 3550 section 6.4.1).
+	PacketsLost int32
+	// LossRate is the share of expected packets that were lost.
+	LossRate float64
+	// Jitter is the interarrival jitter of received packets.
+	Jitter time.Duration
+	// RTT is the round trip time from the last report of the peer, zero
+	// until the peer reported on our media.
+	RTT time.Duration
+	// RemoteFractionLost and RemoteJitter are what the peer last reported
+	// about the media we send.
+	RemoteFractionLost float64
+	RemoteJitter       time.Duration
+	// MOS estimates the mean opinion score, from 1 to 4.5, of what we
+	// receive.
+	MOS float64
+}
+
+// rtpStats keeps the counters of one RTP session: of the source we send and
+// of the one we receive (RFC 3550 appendix A.1, A.3 and A.8).
+type rtpStats struct {
+	mu        sync.Mutex
+	clockRate uint32
+	start     time.Time // arrival times are taken relative to it
+
+	ssrc        uint32
+	packetsSent uint32
+	octetsSent  uint32
+	lastTS      uint32
+	lastSentAt  time.Time
+	sentSince   bool // sent since the last report
+
+	remoteSSRC    uint32
+	receiving     bool
+	maxSeq        uint16
+	cycles        uint32
+	baseSeq       uint32
+	badSeq        uint32
+	received      uint32
+	expectedPrior uint32
+	receivedPrior uint32
+	transit       int64
+	jitter        float64 // in timestamp units
+
+	lastSR   uint32 // middle 32 bits of the NTP time of the last SR
+	lastSRAt time.Time
+
+	rtt          time.Duration
+	remoteLost   float64
+	remoteJitter time.Duration
+}
+
+func newRTPStats(ssrc uint32) *rtpStats {
+	return &rtpStats{ssrc: ssrc, clockRate: 8000, start: time.Now(), badSeq: math.MaxUint32}
+}
+
+func (s *rtpStats) setClockRate(clockRate uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if clockRate > 0 {
+		s.clockRate = clockRate
+	}
+}
+
+// sent counts a packet we sent at now.
+func (s *rtpStats) sent(pkt *rtp.Packet, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ssrc = pkt.SSRC
+	s.packetsSent++
+	s.octetsSent += uint32(len(pkt.Payload))
+	s.lastTS = pkt.Timestamp
+	s.lastSentAt = now
+	s.sentSince = true
+}
+
+// receive counts a packet that arrived at now.
+func (s *rtpStats) receive(pkt *rtp.Packet, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq := pkt.SequenceNumber
+	if !s.receiving || pkt.SSRC != s.remoteSSRC {
+		s.restart(pkt.SSRC, seq)
+	} else if delta := seq - s.maxSeq; delta < maxDropout {
+		if seq < s.maxSeq {
+			s.cycles += 1 << 16
+		}
+		s.maxSeq = seq
+	} else if delta <= 1<<16-maxMisorder {
+		// A large jump: take it as a restart of the sender when the next
+		// packet continues from it, otherwise drop it.
+		if uint32(seq) != s.badSeq {
+			s.badSeq = uint32(seq+1) & 0xffff
+			return
+		}
+		s.restart(pkt.SSRC, seq)
+	}
+	// Anything else is a duplicate or reordered packet and still counts.
+	s.received++
+
+	// Interarrival jitter (RFC 3550 section 6.4.1 and A.8).
+	arrival := int64(now.Sub(s.start)/time.Microsecond) * int64(s.clockRate) / 1e6
+	transit := arrival - int64(pkt.Timestamp)
+	if s.received > 1 {
+		d := transit - s.transit
+		if d < 0 {
+			d = -d
+		}
+		s.jitter += (float64(d) - s.jitter) / 16
+	}
+	s.transit = transit
+}
+
+func (s *rtpStats) restart(ssrc uint32, seq uint16) {
+	s.receiving = true
+	s.remoteSSRC = ssrc
+	s.maxSeq = seq
+	s.cycles = 0
+	s.baseSeq = uint32(seq)
+	s.badSeq = math.MaxUint32
+	s.received = 0
+	s.expectedPrior = 0
+	s.receivedPrior = 0
+	s.jitter = 0
+}
+
+// lost returns the packets expected and lost so far.
+func (s *rtpStats) lost() (expected uint32, lost int32) {
+	expected = s.cycles + uint32(s.maxSeq) - s.baseSeq + 1
+	lost = int32(expected - s.received)
+	// The field in reports is 24 bits signed.
+	return expected, max(min(lost, 0x7fffff), -0x800000)
+}
+
+// report builds the compound packet sent every interval: a sender report
+// when we sent media since the last one, a receiver report otherwise, and
+// our CNAME.
+func (s *rtpStats) report(now time.Time, cname string) []rtcp.Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var blocks []rtcp.ReceptionReport
+	if s.receiving {
+		expected, lost := s.lost()
+		expectedInterval := expected - s.expectedPrior
+		receivedInterval := s.received - s.receivedPrior
+		s.expectedPrior, s.receivedPrior = expected, s.received
+		var fraction uint8
+		if lostInterval := int64(expectedInterval) - int64(receivedInterval); expectedInterval > 0 && lostInterval > 0 {
+			fraction = uint8(lostInterval << 8 / int64(expectedInterval))
+			rtpPacketsLost.Add(float64(lostInterval))
+		}
+		block := rtcp.ReceptionReport{
+			SSRC:               s.remoteSSRC,
+			FractionLost:       fraction,
+			TotalLost:          uint32(lost) & 0xffffff,
+			LastSequenceNumber: s.cycles + uint32(s.maxSeq),
+			Jitter:             uint32(s.jitter),
+		}
+		if !s.lastSRAt.IsZero() {
+			block.LastSenderReport = s.lastSR
+			block.Delay = uint32(now.Sub(s.lastSRAt) * 65536 / time.Second)
+		}
+		blocks = append(blocks, block)
+
+		rtpJitter.Observe(s.jitterDuration().Seconds())
+		callMOS.Observe(s.mos())
+	}
+
+	var head rtcp.Packet
+	if s.sentSince {
+		s.sentSince = false
+		head = &rtcp.SenderReport{
+			SSRC:        s.ssrc,
+			NTPTime:     ntpTime(now),
+			RTPTime:     s.lastTS + uint32(now.Sub(s.lastSentAt)*time.Duration(s.clockRate)/time.Second),
+			PacketCount: s.packetsSent,
+			OctetCount:  s.octetsSent,
+			Reports:     blocks,
+		}
+	} else {
+		head = &rtcp.ReceiverReport{SSRC: s.ssrc, Reports: blocks}
+	}
+	return []rtcp.Packet{head, &rtcp.SourceDescription{Chunks: []rtcp.SourceDescriptionChunk{{
+		Source: s.ssrc,
+		Items:  []rtcp.SourceDescriptionItem{{Type: rtcp.SDESCNAME, Text: cname}},
+	}}}}
+}
+
+// source returns the SSRC we receive, or false before any RTP arrived.
+func (s *rtpStats) source() (uint32, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remoteSSRC, s.receiving
+}
+
+// process takes in a compound packet from the peer received at now.
+func (s *rtpStats) process(pkts []rtcp.Packet, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range pkts {
+		switch p := p.(type) {
+		case *rtcp.SenderReport:
+			s.lastSR = uint32(p.NTPTime >> 16)
+			s.lastSRAt = now
+			s.reportBlocks(p.Reports, now)
+		case *rtcp.ReceiverReport:
+			s.reportBlocks(p.Reports, now)
+		}
+	}
+}
+
+// reportBlocks takes in what the peer reports about our media and derives
+// the round trip time (RFC 3550 section 6.4.1).
+func (s *rtpStats) reportBlocks(blocks []rtcp.ReceptionReport, now time.Time) {
+	for _, b := range blocks {
+		if b.SSRC != s.ssrc {
+			continue
+		}
+		s.remoteLost = float64(b.FractionLost) / 256
+		s.remoteJitter = time.Duration(b.Jitter) * time.Second / time.Duration(s.clockRate)
+		if b.LastSenderReport == 0 {
+			continue
+		}
+		rtt := uint32(ntpTime(now)>>16) - b.LastSenderReport - b.Delay
+		// Clock trouble shows as a huge value; ignore it.
+		if rtt < 65536*10 {
+			s.rtt = time.Duration(rtt) * time.Second / 65536
+			rtcpRTT.Observe(s.rtt.Seconds())
+		}
+	}
+}
+
+func (s *rtpStats) stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := Stats{
+		PacketsSent:        s.packetsSent,
+		OctetsSent:         s.octetsSent,
+		PacketsReceived:    s.received,
+		Jitter:             s.jitterDuration(),
+		RTT:                s.rtt,
+		RemoteFractionLost: s.remoteLost,
+		RemoteJitter:       s.remoteJitter,
+		MOS:                s.mos(),
+	}
+	if s.receiving {
+		expected, lost := s.lost()
+		st.PacketsLost = lost
+		if lost > 0 {
+			st.LossRate = float64(lost) / float64(expected)
+		}
+	}
+	return st
+}
+
+func (s *rtpStats) jitterDuration() time.Duration {
+	return time.Duration(s.jitter * float64(time.Second) / float64(s.clockRate))
+}
+
+func (s *rtpStats) mos() float64 {
+	var loss float64
+	if s.receiving {
+		if expected, lost := s.lost(); lost > 0 {
+			loss = float64(lost) / float64(expected)
+		}
+	}
+	return estimateMOS(s.rtt, s.jitterDuration(), loss)
+}
+
+// estimateMOS maps delay, jitter and loss to a mean opinion score with the
+// simplified E-model commonly used for VoIP monitoring (after ITU-T G.107):
+// jitter counts twice towards the one-way delay, which with a fixed codec
+// and jitter buffer overhead of 10ms degrades R faster past 160ms, and every
+// percent of loss costs 2.5 points of R.
+func estimateMOS(rtt, jitter time.Duration, loss float64) float64 {
+	latency := float64(rtt/2+2*jitter)/float64(time.Millisecond) + 10
+	r := 93.2
+	if latency < 160 {
+		r -= latency / 40
+	} else {
+		r -= (latency - 120) / 10
+	}
+	r -= loss * 100 * 2.5
+	if r < 0 {
+		return 1
+	}
+	if r > 100 {
+		r = 100
+	}
+	return 1 + 0.035*r + 7e-6*r*(r-60)*(100-r)
+}
+
+// ntpEpochOffset is the number of seconds from 1900 to 1970.
+const ntpEpochOffset = 2208988800
+
+// ntpTime returns t as a 64 bit NTP timestamp.
+func ntpTime(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+// isRTCP reports whether a packet received on a muxed port is RTCP rather
+// than RTP, by its packet type (RFC 5761 section 4).
+func isRTCP(b []byte) bool {
+	return len(b) >= 2 && b[1] >= 192 && b[1] <= 223
+}
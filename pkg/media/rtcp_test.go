@@ -0,0 +1,293 @@
+package media
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/itzmanish/sipnexus/pkg/logger"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+func TestRTPStatsReceive(t *testing.T) {
+	tests := []struct {
+		name     string
+		seqs     []uint16
+		expected uint32
+		lost     int32
+	}{
+		{"in order", []uint16{10, 11, 12, 13}, 4, 0},
+		{"gap", []uint16{10, 11, 14, 15}, 6, 2},
+		{"reordered", []uint16{10, 12, 11, 13}, 4, 0},
+		{"duplicate", []uint16{10, 11, 11, 12}, 3, -1},
+		{"wrap", []uint16{65534, 65535, 0, 2}, 5, 1},
+		// The jump is taken as a restart at its second packet.
+		{"sender restart", []uint16{10, 11, 40000, 40001, 40002}, 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newRTPStats(1)
+			now := time.Now()
+			for i, seq := range tt.seqs {
+				now = now.Add(20 * time.Millisecond)
+				s.receive(&rtp.Packet{Header: rtp.Header{SSRC: 2, SequenceNumber: seq, Timestamp: uint32(160 * i)}}, now)
+			}
+			expected, lost := s.lost()
+			if expected != tt.expected || lost != tt.lost {
+				t.Fatalf("expected %d packets and %d lost, got %d and %d", tt.expected, tt.lost, expected, lost)
+			}
+			// Packets arrived exactly at their playout rate.
+			if s.jitter != 0 {
+				t.Fatalf("expected no jitter, got %f", s.jitter)
+			}
+		})
+	}
+}
+
+func TestRTPStatsJitter(t *testing.T) {
+	s := newRTPStats(1)
+	now := time.Now()
+	for i := 0; i < 200; i++ {
+		// Every other packet is 10ms late: each transit differs by 80
+		// timestamp units from the previous one.
+		at := now.Add(time.Duration(i) * 20 * time.Millisecond)
+		if i%2 == 1 {
+			at = at.Add(10 * time.Millisecond)
+		}
+		s.receive(&rtp.Packet{Header: rtp.Header{SSRC: 2, SequenceNumber: uint16(i), Timestamp: uint32(160 * i)}}, at)
+	}
+	if got := s.stats().Jitter; got < 9*time.Millisecond || got > 10*time.Millisecond {
+		t.Fatalf("expected jitter to converge to 10ms, got %s", got)
+	}
+}
+
+func TestRTPStatsReport(t *testing.T) {
+	s := newRTPStats(1)
+	now := time.Now()
+	for _, seq := range []uint16{0, 1, 2, 3, 5, 6, 7, 9} {
+		s.receive(&rtp.Packet{Header: rtp.Header{SSRC: 2, SequenceNumber: seq}}, now)
+	}
+
+	pkts := s.report(now, "cname")
+	rr, ok := pkts[0].(*rtcp.ReceiverReport)
+	if !ok {
+		t.Fatalf("expected a receiver report before sending, got %T", pkts[0])
+	}
+	if len(rr.Reports) != 1 || rr.Reports[0].SSRC != 2 || rr.Reports[0].TotalLost != 2 || rr.Reports[0].LastSequenceNumber != 9 {
+		t.Fatalf("unexpected report block %+v", rr.Reports)
+	}
+	if want := uint8(2 * 256 / 10); rr.Reports[0].FractionLost != want {
+		t.Fatalf("expected fraction lost %d, got %d", want, rr.Reports[0].FractionLost)
+	}
+	if sdes, ok := pkts[1].(*rtcp.SourceDescription); !ok || sdes.Chunks[0].Items[0].Text != "cname" {
+		t.Fatalf("expected SDES with the CNAME, got %v", pkts[1])
+	}
+
+	// The next interval lost nothing.
+	s.receive(&rtp.Packet{Header: rtp.Header{SSRC: 2, SequenceNumber: 10}}, now)
+	s.sent(&rtp.Packet{Header: rtp.Header{SSRC: 1, Timestamp: 1000}, Payload: make([]byte, 160)}, now)
+	sr, ok := s.report(now.Add(time.Second), "cname")[0].(*rtcp.SenderReport)
+	if !ok {
+		t.Fatal("expected a sender report after sending")
+	}
+	if sr.PacketCount != 1 || sr.OctetCount != 160 || sr.RTPTime != 1000+8000 {
+		t.Fatalf("unexpected sender report %+v", sr)
+	}
+	if sr.Reports[0].FractionLost != 0 || sr.Reports[0].TotalLost != 2 {
+		t.Fatalf("unexpected report block %+v", sr.Reports[0])
+	}
+}
+
+func TestRTPStatsRTT(t *testing.T) {
+	s := newRTPStats(1)
+	now := time.Now()
+	// The peer got our SR 100ms ago and held it for 20ms before reporting.
+	lsr := uint32(ntpTime(now.Add(-100*time.Millisecond)) >> 16)
+	s.process([]rtcp.Packet{&rtcp.ReceiverReport{SSRC: 2, Reports: []rtcp.ReceptionReport{
+		{SSRC: 1, FractionLost: 64, Jitter: 80, LastSenderReport: lsr, Delay: 65536 / 50},
+	}}}, now)
+
+	st := s.stats()
+	if st.RTT < 79*time.Millisecond || st.RTT > 81*time.Millisecond {
+		t.Fatalf("expected RTT of 80ms, got %s", st.RTT)
+	}
+	if st.RemoteFractionLost != 0.25 || st.RemoteJitter != 10*time.Millisecond {
+		t.Fatalf("unexpected remote view %+v", st)
+	}
+}
+
+func TestEstimateMOS(t *testing.T) {
+	perfect := estimateMOS(0, 0, 0)
+	if perfect < 4.3 || perfect > 4.5 {
+		t.Fatalf("expected about 4.4 for a perfect call, got %f", perfect)
+	}
+	prev := perfect
+	for _, c := range []struct {
+		rtt, jitter time.Duration
+		loss        float64
+	}{
+		{100 * time.Millisecond, 5 * time.Millisecond, 0},
+		{300 * time.Millisecond, 20 * time.Millisecond, 0.01},
+		{300 * time.Millisecond, 20 * time.Millisecond, 0.05},
+		{800 * time.Millisecond, 50 * time.Millisecond, 0.2},
+	} {
+		mos := estimateMOS(c.rtt, c.jitter, c.loss)
+		if mos >= prev {
+			t.Fatalf("expected MOS to drop below %f for %+v, got %f", prev, c, mos)
+		}
+		prev = mos
+	}
+	if worst := estimateMOS(time.Second, time.Second, 1); worst != 1 {
+		t.Fatalf("expected 1 for an unusable call, got %f", worst)
+	}
+}
+
+func TestRTCPExchange(t *testing.T) {
+	ports, _ := NewPortAllocator(34500, 34503)
+	newEngine := func() *UDPMediaEngine {
+		ume := NewUDPMediaEngine(logger.NewLogger(), ports, Interface{BindIP: net.IPv4(127, 0, 0, 1)}).(*UDPMediaEngine)
+		ume.reportInterval = 40 * time.Millisecond
+		t.Cleanup(func() { ume.Close() })
+		return ume
+	}
+	a, b := newEngine(), newEngine()
+	offer, err := a.CreateOffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := b.SetOffer(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetAnswer(answer); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := a.WriteSample(Sample{Data: make([]byte, 160)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.WriteSample(Sample{Data: make([]byte, 160)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	// Reports flow while media does; wait for both to be complete.
+	for a.Stats().RTT == 0 || b.Stats().RTT == 0 || a.Stats().PacketsReceived < 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no RTT measured: %+v, %+v", a.Stats(), b.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	st := a.Stats()
+	if st.PacketsSent != 10 || st.PacketsReceived != 10 || st.PacketsLost != 0 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	if st.RTT > 100*time.Millisecond || st.MOS < 4 {
+		t.Fatalf("expected a good loopback call, got %+v", st)
+	}
+}
+
+func TestRTCPMux(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	ports, _ := NewPortAllocator(34600, 34601)
+	ume := NewUDPMediaEngine(logger.NewLogger(), ports, Interface{BindIP: net.IPv4(127, 0, 0, 1)}).(*UDPMediaEngine)
+	ume.reportInterval = 20 * time.Millisecond
+	defer ume.Close()
+
+	answer, err := ume.SetOffer(sdpOf("c=IN IP4 127.0.0.1",
+		fmt.Sprintf("m=audio %d RTP/AVP 0", peer.LocalAddr().(*net.UDPAddr).Port),
+		"a=rtpmap:0 PCMU/8000", "a=rtcp-mux"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(answer, "a=rtcp-mux") {
+		t.Fatalf("expected rtcp-mux in the answer:\n%s", answer)
+	}
+
+	// Our reports arrive on the RTP port of the peer.
+	buf := make([]byte, 1500)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := peer.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isRTCP(buf[:n]) {
+		t.Fatalf("expected RTCP, got % x", buf[:n])
+	}
+
+	// The peer's reports on our RTP port are not taken for RTP.
+	b, _ := rtcp.Marshal([]rtcp.Packet{&rtcp.SenderReport{SSRC: 9, NTPTime: ntpTime(time.Now())}})
+	peer.WriteToUDP(b, ume.LocalAddr())
+	pkt, _ := (&rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 9}}).Marshal()
+	peer.WriteToUDP(pkt, ume.LocalAddr())
+	if got, err := ume.ReadRTP(); err != nil || got.SSRC != 9 || got.PayloadType != 0 {
+		t.Fatalf("expected the RTP packet, got %v, %v", got, err)
+	}
+	if st := ume.Stats(); st.PacketsReceived != 1 {
+		t.Fatalf("expected one RTP packet counted, got %+v", st)
+	}
+}
+
+func TestRTCPSource(t *testing.T) {
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	peer, peerRTCP, stranger := listen(), listen(), listen()
+	ports, _ := NewPortAllocator(34800, 34801)
+	ume := NewUDPMediaEngine(logger.NewLogger(), ports, Interface{BindIP: net.IPv4(127, 0, 0, 1)}).(*UDPMediaEngine)
+	defer ume.Close()
+	if _, err := ume.SetOffer(sdpOf("c=IN IP4 127.0.0.1",
+		fmt.Sprintf("m=audio %d RTP/AVP 0", peer.LocalAddr().(*net.UDPAddr).Port),
+		"a=rtpmap:0 PCMU/8000",
+		fmt.Sprintf("a=rtcp:%d", peerRTCP.LocalAddr().(*net.UDPAddr).Port))); err != nil {
+		t.Fatal(err)
+	}
+	rtcpAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: ume.LocalAddr().Port + 1}
+	report := func(from *net.UDPConn, ssrc uint32, fractionLost uint8) {
+		b, _ := rtcp.Marshal([]rtcp.Packet{&rtcp.ReceiverReport{SSRC: ssrc, Reports: []rtcp.ReceptionReport{{SSRC: ume.SSRC(), FractionLost: fractionLost}}}})
+		if _, err := from.WriteToUDP(b, rtcpAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectLost := func(want float64) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for ume.Stats().RemoteFractionLost != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected remote fraction lost %v, got %v", want, ume.Stats().RemoteFractionLost)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// Reports from anywhere but the peer are dropped.
+	report(stranger, 9, 128)
+	time.Sleep(50 * time.Millisecond)
+	expectLost(0)
+
+	report(peerRTCP, 9, 64)
+	expectLost(0.25)
+
+	// Reports from elsewhere are taken in once they come from the source we
+	// receive, as when the peer is behind NAT.
+	pkt, _ := (&rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 9}}).Marshal()
+	peer.WriteToUDP(pkt, ume.LocalAddr())
+	if _, err := ume.ReadRTP(); err != nil {
+		t.Fatal(err)
+	}
+	report(stranger, 9, 128)
+	expectLost(0.5)
+}
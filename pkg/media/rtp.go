@@ -0,0 +1,111 @@
+package media
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// ErrNotNegotiated is returned when media is written before offer/answer
+// completed.
+var ErrNotNegotiated = errors.New("media not negotiated")
+
+// rtpBufferSize bounds how many received packets wait for ReadRTP. Packets
+// arriving while it is full are dropped.
+const rtpBufferSize = 64
+
+// maxLag is how far behind its schedule the pacer may fall before it
+// restarts from the current time instead of sending a burst.
+const maxLag = 100 * time.Millisecond
+
+// Sample is one frame of encoded media.
+type Sample struct {
+	Data []byte
+	// Duration is the playout time of Data. Zero means the negotiated ptime.
+	Duration time.Duration
+}
+
+// packetizer turns samples into RTP packets of a single source (RFC 3550
+// section 5.1): the sequence number grows by one per packet and the
+// timestamp by the samples in each frame, both from random initial values.
+type packetizer struct {
+	ssrc      uint32
+	seq       uint16
+	timestamp uint32
+	// marker is set on the first packet of a talkspurt.
+	marker bool
+}
+
+func newPacketizer() *packetizer {
+	return &packetizer{
+		ssrc:      rand.Uint32(),
+		seq:       uint16(rand.Uint32()),
+		timestamp: rand.Uint32(),
+		marker:    true,
+	}
+}
+
+// skip moves the timestamp over samples that were not sent, as after a pause,
+// and marks the next packet as the start of a talkspurt.
+func (p *packetizer) skip(samples uint32) {
+	p.timestamp += samples
+	p.marker = true
+}
+
+// packetize wraps payload in the next packet and advances the timestamp by
+// samples.
+func (p *packetizer) packetize(pt uint8, payload []byte, samples uint32) *rtp.Packet {
+	pkt := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         p.marker,
+			PayloadType:    pt,
+			SequenceNumber: p.seq,
+			Timestamp:      p.timestamp,
+			SSRC:           p.ssrc,
+		},
+		Payload: payload,
+	}
+	p.marker = false
+	p.seq++
+	p.timestamp += samples
+	return pkt
+}
+
+// pacer spaces writes by the duration of the media they carry so that
+// samples produced faster than real time go out at their playout rate.
+type pacer struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+// wait blocks until the frame of length d is due or done is closed. When
+// the writer fell behind by more than maxLag, such as after a pause in
+// sending, the schedule restarts and wait returns how long the pause was.
+func (p *pacer) wait(d time.Duration, done <-chan struct{}) (gap time.Duration, err error) {
+	p.mu.Lock()
+	now := time.Now()
+	if lag := now.Sub(p.next); p.next.IsZero() || lag > maxLag {
+		if !p.next.IsZero() {
+			gap = lag
+		}
+		p.next = now
+	}
+	due := p.next
+	p.next = p.next.Add(d)
+	p.mu.Unlock()
+
+	if wait := time.Until(due); wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-done:
+			return gap, ErrEngineClosed
+		}
+	}
+	return gap, nil
+}
@@ -0,0 +1,213 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/itzmanish/sipnexus/pkg/codec"
+	"github.com/itzmanish/sipnexus/pkg/logger"
+	"github.com/pion/rtp"
+)
+
+// newTestPeer returns a socket standing in for the far end and an engine
+// that negotiated PCMU with it, with the far end using direction dir.
+func newTestPeer(t *testing.T, dir Direction) (*net.UDPConn, *UDPMediaEngine) {
+	t.Helper()
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+
+	ports, err := NewPortAllocator(34000, 34099)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ume := NewUDPMediaEngine(logger.NewLogger(), ports, Interface{BindIP: net.IPv4(127, 0, 0, 1)}).(*UDPMediaEngine)
+	t.Cleanup(func() { ume.Close() })
+
+	offer := sdpOf("c=IN IP4 127.0.0.1",
+		fmt.Sprintf("m=audio %d RTP/AVP 0", peer.LocalAddr().(*net.UDPAddr).Port),
+		"a=rtpmap:0 PCMU/8000", "a="+string(dir))
+	if _, err := ume.SetOffer(offer); err != nil {
+		t.Fatal(err)
+	}
+	return peer, ume
+}
+
+func TestWriteSample(t *testing.T) {
+	peer, ume := newTestPeer(t, SendRecv)
+
+	const frames = 10
+	start := time.Now()
+	go func() {
+		for i := 0; i < frames; i++ {
+			if err := ume.WriteSample(Sample{Data: make([]byte, 160)}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	var first rtp.Packet
+	buf := make([]byte, 1500)
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for i := 0; i < frames; i++ {
+		n, err := peer.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pkt rtp.Packet
+		if err := pkt.Unmarshal(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = pkt
+			if !pkt.Marker {
+				t.Fatal("expected marker on the first packet")
+			}
+		} else if pkt.Marker {
+			t.Fatalf("unexpected marker on packet %d", i)
+		}
+		if pkt.PayloadType != 0 || len(pkt.Payload) != 160 {
+			t.Fatalf("expected 160 bytes of PCMU, got pt %d with %d bytes", pkt.PayloadType, len(pkt.Payload))
+		}
+		if pkt.SSRC != first.SSRC {
+			t.Fatalf("SSRC changed from %d to %d", first.SSRC, pkt.SSRC)
+		}
+		if pkt.SequenceNumber != first.SequenceNumber+uint16(i) {
+			t.Fatalf("packet %d: expected sequence %d, got %d", i, first.SequenceNumber+uint16(i), pkt.SequenceNumber)
+		}
+		if pkt.Timestamp != first.Timestamp+uint32(160*i) {
+			t.Fatalf("packet %d: expected timestamp %d, got %d", i, first.Timestamp+uint32(160*i), pkt.Timestamp)
+		}
+	}
+	// Ten 20ms frames are spread over 180ms from the first to the last.
+	if elapsed := time.Since(start); elapsed < 170*time.Millisecond {
+		t.Fatalf("samples were not paced, took %s", elapsed)
+	}
+}
+
+func TestWriteSampleG722(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	ports, _ := NewPortAllocator(34700, 34701)
+	g722, _ := codec.Default.Select("G722", "PCMU")
+	ume := NewUDPMediaEngine(logger.NewLogger(), ports, Interface{BindIP: net.IPv4(127, 0, 0, 1), Codecs: RegistryCodecs(g722)})
+	defer ume.Close()
+
+	offer := sdpOf("c=IN IP4 127.0.0.1",
+		fmt.Sprintf("m=audio %d RTP/AVP 9 0", peer.LocalAddr().(*net.UDPAddr).Port),
+		"a=rtpmap:9 G722/8000", "a=rtpmap:0 PCMU/8000")
+	if _, err := ume.SetOffer(offer); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := 0; i < 2; i++ {
+			ume.WriteSample(Sample{Data: make([]byte, 160)})
+		}
+	}()
+
+	// 20ms of G.722 are 320 samples, yet the timestamp advances by 160
+	// (RFC 3551 section 4.5.2).
+	var ts [2]uint32
+	buf := make([]byte, 1500)
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for i := range ts {
+		n, err := peer.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pkt rtp.Packet
+		if err := pkt.Unmarshal(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if pkt.PayloadType != 9 {
+			t.Fatalf("expected G.722, got payload type %d", pkt.PayloadType)
+		}
+		ts[i] = pkt.Timestamp
+	}
+	if ts[1]-ts[0] != 160 {
+		t.Fatalf("expected timestamps 160 apart, got %d", ts[1]-ts[0])
+	}
+}
+
+func TestWriteSampleOnHold(t *testing.T) {
+	// The peer only sends, so we answer recvonly and must not send to it.
+	peer, ume := newTestPeer(t, SendOnly)
+	if err := ume.WriteSample(Sample{Data: make([]byte, 160)}); err != nil {
+		t.Fatal(err)
+	}
+	peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := peer.Read(make([]byte, 1500)); err == nil {
+		t.Fatal("received media while the peer did not want it")
+	}
+}
+
+func TestReadRTP(t *testing.T) {
+	peer, ume := newTestPeer(t, SendRecv)
+
+	sent := &rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 0, SequenceNumber: 7, Timestamp: 160, SSRC: 42},
+		Payload: []byte{1, 2, 3},
+	}
+	b, _ := sent.Marshal()
+	peer.WriteToUDP(b, ume.LocalAddr())
+	// Garbage is dropped rather than returned.
+	peer.WriteToUDP([]byte{0x00}, ume.LocalAddr())
+
+	pkt, err := ume.ReadRTP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.SSRC != 42 || pkt.SequenceNumber != 7 || string(pkt.Payload) != string(sent.Payload) {
+		t.Fatalf("unexpected packet %v", pkt)
+	}
+	if ume.LastRTP().IsZero() {
+		t.Fatal("LastRTP not updated")
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := ume.ReadRTP()
+		done <- err
+	}()
+	ume.Close()
+	if err := <-done; !errors.Is(err, ErrEngineClosed) {
+		t.Fatalf("expected ErrEngineClosed after Close, got %v", err)
+	}
+	if err := ume.WriteSample(Sample{Data: make([]byte, 160)}); !errors.Is(err, ErrEngineClosed) {
+		t.Fatalf("expected ErrEngineClosed writing after Close, got %v", err)
+	}
+}
+
+func TestWriteBeforeNegotiation(t *testing.T) {
+	ports, _ := NewPortAllocator(34100, 34101)
+	ume := NewUDPMediaEngine(logger.NewLogger(), ports, Interface{})
+	defer ume.Close()
+	if err := ume.WriteSample(Sample{Data: make([]byte, 160)}); !errors.Is(err, ErrNotNegotiated) {
+		t.Fatalf("expected ErrNotNegotiated, got %v", err)
+	}
+}
+
+func TestPacketizerSkip(t *testing.T) {
+	p := newPacketizer()
+	a := p.packetize(0, nil, 160)
+	p.skip(8000)
+	b := p.packetize(0, nil, 160)
+	if b.Timestamp != a.Timestamp+160+8000 {
+		t.Fatalf("expected timestamp to cover the pause, got %d after %d", b.Timestamp, a.Timestamp)
+	}
+	if b.SequenceNumber != a.SequenceNumber+1 {
+		t.Fatal("sequence numbers must stay contiguous across a pause")
+	}
+	if !b.Marker {
+		t.Fatal("expected marker after a pause")
+	}
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrNoLocalIP is returned when no interface address can be detected.
+var ErrNoLocalIP = errors.New("no usable local interface address")
+
+// LocalIP returns the address of the interface the default route goes out
+// of, falling back to the first non-loopback IPv4 address of an interface
+// that is up. No packets are sent.
+func LocalIP() (net.IP, error) {
+	if conn, err := net.Dial("udp4", "192.0.2.1:9"); err == nil {
+		defer conn.Close()
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && !addr.IP.IsUnspecified() {
+			return addr.IP, nil
+		}
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoLocalIP, err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				return ipnet.IP, nil
+			}
+		}
+	}
+	return nil, ErrNoLocalIP
+}
+
+// AdvertisedIP returns advertised when set and otherwise bind, detecting the
+// local interface address when bind is empty or unspecified.
+func AdvertisedIP(advertised, bind string) (net.IP, error) {
+	if advertised != "" {
+		ip := net.ParseIP(advertised)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid advertised address %q", advertised)
+		}
+		return ip, nil
+	}
+	if ip := net.ParseIP(bind); ip != nil && !ip.IsUnspecified() {
+		return ip, nil
+	}
+	return LocalIP()
+}
@@ -0,0 +1,210 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/sdp/v3"
+)
+
+// ErrMalformedSDP is returned for bodies that are not a session description.
+var ErrMalformedSDP = errors.New("malformed SDP")
+
+// SDPError reports a session description that parses but cannot be used,
+// such as one whose only m-line has no usable connection address.
+type SDPError struct {
+	// Media is the index of the offending m-line, or -1 for the session
+	// level.
+	Media  int
+	Reason string
+}
+
+func (e *SDPError) Error() string {
+	if e.Media < 0 {
+		return "unusable SDP: " + e.Reason
+	}
+	return fmt.Sprintf("unusable SDP m-line %d: %s", e.Media, e.Reason)
+}
+
+// SessionDescription is a parsed session description with the transport
+// addresses of its m-lines resolved.
+type SessionDescription struct {
+	*sdp.SessionDescription
+	Media []*MediaDescription
+}
+
+// MediaDescription is an m-line and where its peer receives RTP and RTCP.
+type MediaDescription struct {
+	*sdp.MediaDescription
+	// RTP and RTCP are nil for m-lines with port 0. The IP is unspecified
+	// when the peer put the stream on hold with c=0.0.0.0.
+	RTP  *net.UDPAddr
+	RTCP *net.UDPAddr
+	// RTCPMux is set when RTCP shares the RTP port (RFC 5761).
+	RTCPMux bool
+	// Err is why an m-line with a port cannot be used, such as a missing
+	// connection address. Such m-lines are treated as disabled.
+	Err error
+}
+
+// Disabled reports whether the m-line was offered or answered with port 0,
+// or cannot be used.
+func (md *MediaDescription) Disabled() bool {
+	return md.RTP == nil
+}
+
+// ParseSDP parses body and resolves the connection address of every m-line.
+// A body that does not parse fails with ErrMalformedSDP, one that parses but
+// has no usable m-line with *SDPError.
+func ParseSDP(body []byte) (*SessionDescription, error) {
+	var sd sdp.SessionDescription
+	if err := sd.Unmarshal(body); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedSDP, err)
+	}
+	return NewSessionDescription(&sd)
+}
+
+// NewSessionDescription resolves the m-lines of sd. An m-line that cannot be
+// used is disabled, so that it is rejected with port 0 like any other stream
+// we do not accept (RFC 3264 section 6); sd fails only when none is left.
+func NewSessionDescription(sd *sdp.SessionDescription) (*SessionDescription, error) {
+	var session net.IP
+	var sessionErr error
+	if sd.ConnectionInformation != nil {
+		session, sessionErr = connectionIP(sd.ConnectionInformation)
+	}
+
+	s := &SessionDescription{SessionDescription: sd, Media: make([]*MediaDescription, len(sd.MediaDescriptions))}
+	var unusable *SDPError
+	usable := false
+	for i, md := range sd.MediaDescriptions {
+		m, err := resolveMedia(md, session, sessionErr)
+		if err != nil {
+			m = &MediaDescription{MediaDescription: md, Err: err}
+			if unusable == nil {
+				unusable = &SDPError{Media: i, Reason: err.Error()}
+				if err == sessionErr {
+					unusable.Media = -1
+				}
+			}
+		}
+		usable = usable || !m.Disabled()
+		s.Media[i] = m
+	}
+	if unusable != nil && !usable {
+		return nil, unusable
+	}
+	return s, nil
+}
+
+func resolveMedia(md *sdp.MediaDescription, session net.IP, sessionErr error) (*MediaDescription, error) {
+	m := &MediaDescription{MediaDescription: md}
+	port := md.MediaName.Port.Value
+	if port == 0 {
+		return m, nil
+	}
+	if port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", port)
+	}
+
+	// A media-level c= line overrides the session-level one (RFC 4566 5.7).
+	ip := session
+	if md.ConnectionInformation != nil {
+		var err error
+		if ip, err = connectionIP(md.ConnectionInformation); err != nil {
+			return nil, err
+		}
+	} else if sessionErr != nil {
+		return nil, sessionErr
+	}
+	if ip == nil {
+		return nil, errors.New("no connection address")
+	}
+	m.RTP = &net.UDPAddr{IP: ip, Port: port}
+
+	_, m.RTCPMux = md.Attribute("rtcp-mux")
+	switch v, ok := md.Attribute("rtcp"); {
+	case ok:
+		rtcp, err := parseRTCP(v, ip)
+		if err != nil {
+			return nil, err
+		}
+		m.RTCP = rtcp
+	case m.RTCPMux:
+		m.RTCP = m.RTP
+	default:
+		m.RTCP = &net.UDPAddr{IP: ip, Port: port + 1}
+	}
+	return m, nil
+}
+
+// connectionIP returns the unicast IP of a c= line.
+func connectionIP(ci *sdp.ConnectionInformation) (net.IP, error) {
+	if ci.NetworkType != "IN" {
+		return nil, fmt.Errorf("unsupported network type %q", ci.NetworkType)
+	}
+	if ci.Address == nil {
+		return nil, errors.New("missing connection address")
+	}
+	return parseIP(ci.AddressType, ci.Address.Address)
+}
+
+// lookupTimeout bounds the resolution of a hostname connection address.
+const lookupTimeout = 2 * time.Second
+
+// parseIP parses addr, an IP literal or a hostname resolved to an address
+// of addrType.
+func parseIP(addrType, addr string) (net.IP, error) {
+	network := "ip4"
+	switch addrType {
+	case "IP4":
+	case "IP6":
+		network = "ip6"
+	default:
+		return nil, fmt.Errorf("unsupported address type %q", addrType)
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		defer cancel()
+		ips, err := net.DefaultResolver.LookupIP(ctx, network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve connection address %q: %v", addr, err)
+		}
+		ip = ips[0]
+	}
+	switch {
+	case addrType == "IP4" && ip.To4() == nil, addrType == "IP6" && ip.To4() != nil:
+		return nil, fmt.Errorf("connection address %q is not %s", addr, addrType)
+	case ip.IsMulticast():
+		return nil, fmt.Errorf("multicast connection address %q", addr)
+	}
+	return ip, nil
+}
+
+// parseRTCP parses an a=rtcp value, "<port> [IN <IP4|IP6> <address>]"
+// (RFC 3605). The address defaults to the RTP one.
+func parseRTCP(v string, ip net.IP) (*net.UDPAddr, error) {
+	fields := strings.Fields(v)
+	if len(fields) != 1 && len(fields) != 4 {
+		return nil, fmt.Errorf("invalid rtcp attribute %q", v)
+	}
+	port, err := strconv.Atoi(fields[0])
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid rtcp port %q", fields[0])
+	}
+	if len(fields) == 4 {
+		if fields[1] != "IN" {
+			return nil, fmt.Errorf("unsupported network type %q", fields[1])
+		}
+		if ip, err = parseIP(fields[2], fields[3]); err != nil {
+			return nil, err
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseSDP(t *testing.T) {
+	const head = "v=0\r\no=- 1 1 IN IP4 192.0.2.1\r\ns=-\r\n"
+	testCases := []struct {
+		name string
+		body string
+		// rtp and rtcp of each m-line, empty for disabled ones.
+		rtp, rtcp []string
+		mux       bool
+		media     int // m-line of the SDPError, -2 for none
+	}{
+		{
+			name:  "session level connection only",
+			body:  head + "c=IN IP4 192.0.2.10\r\nt=0 0\r\nm=audio 4000 RTP/AVP 0\r\n",
+			rtp:   []string{"192.0.2.10:4000"},
+			rtcp:  []string{"192.0.2.10:4001"},
+			media: -2,
+		},
+		{
+			name: "media level connection overrides session level",
+			body: head + "c=IN IP4 192.0.2.10\r\nt=0 0\r\n" +
+				"m=audio 4000 RTP/AVP 0\r\nc=IN IP4 192.0.2.11\r\n" +
+				"m=audio 4002 RTP/AVP 0\r\n",
+			rtp:   []string{"192.0.2.11:4000", "192.0.2.10:4002"},
+			rtcp:  []string{"192.0.2.11:4001", "192.0.2.10:4003"},
+			media: -2,
+		},
+		{
+			name:  "ipv6",
+			body:  head + "t=0 0\r\nm=audio 4000 RTP/AVP 0\r\nc=IN IP6 2001:db8::10\r\n",
+			rtp:   []string{"[2001:db8::10]:4000"},
+			rtcp:  []string{"[2001:db8::10]:4001"},
+			media: -2,
+		},
+		{
+			name:  "rtcp port",
+			body:  head + "c=IN IP4 192.0.2.10\r\nt=0 0\r\nm=audio 4000 RTP/AVP 0\r\na=rtcp:5000\r\n",
+			rtp:   []string{"192.0.2.10:4000"},
+			rtcp:  []string{"192.0.2.10:5000"},
+			media: -2,
+		},
+		{
+			name:  "rtcp address",
+			body:  head + "c=IN IP4 192.0.2.10\r\nt=0 0\r\nm=audio 4000 RTP/AVP 0\r\na=rtcp:5000 IN IP6 2001:db8::20\r\n",
+			rtp:   []string{"192.0.2.10:4000"},
+			rtcp:  []string{"[2001:db8::20]:5000"},
+			media: -2,
+		},
+		{
+			name:  "rtcp mux",
+			body:  head + "c=IN IP4 192.0.2.10\r\nt=0 0\r\nm=audio 4000 RTP/AVP 0\r\na=rtcp-mux\r\n",
+			rtp:   []string{"192.0.2.10:4000"},
+			rtcp:  []string{"192.0.2.10:4000"},
+			mux:   true,
+			media: -2,
+		},
+		{
+			name:  "hold",
+			body:  head + "c=IN IP4 0.0.0.0\r\nt=0 0\r\nm=audio 4000 RTP/AVP 0\r\n",
+			rtp:   []string{"0.0.0.0:4000"},
+			rtcp:  []string{"0.0.0.0:4001"},
+			media: -2,
+		},
+		{
+			name:  "disabled stream needs no connection",
+			body:  head + "t=0 0\r\nm=audio 4000 RTP/AVP 0\r\nc=IN IP4 192.0.2.10\r\nm=video 0 RTP/AVP 96\r\n",
+			rtp:   []string{"192.0.2.10:4000", ""},
+			rtcp:  []string{"192.0.2.10:4001", ""},
+			media: -2,
+		},
+		{
+			name:  "no connection",
+			body:  head + "t=0 0\r\nm=audio 4000 RTP/AVP 0\r\n",
+			media: 0,
+		},
+		{
+			name:  "hostname",
+			body:  head + "c=IN IP4 localhost\r\nt=0 0\r\nm=audio 4000 RTP/AVP 0\r\n",
+			rtp:   []string{"127.0.0.1:4000"},
+			rtcp:  []string{"127.0.0.1:4001"},
+			media: -2,
+		},
+		{
+			name:  "unresolvable hostname",
+			body:  head + "c=IN IP4 media.invalid\r\nt=0 0\r\nm=audio 4000 RTP/AVP 0\r\n",
+			media: -1,
+		},
+		{
+			name: "unusable stream is disabled",
+			body: head + "c=IN IP4 192.0.2.10\r\nt=0 0\r\n" +
+				"m=audio 4000 RTP/AVP 0\r\na=rtcp:x\r\n" +
+				"m=audio 4002 RTP/AVP 0\r\n",
+			rtp:   []string{"", "192.0.2.10:4002"},
+			rtcp:  []string{"", "192.0.2.10:4003"},
+			media: -2,
+		},
+		{
+			name: "unusable session connection only affects streams using it",
+			body: head + "c=IN IP4 media.invalid\r\nt=0 0\r\n" +
+				"m=audio 4000 RTP/AVP 0\r\n" +
+				"m=audio 4002 RTP/AVP 0\r\nc=IN IP4 192.0.2.11\r\n",
+			rtp:   []string{"", "192.0.2.11:4002"},
+			rtcp:  []string{"", "192.0.2.11:4003"},
+			media: -2,
+		},
+		{
+			name:  "address type mismatch",
+			body:  head + "t=0 0\r\nm=audio 4000 RTP/AVP 0\r\nc=IN IP4 2001:db8::10\r\n",
+			media: 0,
+		},
+		{
+			name:  "multicast",
+			body:  head + "t=0 0\r\nm=audio 4000 RTP/AVP 0\r\nc=IN IP4 224.2.1.1/127\r\n",
+			media: 0,
+		},
+		{
+			name:  "bad rtcp attribute",
+			body:  head + "c=IN IP4 192.0.2.10\r\nt=0 0\r\nm=audio 4000 RTP/AVP 0\r\na=rtcp:x\r\n",
+			media: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sd, err := ParseSDP([]byte(tc.body))
+			if tc.media != -2 {
+				var sdpErr *SDPError
+				if !errors.As(err, &sdpErr) {
+					t.Fatalf("expected SDPError, got %v", err)
+				}
+				if sdpErr.Media != tc.media {
+					t.Fatalf("expected error for m-line %d, got %d: %v", tc.media, sdpErr.Media, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sd.Media) != len(tc.rtp) {
+				t.Fatalf("expected %d m-lines, got %d", len(tc.rtp), len(sd.Media))
+			}
+			for i, md := range sd.Media {
+				if tc.rtp[i] == "" {
+					if !md.Disabled() || md.RTCP != nil {
+						t.Fatalf("m-line %d: expected disabled stream", i)
+					}
+					if (md.MediaName.Port.Value != 0) != (md.Err != nil) {
+						t.Fatalf("m-line %d: unexpected error %v", i, md.Err)
+					}
+					continue
+				}
+				if got := md.RTP.String(); got != tc.rtp[i] {
+					t.Fatalf("m-line %d: expected RTP %s, got %s", i, tc.rtp[i], got)
+				}
+				if got := md.RTCP.String(); got != tc.rtcp[i] {
+					t.Fatalf("m-line %d: expected RTCP %s, got %s", i, tc.rtcp[i], got)
+				}
+				if md.RTCPMux != tc.mux {
+					t.Fatalf("m-line %d: expected rtcp-mux %v", i, tc.mux)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSDPMalformed(t *testing.T) {
+	for _, body := range []string{"not sdp", "v=0\r\nm=audio\r\n"} {
+		_, err := ParseSDP([]byte(body))
+		if !errors.Is(err, ErrMalformedSDP) {
+			t.Errorf("%q: expected ErrMalformedSDP, got %v", body, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "malformed SDP") {
+			t.Errorf("%q: unexpected message %q", body, err)
+		}
+	}
+}
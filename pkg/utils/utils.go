@@ -1,21 +1,11 @@
 package utils
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/pion/sdp/v3"
 )
 
-func ParseSDP(body []byte) (*sdp.SessionDescription, error) {
-	var sd sdp.SessionDescription
-	err := sd.Unmarshal(body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse SDP: %w", err)
-	}
-	return &sd, nil
-}
-
 func GenerateSDP(mediaTypes []string) (*sdp.SessionDescription, error) {
 	sd, err := sdp.NewJSEPSessionDescription(false)
 	if err != nil {
@@ -0,0 +1,87 @@
+package sipnexus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// byeTimeout bounds how long the reaper waits for the answer to its BYE.
+const byeTimeout = 5 * time.Second
+
+// runReaper ends expired sessions every ReapInterval until ctx is done.
+func (s *Server) runReaper(ctx context.Context) {
+	ticker := time.NewTicker(s.config.Sessions.ReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.reap(ctx, now)
+		}
+	}
+}
+
+// reap hangs up every session that expired at now and waits for the BYEs to
+// complete.
+func (s *Server) reap(ctx context.Context, now time.Time) {
+	var wg sync.WaitGroup
+	for _, session := range s.sessionManager.all() {
+		reason := s.expired(session, now)
+		if reason == "" || !session.markEnding(reason) {
+			continue
+		}
+		s.logger.Infof("ending call %s: %s", session.CallID, reason)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, byeTimeout)
+			defer cancel()
+			if err := session.Hangup(ctx); errors.Is(err, ErrNoDialog) {
+				session.close(SessionStatus_Failed)
+			} else if err != nil {
+				s.logger.Errorf("failed to end call %s: %v", session.CallID, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// expired returns why session should be ended at now, or "" if it should not.
+func (s *Server) expired(session *Session, now time.Time) string {
+	cfg := s.config.Sessions
+
+	session.mu.Lock()
+	status, answeredAt, connectedAt, negotiated := session.Status, session.AnsweredAt, session.ConnectedAt, session.negotiatedAt
+	session.mu.Unlock()
+
+	switch {
+	case status == SessionStatus_Connected:
+		if cfg.MaxDuration > 0 && now.Sub(connectedAt) >= cfg.MaxDuration {
+			return EndReasonMaxDuration
+		}
+		// No RTP is expected while the call is held, and the timeout starts
+		// over once it is resumed.
+		if cfg.RTPTimeout > 0 && session.expectsRTP() {
+			last := connectedAt
+			if negotiated.After(last) {
+				last = negotiated
+			}
+			if rtp := session.rtc.LastRTP(); rtp.After(last) {
+				last = rtp
+			}
+			if now.Sub(last) >= cfg.RTPTimeout {
+				return EndReasonRTPTimeout
+			}
+		}
+	case !status.terminal() && !answeredAt.IsZero():
+		if cfg.SetupTimeout > 0 && now.Sub(answeredAt) >= cfg.SetupTimeout {
+			return EndReasonSetupTimeout
+		}
+	}
+	return ""
+}
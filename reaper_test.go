@@ -0,0 +1,182 @@
+package sipnexus
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+	"github.com/itzmanish/sipnexus/pkg/media"
+)
+
+func newTestReaper(t *testing.T, sessions SessionConfig) (*Server, *testUAS) {
+	t.Helper()
+	var uas *testUAS
+	uas = startTestUAS(t, answerInvite(func() *testUAS { return uas }))
+	// A long interval keeps the background reaper out of the way; the tests
+	// call reap directly.
+	sessions.ReapInterval = time.Hour
+	s, _ := startTestServer(t, ServerConfig{
+		Listeners: []ListenerConfig{{Transport: TransportUDP, BindAddress: "127.0.0.1"}},
+		Sessions:  sessions,
+	})
+	return s, uas
+}
+
+func recordReasons(s *Server) (func(callID string) string, func()) {
+	var mu sync.Mutex
+	reasons := map[string]string{}
+	unsubscribe := s.SubscribeSessions(func(ev SessionEvent) {
+		if ev.Status.terminal() {
+			mu.Lock()
+			reasons[ev.Session.CallID] = ev.Reason
+			mu.Unlock()
+		}
+	})
+	return func(callID string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		return reasons[callID]
+	}, unsubscribe
+}
+
+func TestReaperMaxDuration(t *testing.T) {
+	s, uas := newTestReaper(t, SessionConfig{MaxDuration: time.Minute})
+	reason, unsubscribe := recordReasons(s)
+	defer unsubscribe()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	session, err := s.Dial(ctx, DialRequest{Recipient: uas.uri})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Hangup(ctx)
+
+	s.reap(ctx, time.Now().Add(30*time.Second))
+	if session.State() != SessionStatus_Connected {
+		t.Fatalf("call ended before max duration: %s", session.State())
+	}
+
+	s.reap(ctx, time.Now().Add(time.Minute))
+	waitRequest(t, uas.byes, session.CallID)
+	if session.State() != SessionStatus_Disconnected {
+		t.Fatalf("expected disconnected, got %s", session.State())
+	}
+	if got := reason(session.CallID); got != EndReasonMaxDuration {
+		t.Fatalf("expected reason %q, got %q", EndReasonMaxDuration, got)
+	}
+	if s.sessionManager.Len() != 0 {
+		t.Fatal("session not removed")
+	}
+}
+
+func TestReaperRTPTimeout(t *testing.T) {
+	s, uas := newTestReaper(t, SessionConfig{RTPTimeout: time.Minute})
+	reason, unsubscribe := recordReasons(s)
+	defer unsubscribe()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	session, err := s.Dial(ctx, DialRequest{Recipient: uas.uri})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Hangup(ctx)
+
+	// Send a packet to our media port, which resets the inactivity timer.
+	port := session.rtc.(*media.UDPMediaEngine).LocalAddr().Port
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(10 * time.Millisecond)
+	sent := time.Now()
+	conn.Write([]byte{0x80, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1})
+	waitFor(t, func() bool { return !session.rtc.LastRTP().Before(sent) })
+
+	s.reap(ctx, session.ConnectedAt.Add(time.Minute))
+	if session.State() != SessionStatus_Connected {
+		t.Fatalf("call with recent RTP was ended: %s", session.State())
+	}
+
+	s.reap(ctx, time.Now().Add(time.Minute))
+	waitRequest(t, uas.byes, session.CallID)
+	if got := reason(session.CallID); got != EndReasonRTPTimeout {
+		t.Fatalf("expected reason %q, got %q", EndReasonRTPTimeout, got)
+	}
+}
+
+func TestReaperRTPTimeoutOnHold(t *testing.T) {
+	s, uas := newTestReaper(t, SessionConfig{RTPTimeout: time.Minute})
+	reason, unsubscribe := recordReasons(s)
+	defer unsubscribe()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	session, err := s.Dial(ctx, DialRequest{Recipient: uas.uri})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Hangup(ctx)
+	if err := session.Hold(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A held call receives no RTP, however long it stays held.
+	s.reap(ctx, time.Now().Add(time.Hour))
+	if session.State() != SessionStatus_Connected {
+		t.Fatalf("held call was ended: %s", session.State())
+	}
+
+	// Once resumed the timeout starts over.
+	if err := session.Resume(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.reap(ctx, time.Now().Add(30*time.Second))
+	if session.State() != SessionStatus_Connected {
+		t.Fatalf("resumed call was ended: %s", session.State())
+	}
+	s.reap(ctx, time.Now().Add(time.Minute))
+	waitRequest(t, uas.byes, session.CallID)
+	if got := reason(session.CallID); got != EndReasonRTPTimeout {
+		t.Fatalf("expected reason %q, got %q", EndReasonRTPTimeout, got)
+	}
+}
+
+func TestReaperSetupTimeout(t *testing.T) {
+	s, uas := newTestReaper(t, DefaultSessionConfig())
+	reason, unsubscribe := recordReasons(s)
+	defer unsubscribe()
+
+	// An inbound call is answered but the caller never sends its ACK.
+	invite := newTestInDialog(t, sip.INVITE, "no-ack", "", 1, testOfferSDP)
+	invite.RemoveHeader("Contact")
+	invite.AppendHeader(&sip.ContactHeader{Address: uas.uri})
+	handle(t, s.handleInvite, invite)
+
+	session, ok := s.sessionManager.GetSessionByCallID("no-ack")
+	if !ok {
+		t.Fatal("session not created")
+	}
+	ctx := context.Background()
+	s.reap(ctx, time.Now().Add(time.Second))
+	if session.State() != SessionStatus_Ringing {
+		t.Fatalf("expected call still waiting for ACK, got %s", session.State())
+	}
+
+	s.reap(ctx, time.Now().Add(DefaultSessionConfig().SetupTimeout))
+	bye := waitRequest(t, uas.byes, "no-ack")
+	if to, _ := bye.To().Params.Get("tag"); to != "alice-tag" {
+		t.Fatalf("BYE not sent within the dialog: %s", bye.To().Value())
+	}
+	if got := reason("no-ack"); got != EndReasonSetupTimeout {
+		t.Fatalf("expected reason %q, got %q", EndReasonSetupTimeout, got)
+	}
+	if s.sessionManager.Len() != 0 {
+		t.Fatal("session not removed")
+	}
+}
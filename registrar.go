@@ -0,0 +1,151 @@
+package sipnexus
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+func (s *Server) handleRegister(req *sip.Request, tx sip.ServerTransaction) {
+	to := req.To()
+	callID := req.CallID()
+	cseq := req.CSeq()
+	if to == nil || callID == nil || cseq == nil {
+		s.sendErrorResponse(req, tx, sip.StatusBadRequest, "Bad Request: Missing Headers")
+		return
+	}
+
+	user, ok := s.authenticate(req, tx, to.Address, false)
+	if !ok {
+		return
+	}
+	// RFC 3261 10.3 step 3: a user may only modify its own bindings.
+	if s.authenticator != nil && user != to.Address.User {
+		s.sendErrorResponse(req, tx, sip.StatusForbidden, "Forbidden")
+		return
+	}
+	aor := AddressOfRecord(to.Address)
+	s.logger.Infof("Received REGISTER request for %s", aor)
+
+	defaultExpires := s.config.Registrar.DefaultExpires
+	if h := req.GetHeader("Expires"); h != nil {
+		v, err := strconv.ParseUint(h.Value(), 10, 32)
+		if err != nil {
+			s.sendErrorResponse(req, tx, sip.StatusBadRequest, "Bad Request: Invalid Expires")
+			return
+		}
+		defaultExpires = uint32(v)
+	}
+
+	contacts := req.GetHeaders("Contact")
+	bindings := make([]Binding, 0, len(contacts))
+	now := time.Now()
+	for _, h := range contacts {
+		contact, ok := h.(*sip.ContactHeader)
+		if !ok {
+			s.sendErrorResponse(req, tx, sip.StatusBadRequest, "Bad Request: Invalid Contact")
+			return
+		}
+
+		if contact.Address.Wildcard {
+			// RFC 3261 10.3 step 6: "*" is only valid alone with Expires: 0.
+			if len(contacts) != 1 || req.GetHeader("Expires") == nil || defaultExpires != 0 {
+				s.sendErrorResponse(req, tx, sip.StatusBadRequest, "Bad Request: Invalid Wildcard")
+				return
+			}
+			if err := s.location.RemoveAll(aor); err != nil {
+				s.logger.Errorf("failed to remove bindings for %s: %v", aor, err)
+				s.sendErrorResponse(req, tx, sip.StatusInternalServerError, "Internal Server Error")
+				return
+			}
+			s.respondBindings(req, tx, aor)
+			return
+		}
+
+		expires := defaultExpires
+		if v, ok := contact.Params.Get("expires"); ok {
+			e, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				s.sendErrorResponse(req, tx, sip.StatusBadRequest, "Bad Request: Invalid Expires")
+				return
+			}
+			expires = uint32(e)
+		}
+		if expires != 0 && expires < s.config.Registrar.MinExpires {
+			s.sendIntervalTooBrief(req, tx)
+			return
+		}
+		if expires > s.config.Registrar.MaxExpires {
+			expires = s.config.Registrar.MaxExpires
+		}
+
+		c := *contact.Clone()
+		if c.Params == nil {
+			c.Params = sip.NewParams()
+		}
+		c.Params.Remove("expires")
+		bindings = append(bindings, Binding{
+			AOR:       aor,
+			Contact:   c,
+			CallID:    callID.Value(),
+			CSeq:      cseq.SeqNo,
+			Expires:   now.Add(time.Duration(expires) * time.Second),
+			Source:    req.Source(),
+			Transport: req.Transport(),
+		})
+	}
+
+	// Every contact was validated above, so the REGISTER is applied as a
+	// whole or not at all.
+	if err := s.location.Update(bindings...); err != nil {
+		if errors.Is(err, ErrStaleBinding) {
+			s.sendErrorResponse(req, tx, sip.StatusInternalServerError, "Out Of Order CSeq")
+			return
+		}
+		s.logger.Errorf("failed to update bindings for %s: %v", aor, err)
+		s.sendErrorResponse(req, tx, sip.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	s.respondBindings(req, tx, aor)
+}
+
+// respondBindings answers a REGISTER with every current binding of aor.
+func (s *Server) respondBindings(req *sip.Request, tx sip.ServerTransaction, aor string) {
+	bindings, err := s.location.Lookup(aor)
+	if err != nil {
+		s.logger.Errorf("failed to lookup bindings for %s: %v", aor, err)
+		s.sendErrorResponse(req, tx, sip.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	resp := sip.NewResponseFromRequest(req, sip.StatusOK, "OK", nil)
+	now := time.Now()
+	for _, b := range bindings {
+		c := b.Contact.Clone()
+		c.Params.Add("expires", strconv.Itoa(int(b.Expires.Sub(now).Round(time.Second).Seconds())))
+		resp.AppendHeader(c)
+	}
+	resp.AppendHeader(sip.NewHeader("Date", now.UTC().Format(time.RFC1123)))
+	if err := tx.Respond(resp); err != nil {
+		s.logger.Error("Failed to send 200 OK response for REGISTER: " + err.Error())
+	}
+}
+
+func (s *Server) sendIntervalTooBrief(req *sip.Request, tx sip.ServerTransaction) {
+	resp := sip.NewResponseFromRequest(req, sip.StatusIntervalToBrief, "Interval Too Brief", nil)
+	resp.AppendHeader(sip.NewHeader("Min-Expires", strconv.Itoa(int(s.config.Registrar.MinExpires))))
+	if err := tx.Respond(resp); err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to send %d response: %s", sip.StatusIntervalToBrief, err.Error()))
+	}
+}
+
+// LookupContacts returns the registered contacts for the given request URI,
+// most preferred first. It is the entry point for routing calls to
+// registered users.
+func (s *Server) LookupContacts(uri sip.Uri) ([]Binding, error) {
+	return s.location.Lookup(AddressOfRecord(uri))
+}
@@ -0,0 +1,267 @@
+package sipnexus
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+	"github.com/emiago/sipgo/siptest"
+	"github.com/icholy/digest"
+	"github.com/itzmanish/sipnexus/pkg/auth"
+	"github.com/itzmanish/sipnexus/pkg/logger"
+)
+
+func newTestRegister(t *testing.T, cseq int, headers ...string) *sip.Request {
+	t.Helper()
+	raw := "REGISTER sip:example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.5:5060;branch=z9hG4bK" + fmt.Sprint(time.Now().UnixNano()) + "\r\n" +
+		"From: <sip:alice@example.com>;tag=abc\r\n" +
+		"To: <sip:alice@Example.com>\r\n" +
+		"Call-ID: reg-call-1\r\n" +
+		fmt.Sprintf("CSeq: %d REGISTER\r\n", cseq)
+	for _, h := range headers {
+		raw += h + "\r\n"
+	}
+	raw += "Content-Length: 0\r\n\r\n"
+
+	msg, err := sip.ParseMessage([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.(*sip.Request)
+}
+
+func doRegister(t *testing.T, s *Server, req *sip.Request) *sip.Response {
+	t.Helper()
+	tx := siptest.NewServerTxRecorder(req)
+	s.handleRegister(req, tx)
+	res := tx.Result()
+	if len(res) != 1 {
+		t.Fatalf("expected 1 response, got %d", len(res))
+	}
+	return res[0]
+}
+
+func newTestRegistrar(t *testing.T) *Server {
+	t.Helper()
+	s, err := NewServer(logger.NewLogger(), DefaultServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRegistrarBindings(t *testing.T) {
+	s := newTestRegistrar(t)
+
+	res := doRegister(t, s, newTestRegister(t, 1,
+		"Contact: <sip:alice@10.0.0.5:5060>;q=0.5",
+		"Contact: <sip:alice@10.0.0.6:5060>",
+		"Expires: 600",
+	))
+	if res.StatusCode != sip.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	if got := len(res.GetHeaders("Contact")); got != 2 {
+		t.Fatalf("expected 2 contacts in response, got %d", got)
+	}
+
+	bindings, _ := s.LookupContacts(sip.Uri{User: "alice", Host: "example.com"})
+	if len(bindings) != 2 {
+		t.Fatalf("expected 2 bindings, got %d", len(bindings))
+	}
+	if bindings[0].Contact.Address.Host != "10.0.0.6" {
+		t.Fatalf("expected q=1.0 contact first, got %s", bindings[0].Key())
+	}
+
+	// Unregister a single contact.
+	res = doRegister(t, s, newTestRegister(t, 2, "Contact: <sip:alice@10.0.0.6:5060>;expires=0"))
+	if res.StatusCode != sip.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	bindings, _ = s.LookupContacts(sip.Uri{User: "alice", Host: "example.com"})
+	if len(bindings) != 1 || bindings[0].Contact.Address.Host != "10.0.0.5" {
+		t.Fatalf("unexpected bindings after unregister: %+v", bindings)
+	}
+
+	// Query without Contact returns current bindings.
+	res = doRegister(t, s, newTestRegister(t, 3))
+	if got := len(res.GetHeaders("Contact")); got != 1 {
+		t.Fatalf("expected 1 contact in query response, got %d", got)
+	}
+
+	// Wildcard removes everything.
+	res = doRegister(t, s, newTestRegister(t, 4, "Contact: *", "Expires: 0"))
+	if res.StatusCode != sip.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	bindings, _ = s.LookupContacts(sip.Uri{User: "alice", Host: "example.com"})
+	if len(bindings) != 0 {
+		t.Fatalf("expected no bindings, got %d", len(bindings))
+	}
+}
+
+func TestRegistrarRejects(t *testing.T) {
+	s := newTestRegistrar(t)
+
+	testCases := []struct {
+		name    string
+		cseq    int
+		headers []string
+		status  sip.StatusCode
+	}{
+		{"interval too brief", 1, []string{"Contact: <sip:alice@10.0.0.5>", "Expires: 10"}, sip.StatusIntervalToBrief},
+		{"wildcard without expires", 1, []string{"Contact: *"}, sip.StatusBadRequest},
+		{"wildcard with other contacts", 1, []string{"Contact: *", "Contact: <sip:alice@10.0.0.5>", "Expires: 0"}, sip.StatusBadRequest},
+		{"invalid expires", 1, []string{"Contact: <sip:alice@10.0.0.5>", "Expires: soon"}, sip.StatusBadRequest},
+		{"fresh binding", 5, []string{"Contact: <sip:alice@10.0.0.5>"}, sip.StatusOK},
+		{"out of order cseq", 4, []string{"Contact: <sip:alice@10.0.0.5>"}, sip.StatusInternalServerError},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := doRegister(t, s, newTestRegister(t, tc.cseq, tc.headers...))
+			if res.StatusCode != tc.status {
+				t.Fatalf("expected %d, got %d", tc.status, res.StatusCode)
+			}
+			if tc.status == sip.StatusIntervalToBrief && res.GetHeader("Min-Expires") == nil {
+				t.Fatal("missing Min-Expires header")
+			}
+		})
+	}
+}
+
+func TestRegistrarAtomicUpdate(t *testing.T) {
+	s := newTestRegistrar(t)
+	alice := sip.Uri{User: "alice", Host: "example.com"}
+
+	// A contact that fails validation leaves the valid ones unregistered.
+	res := doRegister(t, s, newTestRegister(t, 1,
+		"Contact: <sip:alice@10.0.0.5>",
+		"Contact: <sip:alice@10.0.0.6>;expires=10",
+	))
+	if res.StatusCode != sip.StatusIntervalToBrief {
+		t.Fatalf("expected 423, got %d", res.StatusCode)
+	}
+	if bindings, _ := s.LookupContacts(alice); len(bindings) != 0 {
+		t.Fatalf("expected no bindings, got %+v", bindings)
+	}
+
+	// So does a stale refresh of one of them.
+	doRegister(t, s, newTestRegister(t, 5, "Contact: <sip:alice@10.0.0.5>"))
+	res = doRegister(t, s, newTestRegister(t, 4,
+		"Contact: <sip:alice@10.0.0.6>",
+		"Contact: <sip:alice@10.0.0.5>",
+	))
+	if res.StatusCode != sip.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", res.StatusCode)
+	}
+	if bindings, _ := s.LookupContacts(alice); len(bindings) != 1 || bindings[0].Contact.Address.Host != "10.0.0.5" {
+		t.Fatalf("expected only the first binding, got %+v", bindings)
+	}
+}
+
+func TestInviteRedirectsRegistered(t *testing.T) {
+	s := newTestRegistrar(t)
+	contact := sip.ContactHeader{Address: sip.Uri{User: "bob", Host: "10.0.0.7", Port: 5062}, Params: sip.NewParams()}
+	if err := s.location.Update(Binding{AOR: "sip:bob@127.0.0.1", Contact: contact, CallID: "c1", CSeq: 1, Expires: time.Now().Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+
+	invite := newTestInDialog(t, sip.INVITE, "redirect-1", "", 1, testOfferSDP)
+	tx := newCancelTx(invite)
+	s.handleInvite(invite, tx)
+	res := tx.result()
+	if len(res) != 1 || res[0].StatusCode != sip.StatusMovedTemporarily {
+		t.Fatalf("expected 302, got %v", res)
+	}
+	if c := res[0].Contact(); c == nil || c.Address.Host != "10.0.0.7" || c.Address.Port != 5062 {
+		t.Fatalf("expected the registered contact, got %v", c)
+	}
+	if n := s.sessionManager.Len(); n != 0 {
+		t.Fatalf("expected no session for a redirected call, got %d", n)
+	}
+}
+
+func TestMemoryLocationServiceExpiry(t *testing.T) {
+	m := NewMemoryLocationService()
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	contact := sip.ContactHeader{Address: sip.Uri{User: "bob", Host: "10.0.0.7"}, Params: sip.NewParams()}
+	if err := m.Update(Binding{AOR: "sip:bob@example.com", Contact: contact, CallID: "c1", CSeq: 1, Expires: now.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := m.Lookup("sip:bob@example.com"); len(b) != 1 {
+		t.Fatalf("expected 1 binding, got %d", len(b))
+	}
+
+	now = now.Add(2 * time.Minute)
+	if b, _ := m.Lookup("sip:bob@example.com"); len(b) != 0 {
+		t.Fatalf("expected binding to expire, got %d", len(b))
+	}
+
+	// An expired binding does not block a lower CSeq from the same Call-ID.
+	if err := m.Update(Binding{AOR: "sip:bob@example.com", Contact: contact, CallID: "c1", CSeq: 1, Expires: now.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistrarDigestAuth(t *testing.T) {
+	store := auth.NewMemoryCredentialStore()
+	store.Set("Example.com", "alice", "secret")
+	cfg := DefaultServerConfig()
+	cfg.Auth.Credentials = store
+	s, err := NewServer(logger.NewLogger(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := doRegister(t, s, newTestRegister(t, 1, "Contact: <sip:alice@10.0.0.5>"))
+	if res.StatusCode != sip.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", res.StatusCode)
+	}
+	chal, err := digest.ParseChallenge(res.GetHeader("WWW-Authenticate").Value())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cred, err := digest.Digest(chal, digest.Options{
+		Method:   "REGISTER",
+		URI:      "sip:example.com",
+		Username: "alice",
+		Password: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authz := "Authorization: " + cred.String()
+	res = doRegister(t, s, newTestRegister(t, 2, "Contact: <sip:alice@10.0.0.5>", authz))
+	if res.StatusCode != sip.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+
+	// Replaying the same nonce count is challenged again.
+	res = doRegister(t, s, newTestRegister(t, 3, "Contact: <sip:alice@10.0.0.5>", authz))
+	if res.StatusCode != sip.StatusUnauthorized {
+		t.Fatalf("expected 401 on replay, got %d", res.StatusCode)
+	}
+
+	// So are credentials for another Request-URI.
+	cred, err = digest.Digest(chal, digest.Options{
+		Method:   "REGISTER",
+		URI:      "sip:example.com",
+		Username: "alice",
+		Password: "secret",
+		Count:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := newTestRegister(t, 4, "Contact: <sip:alice@10.0.0.5>", "Authorization: "+cred.String())
+	req.Recipient = sip.Uri{Host: "other.example.com"}
+	if res = doRegister(t, s, req); res.StatusCode != sip.StatusUnauthorized {
+		t.Fatalf("expected 401 for another Request-URI, got %d", res.StatusCode)
+	}
+}
@@ -2,29 +2,112 @@ package sipnexus
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"strings"
 	"sync"
 
 	"github.com/emiago/sipgo"
 	"github.com/emiago/sipgo/sip"
+	"github.com/itzmanish/sipnexus/pkg/auth"
+	"github.com/itzmanish/sipnexus/pkg/codec"
 	"github.com/itzmanish/sipnexus/pkg/logger"
+	"github.com/itzmanish/sipnexus/pkg/media"
 	"github.com/itzmanish/sipnexus/pkg/utils"
 )
 
 type Server struct {
 	logger         logger.Logger
+	config         ServerConfig
+	ua             *sipgo.UserAgent
 	srv            *sipgo.Server
+	client         *sipgo.Client
+	listeners      []*listener
+	done           chan struct{}
+	shutdownOnce   sync.Once
 	instances      []string
 	hashRing       *ConsistentHash
 	mu             sync.RWMutex
 	sessionManager *SessionManager
+	location       LocationService
+	authenticator  *auth.DigestAuthenticator
+	ports          *media.PortAllocator
+	// advertised holds the resolved advertised IP of each listener in
+	// config order.
+	advertised []net.IP
+	// clients send requests over a transport whose Via carries the
+	// advertised address. Requests on other transports use client.
+	clients map[string]*sipgo.Client
 }
 
-func NewServer(log logger.Logger) (*Server, error) {
+func NewServer(log logger.Logger, cfg ServerConfig) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid server config: %w", err)
+	}
+	if cfg.Registrar == (RegistrarConfig{}) {
+		cfg.Registrar = DefaultRegistrarConfig()
+	}
+	if cfg.Location == nil {
+		cfg.Location = NewMemoryLocationService()
+	}
+	if cfg.Sessions == (SessionConfig{}) {
+		cfg.Sessions = DefaultSessionConfig()
+	}
+	if cfg.Sessions.ReapInterval == 0 {
+		cfg.Sessions.ReapInterval = DefaultSessionConfig().ReapInterval
+	}
+	if cfg.Media.RTPPortMin == 0 && cfg.Media.RTPPortMax == 0 {
+		cfg.Media.RTPPortMin = DefaultMediaConfig().RTPPortMin
+		cfg.Media.RTPPortMax = DefaultMediaConfig().RTPPortMax
+	}
+	ports, err := media.NewPortAllocator(cfg.Media.RTPPortMin, cfg.Media.RTPPortMax)
+	if err != nil {
+		return nil, err
+	}
+	mediaIP, err := resolveAdvertisedIP(log, "media", cfg.Media.AdvertisedAddress, cfg.Media.BindAddress)
+	if err != nil {
+		return nil, fmt.Errorf("media: %w", err)
+	}
+	iface := media.Interface{
+		BindIP:       net.ParseIP(cfg.Media.BindAddress),
+		AdvertisedIP: mediaIP,
+		SymmetricRTP: cfg.Media.SymmetricRTP,
+	}
+	if len(cfg.Media.Codecs) > 0 {
+		codecs, err := codec.Default.Select(cfg.Media.Codecs...)
+		if err != nil {
+			return nil, fmt.Errorf("media: %w", err)
+		}
+		iface.Codecs = media.RegistryCodecs(codecs)
+	}
+	advertised := make([]net.IP, len(cfg.Listeners))
+	for i, l := range cfg.Listeners {
+		if advertised[i], err = resolveAdvertisedIP(log, fmt.Sprintf("listener %d", i), l.AdvertisedAddress, l.BindAddress); err != nil {
+			return nil, fmt.Errorf("listener %d: %w", i, err)
+		}
+	}
+
 	s := &Server{
 		logger:         log,
+		config:         cfg,
+		done:           make(chan struct{}),
 		instances:      []string{"instance1", "instance2", "instance3"},
-		sessionManager: NewSessionManager(),
+		sessionManager: NewSessionManager(ports, iface),
+		location:       cfg.Location,
+		ports:          ports,
+		advertised:     advertised,
+		clients:        make(map[string]*sipgo.Client),
+	}
+
+	if cfg.Auth.Credentials != nil {
+		authenticator, err := auth.NewDigestAuthenticator(cfg.Auth.Credentials, cfg.Auth.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create authenticator: %w", err)
+		}
+		s.authenticator = authenticator
+	} else {
+		log.Warn("no credential store configured, REGISTER and INVITE are not authenticated")
 	}
 
 	// Initialize consistent hash ring
@@ -58,20 +141,196 @@ func NewServer(log logger.Logger) (*Server, error) {
 	srv.OnInvite(s.handleInvite)
 	srv.OnBye(s.handleBye)
 	srv.OnCancel(s.handleCancel)
+	srv.OnUpdate(s.handleUpdate)
 	srv.OnRegister(s.handleRegister)
 
+	client, err := sipgo.NewClient(ua)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SIP client: %w", err)
+	}
+
+	s.ua = ua
 	s.srv = srv
+	s.client = client
 	return s, nil
 }
 
+// Start binds every configured listener and serves them until ctx is done,
+// Shutdown is called or one of the listeners fails.
 func (s *Server) Start(ctx context.Context) error {
 	s.logger.Info("Starting SIP server...")
-	return s.srv.ListenAndServe(ctx, "udp", "0.0.0.0:5060")
+	if err := s.listen(); err != nil {
+		return err
+	}
+	return s.serve(ctx)
 }
 
 func (s *Server) Shutdown() error {
 	s.logger.Info("Shutting down SIP server...")
-	return s.srv.Close()
+	var err error
+	s.shutdownOnce.Do(func() {
+		close(s.done)
+		err = errors.Join(s.closeListeners(), s.srv.Close(), s.ua.Close())
+	})
+	return err
+}
+
+func (s *Server) listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, cfg := range s.config.Listeners {
+		var onServe func()
+		if cfg.transport() == TransportUDP && i == s.firstListener(TransportUDP) {
+			onServe = s.useAdvertisedClient(i)
+		}
+		l, err := s.openListener(cfg, s.advertised[i], onServe)
+		if err != nil {
+			for _, l := range s.listeners {
+				l.closer.Close()
+			}
+			s.listeners = nil
+			return fmt.Errorf("failed to listen on %s %s: %w", cfg.transport(), cfg.addr(), err)
+		}
+		s.logger.Infof("listening on %s %s, advertised as %s", cfg.transport(), l.addr, s.advertised[i])
+		s.listeners = append(s.listeners, l)
+	}
+	return nil
+}
+
+// useAdvertisedClient returns a function switching udp requests to a client
+// whose Via sent-by is the advertised address of listener i. It must only
+// run once that listener is served, since sipgo otherwise tries to bind the
+// sent-by address itself.
+func (s *Server) useAdvertisedClient(i int) func() {
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if i >= len(s.listeners) {
+			return
+		}
+		_, port, _ := sip.ParseAddr(s.listeners[i].addr.String())
+		client, err := sipgo.NewClient(s.ua, sipgo.WithClientHostname(s.advertised[i].String()), sipgo.WithClientPort(port))
+		if err != nil {
+			s.logger.Errorf("failed to create SIP client: %v", err)
+			return
+		}
+		s.clients[TransportUDP] = client
+	}
+}
+
+// firstListener returns the index of the first listener on transport, or -1.
+func (s *Server) firstListener(transport string) int {
+	for i, l := range s.config.Listeners {
+		if l.transport() == strings.ToLower(transport) {
+			return i
+		}
+	}
+	return -1
+}
+
+// clientFor returns the client sending requests over transport.
+func (s *Server) clientFor(transport string) *sipgo.Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if client, ok := s.clients[strings.ToLower(transport)]; ok {
+		return client
+	}
+	return s.client
+}
+
+// advertisedIP returns the advertised IP of the first listener on transport,
+// falling back to the IP of the user agent.
+func (s *Server) advertisedIP(transport string) net.IP {
+	if i := s.firstListener(transport); i >= 0 {
+		return s.advertised[i]
+	}
+	return s.ua.GetIP()
+}
+
+// detectAdvertisedIP is replaced in tests to simulate hosts without network.
+var detectAdvertisedIP = utils.AdvertisedIP
+
+// resolveAdvertisedIP returns the IP advertised for a socket bound to bind.
+// A host without a usable interface, such as a container with no network,
+// advertises loopback rather than refusing to start.
+func resolveAdvertisedIP(log logger.Logger, name, advertised, bind string) (net.IP, error) {
+	ip, err := detectAdvertisedIP(advertised, bind)
+	if !errors.Is(err, utils.ErrNoLocalIP) {
+		return ip, err
+	}
+	ip = net.IPv4(127, 0, 0, 1)
+	if b := net.ParseIP(bind); b != nil && b.To4() == nil {
+		ip = net.IPv6loopback
+	}
+	log.Warnf("%s: %v, advertising %s", name, err, ip)
+	return ip, nil
+}
+
+func (s *Server) serve(ctx context.Context) error {
+	s.mu.RLock()
+	listeners := s.listeners
+	s.mu.RUnlock()
+
+	reapCtx, stopReaper := context.WithCancel(ctx)
+	defer stopReaper()
+	go s.runReaper(reapCtx)
+
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l *listener) {
+			errCh <- l.serve()
+		}(l)
+	}
+
+	select {
+	case <-ctx.Done():
+		return s.closeListeners()
+	case <-s.done:
+		return nil
+	case err := <-errCh:
+		select {
+		case <-s.done:
+			return nil
+		default:
+		}
+		s.closeListeners()
+		if isClosedErr(err) {
+			return nil
+		}
+		return err
+	}
+}
+
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, l := range s.listeners {
+		if err := l.closer.Close(); err != nil && !isClosedErr(err) {
+			errs = append(errs, err)
+		}
+	}
+	s.listeners = nil
+	return errors.Join(errs...)
+}
+
+// listenAddrs returns the bound address of each listener in config order.
+func (s *Server) listenAddrs() []net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.addr)
+	}
+	return addrs
+}
+
+// SubscribeSessions registers h for status changes of every session.
+func (s *Server) SubscribeSessions(h SessionEventHandler) (unsubscribe func()) {
+	return s.sessionManager.Subscribe(h)
 }
 
 func (s *Server) getInstanceForRequest(callID string) string {
@@ -82,84 +341,301 @@ func (s *Server) getInstanceForRequest(callID string) string {
 
 func (s *Server) handleInvite(req *sip.Request, tx sip.ServerTransaction) {
 	s.logger.Infof("handling invite request: %v", req)
+	if req.From() == nil || req.To() == nil || req.CallID() == nil {
+		s.sendErrorResponse(req, tx, sip.StatusBadRequest, "Bad Request: Missing Dialog Headers")
+		return
+	}
+	if _, ok := req.To().Params.Get("tag"); ok {
+		s.handleReInvite(req, tx)
+		return
+	}
+	p := newPendingInvite(req, tx)
+	if _, ok := s.authenticate(req, tx, req.From().Address, true); !ok {
+		return
+	}
+	if s.redirectRegistered(p) {
+		return
+	}
+
 	// Create a new session
-	session := s.sessionManager.CreateSession(req.CallID().String())
+	session := s.sessionManager.CreateSession(req.CallID().Value())
+	go s.watchCancel(p, session)
 
-	// Parse SDP offer
-	_, err := utils.ParseSDP(req.Body())
+	// Handle media setup
+	answerSDP, err := session.setRemoteOffer(string(req.Body()))
 	if err != nil {
-		s.sendErrorResponse(req, tx, sip.StatusBadRequest, "Bad Request: Invalid SDP")
+		code, reason := s.offerError(session, err)
+		s.rejectInvite(p, session, code, reason)
 		return
 	}
 
-	// Handle media setup
-	answerSDP, err := session.rtc.SetOffer(string(req.Body()))
+	// The 180 carries our tag and creates the early dialog; the 200 reuses it.
+	ringing := sip.NewResponseFromRequest(req, sip.StatusRinging, "Ringing", nil)
+	ringing.AppendHeader(s.contactHeader(req.Transport()))
+	d, err := newUASDialog(s.clientFor(req.Transport()), req, ringing)
 	if err != nil {
-		s.logger.Errorf("failed to generate answer: %v", err)
-		s.sendErrorResponse(req, tx, sip.StatusInternalServerError, "Internal Server Error")
+		s.rejectInvite(p, session, sip.StatusBadRequest, "Bad Request: "+err.Error())
 		return
 	}
+	session.setDialog(d)
+	if sent, err := p.respond(ringing); !sent {
+		session.close(SessionStatus_Disconnected)
+		return
+	} else if err != nil {
+		s.logger.Errorf("failed to send 180 Ringing: %v", err)
+		session.close(SessionStatus_Failed)
+		return
+	}
+	session.setStatus(SessionStatus_Ringing)
 
 	// Create 200 OK response with SDP answer
-	resp := sip.NewResponseFromRequest(req, 200, "OK", []byte(answerSDP))
-	if err := tx.Respond(resp); err != nil {
+	resp := s.newDialogResponse(req, d, sip.StatusOK, "OK", []byte(answerSDP))
+	resp.AppendHeader(sip.NewHeader("Content-Type", "application/sdp"))
+	if sent, err := p.respond(resp); !sent {
+		// Cancelled before we could answer.
+		session.close(SessionStatus_Disconnected)
+		return
+	} else if err != nil {
 		s.logger.Error("Failed to send 200 OK response: " + err.Error())
+		session.close(SessionStatus_Failed)
+		return
 	}
+	d.confirm()
+	session.answered()
 }
 
-func (s *Server) handleAck(req *sip.Request, tx sip.ServerTransaction) {
-	// ACK doesn't require a response, but we can use it to finalize the call setup
-	s.logger.Info("Received ACK for call: " + req.CallID().String())
+// redirectRegistered answers an INVITE for a registered AOR with 302 and its
+// contacts, so that the caller reaches the user where it registered (RFC
+// 3261 8.3). It reports whether it did; INVITEs for anyone else are
+// answered here.
+func (s *Server) redirectRegistered(p *pendingInvite) bool {
+	bindings, err := s.LookupContacts(p.req.Recipient)
+	if err != nil {
+		s.logger.Errorf("failed to lookup bindings for %s: %v", AddressOfRecord(p.req.Recipient), err)
+		return false
+	}
+	if len(bindings) == 0 {
+		return false
+	}
+	res := sip.NewResponseFromRequest(p.req, sip.StatusMovedTemporarily, "Moved Temporarily", nil)
+	for _, b := range bindings {
+		res.AppendHeader(b.Contact.Clone())
+	}
+	s.logger.Infof("redirecting call %s to %d contacts of %s", p.req.CallID().Value(), len(bindings), AddressOfRecord(p.req.Recipient))
+	if _, err := p.respond(res); err != nil {
+		s.logger.Errorf("failed to send 302 response: %v", err)
+	}
+	return true
+}
 
+// rejectInvite fails session and answers the INVITE with an error, unless
+// it has already been cancelled.
+func (s *Server) rejectInvite(p *pendingInvite, session *Session, statusCode sip.StatusCode, reason string) {
+	s.logger.Errorf("rejecting call %s: %v", session.CallID, reason)
+	session.close(SessionStatus_Failed)
+	if _, err := p.respond(sip.NewResponseFromRequest(p.req, statusCode, reason, nil)); err != nil {
+		s.logger.Errorf("failed to send %d response: %v", statusCode, err)
+	}
+}
+
+// statusRequestPending rejects an offer that crosses one of ours (RFC 3261
+// 14.2); sipgo has no constant for it.
+const statusRequestPending sip.StatusCode = 491
+
+// offerError maps a failure to apply a remote offer to the status
+// rejecting it.
+func (s *Server) offerError(session *Session, err error) (sip.StatusCode, string) {
+	var sdpErr *utils.SDPError
+	switch {
+	case errors.Is(err, utils.ErrMalformedSDP):
+		return sip.StatusBadRequest, "Bad Request: Invalid SDP"
+	case errors.As(err, &sdpErr), errors.Is(err, media.ErrNoCommonMedia):
+		s.logger.Infof("rejecting offer of call %s: %v", session.CallID, err)
+		return sip.StatusNotAcceptableHere, "Not Acceptable Here"
+	case errors.Is(err, media.ErrPortsExhausted):
+		return sip.StatusServiceUnavailable, "Service Unavailable: No Media Ports"
+	}
+	s.logger.Errorf("failed to generate answer: %v", err)
+	return sip.StatusInternalServerError, "Internal Server Error"
+}
+
+// handleReInvite handles an INVITE within an existing dialog, which changes
+// the media of the session or refreshes it. A rejected offer leaves the
+// session as it was (RFC 3261 14.2).
+func (s *Server) handleReInvite(req *sip.Request, tx sip.ServerTransaction) {
+	session, ok := s.matchDialog(req, tx)
+	if !ok {
+		return
+	}
+	s.updateSession(req, tx, session)
+}
+
+// handleUpdate handles UPDATE (RFC 3311), which changes the media of a
+// session like a re-INVITE but without ACK.
+func (s *Server) handleUpdate(req *sip.Request, tx sip.ServerTransaction) {
+	session, ok := s.matchDialog(req, tx)
+	if !ok {
+		return
+	}
+	s.updateSession(req, tx, session)
+}
+
+// updateSession answers a target refresh request that may carry an offer.
+// A re-INVITE without offer is answered with ours, to be answered in the
+// ACK; an UPDATE without offer only refreshes the dialog.
+func (s *Server) updateSession(req *sip.Request, tx sip.ServerTransaction, session *Session) {
+	if !session.beginOffer() {
+		s.sendErrorResponse(req, tx, statusRequestPending, "Request Pending")
+		return
+	}
+	// Our offer in the 2xx to a re-INVITE without one is answered in the
+	// ACK, so the exchange only ends there.
+	awaitAck := false
+	defer func() {
+		if !awaitAck {
+			session.endOffer()
+		}
+	}()
+
+	var (
+		body []byte
+		err  error
+	)
+	switch {
+	case len(req.Body()) > 0:
+		var answer string
+		answer, err = session.setRemoteOffer(string(req.Body()))
+		if err != nil {
+			code, reason := s.offerError(session, err)
+			s.sendErrorResponse(req, tx, code, reason)
+			return
+		}
+		body = []byte(answer)
+		s.logger.Infof("call %s media updated, remote hold %v", session.CallID, session.RemoteHeld())
+	case req.IsInvite():
+		var offer string
+		if offer, err = session.rtc.CreateOffer(); err != nil {
+			s.logger.Errorf("failed to create offer for call %s: %v", session.CallID, err)
+			s.sendErrorResponse(req, tx, sip.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		body = []byte(offer)
+	}
+
+	d := session.getDialog()
+	d.refresh(req.Contact())
+	res := s.newDialogResponse(req, d, sip.StatusOK, "OK", body)
+	if body != nil {
+		res.AppendHeader(sip.NewHeader("Content-Type", "application/sdp"))
+	}
+	if err := tx.Respond(res); err != nil {
+		s.logger.Errorf("failed to send 200 OK for %s: %v", req.Method, err)
+		return
+	}
+	if req.IsInvite() && len(req.Body()) == 0 {
+		session.awaitAck(sip.Timer_H)
+		awaitAck = true
+	}
+}
+
+func (s *Server) handleAck(req *sip.Request, tx sip.ServerTransaction) {
+	// ACK for our 2xx confirms the call; ACKs for non-2xx are absorbed by
+	// the INVITE transaction.
+	session, ok := s.findDialog(req)
+	if !ok {
+		s.logger.Infof("ACK does not match any dialog, call %s", req.CallID().Value())
+		return
+	}
+	if session.setStatus(SessionStatus_Connected) {
+		s.logger.Infof("call %s connected", session.CallID)
+	}
+	// The ACK answers the offer we sent in the 2xx to a re-INVITE without
+	// offer.
+	if !session.ackReceived() {
+		return
+	}
+	if len(req.Body()) == 0 {
+		s.logger.Errorf("ACK of call %s has no answer to our offer", session.CallID)
+		return
+	}
+	if err := session.setRemoteAnswer(string(req.Body())); err != nil {
+		s.logger.Errorf("failed to apply answer in ACK of call %s: %v", session.CallID, err)
+	}
 }
 
 func (s *Server) handleOptions(req *sip.Request, tx sip.ServerTransaction) {
+	if _, ok := req.To().Params.Get("tag"); ok {
+		if _, ok := s.matchDialog(req, tx); !ok {
+			return
+		}
+	}
 	res := sip.NewResponseFromRequest(req, 200, "OK", nil)
 	tx.Respond(res)
 }
 
 func (s *Server) handleBye(req *sip.Request, tx sip.ServerTransaction) {
-	// End the session
-	callId := req.CallID()
-	if callId == nil {
-		s.logger.Error("call id is empty, not handling bye")
+	session, ok := s.matchDialog(req, tx)
+	if !ok {
+		return
 	}
 
-	s.sessionManager.DeleteSession(callId.Value())
-
 	// Send 200 OK response
 	resp := sip.NewResponseFromRequest(req, 200, "OK", nil)
 	if err := tx.Respond(resp); err != nil {
 		s.logger.Error("Failed to send 200 OK response: " + err.Error())
 	}
+
+	// End the session
+	session.close(SessionStatus_Disconnected)
 }
 
 func (s *Server) handleCancel(req *sip.Request, tx sip.ServerTransaction) {
-	// Handle CANCEL request
-	s.logger.Infof("Received CANCEL for call: %v", req.CallID())
+	// A CANCEL matching a pending INVITE is delivered to that INVITE's
+	// transaction; anything reaching this handler has nothing to cancel
+	// (RFC 3261 9.2).
+	s.logger.Infof("Received CANCEL without matching INVITE for call: %v", req.CallID())
+	s.sendErrorResponse(req, tx, sip.StatusCallTransactionDoesNotExists, "Call/Transaction Does Not Exist")
+}
 
-	// Send 200 OK for the CANCEL request
-	resp := sip.NewResponseFromRequest(req, 200, "OK", nil)
-	if err := tx.Respond(resp); err != nil {
-		s.logger.Error("Failed to send 200 OK response for CANCEL: " + err.Error())
+// findDialog returns the session of the dialog req belongs to. The To tag
+// of an incoming in-dialog request is our tag, the From tag the remote one.
+func (s *Server) findDialog(req *sip.Request) (*Session, bool) {
+	from, to, callID := req.From(), req.To(), req.CallID()
+	if from == nil || to == nil || callID == nil {
+		return nil, false
 	}
-	tx.Terminate()
-	// TODO: Terminate the pending INVITE transaction if it exists
+	localTag, ok := to.Params.Get("tag")
+	if !ok {
+		return nil, false
+	}
+	remoteTag, _ := from.Params.Get("tag")
+	return s.sessionManager.FindDialog(callID.Value(), localTag, remoteTag)
 }
 
-func (s *Server) handleRegister(req *sip.Request, tx sip.ServerTransaction) {
-	authHeader := req.GetHeader("Authorization")
-	if authHeader == nil || !s.isValidToken(authHeader.Value()) {
-		s.sendErrorResponse(req, tx, sip.StatusUnauthorized, "Unauthorized")
-		return
+// matchDialog finds the session for an in-dialog request and validates its
+// CSeq, answering 481 or 500 itself when that fails.
+func (s *Server) matchDialog(req *sip.Request, tx sip.ServerTransaction) (*Session, bool) {
+	session, ok := s.findDialog(req)
+	if !ok {
+		s.sendErrorResponse(req, tx, sip.StatusCallTransactionDoesNotExists, "Call/Transaction Does Not Exist")
+		return nil, false
 	}
+	if err := session.getDialog().receive(req); err != nil {
+		s.sendErrorResponse(req, tx, sip.StatusInternalServerError, "Server Internal Error: "+err.Error())
+		return nil, false
+	}
+	return session, true
+}
 
-	// Proceed with registration logic
-	s.logger.Info("Received REGISTER request")
-	resp := sip.NewResponseFromRequest(req, 200, "OK", nil)
-	if err := tx.Respond(resp); err != nil {
-		s.logger.Error("Failed to send 200 OK response for REGISTER: " + err.Error())
+// newDialogResponse builds a response carrying the dialog's local tag and
+// our Contact.
+func (s *Server) newDialogResponse(req *sip.Request, d *dialog, code sip.StatusCode, reason string, body []byte) *sip.Response {
+	res := sip.NewResponseFromRequest(req, code, reason, body)
+	res.To().Params.Add("tag", d.localTag)
+	if d.contact != nil {
+		res.AppendHeader(d.contact.Clone())
 	}
+	return res
 }
 
 func (s *Server) sendErrorResponse(req *sip.Request, tx sip.ServerTransaction, statusCode sip.StatusCode, reason string) {
@@ -169,8 +645,3 @@ func (s *Server) sendErrorResponse(req *sip.Request, tx sip.ServerTransaction, s
 		s.logger.Error(fmt.Sprintf("Failed to send %d response: %s", statusCode, err.Error()))
 	}
 }
-
-func (s *Server) isValidToken(token string) bool {
-	// Implement token validation logic here
-	return token == "valid-token" // Placeholder for actual validation
-}
@@ -0,0 +1,256 @@
+package sipnexus
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+	"github.com/itzmanish/sipnexus/pkg/logger"
+	"github.com/itzmanish/sipnexus/pkg/media"
+	"github.com/itzmanish/sipnexus/pkg/utils"
+)
+
+func writeTestCert(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// startTestServer brings up a Server with the given listeners and returns
+// the bound listener addresses in config order.
+func startTestServer(t *testing.T, cfg ServerConfig) (*Server, []net.Addr) {
+	t.Helper()
+	s, err := NewServer(logger.NewLogger(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.serve(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		s.Shutdown()
+		if err := <-errCh; err != nil {
+			t.Errorf("serve returned error: %v", err)
+		}
+	})
+	return s, s.listenAddrs()
+}
+
+func newTestClient(t *testing.T) *sipgo.Client {
+	t.Helper()
+	ua, err := sipgo.NewUA(sipgo.WithUserAgenTLSConfig(&tls.Config{InsecureSkipVerify: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ua.Close() })
+
+	client, err := sipgo.NewClient(ua, sipgo.WithClientHostname("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func sendOptions(t *testing.T, client *sipgo.Client, transport string, addr net.Addr) *sip.Response {
+	t.Helper()
+	host, port, _ := sip.ParseAddr(addr.String())
+	recipient := sip.Uri{Host: host, Port: port, UriParams: sip.NewParams()}
+	recipient.UriParams.Add("transport", transport)
+
+	req := sip.NewRequest(sip.OPTIONS, recipient)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := client.Do(ctx, req)
+	if err != nil {
+		t.Fatalf("%s OPTIONS failed: %v", transport, err)
+	}
+	return res
+}
+
+func TestServerListeners(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+
+	testCases := []ListenerConfig{
+		{Transport: TransportUDP, BindAddress: "127.0.0.1"},
+		{Transport: TransportTCP, BindAddress: "127.0.0.1"},
+		{Transport: TransportTLS, BindAddress: "127.0.0.1", TLSCertFile: certFile, TLSKeyFile: keyFile},
+		{Transport: TransportWS, BindAddress: "127.0.0.1", WSPath: "/"},
+		{Transport: TransportWSS, BindAddress: "127.0.0.1", TLSCertFile: certFile, TLSKeyFile: keyFile},
+	}
+
+	_, addrs := startTestServer(t, ServerConfig{Listeners: testCases})
+	if len(addrs) != len(testCases) {
+		t.Fatalf("expected %d listeners, got %d", len(testCases), len(addrs))
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.Transport, func(t *testing.T) {
+			client := newTestClient(t)
+			res := sendOptions(t, client, tc.Transport, addrs[i])
+			if res.StatusCode != sip.StatusOK {
+				t.Fatalf("expected 200, got %d", res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestServerWSPathMismatch(t *testing.T) {
+	_, addrs := startTestServer(t, ServerConfig{Listeners: []ListenerConfig{
+		{Transport: TransportWS, BindAddress: "127.0.0.1", WSPath: "/sip"},
+	}})
+
+	conn, err := net.Dial("tcp", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /other HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _ := conn.Read(buf)
+	if got := string(buf[:n]); len(got) < 12 || got[9:12] != "404" {
+		t.Fatalf("expected 404 response, got %q", got)
+	}
+}
+
+func TestServerWSSlowClient(t *testing.T) {
+	_, addrs := startTestServer(t, ServerConfig{Listeners: []ListenerConfig{
+		{Transport: TransportWS, BindAddress: "127.0.0.1", WSPath: "/"},
+	}})
+
+	// One client stalls in the middle of its upgrade request, another one
+	// sends nothing at all.
+	for _, partial := range []string{"GET / HTTP/1.1\r\nHost: localhost\r\n", ""} {
+		conn, err := net.Dial("tcp", addrs[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(partial))
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if res := sendOptions(t, newTestClient(t), TransportWS, addrs[0]); res.StatusCode != sip.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	if d := time.Since(start); d > wsHandshakeTimeout/2 {
+		t.Fatalf("OPTIONS took %v behind slow clients", d)
+	}
+}
+
+func TestServerConfigValidate(t *testing.T) {
+	bad := []ServerConfig{
+		{},
+		{Listeners: []ListenerConfig{{Transport: "sctp"}}},
+		{Listeners: []ListenerConfig{{Transport: TransportTLS}}},
+		{Listeners: []ListenerConfig{{Transport: TransportWS, WSPath: "sip"}}},
+		{Listeners: []ListenerConfig{{Transport: TransportUDP}}, Sessions: SessionConfig{RTPTimeout: -time.Second}},
+		{Listeners: []ListenerConfig{{Transport: TransportUDP, AdvertisedAddress: "sip.example.com"}}},
+		{Listeners: []ListenerConfig{{Transport: TransportUDP}}, Media: MediaConfig{AdvertisedAddress: "300.1.1.1"}},
+		{Listeners: []ListenerConfig{{Transport: TransportUDP}}, Media: MediaConfig{SymmetricRTP: media.SymmetricRTP{Enabled: true, RelatchPackets: -1}}},
+		{Listeners: []ListenerConfig{{Transport: TransportUDP}}, Media: MediaConfig{Codecs: []string{"G729"}}},
+	}
+	for _, cfg := range bad {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+	if err := DefaultServerConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerAdvertisesLoopbackWithoutNetwork(t *testing.T) {
+	detect := detectAdvertisedIP
+	detectAdvertisedIP = func(advertised, bind string) (net.IP, error) {
+		if advertised != "" {
+			return net.ParseIP(advertised), nil
+		}
+		return nil, utils.ErrNoLocalIP
+	}
+	t.Cleanup(func() { detectAdvertisedIP = detect })
+
+	cfg := DefaultServerConfig()
+	cfg.Listeners = append(cfg.Listeners,
+		ListenerConfig{Transport: TransportTCP, BindAddress: "::"},
+		ListenerConfig{Transport: TransportTLS, AdvertisedAddress: "203.0.113.7", TLSCertFile: "crt", TLSKeyFile: "key"},
+	)
+	s, err := NewServer(logger.NewLogger(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for transport, want := range map[string]string{TransportUDP: "127.0.0.1", TransportTCP: "::1", TransportTLS: "203.0.113.7"} {
+		if got := s.advertisedIP(transport).String(); got != want {
+			t.Errorf("%s: expected %s, got %s", transport, want, got)
+		}
+	}
+}
+
+func TestServerMediaCodecs(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.Media.Codecs = []string{"G722", "PCMU"}
+	s, err := NewServer(logger.NewLogger(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := s.sessionManager.CreateSession("codecs-1")
+	defer session.close(SessionStatus_Disconnected)
+	offer, err := session.rtc.CreateOffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(offer, " RTP/AVP 9 0 13 101") {
+		t.Fatalf("expected G.722 offered first, then PCMU:\n%s", offer)
+	}
+}
@@ -1,9 +1,14 @@
 package sipnexus
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
 	"github.com/google/uuid"
 	"github.com/itzmanish/sipnexus/pkg/logger"
 	"github.com/itzmanish/sipnexus/pkg/media"
@@ -19,37 +24,470 @@ const (
 	SessionStatus_Failed
 )
 
+func (st SessionStatus) String() string {
+	switch st {
+	case SessionStatus_New:
+		return "new"
+	case SessionStatus_Ringing:
+		return "ringing"
+	case SessionStatus_Connected:
+		return "connected"
+	case SessionStatus_Disconnected:
+		return "disconnected"
+	case SessionStatus_Failed:
+		return "failed"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(st))
+}
+
+// terminal reports whether no further transitions are possible.
+func (st SessionStatus) terminal() bool {
+	return st == SessionStatus_Disconnected || st == SessionStatus_Failed
+}
+
+// canTransition reports whether a session may move from st to next. Sessions
+// only move forward and an answered call ends as disconnected, not failed.
+func (st SessionStatus) canTransition(next SessionStatus) bool {
+	if st.terminal() || next <= st {
+		return false
+	}
+	return !(st == SessionStatus_Connected && next == SessionStatus_Failed)
+}
+
+var ErrNoDialog = errors.New("session has no established dialog")
+
+// ErrOfferPending is returned when a re-INVITE cannot be sent because
+// another offer/answer exchange on the session has not finished yet.
+var ErrOfferPending = errors.New("offer/answer exchange in progress")
+
+// Reasons recorded by the reaper when it ends a session.
+const (
+	EndReasonMaxDuration  = "max call duration exceeded"
+	EndReasonSetupTimeout = "no ACK for 2xx"
+	EndReasonRTPTimeout   = "no RTP received"
+)
+
+// SessionEvent describes a change of Session.Status.
+type SessionEvent struct {
+	Session  *Session
+	Previous SessionStatus
+	Status   SessionStatus
+	// Reason is set when the server ended the session by itself.
+	Reason string
+	Time   time.Time
+}
+
+// SessionEventHandler is called synchronously for every status change and
+// must not block.
+type SessionEventHandler func(ev SessionEvent)
+
 type Session struct {
 	ID     string
 	CallID string
+	// Status is driven by the dialog layer; read it with State when the
+	// session is shared with SIP handlers.
 	Status SessionStatus
 	rtc    media.MediaEngine
+	dialog *dialog
+	sm     *SessionManager
+	mu     sync.Mutex
 
 	CreatedAt time.Time
+	// AnsweredAt is when the 2xx for the INVITE was sent or received.
+	AnsweredAt time.Time
+	// ConnectedAt is when the call reached SessionStatus_Connected.
+	ConnectedAt time.Time
+	// EndReason records why the server ended the session, if it did.
+	EndReason string
+
+	// offering is set while an offer/answer exchange is in progress, to
+	// detect glare (RFC 3261 14.1).
+	offering bool
+	// ackTimer ends the exchange of an offer we sent in the 2xx to a
+	// re-INVITE without offer if the ACK with the answer never arrives.
+	ackTimer *time.Timer
+	// held and remoteHeld record which side put the call on hold.
+	held       bool
+	remoteHeld bool
+	// negotiatedAt is when media was last renegotiated, from which the RTP
+	// timeout counts.
+	negotiatedAt time.Time
+}
+
+// State returns the current status.
+func (s *Session) State() SessionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Status
+}
+
+// setStatus moves the session to status and notifies subscribers. It
+// reports false and does nothing when the transition is not allowed.
+func (s *Session) setStatus(status SessionStatus) bool {
+	prev, ok := s.transition(status)
+	if ok {
+		s.notify(prev, status)
+	}
+	return ok
+}
+
+func (s *Session) transition(status SessionStatus) (SessionStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.Status
+	if !prev.canTransition(status) {
+		return prev, false
+	}
+	s.Status = status
+	if status == SessionStatus_Connected {
+		s.ConnectedAt = time.Now()
+	}
+	return prev, true
+}
+
+func (s *Session) notify(prev, status SessionStatus) {
+	if s.sm == nil {
+		return
+	}
+	s.mu.Lock()
+	reason := s.EndReason
+	s.mu.Unlock()
+	s.sm.emit(SessionEvent{Session: s, Previous: prev, Status: status, Reason: reason, Time: time.Now()})
+}
+
+// markEnding records why the server is ending the session. It reports false
+// if the session is already being ended.
+func (s *Session) markEnding(reason string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.EndReason != "" || s.Status.terminal() {
+		return false
+	}
+	s.EndReason = reason
+	return true
+}
+
+// answered records that the INVITE got its 2xx.
+func (s *Session) answered() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.AnsweredAt = time.Now()
+}
+
+func (s *Session) getDialog() *dialog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dialog
+}
+
+func (s *Session) setDialog(d *dialog) {
+	s.mu.Lock()
+	s.dialog = d
+	s.mu.Unlock()
+
+	if s.sm != nil {
+		s.sm.indexDialog(s, d)
+	}
+}
+
+// Held reports whether we put the call on hold with Hold.
+func (s *Session) Held() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.held
+}
+
+// RemoteHeld reports whether the remote party put the call on hold.
+func (s *Session) RemoteHeld() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remoteHeld
+}
+
+// MediaStats returns the quality statistics of the call's media: packet
+// counts, loss, jitter, round trip time and an estimated MOS.
+func (s *Session) MediaStats() media.Stats {
+	if s.rtc == nil {
+		return media.Stats{}
+	}
+	return s.rtc.Stats()
+}
+
+// Hold puts the call on hold by sending a re-INVITE that makes our media
+// sendonly.
+func (s *Session) Hold(ctx context.Context) error {
+	return s.reinvite(ctx, true)
+}
+
+// Resume takes the call off hold again.
+func (s *Session) Resume(ctx context.Context) error {
+	return s.reinvite(ctx, false)
+}
+
+// reinvite re-offers the media with the hold state changed to hold. The
+// session stays as it was when the offer is rejected.
+func (s *Session) reinvite(ctx context.Context, hold bool) error {
+	d := s.getDialog()
+	if d == nil || s.State() != SessionStatus_Connected {
+		return ErrNoDialog
+	}
+	if !s.beginOffer() {
+		return ErrOfferPending
+	}
+	defer s.endOffer()
+
+	s.rtc.Hold(hold)
+	ok := false
+	defer func() {
+		if !ok {
+			s.rtc.Hold(s.Held())
+		}
+	}()
+	offer, err := s.rtc.CreateOffer()
+	if err != nil {
+		return fmt.Errorf("failed to create offer: %w", err)
+	}
+
+	req := d.newRequest(sip.INVITE)
+	req.AppendHeader(sip.NewHeader("Content-Type", "application/sdp"))
+	req.SetBody([]byte(offer))
+	res, err := d.do(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to send re-INVITE: %w", err)
+	}
+	if !res.IsSuccess() {
+		return fmt.Errorf("re-INVITE rejected: %s", res.StartLine())
+	}
+	d.refresh(res.Contact())
+	if err := d.client.WriteRequest(d.newRequest(sip.ACK), sipgo.ClientRequestBuild); err != nil {
+		return fmt.Errorf("failed to send ACK: %w", err)
+	}
+	if err := s.setRemoteAnswer(string(res.Body())); err != nil {
+		return fmt.Errorf("failed to apply answer: %w", err)
+	}
+	ok = true
+	s.mu.Lock()
+	s.held = hold
+	s.mu.Unlock()
+	return nil
+}
+
+// beginOffer marks an offer/answer exchange as started. It reports false if
+// one is already in progress.
+func (s *Session) beginOffer() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.offering {
+		return false
+	}
+	s.offering = true
+	return true
+}
+
+func (s *Session) endOffer() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offering = false
+}
+
+// awaitAck keeps the exchange started by beginOffer open until ackReceived
+// is called, or for at most timeout.
+func (s *Session) awaitAck(timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var t *time.Timer
+	t = time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.ackTimer == t {
+			s.ackTimer = nil
+			s.offering = false
+		}
+	})
+	s.ackTimer = t
+}
+
+// ackReceived ends the exchange kept open by awaitAck. It reports false if
+// none was.
+func (s *Session) ackReceived() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ackTimer == nil {
+		return false
+	}
+	s.ackTimer.Stop()
+	s.ackTimer = nil
+	s.offering = false
+	return true
+}
+
+// setRemoteOffer applies an offer from the remote party and returns our
+// answer.
+func (s *Session) setRemoteOffer(offer string) (string, error) {
+	answer, err := s.rtc.SetOffer(offer)
+	if err == nil {
+		s.mediaChanged()
+	}
+	return answer, err
+}
+
+// setRemoteAnswer applies the remote answer to our last offer.
+func (s *Session) setRemoteAnswer(answer string) error {
+	err := s.rtc.SetAnswer(answer)
+	if err == nil {
+		s.mediaChanged()
+	}
+	return err
+}
+
+// mediaChanged updates the remote hold state after a negotiation.
+func (s *Session) mediaChanged() {
+	stream, ok := s.rtc.Stream()
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remoteHeld = stream.RemoteHold()
+	s.negotiatedAt = time.Now()
+}
+
+// expectsRTP reports whether the remote party is meant to be sending us
+// media, which it is not while the call is on hold on either side.
+func (s *Session) expectsRTP() bool {
+	s.mu.Lock()
+	held := s.held || s.remoteHeld
+	s.mu.Unlock()
+	if held {
+		return false
+	}
+	stream, ok := s.rtc.Stream()
+	return !ok || stream.Direction.Receives()
+}
+
+// Hangup sends BYE to the remote party and removes the session.
+func (s *Session) Hangup(ctx context.Context) error {
+	d := s.getDialog()
+	if d == nil {
+		return ErrNoDialog
+	}
+	if s.State().terminal() {
+		return nil
+	}
+	defer s.close(SessionStatus_Disconnected)
+
+	res, err := d.do(ctx, d.newRequest(sip.BYE))
+	if err != nil {
+		return fmt.Errorf("failed to send BYE: %w", err)
+	}
+	if !res.IsSuccess() {
+		return fmt.Errorf("BYE rejected: %s", res.StartLine())
+	}
+	return nil
 }
 
+// close moves the session to its final status, terminates its dialog,
+// releases media and removes it from its manager before notifying
+// subscribers. Closing an already closed session is a no-op.
+func (s *Session) close(status SessionStatus) {
+	prev, ok := s.transition(status)
+	if !ok {
+		return
+	}
+	defer s.notify(prev, status)
+
+	if d := s.getDialog(); d != nil {
+		d.terminate()
+	}
+	if s.rtc != nil {
+		s.rtc.Close()
+	}
+	if s.sm != nil {
+		s.sm.remove(s)
+	}
+}
+
+// SessionManager owns the live sessions. Besides the primary index by
+// session ID it indexes sessions by Call-ID, by dialog ID and by our local
+// tag so that in-dialog requests are matched in constant time.
 type SessionManager struct {
 	sessions map[string]*Session
+	byCallID map[string]map[string]*Session
+	byDialog map[string]*Session
+	byTag    map[string]*Session
 	mu       sync.RWMutex
+	ports    *media.PortAllocator
+	iface    media.Interface
+
+	subMu       sync.RWMutex
+	subscribers map[int]SessionEventHandler
+	nextSub     int
 }
 
-func NewSessionManager() *SessionManager {
+// NewSessionManager returns a manager whose sessions bind media on ports of
+// iface.
+func NewSessionManager(ports *media.PortAllocator, iface media.Interface) *SessionManager {
 	return &SessionManager{
-		sessions: make(map[string]*Session),
+		ports:       ports,
+		iface:       iface,
+		sessions:    make(map[string]*Session),
+		byCallID:    make(map[string]map[string]*Session),
+		byDialog:    make(map[string]*Session),
+		byTag:       make(map[string]*Session),
+		subscribers: make(map[int]SessionEventHandler),
+	}
+}
+
+// Subscribe registers h for status changes of every session and returns a
+// function removing it again.
+func (sm *SessionManager) Subscribe(h SessionEventHandler) (unsubscribe func()) {
+	sm.subMu.Lock()
+	defer sm.subMu.Unlock()
+
+	id := sm.nextSub
+	sm.nextSub++
+	sm.subscribers[id] = h
+	return func() {
+		sm.subMu.Lock()
+		defer sm.subMu.Unlock()
+		delete(sm.subscribers, id)
+	}
+}
+
+func (sm *SessionManager) emit(ev SessionEvent) {
+	sm.subMu.RLock()
+	handlers := make([]SessionEventHandler, 0, len(sm.subscribers))
+	for _, h := range sm.subscribers {
+		handlers = append(handlers, h)
+	}
+	sm.subMu.RUnlock()
+
+	for _, h := range handlers {
+		h(ev)
 	}
 }
 
 func (sm *SessionManager) CreateSession(callID string) *Session {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
+	return sm.createLocked(callID)
+}
 
+func (sm *SessionManager) createLocked(callID string) *Session {
 	session := &Session{
 		ID:        uuid.New().String(),
 		CallID:    callID,
 		CreatedAt: time.Now(),
-		rtc:       media.NewUDPMediaEngine(logger.NewLogger()),
+		rtc:       media.NewUDPMediaEngine(logger.NewLogger(), sm.ports, sm.iface),
+		sm:        sm,
 	}
 	sm.sessions[session.ID] = session
+	calls, ok := sm.byCallID[callID]
+	if !ok {
+		calls = make(map[string]*Session, 1)
+		sm.byCallID[callID] = calls
+	}
+	calls[session.ID] = session
 	return session
 }
 
@@ -61,41 +499,119 @@ func (sm *SessionManager) GetSession(sessionID string) (*Session, bool) {
 	return session, exists
 }
 
-func (sm *SessionManager) DeleteSession(sessionID string) {
+// GetSessionByCallID returns a session of the call. A Call-ID has more than
+// one session only when an INVITE forked, in which case any of them may be
+// returned.
+func (sm *SessionManager) GetSessionByCallID(callID string) (*Session, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	for _, session := range sm.byCallID[callID] {
+		return session, true
+	}
+	return nil, false
+}
+
+// GetSessionByTag returns the session whose dialog uses localTag as our tag.
+func (sm *SessionManager) GetSessionByTag(localTag string) (*Session, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	session, exists := sm.byTag[localTag]
+	return session, exists
+}
+
+// FindDialog returns the session whose dialog matches the given identifiers,
+// taken from the perspective of this server.
+func (sm *SessionManager) FindDialog(callID, localTag, remoteTag string) (*Session, bool) {
+	sm.mu.RLock()
+	session, ok := sm.byDialog[dialogID(callID, localTag, remoteTag)]
+	sm.mu.RUnlock()
+
+	if !ok {
+		return nil, false
+	}
+	if d := session.getDialog(); d == nil || !d.matches(callID, localTag, remoteTag) {
+		return nil, false
+	}
+	return session, true
+}
+
+func (sm *SessionManager) all() []*Session {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	sessions := make([]*Session, 0, len(sm.sessions))
+	for _, session := range sm.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// Len returns the number of live sessions.
+func (sm *SessionManager) Len() int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return len(sm.sessions)
+}
+
+// indexDialog makes session reachable through the identifiers of d.
+func (sm *SessionManager) indexDialog(session *Session, d *dialog) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	delete(sm.sessions, sessionID)
+	if _, ok := sm.sessions[session.ID]; !ok {
+		// Already deleted, e.g. cancelled while being set up.
+		return
+	}
+	sm.byDialog[d.id()] = session
+	sm.byTag[d.localTag] = session
 }
 
-func (sm *SessionManager) GetOrCreateSession(callID string) *Session {
+// DeleteSession ends the session, releasing its media engine, and removes it
+// from every index.
+func (sm *SessionManager) DeleteSession(sessionID string) {
+	session, ok := sm.GetSession(sessionID)
+	if !ok {
+		return
+	}
+	session.close(SessionStatus_Disconnected)
+	// close is a no-op for sessions that already ended.
+	sm.remove(session)
+}
+
+func (sm *SessionManager) remove(session *Session) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	for _, session := range sm.sessions {
-		if session.CallID == callID {
-			return session
+	if sm.sessions[session.ID] != session {
+		return
+	}
+	delete(sm.sessions, session.ID)
+	if calls := sm.byCallID[session.CallID]; calls != nil {
+		delete(calls, session.ID)
+		if len(calls) == 0 {
+			delete(sm.byCallID, session.CallID)
 		}
 	}
-
-	// If no existing session found, create a new one
-	session := &Session{
-		ID:        uuid.New().String(),
-		CallID:    callID,
-		CreatedAt: time.Now(),
+	if d := session.getDialog(); d != nil {
+		if sm.byDialog[d.id()] == session {
+			delete(sm.byDialog, d.id())
+		}
+		if sm.byTag[d.localTag] == session {
+			delete(sm.byTag, d.localTag)
+		}
 	}
-	sm.sessions[session.ID] = session
-	return session
 }
 
-func (sm *SessionManager) CleanupSessions() {
+func (sm *SessionManager) GetOrCreateSession(callID string) *Session {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	now := time.Now()
-	for id, session := range sm.sessions {
-		if now.Sub(session.CreatedAt) > 24*time.Hour {
-			delete(sm.sessions, id)
-		}
+	for _, session := range sm.byCallID[callID] {
+		return session
 	}
+
+	// If no existing session found, create a new one
+	return sm.createLocked(callID)
 }
@@ -1,9 +1,17 @@
 package sipnexus
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"runtime"
 	"testing"
+	"time"
 
+	"github.com/emiago/sipgo/sip"
+	"github.com/itzmanish/sipnexus/pkg/codec"
+	"github.com/itzmanish/sipnexus/pkg/media"
+	"github.com/itzmanish/sipnexus/pkg/utils"
 	"github.com/pion/sdp/v3"
 )
 
@@ -53,4 +61,128 @@ a=ssrc:4246817614 msid:- 0a572566-fd9d-4db2-9f68-2744a2204ec1
 	for _, m := range parsed.MediaDescriptions {
 		log.Printf("md: %#v \n", m)
 	}
+
+	// This is a browser's offer. UDP/TLS/RTP/SAVPF needs DTLS-SRTP, which
+	// sipnexus does not do, so it is declined even by builds with Opus that
+	// offer it.
+	sd, err := utils.ParseSDP([]byte(sdpString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &media.Negotiator{Codecs: media.RegistryCodecs(codec.Default), Ptime: media.DefaultPtime}
+	if _, err := n.Negotiate(sd); !errors.Is(err, media.ErrNoCommonMedia) {
+		t.Fatalf("expected the WebRTC offer to be declined, got %v", err)
+	}
+}
+
+func sessionIndexSizes(sm *SessionManager) [4]int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return [4]int{len(sm.sessions), len(sm.byCallID), len(sm.byDialog), len(sm.byTag)}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(50 * time.Microsecond)
+	}
+}
+
+func TestSessionManagerIndexes(t *testing.T) {
+	s := newTestRegistrar(t)
+	res := handle(t, s.handleInvite, newTestInDialog(t, sip.INVITE, "idx-1", "", 1, testOfferSDP))
+	tag, _ := res[len(res)-1].To().Params.Get("tag")
+
+	sm := s.sessionManager
+	byCallID, ok := sm.GetSessionByCallID("idx-1")
+	if !ok {
+		t.Fatal("session not indexed by Call-ID")
+	}
+	if got, ok := sm.GetSessionByTag(tag); !ok || got != byCallID {
+		t.Fatal("session not indexed by tag")
+	}
+	if got, ok := sm.FindDialog("idx-1", tag, "alice-tag"); !ok || got != byCallID {
+		t.Fatal("session not indexed by dialog")
+	}
+	if _, ok := sm.FindDialog("idx-1", tag, "other"); ok {
+		t.Fatal("dialog matched with the wrong remote tag")
+	}
+	if got := sm.GetOrCreateSession("idx-1"); got != byCallID {
+		t.Fatal("GetOrCreateSession created a duplicate")
+	}
+
+	sm.DeleteSession(byCallID.ID)
+	if byCallID.State() != SessionStatus_Disconnected {
+		t.Fatalf("expected deleted session to be disconnected, got %s", byCallID.State())
+	}
+	if sizes := sessionIndexSizes(sm); sizes != [4]int{} {
+		t.Fatalf("indexes not empty after delete: %v", sizes)
+	}
+	// The media ports were released by the delete.
+	if n := s.ports.InUse(); n != 0 {
+		t.Fatalf("%d media port pairs still in use", n)
+	}
+}
+
+func TestSessionManagerNoLeaks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("simulates thousands of calls")
+	}
+	s := newTestRegistrar(t)
+	goroutines := runtime.NumGoroutine()
+
+	const calls = 3000
+	for i := 0; i < calls; i++ {
+		callID := fmt.Sprintf("leak-%d", i)
+		invite := newTestInDialog(t, sip.INVITE, callID, "", 1, testOfferSDP)
+
+		switch i % 4 {
+		case 0, 1: // answered, then hung up by the caller
+			res := handle(t, s.handleInvite, invite)
+			tag, _ := res[len(res)-1].To().Params.Get("tag")
+			s.handleAck(newTestInDialog(t, sip.ACK, callID, tag, 1, ""), nil)
+			if res := handle(t, s.handleBye, newTestInDialog(t, sip.BYE, callID, tag, 2, "")); res[0].StatusCode != sip.StatusOK {
+				t.Fatalf("call %s: BYE got %d", callID, res[0].StatusCode)
+			}
+		case 2: // cancelled, usually before the answer
+			tx := newCancelTx(invite)
+			done := make(chan bool)
+			go func() {
+				done <- tx.deliverCancel(newTestCancel(t, invite))
+			}()
+			s.handleInvite(invite, tx)
+			if !<-done {
+				// The answer won the race, so hang up as in case 0.
+				tag, _ := tx.result()[1].To().Params.Get("tag")
+				handle(t, s.handleBye, newTestInDialog(t, sip.BYE, callID, tag, 2, ""))
+			}
+			// The watcher releases the session after answering the CANCEL.
+			waitFor(t, func() bool { return s.sessionManager.Len() == 0 })
+			tx.Terminate()
+		case 3: // rejected offer
+			invite.SetBody([]byte("not sdp"))
+			if res := handle(t, s.handleInvite, invite); res[0].StatusCode != sip.StatusBadRequest {
+				t.Fatalf("call %s: expected 400, got %d", callID, res[0].StatusCode)
+			}
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for sessionIndexSizes(s.sessionManager) != [4]int{} {
+		if time.Now().After(deadline) {
+			t.Fatalf("sessions leaked after %d calls: %v", calls, sessionIndexSizes(s.sessionManager))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Media read loops and CANCEL watchers must be gone as well.
+	for runtime.NumGoroutine() > goroutines+10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked: %d before, %d after", goroutines, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond)
+	}
 }